@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/arr2036/yksofttoken/internal/audit"
+	"github.com/arr2036/yksofttoken/internal/lease"
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// cliCommand is a yksoft subcommand, run instead of the GUI
+type cliCommand struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var cliCommands []cliCommand
+
+func init() {
+	cliCommands = []cliCommand{
+		{"otp", "Generate an OTP, creating the token if it doesn't exist", cmdOTP},
+		{"loadtest", "Load test a YK-VAL or YK-KSM server with OTPs from many tokens", cmdLoadtest},
+		{"negative", "Print deliberately invalid OTPs, labelled with why they should be rejected", cmdNegative},
+		{"rotate", "Replace a token with a successor, once the successor is registered", cmdRotate},
+		{"rekey", "Rotate a token's private ID and AES key in two phases", cmdRekey},
+		{"simulate", "Simulate months of use of a fleet of tokens, reporting anomalies", cmdSimulate},
+		{"log", "Show or verify the audit log of generated OTPs", cmdLog},
+		{"leased", "Serve leases of counter ranges to hosts sharing tokens", cmdLeased},
+		{"policy", "Show or set the public ID and lifetime warning policy", cmdPolicy},
+		{"store", "Show the token store, or move tokens to another store", cmdStore},
+		{"backup", "Write every token, the policy and audit log to an encrypted backup", cmdBackup},
+		{"restore", "Restore a backup, without rolling back tokens used since", cmdRestore},
+	}
+}
+
+// isCLI returns true if the arguments select a CLI command rather than the GUI
+func isCLI(args []string) bool {
+	// macOS passes a process serial number to apps launched from Finder
+	return len(args) > 0 && !strings.HasPrefix(args[0], "-psn_")
+}
+
+// runCLI runs the subcommand named by args[0], returning the exit code
+func runCLI(args []string) int {
+	switch args[0] {
+	case "-h", "-help", "--help", "help":
+		cliUsage(os.Stdout)
+		return 0
+	}
+
+	for _, cmd := range cliCommands {
+		if cmd.name != args[0] {
+			continue
+		}
+
+		err := cmd.run(args[1:])
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "yksoft %s: %v\n", cmd.name, err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "yksoft: unknown command '%s'\n\n", args[0])
+	cliUsage(os.Stderr)
+	return 64
+}
+
+func cliUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: yksoft [<command> [options]]\n\n")
+	fmt.Fprintf(w, "With no command the GUI is started.\n\n")
+	fmt.Fprintf(w, "Commands:\n")
+	for _, cmd := range cliCommands {
+		fmt.Fprintf(w, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun 'yksoft <command> -h' for command options.\n")
+}
+
+// newFlagSet returns a flag set for a subcommand, with the common -f option
+func newFlagSet(name, args string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: yksoft %s [options] %s\n\n", name, args)
+		fs.PrintDefaults()
+	}
+	dir := fs.String("f", "", "Directory tokens are stored in (default ~/.yksoft)")
+	return fs, dir
+}
+
+// cliTokenDir returns the token directory to use, given the value of -f
+func cliTokenDir(dir string) (string, error) {
+	if dir != "" {
+		return dir, nil
+	}
+	return token.GetDefaultTokenDir()
+}
+
+// passphraseEnv is the environment variable holding the passphrase of an
+// encrypted token directory
+const passphraseEnv = "YKSOFT_PASSPHRASE"
+
+// managerOptions returns the options token directories are opened with.
+// How far each token's counters have got is recorded outside the token
+// directory, to catch tokens restored from old backups.
+func managerOptions() []token.ManagerOption {
+	dir, err := token.DefaultMarksDir()
+	if err != nil {
+		return nil
+	}
+	return []token.ManagerOption{token.WithMarks(token.NewMarks(dir))}
+}
+
+// cliManager returns a manager for the token directory, unlocking it with
+// the passphrase in $YKSOFT_PASSPHRASE if it's encrypted
+func cliManager(tokenDir string) (*token.Manager, error) {
+	m, err := token.OpenManager(tokenDir, managerOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Locked() {
+		return m, nil
+	}
+
+	passphrase, ok := os.LookupEnv(passphraseEnv)
+	if !ok {
+		return nil, fmt.Errorf("%w: set %s to its passphrase", token.ErrLocked, passphraseEnv)
+	}
+	if err := m.Unlock(passphrase); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func cmdOTP(args []string) error {
+	fs, dirFlag := newFlagSet("otp", "[<token name>]")
+	policyFlag := fs.String("p", "never", "Power cycle policy (never, invocation, idle:<duration>)")
+	regInfo := fs.Bool("r", false, "Print registration information instead of generating an OTP")
+	lifetime := fs.Bool("l", false, "Print the remaining lifetime instead of generating an OTP")
+	leaseFlag := fs.String("lease", "", "Only generate within counter ranges leased from this lease service URL or shared file")
+	holder := fs.String("holder", "", "Name to hold leases under (default the hostname)")
+	jump := fs.Bool("jump", false, "Move the token's counter past the highest it has reached, after restoring it from a backup")
+	tokenEnv := fs.String("env", "", "Load the token from this environment variable instead of the token directory")
+	tokenStdin := fs.Bool("stdin", false, "Load the token from stdin instead of the token directory")
+	countersFlag := fs.String("counters", "", "Where a token from -env or -stdin keeps its counters: a file, a counter service URL, - to write them to stdout before the OTP, or fd:<n> to write them to a file descriptor")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	powerPolicy, err := token.ParsePowerCyclePolicy(*policyFlag)
+	if err != nil {
+		return err
+	}
+
+	if *tokenEnv != "" || *tokenStdin {
+		if *tokenEnv != "" && *tokenStdin {
+			return errors.New("-env and -stdin can't be used together")
+		}
+		if *leaseFlag != "" || *jump {
+			return errors.New("-lease and -jump can't be used with -env or -stdin")
+		}
+		name := fs.Arg(0)
+		if name == "" {
+			name = "default"
+		}
+		return otpStateless(name, *tokenEnv, *countersFlag, powerPolicy, *regInfo, *lifetime)
+	}
+
+	tokenDir, err := cliTokenDir(*dirFlag)
+	if err != nil {
+		return err
+	}
+
+	name := fs.Arg(0)
+	if name == "" {
+		name = "default"
+	}
+	m, err := cliManager(tokenDir)
+	if err != nil {
+		return err
+	}
+
+	if *jump {
+		if err := m.JumpCounter(name); err != nil {
+			return err
+		}
+	}
+
+	t, err := m.Get(name)
+	var rollbackErr *token.RollbackError
+	if errors.As(err, &rollbackErr) {
+		return fmt.Errorf("%w, run 'yksoft otp -jump %s' to move its counter past %d",
+			err, name, rollbackErr.Mark.Counter)
+	}
+	if errors.Is(err, token.ErrTokenNotFound) {
+		// Like the legacy tool, a missing token is created and its
+		// registration information printed
+		policy, err := token.LoadPolicy(tokenDir)
+		if err != nil {
+			return err
+		}
+		t, err = m.NewUnique(policy)
+		if err != nil {
+			return err
+		}
+		if err := m.Create(name, t); err != nil {
+			return err
+		}
+		fmt.Println(t.RegistrationInfo())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if *regInfo {
+		fmt.Println(t.RegistrationInfo())
+		return nil
+	}
+
+	if *lifetime {
+		fmt.Println(t.Lifetime())
+		return nil
+	}
+
+	stop := audit.Record(m, audit.New(tokenDir), audit.CurrentConsumer(audit.ConsumerCLI), func(err error) {
+		fmt.Fprintf(os.Stderr, "yksoft: warning: failed to write audit log: %v\n", err)
+	})
+	defer stop()
+
+	if _, err := m.ApplyPowerPolicy(name, powerPolicy, token.PowerEventInvocation); err != nil {
+		return err
+	}
+	if _, err := m.ApplyPowerPolicy(name, powerPolicy, token.PowerEventGenerate); err != nil {
+		return err
+	}
+
+	var otp string
+	if *leaseFlag != "" {
+		if *holder == "" {
+			if *holder, err = os.Hostname(); err != nil {
+				return err
+			}
+		}
+		otp, err = lease.NewLeaser(m, cliCoordinator(*leaseFlag), *holder).Generate(context.Background(), name)
+	} else {
+		otp, err = m.Generate(context.Background(), name)
+	}
+	if errors.Is(err, token.ErrCounterExhausted) || errors.Is(err, lease.ErrExhausted) {
+		return fmt.Errorf("%w, replace it with 'yksoft rotate %s'", err, name)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(otp)
+	warnLifetime(m, name)
+	return nil
+}
+
+// warnLifetime prints a warning to stderr if the named token's remaining
+// lifetime is below the directory policy's thresholds
+func warnLifetime(m *token.Manager, name string) {
+	policy, err := token.LoadPolicy(m.Dir())
+	if err != nil {
+		return
+	}
+	t, err := m.Get(name)
+	if err != nil {
+		return
+	}
+
+	if l := t.Lifetime(); l.Low(policy) {
+		fmt.Fprintf(os.Stderr, "yksoft: warning: token '%s' has %s, replace it with 'yksoft rotate %s'\n",
+			name, l, name)
+	}
+}
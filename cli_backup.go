@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/arr2036/yksofttoken/internal/backup"
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// backupPassphraseEnv is the environment variable holding the passphrase
+// backups are encrypted with
+const backupPassphraseEnv = "YKSOFT_BACKUP_PASSPHRASE"
+
+// backupPassphrase returns the passphrase in $YKSOFT_BACKUP_PASSPHRASE
+func backupPassphrase() (string, error) {
+	passphrase := os.Getenv(backupPassphraseEnv)
+	if passphrase == "" {
+		return "", fmt.Errorf("set %s to the backup's passphrase", backupPassphraseEnv)
+	}
+	return passphrase, nil
+}
+
+func cmdBackup(args []string) error {
+	fs, dirFlag := newFlagSet("backup", "<file>")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: yksoft backup [options] <file>\n\n")
+		fmt.Fprintf(fs.Output(), "Writes every token, with the policy and audit log, to a single file\n")
+		fmt.Fprintf(fs.Output(), "encrypted with the passphrase in $%s.  Use - for stdout.\n\n", backupPassphraseEnv)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("a backup file is required")
+	}
+
+	passphrase, err := backupPassphrase()
+	if err != nil {
+		return err
+	}
+	tokenDir, err := cliTokenDir(*dirFlag)
+	if err != nil {
+		return err
+	}
+	m, err := cliManager(tokenDir)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := backup.Write(&buf, m, passphrase); err != nil {
+		return err
+	}
+	if fs.Arg(0) == "-" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	if err := os.WriteFile(fs.Arg(0), buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Tokens in %s backed up to %s\n", tokenDir, fs.Arg(0))
+	return nil
+}
+
+func cmdRestore(args []string) error {
+	fs, dirFlag := newFlagSet("restore", "<file>")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: yksoft restore [options] <file>\n\n")
+		fmt.Fprintf(fs.Output(), "Restores a backup written by 'yksoft backup', decrypted with the passphrase\n")
+		fmt.Fprintf(fs.Output(), "in $%s.  Use - for stdin.  Tokens used since the backup\n", backupPassphraseEnv)
+		fmt.Fprintf(fs.Output(), "are never rolled back, and are reported as conflicts.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("a backup file is required")
+	}
+
+	passphrase, err := backupPassphrase()
+	if err != nil {
+		return err
+	}
+	tokenDir, err := cliTokenDir(*dirFlag)
+	if err != nil {
+		return err
+	}
+	m, err := cliManager(tokenDir)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	results, err := backup.Restore(r, m, passphrase)
+	conflicts := 0
+	for _, result := range results {
+		if result.Action == token.RestoreConflict {
+			conflicts++
+			fmt.Printf("%s: %v\n", result.Name, result.Err)
+			continue
+		}
+		fmt.Printf("%s: %s\n", result.Name, result.Action)
+	}
+	if err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		return fmt.Errorf("%d of %d conflict with what's in %s, which was kept", conflicts, len(results), tokenDir)
+	}
+	return nil
+}
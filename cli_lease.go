@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/lease"
+)
+
+// leaseKeyEnv is the environment variable holding the key lease service
+// requests and responses are signed with
+const leaseKeyEnv = "YKSOFT_LEASE_KEY"
+
+// leaseKey returns the lease service key from $YKSOFT_LEASE_KEY, or nil if
+// it isn't set
+func leaseKey() []byte {
+	if key := os.Getenv(leaseKeyEnv); key != "" {
+		return []byte(key)
+	}
+	return nil
+}
+
+// cliCoordinator returns the coordinator for the value of -lease: the URL
+// of a lease service, or a file on shared storage
+func cliCoordinator(spec string) lease.Coordinator {
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return &lease.HTTPClient{URL: spec, Key: leaseKey(), HTTP: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return lease.NewFile(spec)
+}
+
+func cmdLeased(args []string) error {
+	fs, _ := newFlagSet("leased", "")
+	listen := fs.String("listen", "localhost:7357", "Address to serve leases on")
+	state := fs.String("state", "", "File to keep leases in (required)")
+	list := fs.Bool("list", false, "List the last lease of each token instead of serving")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *state == "" {
+		return errors.New("-state is required")
+	}
+
+	f := lease.NewFile(*state)
+	if *list {
+		leases, err := f.Leases()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "TOKEN\tCOUNTERS\tHOLDER\tGRANTED")
+		for _, l := range leases {
+			fmt.Fprintf(w, "%s\t%d-%d\t%s\t%s\n", l.Token, l.Start, l.End-1, l.Holder, l.Granted.Local().Format(time.DateTime))
+		}
+		return w.Flush()
+	}
+
+	key := leaseKey()
+	if key == nil {
+		fmt.Fprintf(os.Stderr, "yksoft leased: warning: %s isn't set, so requests aren't authenticated\n", leaseKeyEnv)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(lease.Path, lease.Handler(f, key))
+	fmt.Fprintf(os.Stderr, "Serving leases on http://%s%s\n", *listen, lease.Path)
+	return http.ListenAndServe(*listen, mux)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+
+	"github.com/arr2036/yksofttoken/internal/audit"
+	"github.com/arr2036/yksofttoken/internal/loadtest"
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// loadtestStreamChunk is how many OTPs each token reserves, and saves, at a time
+const loadtestStreamChunk = 256
+
+func cmdLoadtest(args []string) error {
+	fs, dirFlag := newFlagSet("loadtest", "[<token name>...]")
+	urlFlag := fs.String("url", "", "YK-VAL verify URL, or YK-KSM decrypt URL with -ksm")
+	ksm := fs.Bool("ksm", false, "Test a YK-KSM rather than a YK-VAL server")
+	clientID := fs.String("id", "1", "YK-VAL client ID")
+	apiKey := fs.String("key", "", "YK-VAL API key (base64) to sign requests with")
+	rate := fs.Float64("rate", 0, "Requests per second across all tokens (default unlimited)")
+	concurrency := fs.Int("c", 1, "Concurrent requests, at most one per token")
+	requests := fs.Int("n", 0, "Number of requests to make (default unlimited)")
+	duration := fs.Duration("d", 0, "How long to run for (default until interrupted)")
+	replay := fs.Float64("replay", 0, "Fraction of requests that replay an OTP already sent (0-1)")
+	create := fs.Int("create", 0, "Create this many tokens, print their registration information and exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	tokenDir, err := cliTokenDir(*dirFlag)
+	if err != nil {
+		return err
+	}
+	m, err := cliManager(tokenDir)
+	if err != nil {
+		return err
+	}
+
+	if *create > 0 {
+		return createLoadtestTokens(m, *create)
+	}
+
+	if *urlFlag == "" {
+		return errors.New("-url is required")
+	}
+	if *replay < 0 || *replay > 1 {
+		return errors.New("-replay must be between 0 and 1")
+	}
+
+	var verifier loadtest.Verifier
+	if *ksm {
+		verifier = &loadtest.YKKSMClient{URL: *urlFlag}
+	} else {
+		client := &loadtest.YKValClient{URL: *urlFlag, ClientID: *clientID}
+		if *apiKey != "" {
+			if client.APIKey, err = base64.StdEncoding.DecodeString(*apiKey); err != nil {
+				return fmt.Errorf("invalid API key: %w", err)
+			}
+		}
+		verifier = client
+	}
+
+	names := fs.Args()
+	if len(names) == 0 {
+		if names, err = m.Names(); err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("no tokens in '%s', create some with -create", tokenDir)
+		}
+	}
+
+	stopRecording := audit.Record(m, audit.New(tokenDir), audit.CurrentConsumer(audit.ConsumerCLI), func(err error) {
+		fmt.Fprintf(os.Stderr, "yksoft: warning: failed to write audit log: %v\n", err)
+	})
+	defer stopRecording()
+
+	streams := make([]*token.Stream, len(names))
+	for i, name := range names {
+		if streams[i], err = m.NewStream(name, loadtestStreamChunk); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	r, err := loadtest.Run(ctx, loadtest.Config{
+		Streams:        streams,
+		Verifier:       verifier,
+		Rate:           *rate,
+		Concurrency:    *concurrency,
+		Requests:       *requests,
+		Duration:       *duration,
+		ReplayFraction: *replay,
+	})
+	if r != nil {
+		printLoadtestReport(r, len(names))
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(r.DoubleAccepted) > 0 {
+		return fmt.Errorf("%d OTPs were accepted more than once", len(r.DoubleAccepted))
+	}
+	return nil
+}
+
+// createLoadtestTokens creates n tokens named loadtest-NNNN, printing the
+// registration information of each
+func createLoadtestTokens(m *token.Manager, n int) error {
+	policy, err := token.LoadPolicy(m.Dir())
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i <= n; i++ {
+		t, err := m.NewUnique(policy)
+		if err != nil {
+			return err
+		}
+		if err := m.Create(fmt.Sprintf("loadtest-%04d", i), t); err != nil {
+			return err
+		}
+		fmt.Println(t.RegistrationInfo())
+	}
+	return nil
+}
+
+func printLoadtestReport(r *loadtest.Report, tokens int) {
+	fmt.Printf("Requests:   %d from %d tokens in %.2fs (%.1f/s)\n",
+		r.Requests, tokens, r.Elapsed.Seconds(), r.Throughput())
+	fmt.Printf("Errors:     %d\n", r.Errors)
+	fmt.Printf("Latency:    p50 %v, p90 %v, p99 %v, max %v\n",
+		r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Percentile(100))
+
+	statuses := make([]string, 0, len(r.Statuses))
+	for status := range r.Statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	fmt.Println("Statuses:")
+	for _, status := range statuses {
+		fmt.Printf("  %-20s %d\n", status, r.Statuses[status])
+	}
+
+	fmt.Printf("Accepted more than once: %d\n", len(r.DoubleAccepted))
+	for _, otp := range r.DoubleAccepted {
+		fmt.Printf("  %s\n", otp)
+	}
+}
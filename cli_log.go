@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/audit"
+)
+
+func cmdLog(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "verify":
+			return cmdLogVerify(args[1:])
+		case "key":
+			return cmdLogKey(args[1:])
+		}
+	}
+
+	fs, dirFlag := newFlagSet("log", "")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: yksoft log [options]\n")
+		fmt.Fprintf(fs.Output(), "       yksoft log verify [-f <dir>]   Check the log hasn't been truncated, reordered or modified\n")
+		fmt.Fprintf(fs.Output(), "       yksoft log key [-f <dir>]      Create a key to MAC entries with\n\n")
+		fs.PrintDefaults()
+	}
+	tokenFlag := fs.String("t", "", "Only show OTPs generated from this token")
+	consumerFlag := fs.String("c", "", "Only show OTPs generated by this consumer (gui, cli, agent)")
+	sinceFlag := fs.String("since", "", "Only show OTPs generated since this time (a duration like 24h, a date or RFC 3339 time)")
+	untilFlag := fs.String("until", "", "Only show OTPs generated before this time")
+	limit := fs.Int("n", 0, "Only show the most recent entries")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	tokenDir, err := cliTokenDir(*dirFlag)
+	if err != nil {
+		return err
+	}
+
+	filter := audit.Filter{Token: *tokenFlag, Consumer: *consumerFlag, Limit: *limit}
+	if filter.Since, err = parseLogTime(*sinceFlag); err != nil {
+		return fmt.Errorf("invalid -since: %w", err)
+	}
+	if filter.Until, err = parseLogTime(*untilFlag); err != nil {
+		return fmt.Errorf("invalid -until: %w", err)
+	}
+
+	entries, err := audit.New(tokenDir).Entries(filter)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTOKEN\tCOUNTER\tFINGERPRINT\tCONSUMER\tPROCESS\tUSER\tPARENT")
+	for _, e := range entries {
+		parent := fmt.Sprint(e.ParentPID)
+		if e.Parent != "" {
+			parent += " (" + e.Parent + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d/%d\t%s\t%s\t%d (%s)\t%s\t%s\n",
+			e.Time.Local().Format(time.DateTime), e.Token, e.Counter, e.Session,
+			e.Summary(), e.Name, e.PID, e.Process, e.User, parent)
+	}
+	return w.Flush()
+}
+
+func cmdLogVerify(args []string) error {
+	fs, dirFlag := newFlagSet("log verify", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	tokenDir, err := cliTokenDir(*dirFlag)
+	if err != nil {
+		return err
+	}
+
+	v, err := audit.New(tokenDir).Verify()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d entries verified", v.Entries)
+	if v.MACs > 0 {
+		fmt.Printf(", %d with MACs", v.MACs)
+	}
+	fmt.Println()
+	if v.Legacy > 0 {
+		fmt.Printf("%d entries from before chaining can't be verified\n", v.Legacy)
+	}
+	return nil
+}
+
+func cmdLogKey(args []string) error {
+	fs, dirFlag := newFlagSet("log key", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	tokenDir, err := cliTokenDir(*dirFlag)
+	if err != nil {
+		return err
+	}
+
+	l := audit.New(tokenDir)
+	if err := l.CreateKey(); err != nil {
+		return err
+	}
+	fmt.Println("Entries will be MACed from now on")
+	return nil
+}
+
+// parseLogTime parses a -since or -until value: a duration before now, a
+// date, or an RFC 3339 time.  An empty value is the zero time.
+func parseLogTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' isn't a duration, date or RFC 3339 time", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+func cmdNegative(args []string) error {
+	fs, dirFlag := newFlagSet("negative", "[<token name>]")
+	kinds := make([]string, len(token.NegativeKinds))
+	for i, k := range token.NegativeKinds {
+		kinds[i] = string(k)
+	}
+	kind := fs.String("k", "", "Only print the OTP of this kind ("+strings.Join(kinds, ", ")+")")
+	bare := fs.Bool("o", false, "Print only the OTP, without its label (requires -k)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *bare && *kind == "" {
+		return errors.New("-o requires -k")
+	}
+
+	tokenDir, err := cliTokenDir(*dirFlag)
+	if err != nil {
+		return err
+	}
+
+	name := fs.Arg(0)
+	if name == "" {
+		name = "default"
+	}
+
+	// The token is only read, negative OTPs never advance its state
+	m, err := cliManager(tokenDir)
+	if err != nil {
+		return err
+	}
+	t, err := m.Get(name)
+	if err != nil {
+		return err
+	}
+
+	var otps []token.NegativeOTP
+	if *kind != "" {
+		n, err := t.NegativeOTP(token.NegativeKind(*kind))
+		if err != nil {
+			return err
+		}
+		if *bare {
+			fmt.Println(n.OTP)
+			return nil
+		}
+		otps = append(otps, n)
+	} else if otps, err = t.NegativeOTPs(); err != nil {
+		return err
+	}
+
+	for _, n := range otps {
+		status := "BAD_OTP"
+		if n.Replay {
+			status = "REPLAYED_OTP"
+		}
+		fmt.Printf("%-16s %-12s %-44s %s\n", n.Kind, status, n.OTP, n.Reason)
+	}
+	return nil
+}
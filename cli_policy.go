@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+func cmdPolicy(args []string) error {
+	fs, dir := newFlagSet("policy", "[<field>=<value> ...]")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: yksoft policy [options] [<field>=<value> ...]\n\n")
+		fmt.Fprintf(fs.Output(), "Prints the token directory's public ID and lifetime warning policy, or\n")
+		fmt.Fprintf(fs.Output(), "sets fields of it.  Fields are %s, %s,\n%s and %s.\n\n",
+			token.PublicIDPrefixField, token.PublicIDLengthField, token.WarnPowerUpsField, token.WarnOTPsField)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tokenDir, err := cliTokenDir(*dir)
+	if err != nil {
+		return err
+	}
+
+	p, err := token.LoadPolicy(tokenDir)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fmt.Print(p)
+		return nil
+	}
+
+	// The fields are set as lines of the policy file, so they're checked
+	// just as they will be when it's loaded
+	var lines strings.Builder
+	for _, arg := range fs.Args() {
+		field, value, ok := strings.Cut(arg, "=")
+		switch field {
+		case token.PublicIDPrefixField, token.PublicIDLengthField, token.WarnPowerUpsField, token.WarnOTPsField:
+		default:
+			return fmt.Errorf("unknown policy field '%s'", field)
+		}
+		if !ok {
+			return fmt.Errorf("%s needs a value, as %s=<value>", field, field)
+		}
+		fmt.Fprintf(&lines, "%s: %s\n", field, value)
+	}
+	if p, err = token.ParsePolicy(strings.NewReader(lines.String()), p); err != nil {
+		return err
+	}
+
+	if err := token.SavePolicy(tokenDir, p); err != nil {
+		return err
+	}
+	fmt.Print(p)
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+func cmdRekey(args []string) error {
+	fs, dirFlag := newFlagSet("rekey", "[<token name>]")
+	stage := fs.Bool("stage", false, "Stage a new private ID and AES key, and print their registration information")
+	switchKey := fs.Bool("switch", false, "Start generating OTPs with the staged key")
+	rollback := fs.Bool("rollback", false, "Go back to generating OTPs with the previous key")
+	commit := fs.Bool("commit", false, "Discard the previous key, completing the rotation")
+	discard := fs.Bool("discard", false, "Discard the staged key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var op func(t *token.SoftToken) error
+	ops := 0
+	for _, o := range []struct {
+		set bool
+		fn  func(t *token.SoftToken) error
+	}{
+		{*stage, (*token.SoftToken).StageKey},
+		{*switchKey, (*token.SoftToken).SwitchKey},
+		{*rollback, (*token.SoftToken).RollbackKey},
+		{*commit, (*token.SoftToken).CommitKey},
+		{*discard, (*token.SoftToken).DiscardKey},
+	} {
+		if o.set {
+			op = o.fn
+			ops++
+		}
+	}
+	if ops > 1 {
+		return errors.New("only one of -stage, -switch, -rollback, -commit and -discard may be given")
+	}
+
+	tokenDir, err := cliTokenDir(*dirFlag)
+	if err != nil {
+		return err
+	}
+
+	name := fs.Arg(0)
+	if name == "" {
+		name = "default"
+	}
+	m, err := cliManager(tokenDir)
+	if err != nil {
+		return err
+	}
+
+	if op != nil {
+		if err := m.Update(name, op); err != nil {
+			return err
+		}
+	}
+
+	t, err := m.Get(name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Key rotation: %s\n", t.KeyRotationState())
+	fmt.Printf("Active:       %s\n", t.RegistrationInfo())
+	if staged, err := t.StagedRegistrationInfo(); err == nil {
+		fmt.Printf("Staged:       %s\n", staged)
+	}
+	if t.PreviousKey != nil {
+		fmt.Println("Previous key kept for rollback until -commit")
+	}
+	return nil
+}
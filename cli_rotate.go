@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+func cmdRotate(args []string) error {
+	fs, dirFlag := newFlagSet("rotate", "[<token name>]")
+	keepPublicID := fs.Bool("k", false, "Keep the token's public ID")
+	complete := fs.Bool("complete", false, "Replace the token with its successor, once the successor is registered")
+	cancel := fs.Bool("cancel", false, "Discard the successor")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *complete && *cancel {
+		return errors.New("-complete and -cancel are mutually exclusive")
+	}
+
+	tokenDir, err := cliTokenDir(*dirFlag)
+	if err != nil {
+		return err
+	}
+
+	name := fs.Arg(0)
+	if name == "" {
+		name = "default"
+	}
+	m, err := cliManager(tokenDir)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *complete:
+		if err := m.CompleteRotation(name); err != nil {
+			return err
+		}
+		fmt.Printf("Token '%s' replaced by its successor\n", name)
+		return nil
+
+	case *cancel:
+		return m.CancelRotation(name)
+	}
+
+	// Starting a rotation that's already in progress shows the successor
+	// again, in case its registration information was lost
+	successor, err := m.StartRotation(name, *keepPublicID)
+	if errors.Is(err, token.ErrRotationInProgress) {
+		successor, err = m.Successor(name)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(successor.RegistrationInfo())
+	fmt.Printf("\nRegister the successor, then run 'yksoft rotate -complete %s'\n", name)
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/loadtest"
+	"github.com/arr2036/yksofttoken/internal/simulator"
+	"github.com/arr2036/yksofttoken/internal/token"
+	"github.com/arr2036/yksofttoken/internal/validator"
+)
+
+// maxPrintedAnomalies limits how many anomalies are listed individually
+const maxPrintedAnomalies = 50
+
+func cmdSimulate(args []string) error {
+	fs, _ := newFlagSet("simulate", "")
+	tokens := fs.Int("n", 10, "Number of tokens in the fleet")
+	days := fs.Float64("days", 90, "Days of virtual time to simulate")
+	interval := fs.Duration("interval", time.Hour, "Mean time between uses of each token")
+	jitter := fs.Float64("jitter", 0.5, "Random variation of the interval, as a fraction of it (0-1)")
+	burst := fs.Int("burst", 1, "OTPs generated per use")
+	power := fs.Float64("power", 0, "Probability a token is plugged in again before each use (0-1)")
+	counter := fs.Uint("counter", 0, "Initial use counter of every token (default a new token's)")
+	seed := fs.Int64("seed", 0, "Seed for the usage schedule (default random)")
+	output := fs.String("o", "", "Write OTPs to this file instead of validating them")
+	urlFlag := fs.String("url", "", "Validate OTPs with this YK-VAL server instead of in-process")
+	clientID := fs.String("id", "1", "YK-VAL client ID")
+	apiKey := fs.String("key", "", "YK-VAL API key (base64) to sign requests with")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *counter > 0x7fff {
+		return errors.New("-counter must be at most 32767")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	cfg := simulator.Config{
+		Tokens:       *tokens,
+		StartCounter: uint16(*counter),
+		Start:        time.Now(),
+		Duration:     time.Duration(*days * float64(24*time.Hour)),
+		Schedule: simulator.Schedule{
+			Interval:   *interval,
+			Jitter:     *jitter,
+			Burst:      *burst,
+			PowerCycle: *power,
+		},
+		Seed: *seed,
+	}
+
+	switch {
+	case *output != "":
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cfg.Sink = &simulator.WriterSink{W: f}
+
+	case *urlFlag != "":
+		// The tokens' registration information has to be imported into
+		// the server before they're used, so it's printed first, and the
+		// simulation waits until that's done
+		client := &loadtest.YKValClient{URL: *urlFlag, ClientID: *clientID}
+		if *apiKey != "" {
+			var err error
+			if client.APIKey, err = base64.StdEncoding.DecodeString(*apiKey); err != nil {
+				return fmt.Errorf("invalid API key: %w", err)
+			}
+		}
+		cfg.Sink = &simulator.VerifierSink{Verifier: client}
+		cfg.Register = func(name string, t *token.SoftToken) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, t.RegistrationInfo())
+		}
+		cfg.Ready = func() error {
+			fmt.Fprint(os.Stderr, "Register these tokens with the server, then press Enter to start: ")
+			_, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			return err
+		}
+
+	default:
+		v := validator.New()
+		cfg.Sink = &simulator.ValidatorSink{Validator: v}
+		cfg.Register = func(name string, t *token.SoftToken) { v.RegisterToken(t) }
+	}
+
+	r, err := simulator.Run(cfg)
+	if err != nil {
+		return err
+	}
+
+	printSimulationReport(r, &cfg)
+	return nil
+}
+
+func printSimulationReport(r *simulator.Report, cfg *simulator.Config) {
+	fmt.Printf("Simulated:       %d tokens for %s (seed %d)\n", cfg.Tokens, cfg.Duration, cfg.Seed)
+	fmt.Printf("OTPs:            %d\n", r.OTPs)
+	fmt.Printf("Power ups:       %d\n", r.PowerUps)
+	fmt.Printf("Session wraps:   %d\n", r.SessionWraps)
+	fmt.Printf("Timestamp wraps: %d\n", r.TimestampWraps)
+	fmt.Printf("Exhausted:       %d\n", r.Exhausted)
+
+	if len(r.Statuses) > 0 {
+		statuses := make([]string, 0, len(r.Statuses))
+		for status := range r.Statuses {
+			statuses = append(statuses, status)
+		}
+		sort.Strings(statuses)
+
+		fmt.Println("Statuses:")
+		for _, status := range statuses {
+			fmt.Printf("  %-20s %d\n", status, r.Statuses[status])
+		}
+	}
+
+	fmt.Printf("Anomalies:       %d\n", len(r.Anomalies))
+	for i, a := range r.Anomalies {
+		if i == maxPrintedAnomalies {
+			fmt.Printf("  ... and %d more\n", len(r.Anomalies)-i)
+			break
+		}
+		fmt.Printf("  %s\n", a)
+	}
+}
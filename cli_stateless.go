@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/counters"
+	"github.com/arr2036/yksofttoken/internal/token"
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// countersAuthEnv is the environment variable holding the Authorization
+// header sent to a counter service
+const countersAuthEnv = "YKSOFT_COUNTERS_AUTH"
+
+// cliCounterStore returns the counter store for the value of -counters:
+// - to write the state to stdout, fd:<n> to write it to a file descriptor,
+// the URL of a counter service, or a file.  The function returned writes
+// any state held back, which must be done before the OTP is printed, so
+// an OTP is never used without its state being kept.
+func cliCounterStore(spec string) (token.CounterStore, func() error, error) {
+	switch {
+	case spec == "-":
+		w := counters.NewWriter(os.Stdout)
+		return w, w.Flush, nil
+	case strings.HasPrefix(spec, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(spec, "fd:"))
+		if err != nil || fd < 3 {
+			return nil, nil, fmt.Errorf("invalid -counters %s: the file descriptor must be 3 or more, or use - for stdout", spec)
+		}
+		w := counters.NewWriter(os.NewFile(uintptr(fd), spec))
+		return w, w.Flush, nil
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		c := &counters.HTTP{URL: spec, Auth: os.Getenv(countersAuthEnv), HTTP: &http.Client{Timeout: 10 * time.Second}}
+		return c, func() error { return nil }, nil
+	}
+	return counters.NewFile(spec), func() error { return nil }, nil
+}
+
+// readStatelessToken reads the token passed in the named environment
+// variable, or on stdin if env is empty
+func readStatelessToken(env string) ([]byte, error) {
+	if env == "" {
+		return io.ReadAll(os.Stdin)
+	}
+	data := os.Getenv(env)
+	if strings.TrimSpace(data) == "" {
+		return nil, fmt.Errorf("$%s is empty", env)
+	}
+	return []byte(data), nil
+}
+
+// otpStateless generates an OTP from a token passed in the environment or
+// on stdin, without a token directory.  Its counters are kept in the
+// counter store spec names, and its new state is reported.  With state
+// written to stdout, the OTP follows it after an empty line.
+func otpStateless(name, env, spec string, powerPolicy token.PowerCyclePolicy, regInfo, lifetime bool) error {
+	data, err := readStatelessToken(env)
+	if err != nil {
+		return err
+	}
+	t, err := token.ParseToken(data)
+	if err != nil {
+		return err
+	}
+
+	// Printing the registration information or lifetime saves nothing
+	var store token.CounterStore = counters.NewWriter(io.Discard)
+	flush := func() error { return nil }
+	if !regInfo && !lifetime {
+		if spec == "" {
+			return errors.New("-counters is required with -env or -stdin, or the token's OTPs would repeat")
+		}
+		if store, flush, err = cliCounterStore(spec); err != nil {
+			return err
+		}
+		if _, ok := store.(*counters.Writer); ok && !strings.Contains(string(data), token.CounterField+":") {
+			written := spec
+			if spec == "-" {
+				written = "stdout"
+			}
+			fmt.Fprintf(os.Stderr, "yksoft: warning: the token has no counters, so its OTPs repeat; "+
+				"pass the state written to %s back in with the token, or use -counters <file or URL>\n", written)
+		}
+	}
+	// The counter store is the token's only record, so no high-water marks
+	// are kept.  The home directory may not be writable, or may not outlast
+	// the job.
+	m := token.NewManagerWithStore("", token.NewEphemeralStore(name, t, store))
+	if t, err = m.Get(name); err != nil {
+		return err
+	}
+
+	if regInfo {
+		fmt.Println(t.RegistrationInfo())
+		return nil
+	}
+	if lifetime {
+		fmt.Println(t.Lifetime())
+		return nil
+	}
+
+	if _, err := m.ApplyPowerPolicy(name, powerPolicy, token.PowerEventInvocation); err != nil {
+		return err
+	}
+	if _, err := m.ApplyPowerPolicy(name, powerPolicy, token.PowerEventGenerate); err != nil {
+		return err
+	}
+
+	otp, err := m.Generate(context.Background(), name)
+	if errors.Is(err, token.ErrCounterExhausted) {
+		return fmt.Errorf("%w, replace it with a new token", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+	if spec == "-" {
+		fmt.Println()
+	}
+	fmt.Println(otp)
+	if spec != "-" && !strings.HasPrefix(spec, "fd:") {
+		if t, err := m.Get(name); err == nil {
+			fmt.Fprintf(os.Stderr, "yksoft: token %s now at counter %d, session %d\n",
+				yubikey.ModHexEncode(t.PublicID), t.Counter, t.Session)
+		}
+	}
+	return nil
+}
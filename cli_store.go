@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+func cmdStore(args []string) error {
+	fs, dir := newFlagSet("store", "[<backend>]")
+	path := fs.String("path", "", "Database for the bolt backend, relative to the token directory (default tokens.db)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: yksoft store [options] [<backend>]\n\n")
+		fmt.Fprintf(fs.Output(), "Prints the token directory's store, or moves its tokens to another.\n")
+		fmt.Fprintf(fs.Output(), "Backends are %s, %s and %s.\n\n", token.BackendFile, token.BackendBolt, token.BackendSecretService)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tokenDir, err := cliTokenDir(*dir)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		c, err := token.LoadStoreConfig(tokenDir)
+		if err != nil {
+			return err
+		}
+		if c.Path != "" {
+			fmt.Printf("%s (%s)\n", c.Backend, c.Path)
+			return nil
+		}
+		fmt.Println(c.Backend)
+		return nil
+	}
+
+	c := token.StoreConfig{Backend: fs.Arg(0), Path: *path}
+	switch c.Backend {
+	case token.BackendFile, token.BackendBolt, token.BackendSecretService:
+	default:
+		return fmt.Errorf("%w: '%s'", token.ErrUnknownBackend, c.Backend)
+	}
+	if c.Backend != token.BackendBolt && c.Path != "" {
+		return fmt.Errorf("-path only applies to the %s backend", token.BackendBolt)
+	}
+
+	if err := token.MigrateStore(tokenDir, c); err != nil {
+		return err
+	}
+	fmt.Printf("Tokens in %s moved to the %s store\n", tokenDir, c.Backend)
+	return nil
+}
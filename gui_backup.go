@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+
+	"github.com/arr2036/yksofttoken/internal/backup"
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// mainMenu returns the main window's menu
+func (y *ykSoftApp) mainMenu() *fyne.MainMenu {
+	return fyne.NewMainMenu(
+		fyne.NewMenu("File",
+			fyne.NewMenuItem("Back Up Tokens...", y.onBackup),
+			fyne.NewMenuItem("Restore Backup...", y.onRestore),
+		),
+	)
+}
+
+// onBackup writes every token in the profile, with its policy and audit
+// log, to a backup encrypted with a new passphrase
+func (y *ykSoftApp) onBackup() {
+	y.touch()
+	if y.isLocked() {
+		dialog.ShowError(fmt.Errorf("Failed to back up tokens: %v", token.ErrLocked), y.mainWindow)
+		return
+	}
+
+	passphraseEntry := widget.NewPasswordEntry()
+	passphraseEntry.Validator = func(s string) error {
+		if s == "" {
+			return errors.New("passphrase is required")
+		}
+		return nil
+	}
+
+	confirmEntry := widget.NewPasswordEntry()
+	confirmEntry.Validator = func(s string) error {
+		if s != passphraseEntry.Text {
+			return errors.New("passphrases don't match")
+		}
+		return nil
+	}
+
+	dialog.ShowForm("Back Up Tokens", "Choose File", "Cancel",
+		[]*widget.FormItem{
+			widget.NewFormItem("Passphrase", passphraseEntry),
+			widget.NewFormItem("Confirm", confirmEntry),
+		},
+		func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+			if passphraseEntry.Text != confirmEntry.Text {
+				dialog.ShowError(errors.New("Passphrases don't match"), y.mainWindow)
+				return
+			}
+
+			var buf bytes.Buffer
+			if err := backup.Write(&buf, y.manager, passphraseEntry.Text); err != nil {
+				dialog.ShowError(fmt.Errorf("Failed to back up tokens: %v", err), y.mainWindow)
+				return
+			}
+
+			save := dialog.NewFileSave(func(w fyne.URIWriteCloser, err error) {
+				if err != nil {
+					dialog.ShowError(fmt.Errorf("Failed to save backup: %v", err), y.mainWindow)
+					return
+				}
+				if w == nil {
+					return
+				}
+				_, err = w.Write(buf.Bytes())
+				if closeErr := w.Close(); err == nil {
+					err = closeErr
+				}
+				if err != nil {
+					dialog.ShowError(fmt.Errorf("Failed to save backup: %v", err), y.mainWindow)
+					return
+				}
+				y.statusLabel.SetText("Tokens backed up to " + w.URI().Name())
+			}, y.mainWindow)
+			save.SetFileName("yksoft.backup")
+			save.Show()
+		},
+		y.mainWindow,
+	)
+}
+
+// onRestore restores a backup to the profile, never rolling back tokens
+// used since, and shows what was restored
+func (y *ykSoftApp) onRestore() {
+	y.touch()
+	if y.isLocked() {
+		dialog.ShowError(fmt.Errorf("Failed to restore backup: %v", token.ErrLocked), y.mainWindow)
+		return
+	}
+
+	dialog.ShowFileOpen(func(r fyne.URIReadCloser, err error) {
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("Failed to open backup: %v", err), y.mainWindow)
+			return
+		}
+		if r == nil {
+			return
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("Failed to read backup: %v", err), y.mainWindow)
+			return
+		}
+
+		passphraseEntry := widget.NewPasswordEntry()
+		dialog.ShowForm("Restore Backup", "Restore", "Cancel",
+			[]*widget.FormItem{widget.NewFormItem("Passphrase", passphraseEntry)},
+			func(confirmed bool) {
+				if !confirmed {
+					return
+				}
+				results, err := backup.Restore(bytes.NewReader(data), y.manager, passphraseEntry.Text)
+				if err != nil && len(results) == 0 {
+					dialog.ShowError(fmt.Errorf("Failed to restore backup: %v", err), y.mainWindow)
+					return
+				}
+				y.showRestoreResults(results, err)
+			},
+			y.mainWindow,
+		)
+	}, y.mainWindow)
+}
+
+// showRestoreResults shows what restoring a backup did with each token,
+// and with the policy and audit log
+func (y *ykSoftApp) showRestoreResults(results []token.RestoreResult, err error) {
+	var b strings.Builder
+	conflicts := 0
+	for _, r := range results {
+		if r.Action == token.RestoreConflict {
+			conflicts++
+			fmt.Fprintf(&b, "%s: %v\n", r.Name, r.Err)
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\n", r.Name, r.Action)
+	}
+
+	summary := "Backup restored"
+	switch {
+	case err != nil:
+		summary = fmt.Sprintf("Restoring stopped: %v", err)
+	case conflicts > 0:
+		summary = fmt.Sprintf("%d of %d conflict with what's here, which was kept", conflicts, len(results))
+	}
+	y.statusLabel.SetText(summary)
+
+	details := widget.NewLabel(strings.TrimSuffix(b.String(), "\n"))
+	details.Wrapping = fyne.TextWrapWord
+	d := dialog.NewCustom("Restore Backup", "Close",
+		container.NewBorder(widget.NewLabel(summary), nil, nil, nil, container.NewVScroll(details)),
+		y.mainWindow,
+	)
+	d.Resize(fyne.NewSize(600, 350))
+	d.Show()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"fyne.io/fyne/v2/dialog"
+)
+
+// prefClipboardTimeout is the preference key holding how many seconds
+// copied secrets stay in the clipboard, 0 to keep them
+const prefClipboardTimeout = "clipboardTimeout"
+
+// defaultClipboardTimeout is used if the preference isn't set
+const defaultClipboardTimeout = 30
+
+// clipboardTimeout returns how long copied secrets stay in the clipboard
+func (y *ykSoftApp) clipboardTimeout() time.Duration {
+	seconds := y.app.Preferences().IntWithFallback(prefClipboardTimeout, defaultClipboardTimeout)
+	if seconds < 0 {
+		seconds = 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// copySecret copies an OTP or registration info to the clipboard, marked
+// as sensitive, and returns a description for the status label
+func (y *ykSoftApp) copySecret(what, content string) string {
+	timeout := y.clipboardTimeout()
+	y.clipboard.Copy(content, true, timeout)
+
+	if timeout == 0 {
+		return fmt.Sprintf("%s copied to clipboard!", what)
+	}
+	return fmt.Sprintf("%s copied to clipboard, clearing in %s", what, timeout)
+}
+
+// copyRegInfo copies registration info to the clipboard, once the user
+// confirms they want the AES key there
+func (y *ykSoftApp) copyRegInfo(regInfo string) {
+	dialog.ShowConfirm("Copy Registration Info",
+		"The registration info includes the token's secret AES key.\n\n"+
+			"Anything that can read the clipboard will be able to generate\n"+
+			"valid OTPs.  Copy it anyway?",
+		func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+			y.showStatus(y.copySecret("Registration info", regInfo))
+		},
+		y.mainWindow,
+	)
+}
+
+// showStatus shows a message in the status label for a couple of seconds
+func (y *ykSoftApp) showStatus(msg string) {
+	y.statusLabel.SetText(msg)
+	go func() {
+		time.Sleep(2 * time.Second)
+		y.statusLabel.SetText("Ready")
+	}()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// Validators for token fields entered in forms
+
+func validatePublicID(s string) error {
+	_, err := token.ParsePublicID(s)
+	return err
+}
+
+func validatePrivateID(s string) error {
+	_, err := token.ParsePrivateID(s)
+	return err
+}
+
+func validateAESKey(s string) error {
+	_, err := token.ParseAESKey(s)
+	return err
+}
+
+func validateCounter(s string) error {
+	_, err := token.ParseCounter(s)
+	return err
+}
+
+func validateName(s string) error {
+	if strings.TrimSpace(s) == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+// optional wraps a field validator so an empty field is also valid
+func optional(validate func(s string) error) func(s string) error {
+	return func(s string) error {
+		if strings.TrimSpace(s) == "" {
+			return nil
+		}
+		return validate(s)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+
+	"fyne.io/fyne/v2/dialog"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// offerJump explains a token's counters have gone backwards, and offers to
+// move them past the highest they've reached
+func (y *ykSoftApp) offerJump(name string, rollbackErr *token.RollbackError) {
+	dialog.ShowConfirm("Token Rolled Back",
+		fmt.Sprintf("Token '%s' is at counter %d/%d, but has been used up to %d/%d.\n\n"+
+			"It may have been restored from an old backup or snapshot.  Its next\n"+
+			"OTPs would be rejected as replays, or reuse OTPs already seen.\n\n"+
+			"Jump its counter past %d?",
+			name, rollbackErr.Counter, rollbackErr.Session,
+			rollbackErr.Mark.Counter, rollbackErr.Mark.Session, rollbackErr.Mark.Counter),
+		func(confirmed bool) {
+			if !confirmed {
+				y.tokenSelect.ClearSelected()
+				return
+			}
+			if err := y.manager.JumpCounter(name); err != nil {
+				dialog.ShowError(fmt.Errorf("Failed to jump counter: %v", err), y.mainWindow)
+				return
+			}
+			y.onTokenSelected(name)
+		},
+		y.mainWindow,
+	)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+
+	"github.com/arr2036/yksofttoken/internal/audit"
+)
+
+// historyLimit is how many audit log entries the history view shows
+const historyLimit = 200
+
+// showHistory shows the audit log of OTPs generated from the selected
+// token, or from every token in the directory
+func (y *ykSoftApp) showHistory() {
+	y.touch()
+	name, _ := y.current()
+	log := audit.New(y.tokenDir)
+
+	var entries []audit.Entry
+	list := widget.NewList(
+		func() int { return len(entries) },
+		func() fyne.CanvasObject { return widget.NewLabel("") },
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			// Most recent first
+			e := entries[len(entries)-1-id]
+			o.(*widget.Label).SetText(fmt.Sprintf("%s  %s  %d/%d  %s  %s (%s, pid %d)",
+				e.Time.Local().Format(time.DateTime), e.Token, e.Counter, e.Session,
+				e.Summary(), e.Name, e.Process, e.PID))
+		},
+	)
+	status := widget.NewLabel("")
+
+	allTokens := widget.NewCheck("All tokens", nil)
+	load := func() {
+		filter := audit.Filter{Limit: historyLimit}
+		if !allTokens.Checked {
+			filter.Token = name
+		}
+
+		var err error
+		entries, err = log.Entries(filter)
+		switch {
+		case err != nil:
+			status.SetText(fmt.Sprintf("Failed to read audit log: %v", err))
+		case len(entries) == 0:
+			status.SetText("No OTPs have been generated")
+		default:
+			status.SetText(fmt.Sprintf("%d most recent OTPs", len(entries)))
+		}
+		list.Refresh()
+	}
+	allTokens.OnChanged = func(bool) { load() }
+	if name == "" {
+		allTokens.SetChecked(true)
+		allTokens.Disable()
+	} else {
+		load()
+	}
+
+	d := dialog.NewCustom("History", "Close",
+		container.NewBorder(
+			container.NewHBox(allTokens, status), nil, nil, nil,
+			list,
+		),
+		y.mainWindow,
+	)
+	d.Resize(fyne.NewSize(700, 400))
+	d.Show()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// onImportToken creates a token from existing secrets, e.g. those of a
+// token registered elsewhere.  Pasting registration information into any
+// of the secret fields fills them all.
+func (y *ykSoftApp) onImportToken() {
+	y.touch()
+	nameEntry := widget.NewEntry()
+	nameEntry.SetPlaceHolder("Token name (e.g., default)")
+	nameEntry.Validator = validateName
+
+	publicIDEntry := widget.NewEntry()
+	publicIDEntry.SetPlaceHolder("Modhex, or paste registration info")
+	publicIDEntry.Validator = validatePublicID
+
+	privateIDEntry := widget.NewEntry()
+	privateIDEntry.SetPlaceHolder("12 hex digits")
+	privateIDEntry.Validator = validatePrivateID
+
+	aesKeyEntry := widget.NewEntry()
+	aesKeyEntry.SetPlaceHolder("32 hex digits")
+	aesKeyEntry.Validator = validateAESKey
+
+	counterEntry := widget.NewEntry()
+	counterEntry.SetPlaceHolder("0")
+	counterEntry.Validator = optional(validateCounter)
+
+	// Split pasted registration info across the secret fields
+	fill := func(s string) {
+		if !strings.Contains(s, ",") {
+			return
+		}
+		imported, err := token.ParseRegistrationInfo(s, 0)
+		if err != nil {
+			return // Leave it for the validator to flag
+		}
+
+		regInfo := strings.Split(imported.RegistrationInfo(), ", ")
+		publicIDEntry.SetText(regInfo[0])
+		privateIDEntry.SetText(regInfo[1])
+		aesKeyEntry.SetText(regInfo[2])
+	}
+	publicIDEntry.OnChanged = fill
+	privateIDEntry.OnChanged = fill
+	aesKeyEntry.OnChanged = fill
+
+	dialog.ShowForm("Import Token", "Import", "Cancel",
+		[]*widget.FormItem{
+			widget.NewFormItem("Name", nameEntry),
+			widget.NewFormItem("Public ID", publicIDEntry),
+			widget.NewFormItem("Private ID", privateIDEntry),
+			widget.NewFormItem("AES Key", aesKeyEntry),
+			widget.NewFormItem("Counter", counterEntry),
+		},
+		func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+
+			name := strings.TrimSpace(nameEntry.Text)
+			imported, err := y.newImportedToken(publicIDEntry.Text, privateIDEntry.Text,
+				aesKeyEntry.Text, counterEntry.Text)
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("Failed to import token: %v", err), y.mainWindow)
+				return
+			}
+
+			if err := y.manager.Create(name, imported); err != nil {
+				if errors.Is(err, token.ErrTokenExists) {
+					err = fmt.Errorf("Token '%s' already exists", name)
+				} else {
+					err = fmt.Errorf("Failed to save token: %v", err)
+				}
+				dialog.ShowError(err, y.mainWindow)
+				return
+			}
+
+			y.firstUse(name) // Importing is the first power-up
+			y.tokenSelect.SetSelected(name)
+			y.statusLabel.SetText(fmt.Sprintf("Token '%s' imported", name))
+		},
+		y.mainWindow,
+	)
+}
+
+// newImportedToken builds a token from the import form's fields.  Only the
+// counter may be empty.
+func (y *ykSoftApp) newImportedToken(publicIDText, privateIDText, aesKeyText, counterText string) (*token.SoftToken, error) {
+	publicID, err := token.ParsePublicID(publicIDText)
+	if err != nil {
+		return nil, fmt.Errorf("public ID: %w", err)
+	}
+	privateID, err := token.ParsePrivateID(privateIDText)
+	if err != nil {
+		return nil, fmt.Errorf("private ID: %w", err)
+	}
+	aesKey, err := token.ParseAESKey(aesKeyText)
+	if err != nil {
+		return nil, fmt.Errorf("AES key: %w", err)
+	}
+
+	var counter uint16
+	if strings.TrimSpace(counterText) != "" {
+		if counter, err = token.ParseCounter(counterText); err != nil {
+			return nil, fmt.Errorf("counter: %w", err)
+		}
+	}
+
+	if err := y.manager.CheckPublicID(publicID, ""); err != nil {
+		return nil, err
+	}
+
+	return token.NewWithOptions(publicID, privateID, aesKey, counter)
+}
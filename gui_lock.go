@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// prefLockTimeout is the preference key holding how many minutes without
+// activity lock the application, 0 to only lock on demand
+const prefLockTimeout = "lockTimeout"
+
+// defaultLockTimeout is used if the preference isn't set
+const defaultLockTimeout = 5
+
+// unlockProvider authenticates the user before the application unlocks.
+// The default asks for the token directory's passphrase.  Others, such as
+// OS account re-authentication, may authenticate the user their own way
+// and fetch the passphrase from e.g. the OS keyring.
+type unlockProvider interface {
+	// CanLock returns an error saying why locking wouldn't protect m, such
+	// as there being nothing to authenticate the user with
+	CanLock(m *token.Manager) error
+	// NeedsPassphrase returns true if the lock screen should ask for the
+	// passphrase to unlock m
+	NeedsPassphrase(m *token.Manager) bool
+	// Unlock authenticates the user, and unlocks m if it's encrypted
+	Unlock(m *token.Manager, passphrase string) error
+}
+
+// passphraseUnlocker unlocks with the passphrase typed on the lock screen.
+// Without encryption there's no passphrase to check, so it refuses to lock.
+type passphraseUnlocker struct{}
+
+// errNotEncrypted is why an unencrypted token directory can't be locked
+var errNotEncrypted = errors.New("Tokens aren't encrypted, so anyone could unlock them.  Encrypt them in Settings to lock.")
+
+func (passphraseUnlocker) CanLock(m *token.Manager) error {
+	if !m.Encrypted() {
+		return errNotEncrypted
+	}
+	return nil
+}
+
+func (passphraseUnlocker) NeedsPassphrase(m *token.Manager) bool {
+	return m.Encrypted()
+}
+
+func (passphraseUnlocker) Unlock(m *token.Manager, passphrase string) error {
+	return m.Unlock(passphrase)
+}
+
+// lockTimeout returns how long without activity locks the application
+func (y *ykSoftApp) lockTimeout() time.Duration {
+	minutes := y.app.Preferences().IntWithFallback(prefLockTimeout, defaultLockTimeout)
+	if minutes < 0 {
+		minutes = 0
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// touch records user activity, restarting the idle lock timer.  There's
+// no timer while the unlocker can't lock the token directory.
+func (y *ykSoftApp) touch() {
+	timeout := y.lockTimeout()
+
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	y.stopIdleTimer()
+	if timeout > 0 && !y.locked && y.unlocker.CanLock(y.manager) == nil {
+		generation := y.idleGeneration
+		y.idleTimer = time.AfterFunc(timeout, func() {
+			y.lockIdle(generation)
+		})
+	}
+}
+
+// stopIdleTimer stops the idle lock timer, so one that's already fired
+// doesn't lock the application.  y.mu must be held.
+func (y *ykSoftApp) stopIdleTimer() {
+	if y.idleTimer != nil {
+		y.idleTimer.Stop()
+		y.idleTimer = nil
+	}
+	y.idleGeneration++
+}
+
+// isLocked returns true while the lock screen is showing
+func (y *ykSoftApp) isLocked() bool {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	return y.locked
+}
+
+// onLock locks the application on demand, or says why it can't
+func (y *ykSoftApp) onLock() {
+	if err := y.unlocker.CanLock(y.manager); err != nil {
+		dialog.ShowError(err, y.mainWindow)
+		return
+	}
+	y.lock()
+}
+
+// lock locks the application: the selected token is dropped, nothing can
+// be generated and the lock screen is shown until the unlocker
+// authenticates the user.  The manager's keys are only dropped if the
+// token directory is encrypted.  The caller checks the unlocker can lock
+// it.
+func (y *ykSoftApp) lock() {
+	y.mu.Lock()
+	m := y.markLocked()
+	y.mu.Unlock()
+	if m != nil {
+		y.showLocked(m)
+	}
+}
+
+// lockIdle locks the application from the idle timer, unless there's been
+// activity since the timer was started
+func (y *ykSoftApp) lockIdle(generation int) {
+	var m *token.Manager
+	y.mu.Lock()
+	if generation == y.idleGeneration {
+		m = y.markLocked()
+	}
+	y.mu.Unlock()
+	if m != nil {
+		y.showLocked(m)
+	}
+}
+
+// markLocked marks the application locked, returning the manager to lock,
+// or nil if it's already locked.  y.mu must be held.
+func (y *ykSoftApp) markLocked() *token.Manager {
+	if y.locked {
+		return nil
+	}
+	y.locked = true
+	y.stopIdleTimer()
+	y.tokenName, y.token = "", nil
+	return y.manager
+}
+
+// showLocked drops m's keys and clears any secrets from the clipboard, then
+// shows the lock screen
+func (y *ykSoftApp) showLocked(m *token.Manager) {
+	y.cancelGeneration()
+	if m.Encrypted() {
+		m.Lock()
+	}
+	y.clipboard.Clear()
+
+	y.showLockScreen()
+}
+
+// showLockScreen replaces the main window's content with the lock screen,
+// closing any dialogs, which may be showing secrets.  Profiles can't be
+// switched until the application is unlocked.
+func (y *ykSoftApp) showLockScreen() {
+	overlays := y.mainWindow.Canvas().Overlays()
+	for top := overlays.Top(); top != nil; top = overlays.Top() {
+		overlays.Remove(top)
+	}
+
+	y.tokenSelect.ClearSelected()
+	y.clearUI()
+
+	errorLabel := widget.NewLabel("")
+	errorLabel.Importance = widget.DangerImportance
+	errorLabel.Hide()
+
+	passphraseEntry := widget.NewPasswordEntry()
+	passphraseEntry.SetPlaceHolder("Passphrase")
+
+	unlock := func() {
+		if err := y.unlocker.Unlock(y.manager, passphraseEntry.Text); err != nil {
+			if errors.Is(err, token.ErrWrongPassphrase) {
+				errorLabel.SetText("Wrong passphrase")
+			} else {
+				errorLabel.SetText(fmt.Sprintf("Failed to unlock: %v", err))
+			}
+			errorLabel.Show()
+			passphraseEntry.SetText("")
+			return
+		}
+		y.unlock()
+	}
+	passphraseEntry.OnSubmitted = func(string) { unlock() }
+
+	unlockBtn := widget.NewButtonWithIcon("Unlock", theme.LoginIcon(), unlock)
+	unlockBtn.Importance = widget.HighImportance
+
+	title := widget.NewLabelWithStyle("YKSoft Token is locked", fyne.TextAlignCenter, fyne.TextStyle{Bold: true})
+	profileLabel := widget.NewLabelWithStyle("Profile: "+y.profile.Name, fyne.TextAlignCenter, fyne.TextStyle{})
+	form := container.NewVBox(title, profileLabel)
+	needsPassphrase := y.unlocker.NeedsPassphrase(y.manager)
+	if needsPassphrase {
+		form.Add(passphraseEntry)
+	}
+	form.Add(unlockBtn)
+	form.Add(errorLabel)
+
+	y.mainWindow.SetContent(container.NewVBox(
+		layout.NewSpacer(),
+		container.NewPadded(form),
+		layout.NewSpacer(),
+	))
+	if needsPassphrase {
+		y.mainWindow.Canvas().Focus(passphraseEntry)
+	}
+}
+
+// unlock restores the main window once the unlocker has authenticated the
+// user
+func (y *ykSoftApp) unlock() {
+	y.mu.Lock()
+	y.locked = false
+	y.mu.Unlock()
+
+	y.mainWindow.SetContent(y.content)
+	y.refreshTokenList()
+	y.touch()
+}
+
+// onEncryptTokens encrypts the token directory with a new passphrase
+func (y *ykSoftApp) onEncryptTokens() {
+	passphraseEntry := widget.NewPasswordEntry()
+	passphraseEntry.Validator = func(s string) error {
+		if s == "" {
+			return errors.New("passphrase is required")
+		}
+		return nil
+	}
+
+	confirmEntry := widget.NewPasswordEntry()
+	confirmEntry.Validator = func(s string) error {
+		if s != passphraseEntry.Text {
+			return errors.New("passphrases don't match")
+		}
+		return nil
+	}
+
+	dialog.ShowForm("Encrypt Tokens", "Encrypt", "Cancel",
+		[]*widget.FormItem{
+			widget.NewFormItem("Passphrase", passphraseEntry),
+			widget.NewFormItem("Confirm", confirmEntry),
+		},
+		func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+			if passphraseEntry.Text != confirmEntry.Text {
+				dialog.ShowError(errors.New("Passphrases don't match"), y.mainWindow)
+				return
+			}
+
+			if err := y.manager.Encrypt(passphraseEntry.Text); err != nil {
+				dialog.ShowError(fmt.Errorf("Failed to encrypt tokens: %v", err), y.mainWindow)
+				return
+			}
+			y.statusLabel.SetText("Tokens encrypted")
+			y.touch()
+		},
+		y.mainWindow,
+	)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// onRegenerateToken replaces the selected token's secrets in place, like
+// the legacy tool's -R option
+func (y *ykSoftApp) onRegenerateToken() {
+	y.touch()
+	name, current := y.current()
+	if current == nil {
+		return
+	}
+
+	publicIDEntry := widget.NewEntry()
+	publicIDEntry.SetPlaceHolder("Random, following the directory policy")
+	publicIDEntry.Validator = optional(validatePublicID)
+
+	keepPublicID := widget.NewCheck("Keep the current public ID", func(keep bool) {
+		if keep {
+			publicIDEntry.SetText("")
+			publicIDEntry.Disable()
+		} else {
+			publicIDEntry.Enable()
+		}
+	})
+	keepPublicID.SetChecked(true)
+
+	privateIDEntry := widget.NewEntry()
+	privateIDEntry.SetPlaceHolder("Random (12 hex digits)")
+	privateIDEntry.Validator = optional(validatePrivateID)
+
+	aesKeyEntry := widget.NewEntry()
+	aesKeyEntry.SetPlaceHolder("Random (32 hex digits)")
+	aesKeyEntry.Validator = optional(validateAESKey)
+
+	counterEntry := widget.NewEntry()
+	counterEntry.SetPlaceHolder("0")
+	counterEntry.Validator = optional(validateCounter)
+
+	dialog.ShowForm("Regenerate Token", "Regenerate", "Cancel",
+		[]*widget.FormItem{
+			widget.NewFormItem("", keepPublicID),
+			widget.NewFormItem("Public ID", publicIDEntry),
+			widget.NewFormItem("Private ID", privateIDEntry),
+			widget.NewFormItem("AES Key", aesKeyEntry),
+			widget.NewFormItem("Counter", counterEntry),
+		},
+		func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+
+			var publicID []byte
+			if keepPublicID.Checked {
+				publicID = current.PublicID
+			}
+			regenerated, err := y.newRegeneratedToken(name, publicID,
+				publicIDEntry.Text, privateIDEntry.Text, aesKeyEntry.Text, counterEntry.Text)
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("Failed to regenerate token: %v", err), y.mainWindow)
+				return
+			}
+
+			y.confirmRegenerate(name, regenerated)
+		},
+		y.mainWindow,
+	)
+}
+
+// newRegeneratedToken builds a replacement for the named token from the
+// form's fields, any of which may be empty.  If publicID is non-nil it's
+// kept, otherwise the public ID field is used, or a new one assigned.
+func (y *ykSoftApp) newRegeneratedToken(name string, publicID []byte, publicIDText, privateIDText, aesKeyText, counterText string) (*token.SoftToken, error) {
+	var err error
+
+	if publicID == nil {
+		if strings.TrimSpace(publicIDText) != "" {
+			if publicID, err = token.ParsePublicID(publicIDText); err != nil {
+				return nil, err
+			}
+		} else {
+			unique, err := y.manager.NewUnique(y.policy)
+			if err != nil {
+				return nil, err
+			}
+			publicID = unique.PublicID
+		}
+
+		if err := y.manager.CheckPublicID(publicID, name); err != nil {
+			return nil, err
+		}
+	}
+
+	var privateID, aesKey []byte
+	var counter uint16
+	if strings.TrimSpace(privateIDText) != "" {
+		if privateID, err = token.ParsePrivateID(privateIDText); err != nil {
+			return nil, err
+		}
+	}
+	if strings.TrimSpace(aesKeyText) != "" {
+		if aesKey, err = token.ParseAESKey(aesKeyText); err != nil {
+			return nil, err
+		}
+	}
+	if strings.TrimSpace(counterText) != "" {
+		if counter, err = token.ParseCounter(counterText); err != nil {
+			return nil, err
+		}
+	}
+
+	return token.NewWithOptions(publicID, privateID, aesKey, counter)
+}
+
+// confirmRegenerate shows the regenerated token's registration information,
+// and replaces the named token with it if the user confirms
+func (y *ykSoftApp) confirmRegenerate(name string, regenerated *token.SoftToken) {
+	dialog.ShowConfirm("Confirm Regenerate",
+		fmt.Sprintf("Replace the secrets of token '%s'?\n\n"+
+			"The current registration will stop working, and the token\n"+
+			"must be registered again with:\n\n%s", name, regenerated.RegistrationInfo()),
+		func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+
+			y.cancelGeneration()
+			if err := y.manager.Replace(name, regenerated); err != nil {
+				if errors.Is(err, token.ErrTokenNotFound) {
+					err = fmt.Errorf("Token '%s' no longer exists", name)
+				} else {
+					err = fmt.Errorf("Failed to save token: %v", err)
+				}
+				dialog.ShowError(err, y.mainWindow)
+				return
+			}
+
+			dialog.ShowInformation("Token Regenerated",
+				fmt.Sprintf("Token regenerated!\n\nRegistration info:\n%s", regenerated.RegistrationInfo()),
+				y.mainWindow)
+		},
+		y.mainWindow,
+	)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// onRotateToken starts replacing the selected token with a successor, or
+// shows the successor if a rotation is already in progress
+func (y *ykSoftApp) onRotateToken() {
+	y.touch()
+	name, _ := y.current()
+	if name == "" {
+		return
+	}
+
+	if successor, err := y.manager.Successor(name); err == nil {
+		y.showSuccessor(name, successor)
+		return
+	}
+
+	keepPublicID := widget.NewCheck("Keep the current public ID", nil)
+
+	dialog.ShowCustomConfirm("Rotate Token", "Create", "Cancel",
+		container.NewVBox(
+			widget.NewLabel(fmt.Sprintf("Create a successor for token '%s'?\n\n"+
+				"The current token stays in use until the successor\n"+
+				"has been registered with your authentication server.", name)),
+			keepPublicID,
+		),
+		func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+
+			successor, err := y.manager.StartRotation(name, keepPublicID.Checked)
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("Failed to create successor: %v", err), y.mainWindow)
+				return
+			}
+			y.showSuccessor(name, successor)
+		},
+		y.mainWindow,
+	)
+}
+
+// showSuccessor shows the registration information for a token's successor,
+// and completes the rotation once the user confirms it's registered
+func (y *ykSoftApp) showSuccessor(name string, successor *token.SoftToken) {
+	regInfo := widget.NewMultiLineEntry()
+	regInfo.SetText(successor.RegistrationInfo())
+	regInfo.Wrapping = fyne.TextWrapWord
+	regInfo.SetMinRowsVisible(3)
+	regInfo.Disable()
+
+	var d dialog.Dialog
+
+	copyBtn := widget.NewButtonWithIcon("Copy Registration Info", theme.ContentCopyIcon(), func() {
+		y.copyRegInfo(successor.RegistrationInfo())
+	})
+
+	registeredBtn := widget.NewButtonWithIcon("Registered", theme.ConfirmIcon(), func() {
+		dialog.ShowConfirm("Complete Rotation",
+			fmt.Sprintf("Replace token '%s' with its successor?\n\n"+
+				"OTPs from the current token will no longer be generated.", name),
+			func(confirmed bool) {
+				if !confirmed {
+					return
+				}
+				d.Hide()
+
+				y.cancelGeneration()
+				if err := y.manager.CompleteRotation(name); err != nil {
+					dialog.ShowError(fmt.Errorf("Failed to replace token: %v", err), y.mainWindow)
+					return
+				}
+				y.statusLabel.SetText(fmt.Sprintf("Token '%s' replaced by its successor", name))
+			},
+			y.mainWindow,
+		)
+	})
+	registeredBtn.Importance = widget.HighImportance
+
+	discardBtn := widget.NewButtonWithIcon("Discard Successor", theme.DeleteIcon(), func() {
+		dialog.ShowConfirm("Discard Successor",
+			"Discard the successor?  If it has been registered, it will no longer be usable.",
+			func(confirmed bool) {
+				if !confirmed {
+					return
+				}
+				d.Hide()
+
+				if err := y.manager.CancelRotation(name); err != nil && !errors.Is(err, token.ErrNoRotation) {
+					dialog.ShowError(fmt.Errorf("Failed to discard successor: %v", err), y.mainWindow)
+				}
+			},
+			y.mainWindow,
+		)
+	})
+
+	d = dialog.NewCustom("Successor for "+name, "Later",
+		container.NewVBox(
+			widget.NewLabel("Register the successor with your authentication server,\n"+
+				"then click Registered to replace the current token."),
+			regInfo,
+			copyBtn,
+			container.NewHBox(discardBtn, registeredBtn),
+		),
+		y.mainWindow,
+	)
+	d.Show()
+}
+
+// offerRotation prompts the user to rotate the selected token when its
+// counter is exhausted
+func (y *ykSoftApp) offerRotation(name string) {
+	dialog.ShowConfirm("Token Exhausted",
+		fmt.Sprintf("Token '%s' can't generate any more OTPs.\n\nCreate a successor to replace it?", name),
+		func(confirmed bool) {
+			if confirmed {
+				y.onRotateToken()
+			}
+		},
+		y.mainWindow,
+	)
+}
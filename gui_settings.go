@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+
+	"github.com/arr2036/yksofttoken/internal/audit"
+	"github.com/arr2036/yksofttoken/internal/profile"
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// powerCycleOptions are offered for the power cycle policy setting
+var powerCycleOptions = []string{"never", "start", "invocation", "idle:30m"}
+
+// openProfile switches to a profile's token directory, creating it if
+// needed.  The UI is switched even if the directory can't be created, so
+// the user can fix it in the settings.
+func (y *ykSoftApp) openProfile(p profile.Profile) error {
+	y.cancelGeneration()
+	if y.unsubscribe != nil {
+		y.unsubscribe()
+		y.stopWatching()
+	}
+
+	y.profile = p
+	y.tokenDir = p.Dir
+	mkdirErr := os.MkdirAll(p.Dir, 0700)
+	manager, storeErr := token.OpenManager(p.Dir, managerOptions()...)
+	if storeErr != nil {
+		// Keep the UI usable so the store configuration can be fixed
+		manager = token.NewManagerWithStore(p.Dir, token.NewMemoryStore())
+	}
+
+	y.mu.Lock()
+	previous := y.manager
+	y.manager = manager
+	y.locked = manager.Locked()
+	y.tokenName, y.token = "", nil
+	y.poweredUp = make(map[string]bool)
+	y.stopIdleTimer()
+	y.mu.Unlock()
+
+	// Drop the previous profile's keys, so nothing still holding its
+	// manager can generate from it
+	if previous != nil {
+		previous.Lock()
+	}
+	unsubscribe := y.manager.Subscribe(y.onTokenEvent)
+	stopRecording := audit.Record(y.manager, audit.New(p.Dir), audit.CurrentConsumer(audit.ConsumerGUI), func(err error) {
+		y.statusLabel.SetText(fmt.Sprintf("Failed to write audit log: %v", err))
+	})
+	y.unsubscribe = func() {
+		stopRecording()
+		unsubscribe()
+	}
+
+	// Follow changes made by other processes, such as the CLI
+	ctx, stopWatching := context.WithCancel(context.Background())
+	y.stopWatching = stopWatching
+	if mkdirErr == nil {
+		go func(m *token.Manager) {
+			if err := m.Watch(ctx); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+				y.statusLabel.SetText(fmt.Sprintf("Not watching token directory: %v", err))
+			}
+		}(y.manager)
+	}
+
+	// Load the directory policy, falling back to the default
+	policy, err := token.LoadPolicy(p.Dir)
+	if err != nil {
+		policy = token.DefaultPolicy
+	}
+	y.policy = policy
+
+	y.profileSelect.Options = y.profiles.Names()
+	y.profileSelect.Selected = p.Name
+	y.profileSelect.Refresh()
+
+	y.tokenSelect.ClearSelected()
+	y.clearUI()
+	if y.isLocked() {
+		y.showLockScreen()
+	} else {
+		y.mainWindow.SetContent(y.content)
+		y.touch()
+	}
+	y.refreshTokenList()
+	y.refreshTray()
+
+	if mkdirErr != nil {
+		return fmt.Errorf("Failed to create token directory: %v", mkdirErr)
+	}
+	if storeErr != nil {
+		return fmt.Errorf("Failed to open token store: %v", storeErr)
+	}
+	return nil
+}
+
+func (y *ykSoftApp) onProfileSelected(name string) {
+	if name == "" || name == y.profile.Name {
+		return
+	}
+
+	p, err := y.profiles.Get(name)
+	if err == nil {
+		err = y.profiles.SetCurrent(name)
+	}
+	if err != nil {
+		dialog.ShowError(fmt.Errorf("Failed to switch profile: %v", err), y.mainWindow)
+		return
+	}
+
+	if err := y.openProfile(p); err != nil {
+		dialog.ShowError(err, y.mainWindow)
+	}
+}
+
+func (y *ykSoftApp) onNewProfile() {
+	y.touch()
+	nameEntry := widget.NewEntry()
+	nameEntry.SetPlaceHolder("Profile name (e.g., acme)")
+	nameEntry.Validator = validateName
+
+	dirEntry, dirField := y.newDirField()
+
+	dialog.ShowForm("New Profile", "Create", "Cancel",
+		[]*widget.FormItem{
+			widget.NewFormItem("Name", nameEntry),
+			widget.NewFormItem("Token Directory", dirField),
+		},
+		func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+
+			p := profile.Profile{
+				Name: strings.TrimSpace(nameEntry.Text),
+				Dir:  expandDir(dirEntry.Text),
+			}
+			if err := y.profiles.Create(p); err != nil {
+				if errors.Is(err, profile.ErrProfileExists) {
+					err = fmt.Errorf("Profile '%s' already exists", p.Name)
+				} else {
+					err = fmt.Errorf("Failed to create profile: %v", err)
+				}
+				dialog.ShowError(err, y.mainWindow)
+				return
+			}
+
+			if err := y.profiles.SetCurrent(p.Name); err != nil {
+				dialog.ShowError(fmt.Errorf("Failed to switch profile: %v", err), y.mainWindow)
+				return
+			}
+			if err := y.openProfile(p); err != nil {
+				dialog.ShowError(err, y.mainWindow)
+			}
+		},
+		y.mainWindow,
+	)
+}
+
+// showSettings edits the current profile, and the settings shared by all
+// profiles
+func (y *ykSoftApp) showSettings() {
+	y.touch()
+	prefs := y.app.Preferences()
+	p := y.profile
+
+	dirEntry, dirField := y.newDirField()
+	dirEntry.SetText(p.Dir)
+
+	names, _ := y.manager.Names()
+	defaultTokenEntry := widget.NewSelectEntry(names)
+	defaultTokenEntry.SetPlaceHolder("First token")
+	defaultTokenEntry.SetText(p.DefaultToken)
+
+	timeoutEntry := widget.NewEntry()
+	timeoutEntry.SetText(strconv.Itoa(int(y.clipboardTimeout().Seconds())))
+	timeoutEntry.Validator = func(s string) error {
+		if seconds, err := strconv.Atoi(strings.TrimSpace(s)); err != nil || seconds < 0 {
+			return errors.New("must be a number of seconds, 0 to never clear")
+		}
+		return nil
+	}
+
+	lockEntry := widget.NewEntry()
+	lockEntry.SetText(strconv.Itoa(int(y.lockTimeout().Minutes())))
+	lockEntry.Validator = func(s string) error {
+		if minutes, err := strconv.Atoi(strings.TrimSpace(s)); err != nil || minutes < 0 {
+			return errors.New("must be a number of minutes, 0 to only lock on demand")
+		}
+		return nil
+	}
+
+	var encryption fyne.CanvasObject = widget.NewLabel("Tokens are encrypted")
+	if !y.manager.Encrypted() {
+		encryption = widget.NewButtonWithIcon("Encrypt Tokens", theme.LogoutIcon(), y.onEncryptTokens)
+	}
+
+	powerEntry := widget.NewSelectEntry(powerCycleOptions)
+	powerEntry.SetText(y.powerPolicy.String())
+	powerEntry.Validator = func(s string) error {
+		_, err := token.ParsePowerCyclePolicy(strings.TrimSpace(s))
+		return err
+	}
+
+	timeoutItem := widget.NewFormItem("Clipboard Timeout", timeoutEntry)
+	timeoutItem.HintText = "Seconds before copied secrets are cleared, 0 to keep them"
+	lockItem := widget.NewFormItem("Lock After", lockEntry)
+	lockItem.HintText = "Minutes without activity, 0 to only lock on demand.  Needs encrypted tokens"
+	powerItem := widget.NewFormItem("Power Cycle", powerEntry)
+	powerItem.HintText = "never, start, invocation or idle:<duration>"
+
+	var d *dialog.FormDialog
+
+	deleteBtn := widget.NewButtonWithIcon("Delete Profile", theme.DeleteIcon(), func() {
+		dialog.ShowConfirm("Delete Profile",
+			fmt.Sprintf("Delete profile '%s'?\n\nIts token directory and tokens are kept.", p.Name),
+			func(confirmed bool) {
+				if !confirmed {
+					return
+				}
+				d.Hide()
+
+				if err := y.profiles.Delete(p.Name); err != nil {
+					dialog.ShowError(fmt.Errorf("Failed to delete profile: %v", err), y.mainWindow)
+					return
+				}
+				if err := y.openProfile(y.profiles.Current()); err != nil {
+					dialog.ShowError(err, y.mainWindow)
+				}
+			},
+			y.mainWindow,
+		)
+	})
+	if len(y.profiles.Names()) == 1 {
+		deleteBtn.Disable()
+	}
+
+	d = dialog.NewForm("Settings", "Save", "Cancel",
+		[]*widget.FormItem{
+			widget.NewFormItem("Profile", container.NewBorder(nil, nil, nil, deleteBtn, widget.NewLabel(p.Name))),
+			widget.NewFormItem("Token Directory", dirField),
+			widget.NewFormItem("Default Token", defaultTokenEntry),
+			timeoutItem,
+			widget.NewFormItem("Encryption", encryption),
+			lockItem,
+			powerItem,
+		},
+		func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+
+			powerPolicy, err := token.ParsePowerCyclePolicy(strings.TrimSpace(powerEntry.Text))
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("Invalid power cycle policy: %v", err), y.mainWindow)
+				return
+			}
+			seconds, _ := strconv.Atoi(strings.TrimSpace(timeoutEntry.Text))
+			minutes, _ := strconv.Atoi(strings.TrimSpace(lockEntry.Text))
+
+			prefs.SetInt(prefClipboardTimeout, seconds)
+			prefs.SetInt(prefLockTimeout, minutes)
+			y.touch()
+			prefs.SetString(prefPowerCycle, powerPolicy.String())
+			y.powerPolicy = powerPolicy
+
+			updated := profile.Profile{
+				Name:         p.Name,
+				Dir:          expandDir(dirEntry.Text),
+				DefaultToken: strings.TrimSpace(defaultTokenEntry.Text),
+			}
+			if err := y.profiles.Update(updated); err != nil {
+				dialog.ShowError(fmt.Errorf("Failed to save profile: %v", err), y.mainWindow)
+				return
+			}
+
+			// Only reopen the directory if it changed, so the selected
+			// token stays selected
+			if updated.Dir == y.profile.Dir {
+				y.profile = updated
+				return
+			}
+			if err := y.openProfile(updated); err != nil {
+				dialog.ShowError(err, y.mainWindow)
+			}
+		},
+		y.mainWindow,
+	)
+	d.Resize(fyne.NewSize(500, 0))
+	d.Show()
+}
+
+// newDirField returns an entry for a token directory, and the entry with a
+// button to browse for the directory
+func (y *ykSoftApp) newDirField() (*widget.Entry, fyne.CanvasObject) {
+	entry := widget.NewEntry()
+	entry.SetPlaceHolder("e.g. ~/.yksoft-acme")
+	entry.Validator = func(s string) error {
+		if strings.TrimSpace(s) == "" {
+			return errors.New("token directory is required")
+		}
+		return nil
+	}
+
+	browseBtn := widget.NewButtonWithIcon("", theme.FolderOpenIcon(), func() {
+		dialog.ShowFolderOpen(func(dir fyne.ListableURI, err error) {
+			if err != nil || dir == nil {
+				return
+			}
+			entry.SetText(dir.Path())
+		}, y.mainWindow)
+	})
+
+	return entry, container.NewBorder(nil, nil, nil, browseBtn, entry)
+}
+
+// expandDir expands a leading ~ in a token directory to the user's home
+// directory, as the legacy tool's shell would have
+func expandDir(dir string) string {
+	dir = strings.TrimSpace(dir)
+	if dir != "~" && !strings.HasPrefix(dir, "~/") && !strings.HasPrefix(dir, `~\`) {
+		return filepath.Clean(dir)
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Clean(dir)
+	}
+	return filepath.Join(home, dir[1:])
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/driver/desktop"
+	"fyne.io/fyne/v2/theme"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// setupTray adds a system tray icon, if the platform has one, and makes
+// closing the main window hide it in the tray instead of quitting
+func (y *ykSoftApp) setupTray() {
+	desk, ok := y.app.(desktop.App)
+	if !ok {
+		return
+	}
+	y.tray = desk
+
+	y.refreshTray()
+	y.mainWindow.SetCloseIntercept(func() {
+		y.mainWindow.Hide()
+	})
+}
+
+// refreshTray rebuilds the tray menu from the tokens in the token directory
+func (y *ykSoftApp) refreshTray() {
+	if y.tray == nil {
+		return
+	}
+
+	showItem := fyne.NewMenuItem("Show YKSoft Token", func() {
+		y.mainWindow.Show()
+		y.mainWindow.RequestFocus()
+	})
+	lockItem := fyne.NewMenuItem("Lock", y.lock)
+
+	items := []*fyne.MenuItem{showItem, lockItem, fyne.NewMenuItemSeparator()}
+
+	names, err := y.manager.Names()
+	if err != nil || len(names) == 0 {
+		noTokens := fyne.NewMenuItem("No tokens", nil)
+		noTokens.Disabled = true
+		items = append(items, noTokens)
+	}
+	for _, name := range names {
+		name := name
+		generateItem := fyne.NewMenuItem("Generate & Copy", func() {
+			y.trayGenerate(name)
+		})
+		generateItem.Icon = theme.ContentCopyIcon()
+
+		tokenItem := fyne.NewMenuItem(name, nil)
+		tokenItem.ChildMenu = fyne.NewMenu(name, generateItem)
+		items = append(items, tokenItem)
+	}
+
+	y.tray.SetSystemTrayMenu(fyne.NewMenu("YKSoft Token", items...))
+}
+
+// trayGenerate generates an OTP from the named token, copies it to the
+// clipboard, and reports the token's counters in a notification.  It's run
+// from the tray's goroutine, so may block on the token's rate limit.
+func (y *ykSoftApp) trayGenerate(name string) {
+	if y.isLocked() {
+		y.notify(name, "YKSoft Token is locked, unlock it from the main window")
+		return
+	}
+	y.touch()
+
+	if y.firstUse(name) {
+		if err := y.applyPowerPolicy(name, token.PowerEventStart); err != nil {
+			y.notify(name, err.Error())
+			return
+		}
+	}
+	if err := y.applyPowerPolicy(name, token.PowerEventGenerate); err != nil {
+		y.notify(name, err.Error())
+		return
+	}
+
+	otp, err := y.manager.Generate(context.Background(), name)
+	if errors.Is(err, token.ErrCounterExhausted) {
+		y.notify(name, "Counter exhausted, the token must be rotated")
+		return
+	}
+	if errors.Is(err, token.ErrStaleToken) {
+		y.notify(name, "Token was used elsewhere and has been reloaded, generate again")
+		return
+	}
+	if err != nil {
+		y.notify(name, fmt.Sprintf("Failed to generate OTP: %v", err))
+		return
+	}
+	// The application may have locked while waiting on the rate limit
+	if y.isLocked() {
+		y.notify(name, "YKSoft Token is locked, unlock it from the main window")
+		return
+	}
+	y.clipboard.Copy(otp, true, y.clipboardTimeout())
+
+	t, err := y.manager.Get(name)
+	if err != nil {
+		y.notify(name, "OTP copied")
+		return
+	}
+
+	msg := fmt.Sprintf("OTP copied (counter %d, session %d)", t.Counter, t.Session)
+	if lifetime := t.Lifetime(); lifetime.Low(y.policy) {
+		msg += fmt.Sprintf("\nToken nearly exhausted: %s", lifetime)
+	}
+	y.notify(name, msg)
+}
+
+// notify shows a desktop notification about the named token
+func (y *ykSoftApp) notify(name, content string) {
+	y.app.SendNotification(fyne.NewNotification("YKSoft Token: "+name, content))
+}
@@ -0,0 +1,203 @@
+// Package audit keeps an append-only log of the OTPs generated from the
+// tokens in a token directory, recording what generated them but never
+// the OTPs themselves.  Entries are hash-chained, and optionally MACed,
+// so changes to the log can be detected with Verify.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// logFile is the audit log's file in the token directory.  It's hidden, so
+// isn't mistaken for a token.
+const logFile = ".audit.log"
+
+// fingerprintSize is how many bytes of an OTP's hash are kept
+const fingerprintSize = 4
+
+// Consumers
+const (
+	ConsumerGUI   = "gui"
+	ConsumerCLI   = "cli"
+	ConsumerAgent = "agent"
+)
+
+// Consumer identifies what generated an OTP
+type Consumer struct {
+	Name      string `json:"consumer"`         // ConsumerGUI, ConsumerCLI or ConsumerAgent
+	PID       int    `json:"pid"`              // Process generating the OTP
+	Process   string `json:"process"`          // Its executable
+	User      string `json:"user"`             // The user running it
+	ParentPID int    `json:"ppid"`             // The caller, e.g. the script running the CLI
+	Parent    string `json:"parent,omitempty"` // The caller's name, where the platform provides it
+}
+
+// Entry records one OTP being generated
+type Entry struct {
+	Seq         uint64    `json:"seq"`  // Position in the chain, from 1
+	Prev        string    `json:"prev"` // Hash of the previous entry, see Verify
+	Time        time.Time `json:"time"`
+	Token       string    `json:"token"`
+	Counter     uint16    `json:"counter"`
+	Session     uint8     `json:"session"`
+	Fingerprint string    `json:"fingerprint"`     // Truncated hash of the OTP, see Fingerprint
+	Count       int       `json:"count,omitempty"` // OTPs reserved from Counter/Session on, for bulk generation
+	Consumer
+	MAC string `json:"mac,omitempty"` // HMAC of the entry, if the log has a key
+}
+
+// Fingerprint returns a truncated hash of an OTP.  It's enough to match an
+// entry against a validation server's logs, but not to recover the OTP.
+func Fingerprint(otp string) string {
+	sum := sha256.Sum256([]byte(otp))
+	return hex.EncodeToString(sum[:fingerprintSize])
+}
+
+// Summary returns the entry's fingerprint, or how many OTPs it reserved
+func (e Entry) Summary() string {
+	if e.Count > 0 {
+		return fmt.Sprintf("%d reserved", e.Count)
+	}
+	return e.Fingerprint
+}
+
+// Log is the audit log of a token directory.  It's safe for concurrent use.
+type Log struct {
+	path     string
+	headPath string
+	keyPath  string
+	mu       sync.Mutex // Serializes appends from this process
+}
+
+// New returns the audit log of the token directory
+func New(tokenDir string) *Log {
+	return &Log{
+		path:     filepath.Join(tokenDir, logFile),
+		headPath: filepath.Join(tokenDir, headFile),
+		keyPath:  filepath.Join(tokenDir, keyFile),
+	}
+}
+
+// Path returns the audit log's file
+func (l *Log) Path() string {
+	return l.path
+}
+
+// Append adds an entry to the log, chaining it to the last entry.  The
+// entry's Seq, Prev and MAC are set by Append.
+func (l *Log) Append(e Entry) error {
+	key, err := l.key()
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The lock is held until the head is written, so entries from
+	// different processes are chained in the order they're written
+	if err := lockFile(file); err != nil {
+		return fmt.Errorf("failed to lock audit log: %w", err)
+	}
+
+	last, err := lastLine(file)
+	if err != nil {
+		return err
+	}
+	e.Seq, e.Prev, e.MAC = 1, "", ""
+	if last != nil {
+		var prev Entry
+		if err := json.Unmarshal(last, &prev); err != nil {
+			return fmt.Errorf("%w: last entry is invalid", ErrBrokenChain)
+		}
+		if key == nil && prev.MAC != "" {
+			return fmt.Errorf("%w: entries are MACed, but the log's key is missing", ErrBrokenChain)
+		}
+		e.Seq, e.Prev = prev.Seq+1, hashLine(last)
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		line = appendMAC(line, key)
+	}
+
+	// Each entry is a single write to a file opened for appending, so
+	// entries are never interleaved
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return l.writeHead(head{seq: e.Seq, hash: hashLine(line)}, key)
+}
+
+// Filter selects log entries.  Zero fields match every entry.
+type Filter struct {
+	Token    string
+	Consumer string
+	Since    time.Time // Entries at or after
+	Until    time.Time // Entries before
+	Limit    int       // Only the most recent entries, if positive
+}
+
+func (f Filter) match(e Entry) bool {
+	switch {
+	case f.Token != "" && e.Token != f.Token:
+		return false
+	case f.Consumer != "" && e.Name != f.Consumer:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// Entries returns the entries matching f, oldest first
+func (l *Log) Entries(f Filter) ([]Entry, error) {
+	file, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("invalid entry on line %d: %w", n, err)
+		}
+		if f.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if f.Limit > 0 && len(entries) > f.Limit {
+		entries = entries[len(entries)-f.Limit:]
+	}
+	return entries, nil
+}
@@ -0,0 +1,174 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+func TestFingerprint(t *testing.T) {
+	otp := "ddddcbhuinjlhbrtjdnvlfnbvrlkdtnjcccj"
+	fp := Fingerprint(otp)
+
+	if len(fp) != 2*fingerprintSize {
+		t.Errorf("Fingerprint %q is %d characters, expected %d", fp, len(fp), 2*fingerprintSize)
+	}
+	if fp != Fingerprint(otp) {
+		t.Error("Fingerprint isn't deterministic")
+	}
+	if fp == Fingerprint(otp[:len(otp)-1]+"d") {
+		t.Error("Different OTPs have the same fingerprint")
+	}
+}
+
+func TestLogFilter(t *testing.T) {
+	l := New(t.TempDir())
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	entries := []Entry{
+		{Time: start, Token: "vpn", Counter: 1, Session: 1, Consumer: Consumer{Name: ConsumerCLI}},
+		{Time: start.Add(time.Hour), Token: "vpn", Counter: 1, Session: 2, Consumer: Consumer{Name: ConsumerGUI}},
+		{Time: start.Add(2 * time.Hour), Token: "mail", Counter: 3, Session: 1, Consumer: Consumer{Name: ConsumerCLI}},
+		{Time: start.Add(3 * time.Hour), Token: "vpn", Counter: 2, Session: 1, Consumer: Consumer{Name: ConsumerCLI}},
+	}
+	for _, e := range entries {
+		if err := l.Append(e); err != nil {
+			t.Fatalf("Failed to append entry: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   int
+	}{
+		{"all", Filter{}, 4},
+		{"token", Filter{Token: "vpn"}, 3},
+		{"consumer", Filter{Consumer: ConsumerCLI}, 3},
+		{"since", Filter{Since: start.Add(2 * time.Hour)}, 2},
+		{"until", Filter{Until: start.Add(2 * time.Hour)}, 2},
+		{"combined", Filter{Token: "vpn", Consumer: ConsumerCLI, Since: start.Add(time.Minute)}, 1},
+		{"limit", Filter{Limit: 2}, 2},
+	}
+	for _, tt := range tests {
+		got, err := l.Entries(tt.filter)
+		if err != nil {
+			t.Fatalf("%s: failed to read entries: %v", tt.name, err)
+		}
+		if len(got) != tt.want {
+			t.Errorf("%s: got %d entries, expected %d", tt.name, len(got), tt.want)
+		}
+	}
+
+	// The limit keeps the most recent entries
+	got, _ := l.Entries(Filter{Limit: 1})
+	if len(got) != 1 || !got[0].Time.Equal(entries[3].Time) {
+		t.Errorf("Limit kept %+v, expected the last entry", got)
+	}
+}
+
+func TestLogMissing(t *testing.T) {
+	entries, err := New(t.TempDir()).Entries(Filter{})
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Reading a missing log gave %v, %v", entries, err)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	dir := t.TempDir()
+	m := token.NewManager(dir)
+	tok, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	if err := m.Create("vpn", tok); err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	l := New(dir)
+	consumer := CurrentConsumer(ConsumerCLI)
+	stop := Record(m, l, consumer, func(err error) { t.Errorf("Failed to record: %v", err) })
+
+	otp, err := m.Generate(context.Background(), "vpn")
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	if err := m.PowerCycle("vpn"); err != nil {
+		t.Fatalf("Failed to power cycle: %v", err)
+	}
+	stop()
+	if _, err := m.Generate(context.Background(), "vpn"); err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+
+	entries, err := l.Entries(Filter{})
+	if err != nil {
+		t.Fatalf("Failed to read entries: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Got %d entries, expected only the OTP generated while recording", len(entries))
+	}
+
+	e := entries[0]
+	_, block, err := yubikey.ParseOTP(otp, tok.AESKey[:])
+	if err != nil {
+		t.Fatalf("Failed to parse OTP: %v", err)
+	}
+	if e.Token != "vpn" || e.Counter != block.Counter || e.Session != block.Session {
+		t.Errorf("Entry %+v doesn't match OTP counters %d/%d", e, block.Counter, block.Session)
+	}
+	if e.Fingerprint != Fingerprint(otp) || e.PID != os.Getpid() || e.Name != ConsumerCLI {
+		t.Errorf("Entry %+v has the wrong fingerprint or consumer", e)
+	}
+
+	// Neither the OTP nor the token's secrets are in the log
+	data, err := os.ReadFile(l.Path())
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	if strings.Contains(string(data), otp) || strings.Contains(string(data), otp[len(otp)-32:]) {
+		t.Errorf("Log contains the OTP:\n%s", data)
+	}
+}
+
+func TestRecordReserved(t *testing.T) {
+	dir := t.TempDir()
+	m := token.NewManager(dir)
+	tok, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	if err := m.Create("vpn", tok); err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	l := New(dir)
+	stop := Record(m, l, CurrentConsumer(ConsumerCLI), func(err error) { t.Errorf("Failed to record: %v", err) })
+	defer stop()
+
+	otps, err := m.GenerateN("vpn", 300)
+	if err != nil {
+		t.Fatalf("GenerateN failed: %v", err)
+	}
+
+	entries, err := l.Entries(Filter{})
+	if err != nil {
+		t.Fatalf("Failed to read entries: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Got %d entries, expected one for the reservation", len(entries))
+	}
+	_, block, err := yubikey.ParseOTP(otps[0], tok.AESKey[:])
+	if err != nil {
+		t.Fatalf("Failed to parse OTP: %v", err)
+	}
+	e := entries[0]
+	if e.Count != len(otps) || e.Counter != block.Counter || e.Session != block.Session || e.Fingerprint != "" {
+		t.Errorf("Entry %+v doesn't match the reservation of %d OTPs from %d/%d", e, len(otps), block.Counter, block.Session)
+	}
+}
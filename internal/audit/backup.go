@@ -0,0 +1,128 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/arr2036/yksofttoken/internal/fsutil"
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// State is the log's files, as kept in a backup
+type State struct {
+	Log  []byte `json:"log,omitempty"`
+	Head []byte `json:"head,omitempty"`
+	Key  []byte `json:"key,omitempty"`
+}
+
+// readOptional returns the contents of the file at path, or nil if it
+// doesn't exist
+func readOptional(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Export returns the log's files.  They're read with the log locked, so
+// the head matches the last entry.
+func (l *Log) Export() (State, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var s State
+	var err error
+	if s.Key, err = readOptional(l.keyPath); err != nil {
+		return State{}, err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return State{}, err
+	}
+	defer file.Close()
+	if err := lockFile(file); err != nil {
+		return State{}, fmt.Errorf("failed to lock audit log: %w", err)
+	}
+
+	if s.Log, err = io.ReadAll(file); err != nil {
+		return State{}, err
+	}
+	if s.Head, err = readOptional(l.headPath); err != nil {
+		return State{}, err
+	}
+	return s, nil
+}
+
+// Restore brings the log forward to s.  Entries are only ever added: if
+// the log has entries s doesn't, or a different key, it's left as it is
+// and the error wraps token.ErrRestoreConflict.
+func (l *Log) Restore(s State) (token.RestoreAction, error) {
+	if len(s.Log) == 0 && s.Key == nil {
+		return token.RestoreUnchanged, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return token.RestoreConflict, err
+	}
+	defer file.Close()
+	if err := lockFile(file); err != nil {
+		return token.RestoreConflict, fmt.Errorf("failed to lock audit log: %w", err)
+	}
+
+	local, err := io.ReadAll(file)
+	if err != nil {
+		return token.RestoreConflict, err
+	}
+	key, err := readOptional(l.keyPath)
+	if err != nil {
+		return token.RestoreConflict, err
+	}
+
+	switch {
+	case bytes.HasPrefix(local, s.Log) && (s.Key == nil || bytes.Equal(key, s.Key)):
+		return token.RestoreUnchanged, nil
+	case !bytes.HasPrefix(s.Log, local):
+		return token.RestoreConflict, fmt.Errorf("%w: the audit log has entries the backup doesn't", token.ErrRestoreConflict)
+	case key != nil && !bytes.Equal(key, s.Key):
+		return token.RestoreConflict, fmt.Errorf("%w: the audit log's key differs from the backup's", token.ErrRestoreConflict)
+	}
+
+	wroteKey := false
+	if key == nil && s.Key != nil {
+		if err := fsutil.WriteFileAtomic(l.keyPath, s.Key); err != nil {
+			return token.RestoreConflict, err
+		}
+		wroteKey = true
+	}
+	appended := len(s.Log) > len(local)
+	if appended {
+		if _, err := file.Write(s.Log[len(local):]); err != nil {
+			return token.RestoreConflict, err
+		}
+		if s.Head != nil {
+			if err := fsutil.WriteFileAtomic(l.headPath, s.Head); err != nil {
+				return token.RestoreConflict, err
+			}
+		}
+	}
+
+	switch {
+	case !appended && !wroteKey:
+		return token.RestoreUnchanged, nil
+	case len(local) == 0 && key == nil:
+		return token.RestoreAdded, nil
+	}
+	return token.RestoreUpdated, nil
+}
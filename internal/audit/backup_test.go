@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// appendEntry appends an entry to l
+func appendEntry(t *testing.T, l *Log) {
+	t.Helper()
+	e := Entry{Time: time.Now().UTC(), Token: "vpn", Counter: 1, Consumer: Consumer{Name: ConsumerCLI}}
+	if err := l.Append(e); err != nil {
+		t.Fatalf("Failed to append entry: %v", err)
+	}
+}
+
+func TestExportRestore(t *testing.T) {
+	l := writeEntries(t, 3, true)
+	s, err := l.Export()
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	// Into an empty directory
+	restored := New(t.TempDir())
+	if action, err := restored.Restore(s); err != nil || action != token.RestoreAdded {
+		t.Fatalf("Restore gave %v, %v, expected it added", action, err)
+	}
+	if v, err := restored.Verify(); err != nil || v.Entries != 3 || v.MACs != 3 {
+		t.Errorf("Restored log verified %+v, %v", v, err)
+	}
+	if action, err := restored.Restore(s); err != nil || action != token.RestoreUnchanged {
+		t.Errorf("Restoring again gave %v, %v, expected it unchanged", action, err)
+	}
+
+	// A log behind the backup is brought forward
+	appendEntry(t, l)
+	if s, err = l.Export(); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if action, err := restored.Restore(s); err != nil || action != token.RestoreUpdated {
+		t.Fatalf("Restore gave %v, %v, expected it updated", action, err)
+	}
+	if v, err := restored.Verify(); err != nil || v.Entries != 4 {
+		t.Errorf("Updated log verified %+v, %v", v, err)
+	}
+
+	// Entries are never lost
+	appendEntry(t, restored)
+	appendEntry(t, l)
+	if s, err = l.Export(); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if action, err := restored.Restore(s); !errors.Is(err, token.ErrRestoreConflict) || action != token.RestoreConflict {
+		t.Errorf("Restoring a diverged log gave %v, %v, expected a conflict", action, err)
+	}
+	if v, err := restored.Verify(); err != nil || v.Entries != 5 {
+		t.Errorf("Log verified %+v, %v after a conflict", v, err)
+	}
+}
+
+func TestRestoreKeyOnly(t *testing.T) {
+	keyed := New(t.TempDir())
+	if err := keyed.CreateKey(); err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	s, err := keyed.Export()
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	l := New(t.TempDir())
+	if action, err := l.Restore(s); err != nil || action != token.RestoreAdded {
+		t.Fatalf("Restoring a key into an empty directory gave %v, %v, expected it added", action, err)
+	}
+	if action, err := l.Restore(s); err != nil || action != token.RestoreUnchanged {
+		t.Errorf("Restoring the key again gave %v, %v, expected it unchanged", action, err)
+	}
+
+	// Only the key is missing from an otherwise identical log
+	s, err = writeEntries(t, 2, false).Export()
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	unkeyed := New(t.TempDir())
+	if _, err := unkeyed.Restore(s); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	s.Key = []byte("0123456789abcdef0123456789abcdef")
+	if action, err := unkeyed.Restore(s); err != nil || action != token.RestoreUpdated {
+		t.Errorf("Restoring only a key gave %v, %v, expected it updated", action, err)
+	}
+	if action, err := unkeyed.Restore(s); err != nil || action != token.RestoreUnchanged {
+		t.Errorf("Restoring the same state again gave %v, %v, expected it unchanged", action, err)
+	}
+}
+
+func TestRestoreOtherKey(t *testing.T) {
+	s, err := writeEntries(t, 1, true).Export()
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	l := New(t.TempDir())
+	if err := l.CreateKey(); err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	if action, err := l.Restore(s); !errors.Is(err, token.ErrRestoreConflict) || action != token.RestoreConflict {
+		t.Errorf("Restoring a log with another key gave %v, %v, expected a conflict", action, err)
+	}
+
+	empty, err := New(t.TempDir()).Export()
+	if err != nil || empty.Log != nil || empty.Key != nil {
+		t.Errorf("Exporting a missing log gave %+v, %v", empty, err)
+	}
+}
@@ -0,0 +1,336 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/arr2036/yksofttoken/internal/fsutil"
+)
+
+// headFile records the last entry appended to the log, so truncation can
+// be detected
+const headFile = ".audit.head"
+
+// keyFile holds the key entries are MACed with, if it exists
+const keyFile = ".audit.key"
+
+// keySize is the size of the MAC key in bytes
+const keySize = 32
+
+// macField precedes an entry's MAC, which is always its last field
+const macField = `,"mac":"`
+
+var (
+	// ErrBrokenChain indicates the log has been truncated, reordered or
+	// modified
+	ErrBrokenChain = errors.New("audit log chain broken")
+	// ErrKeyExists indicates the log already has a MAC key
+	ErrKeyExists = errors.New("audit log key already exists")
+)
+
+// hashLine returns the hash of an entry, as it appears in the log
+func hashLine(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// mac returns the HMAC-SHA256 of data
+func mac(key, data []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// appendMAC adds a MAC of the entry to it, as its last field
+func appendMAC(line, key []byte) []byte {
+	sum := mac(key, line)
+	out := append([]byte{}, line[:len(line)-1]...)
+	return append(out, macField+sum+`"}`...)
+}
+
+// checkMAC returns true if the entry's MAC is valid
+func checkMAC(line, key []byte) bool {
+	i := bytes.LastIndex(line, []byte(macField))
+	if i < 0 {
+		return false
+	}
+	body := append(append([]byte{}, line[:i]...), '}')
+	return hmac.Equal(appendMAC(body, key), line)
+}
+
+// key returns the log's MAC key, or nil if it doesn't have one
+func (l *Log) key() ([]byte, error) {
+	data, err := os.ReadFile(l.keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("invalid audit log key '%s'", l.keyPath)
+	}
+	return key, nil
+}
+
+// CreateKey creates a random key for the log, which entries appended from
+// then on are MACed with.  Without the key, the entries and head can't be
+// rewritten to hide a change to the log.
+func (l *Log) CreateKey() error {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := lockFile(file); err != nil {
+		return fmt.Errorf("failed to lock audit log: %w", err)
+	}
+
+	keyOut, err := os.OpenFile(l.keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%w: '%s'", ErrKeyExists, l.keyPath)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(keyOut, hex.EncodeToString(key)); err != nil {
+		keyOut.Close()
+		os.Remove(l.keyPath)
+		return err
+	}
+	if err := keyOut.Close(); err != nil {
+		os.Remove(l.keyPath)
+		return err
+	}
+
+	// MAC the existing head, so it's protected before the next append
+	h, err := l.readHead(nil)
+	if err != nil || h == nil {
+		return err
+	}
+	return l.writeHead(*h, key)
+}
+
+// head is the last entry appended to the log
+type head struct {
+	seq   uint64
+	hash  string
+	keyed bool // The head was MACed, so the log has a key
+}
+
+func (h head) mac(key []byte) string {
+	return mac(key, []byte(fmt.Sprintf("%d:%s", h.seq, h.hash)))
+}
+
+// writeHead replaces the head file, MACing it if key is non-nil
+func (l *Log) writeHead(h head, key []byte) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "seq: %d\nhash: %s\n", h.seq, h.hash)
+	if key != nil {
+		fmt.Fprintf(&b, "mac: %s\n", h.mac(key))
+	}
+
+	return fsutil.WriteFileAtomic(l.headPath, []byte(b.String()))
+}
+
+// readHead returns the log's head, or nil if it doesn't have one.  If key
+// is non-nil the head's MAC is checked.
+func (l *Log) readHead(key []byte) (*head, error) {
+	data, err := os.ReadFile(l.headPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var h head
+	var sum string
+	for _, line := range strings.Split(string(data), "\n") {
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "seq":
+			if h.seq, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return nil, fmt.Errorf("%w: invalid head", ErrBrokenChain)
+			}
+		case "hash":
+			h.hash = value
+		case "mac":
+			sum = value
+		}
+	}
+
+	h.keyed = sum != ""
+	if key != nil && !hmac.Equal([]byte(sum), []byte(h.mac(key))) {
+		return nil, fmt.Errorf("%w: head has been modified", ErrBrokenChain)
+	}
+	return &h, nil
+}
+
+// lastLine returns the last line of file, or nil if it's empty
+func lastLine(file *os.File) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := info.Size()
+	if end == 0 {
+		return nil, nil
+	}
+
+	// Skip the newline ending the last line
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, end-1); err != nil {
+		return nil, err
+	}
+	if b[0] == '\n' {
+		end--
+	}
+
+	var line []byte
+	for end > 0 {
+		start := max(end-4096, 0)
+		chunk := make([]byte, end-start)
+		if _, err := file.ReadAt(chunk, start); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return append(chunk[i+1:], line...), nil
+		}
+		line = append(chunk, line...)
+		end = start
+	}
+	return line, nil
+}
+
+// Verification is the result of verifying a log
+type Verification struct {
+	Entries int // Chained entries verified
+	Legacy  int // Entries written before the log was chained, which can't be verified
+	MACs    int // Entries whose MAC was verified
+}
+
+// Verify checks every entry follows the one before it, and that the log
+// hasn't been truncated, returning an error wrapping ErrBrokenChain that
+// describes the first broken link if it has.  If the log has a key, every
+// entry from the first with a MAC must have a valid one.  A log with MACed
+// entries, or a MACed head, fails to verify if its key is missing.
+//
+// Without a key, the chain only shows the log hasn't been changed by
+// anything that doesn't know to recompute the hashes.
+func (l *Log) Verify() (Verification, error) {
+	var v Verification
+
+	key, err := l.key()
+	if err != nil {
+		return v, err
+	}
+	h, err := l.readHead(key)
+	if err != nil {
+		return v, err
+	}
+	// Deleting the key mustn't turn MAC checking off
+	if key == nil && h != nil && h.keyed {
+		return v, fmt.Errorf("%w: head is MACed, but the log's key is missing", ErrBrokenChain)
+	}
+
+	file, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		if h != nil {
+			return v, fmt.Errorf("%w: log is missing, but %d entries were written", ErrBrokenChain, h.seq)
+		}
+		return v, nil
+	}
+	if err != nil {
+		return v, err
+	}
+	defer file.Close()
+
+	broken := func(n int, format string, args ...any) error {
+		return fmt.Errorf("%w: line %d: %s", ErrBrokenChain, n, fmt.Sprintf(format, args...))
+	}
+
+	var prev string
+	var maced bool
+	headLine := 0
+	scanner := bufio.NewScanner(file)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Bytes()
+
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return v, broken(n, "not a valid entry")
+		}
+
+		// Entries written before chaining was added
+		if e.Seq == 0 {
+			if v.Entries > 0 {
+				return v, broken(n, "entry isn't chained")
+			}
+			v.Legacy++
+			prev = hashLine(line)
+			continue
+		}
+
+		switch want := uint64(v.Entries + 1); {
+		case e.Seq != want:
+			return v, broken(n, "entry %d, expected entry %d", e.Seq, want)
+		case e.Prev != prev:
+			return v, broken(n, "entry %d doesn't follow the previous entry", e.Seq)
+		}
+
+		if key == nil && e.MAC != "" {
+			return v, broken(n, "entry %d has a MAC, but the log's key is missing", e.Seq)
+		}
+		if key != nil && (maced || e.MAC != "") {
+			maced = true
+			if !checkMAC(line, key) {
+				return v, broken(n, "entry %d has an invalid MAC", e.Seq)
+			}
+			v.MACs++
+		}
+
+		prev = hashLine(line)
+		v.Entries++
+		if h != nil && e.Seq == h.seq {
+			headLine = n
+			if prev != h.hash {
+				return v, broken(n, "entry %d doesn't match the head", e.Seq)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return v, err
+	}
+
+	switch {
+	case h == nil && v.Entries > 0:
+		return v, fmt.Errorf("%w: head is missing", ErrBrokenChain)
+	case h != nil && headLine == 0:
+		return v, broken(n+1, "missing, log ends at entry %d but %d entries were written", v.Entries, h.seq)
+	}
+	return v, nil
+}
@@ -0,0 +1,215 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeEntries appends n entries to a new log, returning it
+func writeEntries(t *testing.T, n int, withKey bool) *Log {
+	t.Helper()
+
+	l := New(t.TempDir())
+	if withKey {
+		if err := l.CreateKey(); err != nil {
+			t.Fatalf("Failed to create key: %v", err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		e := Entry{Time: time.Now().UTC(), Token: "vpn", Counter: 1, Session: uint8(i), Consumer: Consumer{Name: ConsumerCLI}}
+		if err := l.Append(e); err != nil {
+			t.Fatalf("Failed to append entry: %v", err)
+		}
+	}
+	return l
+}
+
+func readLines(t *testing.T, l *Log) [][]byte {
+	t.Helper()
+	data, err := os.ReadFile(l.Path())
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	return bytes.SplitAfter(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+}
+
+func writeLines(t *testing.T, l *Log, lines [][]byte) {
+	t.Helper()
+	data := bytes.Join(lines, nil)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	if err := os.WriteFile(l.Path(), data, 0600); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+}
+
+// expectBroken checks Verify reports a broken link on the given line
+func expectBroken(t *testing.T, l *Log, line string) {
+	t.Helper()
+	_, err := l.Verify()
+	if !errors.Is(err, ErrBrokenChain) {
+		t.Fatalf("Verify returned %v, expected %v", err, ErrBrokenChain)
+	}
+	if !strings.Contains(err.Error(), line) {
+		t.Errorf("Verify returned %q, expected it on %s", err, line)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	l := writeEntries(t, 5, false)
+	v, err := l.Verify()
+	if err != nil {
+		t.Fatalf("Failed to verify log: %v", err)
+	}
+	if v.Entries != 5 || v.MACs != 0 {
+		t.Errorf("Verified %+v, expected 5 entries without MACs", v)
+	}
+
+	entries, err := l.Entries(Filter{})
+	if err != nil {
+		t.Fatalf("Failed to read entries: %v", err)
+	}
+	for i, e := range entries {
+		if e.Seq != uint64(i+1) {
+			t.Errorf("Entry %d has sequence number %d", i+1, e.Seq)
+		}
+	}
+
+	empty := New(t.TempDir())
+	if v, err := empty.Verify(); err != nil || v.Entries != 0 {
+		t.Errorf("Verifying an empty log gave %+v, %v", v, err)
+	}
+}
+
+func TestVerifyBroken(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(lines [][]byte) [][]byte
+		line   string
+	}{
+		{"modified", func(lines [][]byte) [][]byte {
+			lines[2] = bytes.Replace(lines[2], []byte(`"vpn"`), []byte(`"web"`), 1)
+			return lines
+		}, "line 4"},
+		{"invalid", func(lines [][]byte) [][]byte {
+			lines[1] = []byte("garbage\n")
+			return lines
+		}, "line 2"},
+		{"removed", func(lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		}, "line 2"},
+		{"reordered", func(lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, "line 2"},
+		{"start truncated", func(lines [][]byte) [][]byte {
+			return lines[2:]
+		}, "line 1"},
+		{"end truncated", func(lines [][]byte) [][]byte {
+			return lines[:3]
+		}, "line 4"},
+		{"last modified", func(lines [][]byte) [][]byte {
+			lines[4] = bytes.Replace(lines[4], []byte(`"vpn"`), []byte(`"web"`), 1)
+			return lines
+		}, "line 5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := writeEntries(t, 5, false)
+			writeLines(t, l, tt.change(readLines(t, l)))
+			expectBroken(t, l, tt.line)
+		})
+	}
+}
+
+func TestVerifyMAC(t *testing.T) {
+	l := writeEntries(t, 3, true)
+	v, err := l.Verify()
+	if err != nil {
+		t.Fatalf("Failed to verify log: %v", err)
+	}
+	if v.MACs != 3 {
+		t.Errorf("Verified %d MACs, expected 3", v.MACs)
+	}
+
+	// Rewriting an entry and recomputing the chain without the key is
+	// detected
+	lines := readLines(t, l)
+	oldHash := hashLine(bytes.TrimSuffix(lines[1], []byte("\n")))
+	lines[1] = bytes.Replace(lines[1], []byte(`"vpn"`), []byte(`"web"`), 1)
+	newHash := hashLine(bytes.TrimSuffix(lines[1], []byte("\n")))
+	lines[2] = bytes.Replace(lines[2], []byte(oldHash), []byte(newHash), 1)
+	writeLines(t, l, lines)
+	expectBroken(t, l, "line 2")
+}
+
+func TestVerifyKeyDeleted(t *testing.T) {
+	l := writeEntries(t, 3, true)
+	if err := os.Remove(filepath.Join(filepath.Dir(l.Path()), keyFile)); err != nil {
+		t.Fatalf("Failed to delete key: %v", err)
+	}
+	if _, err := l.Verify(); !errors.Is(err, ErrBrokenChain) {
+		t.Errorf("Verifying with the key deleted gave %v, expected %v", err, ErrBrokenChain)
+	}
+	if err := l.Append(Entry{Token: "vpn"}); !errors.Is(err, ErrBrokenChain) {
+		t.Errorf("Appending with the key deleted gave %v, expected %v", err, ErrBrokenChain)
+	}
+
+	// Nor does rewriting the head without its MAC hide it
+	if err := l.writeHead(head{seq: 3, hash: hashLine(bytes.TrimSuffix(readLines(t, l)[2], []byte("\n")))}, nil); err != nil {
+		t.Fatalf("Failed to write head: %v", err)
+	}
+	expectBroken(t, l, "line 1")
+}
+
+func TestCreateKeyExisting(t *testing.T) {
+	l := writeEntries(t, 2, false)
+	if err := l.CreateKey(); err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	if err := l.CreateKey(); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Creating a second key returned %v, expected %v", err, ErrKeyExists)
+	}
+
+	// Entries from before the key are covered by the chain, and the head
+	// is MACed straight away
+	if _, err := l.Verify(); err != nil {
+		t.Fatalf("Failed to verify log: %v", err)
+	}
+	if err := l.Append(Entry{Token: "vpn"}); err != nil {
+		t.Fatalf("Failed to append entry: %v", err)
+	}
+	v, err := l.Verify()
+	if err != nil {
+		t.Fatalf("Failed to verify log: %v", err)
+	}
+	if v.Entries != 3 || v.MACs != 1 {
+		t.Errorf("Verified %+v, expected 3 entries with 1 MAC", v)
+	}
+}
+
+func TestVerifyLegacy(t *testing.T) {
+	l := New(t.TempDir())
+	legacy := `{"time":"2024-01-01T00:00:00Z","token":"vpn","counter":1,"session":0,"fingerprint":"00000000","consumer":"cli"}` + "\n"
+	if err := os.WriteFile(l.Path(), []byte(legacy), 0600); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+	if err := l.Append(Entry{Token: "vpn"}); err != nil {
+		t.Fatalf("Failed to append entry: %v", err)
+	}
+
+	v, err := l.Verify()
+	if err != nil {
+		t.Fatalf("Failed to verify log: %v", err)
+	}
+	if v.Legacy != 1 || v.Entries != 1 {
+		t.Errorf("Verified %+v, expected 1 legacy and 1 chained entry", v)
+	}
+}
@@ -0,0 +1,38 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// CurrentConsumer returns a Consumer describing this process, and the
+// process that started it
+func CurrentConsumer(name string) Consumer {
+	c := Consumer{
+		Name:      name,
+		PID:       os.Getpid(),
+		ParentPID: os.Getppid(),
+		Parent:    processName(os.Getppid()),
+	}
+
+	if exe, err := os.Executable(); err == nil {
+		c.Process = filepath.Base(exe)
+	}
+	if u, err := user.Current(); err == nil {
+		c.User = u.Username
+	}
+	return c
+}
+
+// processName returns the name of a process, or "" where the platform
+// doesn't provide it through /proc
+func processName(pid int) string {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
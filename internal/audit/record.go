@@ -0,0 +1,37 @@
+package audit
+
+import (
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// Record appends an entry to l for every OTP generated through m, as c.
+// OTPs generated in bulk are recorded as one entry for each reservation,
+// with its count and no fingerprint, as they're generated later without
+// the manager.  Errors appending are passed to onError, if it's non-nil.
+// The returned function stops recording.
+func Record(m *token.Manager, l *Log, c Consumer, onError func(error)) func() {
+	return m.Subscribe(func(ev token.Event) {
+		e := Entry{
+			Time:     time.Now().UTC(),
+			Token:    ev.Name,
+			Counter:  ev.Counter,
+			Session:  ev.Session,
+			Consumer: c,
+		}
+		switch ev.Type {
+		case token.EventGenerated:
+			e.Fingerprint = Fingerprint(ev.OTP)
+		case token.EventReserved:
+			e.Count = ev.Count
+		default:
+			return
+		}
+
+		err := l.Append(e)
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+// Package backup writes every token in a token directory, with their
+// metadata, the directory's policy and its audit log, to a single archive
+// encrypted and authenticated with a passphrase.  Restoring a backup never
+// rolls anything back: what's further on locally is kept, and reported as
+// a conflict.
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/audit"
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// kind identifies a backup in its sealed header
+const kind = "yksoft-backup"
+
+// version is the version of the archive's contents
+const version = 1
+
+// iterations is the PBKDF2 iteration count for new backups
+var iterations = 600000
+
+// ErrVersion indicates a backup was written by a newer version
+var ErrVersion = errors.New("unsupported backup version")
+
+// archive is a backup's contents, before they're compressed and sealed
+type archive struct {
+	Version int               `json:"version"`
+	Created time.Time         `json:"created"`
+	Tokens  map[string][]byte `json:"tokens"`           // Unencrypted token files, by record name
+	Policy  *token.Policy     `json:"policy,omitempty"` // Nil if the directory has none
+	Audit   audit.State       `json:"audit"`
+}
+
+// Write writes a backup of the tokens m manages, and the policy and audit
+// log of its token directory, encrypted with passphrase.  m must be
+// unlocked.
+func Write(w io.Writer, m *token.Manager, passphrase string) error {
+	a := archive{Version: version, Created: time.Now().UTC()}
+
+	var err error
+	if a.Tokens, err = m.Export(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(m.Dir(), token.PolicyFile)); err == nil {
+		p, err := token.LoadPolicy(m.Dir())
+		if err != nil {
+			return err
+		}
+		a.Policy = &p
+	}
+	if a.Audit, err = audit.New(m.Dir()).Export(); err != nil {
+		return fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(a); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	sealed, err := token.SealWithPassphrase(kind, passphrase, iterations, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// Restore restores a backup, decrypted with passphrase, to the tokens m
+// manages and its token directory.  Every token is restored unless that
+// would roll back its counters, as are the policy and audit log unless
+// they've diverged from the backup's.  What was done with each is
+// returned, with conflicts wrapping token.ErrRestoreConflict.
+func Restore(r io.Reader, m *token.Manager, passphrase string) ([]token.RestoreResult, error) {
+	a, err := read(r, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := m.Restore(a.Tokens)
+	if err != nil {
+		return results, err
+	}
+
+	result := token.RestoreResult{Name: token.PolicyFile}
+	result.Action, result.Err = restorePolicy(m.Dir(), a.Policy)
+	if result.Err != nil && !errors.Is(result.Err, token.ErrRestoreConflict) {
+		return results, fmt.Errorf("failed to restore policy: %w", result.Err)
+	}
+	results = append(results, result)
+
+	l := audit.New(m.Dir())
+	result = token.RestoreResult{Name: filepath.Base(l.Path())}
+	result.Action, result.Err = l.Restore(a.Audit)
+	if result.Err != nil && !errors.Is(result.Err, token.ErrRestoreConflict) {
+		return results, fmt.Errorf("failed to restore audit log: %w", result.Err)
+	}
+	return append(results, result), nil
+}
+
+// read decrypts and decodes a backup
+func read(r io.Reader, passphrase string) (*archive, error) {
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := token.OpenWithPassphrase(kind, passphrase, sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var a archive
+	if err := json.NewDecoder(zr).Decode(&a); err != nil {
+		return nil, fmt.Errorf("invalid backup: %w", err)
+	}
+	if a.Version > version {
+		return nil, fmt.Errorf("%w %d", ErrVersion, a.Version)
+	}
+	return &a, nil
+}
+
+// restorePolicy saves p as the token directory's policy, unless it already
+// has a different one
+func restorePolicy(tokenDir string, p *token.Policy) (token.RestoreAction, error) {
+	if p == nil {
+		return token.RestoreUnchanged, nil
+	}
+
+	_, err := os.Stat(filepath.Join(tokenDir, token.PolicyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		if err := token.SavePolicy(tokenDir, *p); err != nil {
+			return token.RestoreConflict, err
+		}
+		return token.RestoreAdded, nil
+	}
+	if err != nil {
+		return token.RestoreConflict, err
+	}
+
+	local, err := token.LoadPolicy(tokenDir)
+	if err != nil {
+		return token.RestoreConflict, err
+	}
+	// An empty prefix may have been decoded as an empty slice or nil
+	if len(local.PublicIDPrefix) == 0 && len(p.PublicIDPrefix) == 0 {
+		local.PublicIDPrefix = p.PublicIDPrefix
+	}
+	if !reflect.DeepEqual(local, *p) {
+		return token.RestoreConflict, fmt.Errorf("%w: the policy differs from the backup's", token.ErrRestoreConflict)
+	}
+	return token.RestoreUnchanged, nil
+}
@@ -0,0 +1,165 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/audit"
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+func init() {
+	// Keep tests fast; the iteration count is stored in each backup
+	iterations = 1000
+}
+
+// newTestManager returns a manager for a new token directory holding the
+// named tokens
+func newTestManager(t *testing.T, names ...string) *token.Manager {
+	t.Helper()
+
+	m := token.NewManager(t.TempDir())
+	for _, name := range names {
+		tok, err := token.New()
+		if err != nil {
+			t.Fatalf("Failed to create new token: %v", err)
+		}
+		if err := m.Create(name, tok); err != nil {
+			t.Fatalf("Create(%s) failed: %v", name, err)
+		}
+	}
+	return m
+}
+
+// generate generates an OTP from the named token, and logs it
+func generate(t *testing.T, m *token.Manager, name string) {
+	t.Helper()
+
+	otp, err := m.Generate(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	e := audit.Entry{Time: time.Now().UTC(), Token: name, Fingerprint: audit.Fingerprint(otp)}
+	if err := audit.New(m.Dir()).Append(e); err != nil {
+		t.Fatalf("Failed to append entry: %v", err)
+	}
+}
+
+// actions returns what restoring each part of a backup did
+func actions(results []token.RestoreResult) map[string]token.RestoreAction {
+	actions := make(map[string]token.RestoreAction)
+	for _, r := range results {
+		actions[r.Name] = r.Action
+	}
+	return actions
+}
+
+func TestBackupRestore(t *testing.T) {
+	m := newTestManager(t, "a", "b")
+	p := token.DefaultPolicy
+	p.PublicIDPrefix = []byte{0x33}
+	if err := token.SavePolicy(m.Dir(), p); err != nil {
+		t.Fatalf("Failed to save policy: %v", err)
+	}
+	generate(t, m, "a")
+
+	var buf bytes.Buffer
+	if err := Write(&buf, m, "secret"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	want, err := m.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	if strings.Contains(buf.String(), "public_id") {
+		t.Error("Backup isn't encrypted")
+	}
+
+	if _, err := Restore(bytes.NewReader(buf.Bytes()), newTestManager(t), "wrong"); !errors.Is(err, token.ErrWrongPassphrase) {
+		t.Errorf("Restoring with the wrong passphrase gave %v, expected ErrWrongPassphrase", err)
+	}
+
+	restored := newTestManager(t)
+	results, err := Restore(bytes.NewReader(buf.Bytes()), restored, "secret")
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	for _, r := range results {
+		if r.Action != token.RestoreAdded || r.Err != nil {
+			t.Errorf("Restoring '%s' into an empty directory was %v, %v", r.Name, r.Action, r.Err)
+		}
+	}
+	if len(results) != 4 {
+		t.Errorf("Restored %d parts, expected 2 tokens, the policy and the audit log", len(results))
+	}
+
+	if got, err := restored.Get("a"); err != nil || got.AESKey != want.AESKey || got.Session != want.Session {
+		t.Errorf("Restored token differs: %v", err)
+	}
+	if got, err := token.LoadPolicy(restored.Dir()); err != nil || !bytes.Equal(got.PublicIDPrefix, p.PublicIDPrefix) {
+		t.Errorf("Restored policy %+v, %v, expected %+v", got, err, p)
+	}
+	if v, err := audit.New(restored.Dir()).Verify(); err != nil || v.Entries != 1 {
+		t.Errorf("Restored audit log verified %+v, %v", v, err)
+	}
+}
+
+func TestRestoreConflicts(t *testing.T) {
+	m := newTestManager(t, "a", "b")
+	p := token.DefaultPolicy
+	p.PublicIDPrefix = []byte{0x33}
+	if err := token.SavePolicy(m.Dir(), p); err != nil {
+		t.Fatalf("Failed to save policy: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, m, "secret"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// Restored, then used and changed locally
+	restored := newTestManager(t)
+	if _, err := Restore(bytes.NewReader(buf.Bytes()), restored, "secret"); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	generate(t, restored, "a")
+	if err := token.SavePolicy(restored.Dir(), token.DefaultPolicy); err != nil {
+		t.Fatalf("Failed to save policy: %v", err)
+	}
+	before, err := restored.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+
+	results, err := Restore(bytes.NewReader(buf.Bytes()), restored, "secret")
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	got := actions(results)
+	want := map[string]token.RestoreAction{
+		"a":          token.RestoreConflict,
+		"b":          token.RestoreUnchanged,
+		".policy":    token.RestoreConflict,
+		".audit.log": token.RestoreUnchanged, // The backup's is empty
+	}
+	for name, action := range want {
+		if got[name] != action {
+			t.Errorf("Restoring '%s' was %v, expected %v", name, got[name], action)
+		}
+	}
+	for _, r := range results {
+		if r.Action == token.RestoreConflict && !errors.Is(r.Err, token.ErrRestoreConflict) {
+			t.Errorf("Conflict for '%s' is %v, expected ErrRestoreConflict", r.Name, r.Err)
+		}
+	}
+
+	if after, err := restored.Get("a"); err != nil || after.Session != before.Session {
+		t.Errorf("Token rolled back by restoring: %v", err)
+	}
+	if local, err := token.LoadPolicy(restored.Dir()); err != nil || !bytes.Equal(local.PublicIDPrefix, token.DefaultPolicy.PublicIDPrefix) {
+		t.Errorf("Local policy replaced by restoring: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+// Package clipboard copies secrets to the system clipboard, clearing them
+// again after a timeout unless something else has been copied since
+package clipboard
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrUnsupported indicates the platform can't mark clipboard content as
+// sensitive
+var ErrUnsupported = errors.New("sensitive clipboard content not supported")
+
+// Clipboard is the system clipboard, e.g. a fyne.Clipboard
+type Clipboard interface {
+	Content() string
+	SetContent(content string)
+}
+
+// Guard copies secrets to a clipboard, and clears them after a timeout
+type Guard struct {
+	clipboard Clipboard
+
+	// setSensitive copies content marked as sensitive, so clipboard
+	// managers and history skip it.  It's SetSensitive, other than in tests.
+	setSensitive func(content string) error
+
+	mu      sync.Mutex
+	content string      // What we last copied, or "" if it's been cleared
+	timer   *time.Timer // Clears content, nil if there's no timeout
+}
+
+// NewGuard returns a Guard which copies to cb
+func NewGuard(cb Clipboard) *Guard {
+	return &Guard{clipboard: cb, setSensitive: SetSensitive}
+}
+
+// Copy copies content to the clipboard.  If sensitive is true the content
+// is marked as sensitive, where the platform supports it.  If timeout is
+// positive the clipboard is cleared once it has passed, as long as it
+// still holds content.
+func (g *Guard) Copy(content string, sensitive bool, timeout time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+
+	if !sensitive || g.setSensitive(content) != nil {
+		g.clipboard.SetContent(content)
+	}
+	g.content = content
+
+	if timeout > 0 {
+		g.timer = time.AfterFunc(timeout, g.Clear)
+	}
+}
+
+// Clear clears the clipboard now, if it still holds what was last copied
+func (g *Guard) Clear() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+	if g.content == "" {
+		return
+	}
+
+	if g.clipboard.Content() == g.content {
+		g.clipboard.SetContent("")
+	}
+	g.content = ""
+}
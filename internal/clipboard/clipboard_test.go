@@ -0,0 +1,122 @@
+package clipboard
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClipboard is an in-memory Clipboard
+type fakeClipboard struct {
+	mu        sync.Mutex
+	content   string
+	sensitive bool
+}
+
+func (c *fakeClipboard) Content() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.content
+}
+
+func (c *fakeClipboard) SetContent(content string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.content, c.sensitive = content, false
+}
+
+func (c *fakeClipboard) setSensitive(content string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.content, c.sensitive = content, true
+	return nil
+}
+
+func newTestGuard(cb *fakeClipboard, sensitive bool) *Guard {
+	g := NewGuard(cb)
+	if sensitive {
+		g.setSensitive = cb.setSensitive
+	} else {
+		g.setSensitive = func(string) error { return ErrUnsupported }
+	}
+	return g
+}
+
+func waitFor(t *testing.T, cb *fakeClipboard, want string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for cb.Content() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Clipboard holds %q, expected %q", cb.Content(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGuardClearsAfterTimeout(t *testing.T) {
+	cb := &fakeClipboard{}
+	g := newTestGuard(cb, false)
+
+	g.Copy("secret", true, 20*time.Millisecond)
+	if cb.Content() != "secret" {
+		t.Fatalf("Clipboard holds %q, expected 'secret'", cb.Content())
+	}
+	waitFor(t, cb, "")
+}
+
+func TestGuardLeavesOtherContent(t *testing.T) {
+	cb := &fakeClipboard{}
+	g := newTestGuard(cb, false)
+
+	g.Copy("secret", true, 20*time.Millisecond)
+	cb.SetContent("copied by the user")
+
+	time.Sleep(60 * time.Millisecond)
+	if cb.Content() != "copied by the user" {
+		t.Errorf("Clipboard holds %q, expected the user's content to be left alone", cb.Content())
+	}
+}
+
+func TestGuardRecopyRestartsTimeout(t *testing.T) {
+	cb := &fakeClipboard{}
+	g := newTestGuard(cb, false)
+
+	g.Copy("first", false, 20*time.Millisecond)
+	g.Copy("second", false, time.Hour)
+
+	time.Sleep(60 * time.Millisecond)
+	if cb.Content() != "second" {
+		t.Errorf("Clipboard holds %q, expected 'second'", cb.Content())
+	}
+
+	g.Clear()
+	if cb.Content() != "" {
+		t.Errorf("Clipboard holds %q after Clear, expected it empty", cb.Content())
+	}
+}
+
+func TestGuardNoTimeout(t *testing.T) {
+	cb := &fakeClipboard{}
+	g := newTestGuard(cb, false)
+
+	g.Copy("secret", true, 0)
+	time.Sleep(20 * time.Millisecond)
+	if cb.Content() != "secret" {
+		t.Errorf("Clipboard holds %q, expected 'secret' to be kept", cb.Content())
+	}
+}
+
+func TestGuardSensitive(t *testing.T) {
+	cb := &fakeClipboard{}
+	g := newTestGuard(cb, true)
+
+	g.Copy("secret", true, 0)
+	if !cb.sensitive {
+		t.Error("Secret wasn't marked sensitive")
+	}
+
+	g.Copy("public", false, 0)
+	if cb.sensitive || cb.Content() != "public" {
+		t.Errorf("Non-sensitive copy gave %q, sensitive %v", cb.Content(), cb.sensitive)
+	}
+}
@@ -0,0 +1,44 @@
+//go:build darwin && cgo
+
+package clipboard
+
+/*
+#cgo CFLAGS: -x objective-c
+#cgo LDFLAGS: -framework AppKit
+
+#import <AppKit/AppKit.h>
+
+// setConcealed copies s to the general pasteboard, declaring the
+// org.nspasteboard.ConcealedType marker type clipboard managers look for
+static int setConcealed(const char *s) {
+	@autoreleasepool {
+		NSString *concealed = @"org.nspasteboard.ConcealedType";
+		NSPasteboard *pb = [NSPasteboard generalPasteboard];
+
+		[pb clearContents];
+		[pb declareTypes:@[NSPasteboardTypeString, concealed] owner:nil];
+		if (![pb setString:[NSString stringWithUTF8String:s] forType:NSPasteboardTypeString]) {
+			return 0;
+		}
+		return [pb setString:@"" forType:concealed] ? 1 : 0;
+	}
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// SetSensitive copies content to the clipboard, marked with
+// org.nspasteboard.ConcealedType so clipboard managers skip it
+func SetSensitive(content string) error {
+	cs := C.CString(content)
+	defer C.free(unsafe.Pointer(cs))
+
+	if C.setConcealed(cs) == 0 {
+		return errors.New("failed to write to pasteboard")
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !windows && !(darwin && cgo)
+
+package clipboard
+
+// SetSensitive copies content to the clipboard, marked as sensitive.  This
+// platform has no way to do that, so it returns ErrUnsupported.
+func SetSensitive(content string) error {
+	return ErrUnsupported
+}
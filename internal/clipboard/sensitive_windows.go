@@ -0,0 +1,106 @@
+//go:build windows
+
+package clipboard
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	cfUnicodeText = 13
+	gmemMoveable  = 0x0002
+)
+
+var (
+	user32   = syscall.NewLazyDLL("user32.dll")
+	kernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procOpenClipboard           = user32.NewProc("OpenClipboard")
+	procCloseClipboard          = user32.NewProc("CloseClipboard")
+	procEmptyClipboard          = user32.NewProc("EmptyClipboard")
+	procSetClipboardData        = user32.NewProc("SetClipboardData")
+	procRegisterClipboardFormat = user32.NewProc("RegisterClipboardFormatW")
+	procGlobalAlloc             = kernel32.NewProc("GlobalAlloc")
+	procGlobalFree              = kernel32.NewProc("GlobalFree")
+	procGlobalLock              = kernel32.NewProc("GlobalLock")
+	procGlobalUnlock            = kernel32.NewProc("GlobalUnlock")
+	procRtlMoveMemory           = kernel32.NewProc("RtlMoveMemory")
+)
+
+// hintFormats are the clipboard formats which keep content out of
+// clipboard monitors, clipboard history and the cloud clipboard, and the
+// DWORD value each is set to
+var hintFormats = []struct {
+	name  string
+	value uint32
+}{
+	{"ExcludeClipboardContentFromMonitorProcessing", 0},
+	{"CanIncludeInClipboardHistory", 0},
+	{"CanUploadToCloudClipboard", 0},
+}
+
+// SetSensitive copies content to the clipboard, along with the formats
+// telling clipboard monitors and history to skip it
+func SetSensitive(content string) error {
+	text, err := syscall.UTF16FromString(content)
+	if err != nil {
+		return err
+	}
+
+	if r, _, err := procOpenClipboard.Call(0); r == 0 {
+		return fmt.Errorf("failed to open clipboard: %w", err)
+	}
+	defer procCloseClipboard.Call()
+
+	if r, _, err := procEmptyClipboard.Call(); r == 0 {
+		return fmt.Errorf("failed to empty clipboard: %w", err)
+	}
+
+	if err := setData(cfUnicodeText, unsafe.Pointer(&text[0]), uintptr(len(text)*2)); err != nil {
+		return err
+	}
+
+	for _, hint := range hintFormats {
+		name, err := syscall.UTF16PtrFromString(hint.name)
+		if err != nil {
+			return err
+		}
+		format, _, err := procRegisterClipboardFormat.Call(uintptr(unsafe.Pointer(name)))
+		if format == 0 {
+			return fmt.Errorf("failed to register clipboard format %s: %w", hint.name, err)
+		}
+		value := hint.value
+		if err := setData(format, unsafe.Pointer(&value), unsafe.Sizeof(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setData copies size bytes at data to global memory, and hands it to the
+// open clipboard as format
+func setData(format uintptr, data unsafe.Pointer, size uintptr) error {
+	h, _, err := procGlobalAlloc.Call(gmemMoveable, size)
+	if h == 0 {
+		return fmt.Errorf("failed to allocate clipboard memory: %w", err)
+	}
+
+	p, _, err := procGlobalLock.Call(h)
+	if p == 0 {
+		procGlobalFree.Call(h)
+		return fmt.Errorf("failed to lock clipboard memory: %w", err)
+	}
+	// p stays an address, copied to by the OS, so no Go pointer is made
+	// from it
+	procRtlMoveMemory.Call(p, uintptr(data), size)
+	procGlobalUnlock.Call(h)
+
+	// The clipboard owns the memory once it's set
+	if r, _, err := procSetClipboardData.Call(format, h); r == 0 {
+		procGlobalFree.Call(h)
+		return fmt.Errorf("failed to set clipboard data: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+// Package counters keeps the counters of tokens used without a token
+// directory, such as by CI jobs passed a token in an environment variable.
+// Each implements token.CounterStore.
+package counters
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/arr2036/yksofttoken/internal/fsutil"
+)
+
+// File keeps a token's state in a file, replaced atomically on each save
+type File struct {
+	path string
+}
+
+// NewFile returns a counter store keeping state in the file at path
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+// Load returns the state in the file, or nil if it doesn't exist yet
+func (f *File) Load(publicID string) ([]byte, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Save replaces the file with state
+func (f *File) Save(publicID string, state []byte) error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return fsutil.WriteFileAtomic(f.path, state)
+}
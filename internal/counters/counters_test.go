@@ -0,0 +1,146 @@
+package counters
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// generate loads a token into an ephemeral store with counters, generates
+// an OTP from it, and returns the token's new state
+func generate(t *testing.T, tok *token.SoftToken, counters token.CounterStore) *token.SoftToken {
+	t.Helper()
+
+	m := token.NewManagerWithStore("", token.NewEphemeralStore("ci", tok, counters))
+	if _, err := m.Generate(context.Background(), "ci"); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	after, err := m.Get("ci")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	return after
+}
+
+func TestFile(t *testing.T) {
+	tok, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	f := NewFile(filepath.Join(t.TempDir(), "state", "ci"))
+
+	// Every job starts from the same token, and continues from the file
+	first := generate(t, tok, f)
+	second := generate(t, tok, f)
+	if second.Counter != first.Counter || second.Session != first.Session+1 {
+		t.Errorf("Second job at counter %d session %d, expected %d and %d",
+			second.Counter, second.Session, first.Counter, first.Session+1)
+	}
+
+	state, err := f.Load("")
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if strings.Contains(string(state), token.AESKeyField) || strings.Contains(string(state), token.PrivateIDField) {
+		t.Errorf("State holds the token's secrets:\n%s", state)
+	}
+}
+
+func TestFileOtherToken(t *testing.T) {
+	a, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	b, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	f := NewFile(filepath.Join(t.TempDir(), "ci"))
+	generate(t, a, f)
+
+	m := token.NewManagerWithStore("", token.NewEphemeralStore("ci", b, f))
+	if _, err := m.Generate(context.Background(), "ci"); err == nil {
+		t.Error("Generated an OTP from counters saved for another token")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	tok, err := token.ParseToken([]byte("public_id: vvccccdddddd\n" +
+		"private_id: 0102030405ff\n" +
+		"aes_key: 000102030405060708090a0b0c0d0e0f\n" +
+		"counter: 7\n" +
+		"session: 3\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	after := generate(t, tok, w)
+	if buf.Len() != 0 {
+		t.Error("State written before Flush")
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// What's written continues from the token given
+	written, err := token.ParseToken(append(buf.Bytes(), "aes_key: 000102030405060708090a0b0c0d0e0f\n"...))
+	if err != nil {
+		t.Fatalf("Failed to parse state written:\n%s\n%v", buf.Bytes(), err)
+	}
+	if written.Counter != 7 || written.Session != 4 || written.Counter != after.Counter {
+		t.Errorf("State written at counter %d session %d, expected 7 and 4", written.Counter, written.Session)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	var mu sync.Mutex
+	states := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		id := r.URL.Query().Get("public_id")
+		switch r.Method {
+		case http.MethodGet:
+			state, ok := states[id]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(state)
+		case http.MethodPut:
+			states[id], _ = io.ReadAll(r.Body)
+		}
+	}))
+	defer srv.Close()
+
+	tok, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+
+	c := &HTTP{URL: srv.URL + "/counters", Auth: "Bearer secret"}
+	first := generate(t, tok, c)
+	second := generate(t, tok, c)
+	if second.Session != first.Session+1 {
+		t.Errorf("Second job at session %d, expected %d", second.Session, first.Session+1)
+	}
+
+	if _, err := (&HTTP{URL: srv.URL}).Load("x"); err == nil {
+		t.Error("Unauthorized load succeeded")
+	}
+}
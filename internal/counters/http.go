@@ -0,0 +1,79 @@
+package counters
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// maxState is the largest state accepted from a counter service
+const maxState = 64 << 10
+
+// HTTP keeps tokens' state with an HTTP service.  A GET of the URL with a
+// public_id query parameter returns the token's state, or 404 Not Found if
+// there's none, and a PUT to the same URL saves it.
+type HTTP struct {
+	URL  string
+	Auth string // Sent as the Authorization header, if set
+	HTTP *http.Client
+}
+
+// Load fetches a token's state from the service
+func (c *HTTP) Load(publicID string) ([]byte, error) {
+	resp, err := c.do(http.MethodGet, publicID, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(io.LimitReader(resp.Body, maxState))
+	case http.StatusNotFound:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("counter service returned HTTP %s", resp.Status)
+}
+
+// Save sends a token's state to the service
+func (c *HTTP) Save(publicID string, state []byte) error {
+	resp, err := c.do(http.MethodPut, publicID, state)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("counter service returned HTTP %s", resp.Status)
+	}
+	return nil
+}
+
+// do sends a request for the token with the given public ID
+func (c *HTTP) do(method, publicID string, body []byte) (*http.Response, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("public_id", publicID)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(context.Background(), method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if c.Auth != "" {
+		req.Header.Set("Authorization", c.Auth)
+	}
+
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
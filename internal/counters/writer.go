@@ -0,0 +1,46 @@
+package counters
+
+import (
+	"io"
+	"sync"
+)
+
+// Writer writes a token's state for the caller to keep, such as to stdout.
+// Nothing is loaded, so the token must be given with its current state.
+// Only the last state saved is written, by Flush, as a token may be saved
+// more than once while generating an OTP.
+type Writer struct {
+	w    io.Writer
+	mu   sync.Mutex
+	last []byte
+}
+
+// NewWriter returns a counter store writing state to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Load returns nil, as state written is never read back
+func (w *Writer) Load(publicID string) ([]byte, error) {
+	return nil, nil
+}
+
+// Save keeps state until Flush is called
+func (w *Writer) Save(publicID string, state []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last = append([]byte{}, state...)
+	return nil
+}
+
+// Flush writes the last state saved, if any
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.last == nil {
+		return nil
+	}
+	_, err := w.w.Write(w.last)
+	w.last = nil
+	return err
+}
@@ -0,0 +1,129 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// LockStale is how old a lock file must be before it's assumed its holder
+// died, and it's broken
+const LockStale = 30 * time.Second
+
+// ErrLockLost indicates a lock was broken by another process, which took it
+// to be stale, while it was held
+var ErrLockLost = errors.New("lock was broken while held")
+
+// LockFile is a held lock file
+type LockFile struct {
+	path  string
+	owner []byte // Written to the lock file, unique to this holder
+}
+
+// Lock creates the lock file at path exclusively, holding a unique owner
+// token, and retries every retry until ctx is done.  Exclusive creation
+// works on network filesystems without byte range locks.  A lock older than
+// LockStale is broken.
+func Lock(ctx context.Context, path string, retry time.Duration) (*LockFile, error) {
+	id, err := randomHex()
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	owner := []byte(fmt.Sprintf("%s %d %s\n", host, os.Getpid(), id))
+
+	for {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = file.Write(owner)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return &LockFile{path: path, owner: owner}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		if breakStale(path) {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+}
+
+// breakStale removes the lock file at path if it's stale, returning true
+// if it did.  Another process may break the same lock and take a new one
+// between the check and the removal, so the lock is first renamed to a name
+// no one else uses, and only removed if it's still the stale one.
+func breakStale(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) <= LockStale {
+		return false
+	}
+	stale, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	id, err := randomHex()
+	if err != nil {
+		return false
+	}
+	aside := path + ".stale." + id
+	if err := os.Rename(path, aside); err != nil {
+		// Already broken by someone else
+		return false
+	}
+	moved, err := os.ReadFile(aside)
+	if err == nil && bytes.Equal(moved, stale) {
+		os.Remove(aside)
+		return true
+	}
+
+	// It's a new lock, so put it back, unless it's been taken again.  Its
+	// holder then finds it's lost the lock.
+	os.Link(aside, path)
+	os.Remove(aside)
+	return false
+}
+
+// Held returns ErrLockLost if the lock file no longer holds l's owner token
+func (l *LockFile) Held() error {
+	data, err := os.ReadFile(l.path)
+	if err != nil || !bytes.Equal(data, l.owner) {
+		return fmt.Errorf("%w: '%s'", ErrLockLost, l.path)
+	}
+	return nil
+}
+
+// Unlock removes the lock file, if it's still l's
+func (l *LockFile) Unlock() {
+	if l.Held() == nil {
+		os.Remove(l.path)
+	}
+}
+
+// randomHex returns a random hex string, unique enough to name lock owners
+// and files
+func randomHex() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,63 @@
+package fsutil
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.lock")
+	lock, err := Lock(context.Background(), path, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to lock: %v", err)
+	}
+	defer lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := Lock(ctx, path, time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Locking while locked gave %v, expected a timeout", err)
+	}
+}
+
+func TestLockBreakStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.lock")
+	stale, err := Lock(context.Background(), path, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to lock: %v", err)
+	}
+	old := time.Now().Add(-2 * LockStale)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("Failed to age lock: %v", err)
+	}
+
+	lock, err := Lock(context.Background(), path, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to break stale lock: %v", err)
+	}
+	defer lock.Unlock()
+	if err := lock.Held(); err != nil {
+		t.Errorf("New lock isn't held: %v", err)
+	}
+	if err := stale.Held(); !errors.Is(err, ErrLockLost) {
+		t.Errorf("Broken lock gave %v, expected ErrLockLost", err)
+	}
+
+	// The broken lock's holder mustn't remove the new lock
+	stale.Unlock()
+	if err := lock.Held(); err != nil {
+		t.Errorf("Unlocking the broken lock removed the new one: %v", err)
+	}
+
+	// A lock that isn't stale is left alone
+	if breakStale(path) {
+		t.Error("Broke a lock that isn't stale")
+	}
+	if err := lock.Held(); err != nil {
+		t.Errorf("Lock lost checking it: %v", err)
+	}
+}
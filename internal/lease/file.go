@@ -0,0 +1,167 @@
+package lease
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/fsutil"
+)
+
+// lockRetry is how often a held lock is retried
+const lockRetry = 20 * time.Millisecond
+
+// File is a coordinator keeping leases in a file, such as on storage shared
+// by the hosts.  The file is locked with a lock file created exclusively
+// beside it, which works on network filesystems without byte range locks.
+type File struct {
+	path string
+}
+
+// NewFile returns a coordinator keeping leases in the file at path
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+// state is the file's contents: each token's next unleased counter value,
+// and its last lease
+type state map[string]Lease
+
+// Acquire grants the next lease of the requested token, waiting for the
+// file's lock until ctx is done
+func (f *File) Acquire(ctx context.Context, req Request) (Lease, error) {
+	if err := req.validate(); err != nil {
+		return Lease{}, err
+	}
+
+	lock, err := f.lock(ctx)
+	if err != nil {
+		return Lease{}, err
+	}
+	defer lock.Unlock()
+
+	s, err := f.read()
+	if err != nil {
+		return Lease{}, err
+	}
+	l, _, err := grant(req, s[req.Token].End, time.Now())
+	if err != nil {
+		return Lease{}, err
+	}
+	s[req.Token] = l
+
+	// Granting from a broken lock could overlap another host's lease
+	if err := lock.Held(); err != nil {
+		return Lease{}, err
+	}
+	if err := f.write(s); err != nil {
+		return Lease{}, err
+	}
+	return l, nil
+}
+
+// Last returns the last lease granted of a token.  The file is replaced
+// atomically, so it's read without locking it.
+func (f *File) Last(ctx context.Context, token string) (Lease, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return Lease{}, false, err
+	}
+	s, err := f.read()
+	if err != nil {
+		return Lease{}, false, err
+	}
+	l, ok := s[token]
+	return l, ok, nil
+}
+
+// Leases returns the last lease granted of each token
+func (f *File) Leases() ([]Lease, error) {
+	s, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+
+	leases := make([]Lease, 0, len(s))
+	for _, l := range s {
+		leases = append(leases, l)
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Token < leases[j].Token })
+	return leases, nil
+}
+
+// lock takes the file's lock, waiting until ctx is done
+func (f *File) lock(ctx context.Context) (*fsutil.LockFile, error) {
+	lock, err := fsutil.Lock(ctx, f.path+".lock", lockRetry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock '%s': %w", f.path, err)
+	}
+	return lock, nil
+}
+
+// read reads the file.  Each line is
+//
+//	<token>: <start> <end> <holder> <granted>
+func (f *File) read() (state, error) {
+	s := make(state)
+
+	file, err := os.Open(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		token, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid lease on line %d of '%s'", n, f.path)
+		}
+
+		start, err1 := strconv.ParseUint(fields[0], 10, 16)
+		end, err2 := strconv.ParseUint(fields[1], 10, 16)
+		granted, err3 := strconv.ParseInt(fields[3], 10, 64)
+		if err := errors.Join(err1, err2, err3); err != nil {
+			return nil, fmt.Errorf("invalid lease on line %d of '%s': %w", n, f.path, err)
+		}
+
+		token = strings.TrimSpace(token)
+		s[token] = Lease{
+			Token:   token,
+			Holder:  fields[2],
+			Start:   uint16(start),
+			End:     uint16(end),
+			Granted: time.Unix(granted, 0),
+		}
+	}
+	return s, scanner.Err()
+}
+
+// write replaces the file with s
+func (f *File) write(s state) error {
+	tokens := make([]string, 0, len(s))
+	for token := range s {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+
+	var b strings.Builder
+	for _, token := range tokens {
+		l := s[token]
+		fmt.Fprintf(&b, "%s: %d %d %s %d\n", token, l.Start, l.End, l.Holder, l.Granted.Unix())
+	}
+
+	return fsutil.WriteFileAtomic(f.path, []byte(b.String()))
+}
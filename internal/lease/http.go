@@ -0,0 +1,274 @@
+package lease
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/validator"
+)
+
+// Path is where the lease service serves requests
+const Path = "/lease"
+
+// Lease service statuses
+const (
+	StatusOK           = "OK"
+	StatusNoLease      = "NO_LEASE"
+	StatusExhausted    = "EXHAUSTED"
+	StatusBadRequest   = "BAD_REQUEST"
+	StatusBadSignature = "BAD_SIGNATURE"
+	StatusBackendError = "BACKEND_ERROR"
+)
+
+// ErrBadSignature indicates a lease request or response wasn't signed with
+// the service's key
+var ErrBadSignature = errors.New("bad lease signature")
+
+// Handler serves leases from c over HTTP.  Requests are POSTed forms with
+// token, holder, from, size and nonce fields, and responses are key=value
+// lines, like YK-VAL.  A request with op=last, token and nonce fields
+// instead returns the token's last lease.  If key is non-nil requests must
+// be signed with it, and responses are signed, as YK-VAL does with a
+// client's API key.
+func Handler(c Coordinator, key []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := r.PostForm
+
+		resp := url.Values{}
+		resp.Set("nonce", q.Get("nonce"))
+
+		from, fromErr := strconv.ParseUint(q.Get("from"), 10, 16)
+		size, sizeErr := strconv.Atoi(q.Get("size"))
+		switch {
+		case key != nil && q.Get("h") != validator.Sign(q, key):
+			resp.Set("status", StatusBadSignature)
+
+		case q.Get("nonce") == "":
+			resp.Set("status", StatusBadRequest)
+
+		case q.Get("op") == "last":
+			l, ok, err := c.Last(r.Context(), q.Get("token"))
+			switch {
+			case err != nil:
+				resp.Set("status", StatusBackendError)
+			case !ok:
+				resp.Set("status", StatusNoLease)
+			default:
+				setLease(resp, l)
+			}
+
+		case fromErr != nil || sizeErr != nil:
+			resp.Set("status", StatusBadRequest)
+
+		default:
+			l, err := c.Acquire(r.Context(), Request{
+				Token:  q.Get("token"),
+				Holder: q.Get("holder"),
+				From:   uint16(from),
+				Size:   size,
+			})
+			switch {
+			case errors.Is(err, ErrExhausted):
+				resp.Set("status", StatusExhausted)
+			case errors.Is(err, ErrInvalidRequest):
+				resp.Set("status", StatusBadRequest)
+			case err != nil:
+				resp.Set("status", StatusBackendError)
+			default:
+				setLease(resp, l)
+			}
+		}
+
+		if key != nil {
+			resp.Set("h", validator.Sign(resp, key))
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		for _, k := range []string{"h", "nonce", "status", "token", "holder", "start", "end", "granted"} {
+			if resp.Has(k) {
+				fmt.Fprintf(w, "%s=%s\r\n", k, resp.Get(k))
+			}
+		}
+	})
+}
+
+// setLease sets a successful response's lease fields
+func setLease(resp url.Values, l Lease) {
+	resp.Set("status", StatusOK)
+	resp.Set("token", l.Token)
+	resp.Set("holder", l.Holder)
+	resp.Set("start", strconv.Itoa(int(l.Start)))
+	resp.Set("end", strconv.Itoa(int(l.End)))
+	resp.Set("granted", strconv.FormatInt(l.Granted.Unix(), 10))
+}
+
+// HTTPClient is a coordinator leasing from a lease service
+type HTTPClient struct {
+	URL  string       // Lease endpoint, e.g. https://host/lease
+	Key  []byte       // Key to sign requests with, or nil to not sign
+	HTTP *http.Client // Client to use, or nil for http.DefaultClient
+}
+
+// Acquire requests a lease from the service
+func (c *HTTPClient) Acquire(ctx context.Context, req Request) (Lease, error) {
+	if err := req.validate(); err != nil {
+		return Lease{}, err
+	}
+
+	params := url.Values{}
+	params.Set("token", req.Token)
+	params.Set("holder", req.Holder)
+	params.Set("from", strconv.Itoa(int(req.From)))
+	params.Set("size", strconv.Itoa(req.Size))
+	resp, err := c.call(ctx, params)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	switch status := resp.Get("status"); status {
+	case StatusOK:
+	case StatusExhausted:
+		return Lease{}, fmt.Errorf("%w: '%s'", ErrExhausted, req.Token)
+	case StatusBadRequest:
+		return Lease{}, ErrInvalidRequest
+	case StatusBadSignature:
+		return Lease{}, fmt.Errorf("%w: request", ErrBadSignature)
+	default:
+		return Lease{}, fmt.Errorf("lease service returned %s", status)
+	}
+
+	l, err := parseLease(resp)
+	if err != nil {
+		return Lease{}, err
+	}
+	if l.Token != req.Token || l.Start < req.From {
+		return Lease{}, fmt.Errorf("lease service returned a lease for another request")
+	}
+	return l, nil
+}
+
+// Last asks the service for the last lease granted of a token
+func (c *HTTPClient) Last(ctx context.Context, token string) (Lease, bool, error) {
+	params := url.Values{}
+	params.Set("op", "last")
+	params.Set("token", token)
+	resp, err := c.call(ctx, params)
+	if err != nil {
+		return Lease{}, false, err
+	}
+
+	switch status := resp.Get("status"); status {
+	case StatusOK:
+	case StatusNoLease:
+		return Lease{}, false, nil
+	case StatusBadSignature:
+		return Lease{}, false, fmt.Errorf("%w: request", ErrBadSignature)
+	default:
+		return Lease{}, false, fmt.Errorf("lease service returned %s", status)
+	}
+
+	l, err := parseLease(resp)
+	if err != nil {
+		return Lease{}, false, err
+	}
+	if l.Token != token {
+		return Lease{}, false, fmt.Errorf("lease service returned a lease for another request")
+	}
+	return l, true, nil
+}
+
+// call adds a nonce to params, signs them and sends them, returning the
+// response fields once its nonce and signature are checked
+func (c *HTTPClient) call(ctx context.Context, params url.Values) (url.Values, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	params.Set("nonce", hex.EncodeToString(nonce[:]))
+	if c.Key != nil {
+		params.Set("h", validator.Sign(params, c.Key))
+	}
+
+	resp, err := c.post(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// A response for another request, or an unsigned one, could hand out
+	// counters someone else has
+	if resp.Get("nonce") != params.Get("nonce") {
+		return nil, fmt.Errorf("%w: response nonce doesn't match", ErrBadSignature)
+	}
+	if c.Key != nil && resp.Get("h") != validator.Sign(resp, c.Key) {
+		return nil, fmt.Errorf("%w: response", ErrBadSignature)
+	}
+	return resp, nil
+}
+
+// parseLease parses a successful response's lease fields
+func parseLease(resp url.Values) (Lease, error) {
+	start, err1 := strconv.ParseUint(resp.Get("start"), 10, 16)
+	end, err2 := strconv.ParseUint(resp.Get("end"), 10, 16)
+	granted, err3 := strconv.ParseInt(resp.Get("granted"), 10, 64)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return Lease{}, fmt.Errorf("invalid lease in response: %w", err)
+	}
+	if end <= start {
+		return Lease{}, fmt.Errorf("invalid lease in response: %d-%d", start, end)
+	}
+	return Lease{
+		Token:   resp.Get("token"),
+		Holder:  resp.Get("holder"),
+		Start:   uint16(start),
+		End:     uint16(end),
+		Granted: time.Unix(granted, 0),
+	}, nil
+}
+
+// post sends a request, returning the response fields
+func (c *HTTPClient) post(ctx context.Context, params url.Values) (url.Values, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lease service returned HTTP %s", resp.Status)
+	}
+
+	fields := url.Values{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(strings.TrimRight(scanner.Text(), "\r"), "="); ok {
+			fields.Set(k, v)
+		}
+	}
+	return fields, scanner.Err()
+}
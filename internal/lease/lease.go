@@ -0,0 +1,135 @@
+// Package lease coordinates tokens shared by several hosts.  Each host
+// leases a range of a token's use counter values from a coordinator, and
+// only generates OTPs within its lease, so no two hosts ever generate the
+// same OTP.
+package lease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/fsutil"
+)
+
+// maxCounter is the highest use counter a token can reach
+const maxCounter = 0x7fff
+
+var (
+	// ErrExhausted indicates a token has no counter values left to lease
+	ErrExhausted = errors.New("no counter values left to lease")
+	// ErrInvalidRequest indicates a lease request is malformed
+	ErrInvalidRequest = errors.New("invalid lease request")
+	// ErrLockLost indicates a lock was broken by another process, which
+	// took it to be stale, while it was held
+	ErrLockLost = fsutil.ErrLockLost
+)
+
+// Request asks for a lease
+type Request struct {
+	Token  string // Identifies the token, normally its public ID
+	Holder string // Identifies the host asking, normally its hostname
+	From   uint16 // The lease must start at or after this counter value
+	Size   int    // Number of counter values wanted
+}
+
+// Lease is a range of a token's use counter values, reserved for a holder
+type Lease struct {
+	Token   string
+	Holder  string
+	Start   uint16    // First counter value leased
+	End     uint16    // Counter value after the last leased
+	Granted time.Time // When the lease was granted
+}
+
+// Contains returns true if counter is within the lease
+func (l Lease) Contains(counter uint16) bool {
+	return counter >= l.Start && counter < l.End
+}
+
+func (l Lease) String() string {
+	return fmt.Sprintf("%s counters %d-%d for %s", l.Token, l.Start, l.End-1, l.Holder)
+}
+
+// Coordinator grants leases.  Leases of the same token never overlap, and
+// each starts after every lease granted before it.
+type Coordinator interface {
+	Acquire(ctx context.Context, req Request) (Lease, error)
+	// Last returns the last lease granted of a token, or false if none
+	// has been
+	Last(ctx context.Context, token string) (Lease, bool, error)
+}
+
+// validate checks a request is well formed
+func (req Request) validate() error {
+	switch {
+	case req.Token == "" || strings.ContainsAny(req.Token, ": \t\r\n"):
+		return fmt.Errorf("%w: token '%s'", ErrInvalidRequest, req.Token)
+	case req.Holder == "" || strings.ContainsAny(req.Holder, " \t\r\n"):
+		return fmt.Errorf("%w: holder '%s'", ErrInvalidRequest, req.Holder)
+	case req.Size <= 0 || req.Size > maxCounter:
+		return fmt.Errorf("%w: size %d", ErrInvalidRequest, req.Size)
+	}
+	return nil
+}
+
+// grant returns the lease for req, given the token's next unleased counter
+// value, and the token's next unleased counter value after it
+func grant(req Request, next uint16, now time.Time) (Lease, uint16, error) {
+	if err := req.validate(); err != nil {
+		return Lease{}, next, err
+	}
+
+	start := max(next, req.From, 1)
+	if start > maxCounter {
+		return Lease{}, next, fmt.Errorf("%w: '%s'", ErrExhausted, req.Token)
+	}
+	end := min(int(start)+req.Size, maxCounter+1)
+
+	l := Lease{Token: req.Token, Holder: req.Holder, Start: start, End: uint16(end), Granted: now}
+	return l, l.End, nil
+}
+
+// Memory is a coordinator keeping leases in memory, standing in for a
+// shared coordinator in tests and for hosts in a single process
+type Memory struct {
+	mu     sync.Mutex
+	leases map[string]Lease // Last lease of each token
+}
+
+// NewMemory returns an in-memory coordinator
+func NewMemory() *Memory {
+	return &Memory{leases: make(map[string]Lease)}
+}
+
+// Acquire grants the next lease of the requested token
+func (m *Memory) Acquire(ctx context.Context, req Request) (Lease, error) {
+	if err := ctx.Err(); err != nil {
+		return Lease{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, _, err := grant(req, m.leases[req.Token].End, time.Now())
+	if err != nil {
+		return Lease{}, err
+	}
+	m.leases[req.Token] = l
+	return l, nil
+}
+
+// Last returns the last lease granted of a token
+func (m *Memory) Last(ctx context.Context, token string) (Lease, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return Lease{}, false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.leases[token]
+	return l, ok, nil
+}
@@ -0,0 +1,174 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGrant(t *testing.T) {
+	req := Request{Token: "ddddcccc", Holder: "a", Size: 10}
+
+	l, next, err := grant(req, 0, time.Now())
+	if err != nil || l.Start != 1 || l.End != 11 || next != 11 {
+		t.Errorf("First lease %v, next %d, %v, expected 1-10", l, next, err)
+	}
+
+	// Leases start after the holder's own counters
+	req.From = 100
+	if l, _, _ := grant(req, 11, time.Now()); l.Start != 100 {
+		t.Errorf("Lease from 100 started at %d", l.Start)
+	}
+
+	// The last lease is cut short
+	req.From = maxCounter - 4
+	if l, next, _ := grant(req, 0, time.Now()); l.End != maxCounter+1 || next != maxCounter+1 {
+		t.Errorf("Last lease %v, next %d, expected to end at %d", l, next, maxCounter)
+	}
+	if _, _, err := grant(req, maxCounter+1, time.Now()); !errors.Is(err, ErrExhausted) {
+		t.Errorf("Leasing past the last counter gave %v, expected ErrExhausted", err)
+	}
+
+	for _, bad := range []Request{
+		{Holder: "a", Size: 1},
+		{Token: "x", Size: 1},
+		{Token: "x", Holder: "a b", Size: 1},
+		{Token: "x", Holder: "a", Size: 0},
+	} {
+		if _, _, err := grant(bad, 0, time.Now()); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("Request %+v gave %v, expected ErrInvalidRequest", bad, err)
+		}
+	}
+}
+
+// testCoordinators returns each kind of coordinator, with two instances of
+// those that can be shared by hosts
+func testCoordinators(t *testing.T) map[string][]Coordinator {
+	path := filepath.Join(t.TempDir(), "leases")
+	key := []byte("0123456789abcdef")
+
+	srv := httptest.NewServer(Handler(NewFile(filepath.Join(t.TempDir(), "leases")), key))
+	t.Cleanup(srv.Close)
+
+	mem := NewMemory()
+	return map[string][]Coordinator{
+		"memory": {mem, mem},
+		"file":   {NewFile(path), NewFile(path)},
+		"http":   {&HTTPClient{URL: srv.URL + Path, Key: key}, &HTTPClient{URL: srv.URL + Path, Key: key}},
+	}
+}
+
+func TestCoordinatorsDisjoint(t *testing.T) {
+	for name, coordinators := range testCoordinators(t) {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			var leases []Lease
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					c := coordinators[i%2]
+					l, err := c.Acquire(context.Background(), Request{
+						Token: "ddddcccc", Holder: fmt.Sprintf("host%d", i%2), From: uint16(i), Size: 5,
+					})
+					if err != nil {
+						t.Errorf("Failed to acquire lease: %v", err)
+						return
+					}
+					mu.Lock()
+					leases = append(leases, l)
+					mu.Unlock()
+				}(i)
+			}
+			wg.Wait()
+
+			sort.Slice(leases, func(i, j int) bool { return leases[i].Start < leases[j].Start })
+			for i := 1; i < len(leases); i++ {
+				if leases[i].Start < leases[i-1].End {
+					t.Errorf("Lease %v overlaps %v", leases[i], leases[i-1])
+				}
+			}
+
+			// Other tokens are leased independently
+			l, err := coordinators[0].Acquire(context.Background(), Request{Token: "ddddbbbb", Holder: "a", Size: 5})
+			if err != nil || l.Start != 1 {
+				t.Errorf("First lease of another token %v, %v, expected to start at 1", l, err)
+			}
+		})
+	}
+}
+
+func TestCoordinatorsLast(t *testing.T) {
+	for name, coordinators := range testCoordinators(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, ok, err := coordinators[0].Last(context.Background(), "ddddcccc"); err != nil || ok {
+				t.Errorf("Last lease before any were granted gave %v, %v", ok, err)
+			}
+
+			for _, holder := range []string{"a", "b"} {
+				if _, err := coordinators[0].Acquire(context.Background(), Request{Token: "ddddcccc", Holder: holder, Size: 5}); err != nil {
+					t.Fatalf("Failed to acquire lease: %v", err)
+				}
+			}
+			l, ok, err := coordinators[1].Last(context.Background(), "ddddcccc")
+			if err != nil || !ok || l.Holder != "b" || l.Start != 6 || l.End != 11 {
+				t.Errorf("Last lease is %v, %v, %v, expected b's 6-10", l, ok, err)
+			}
+		})
+	}
+}
+
+func TestFileLeases(t *testing.T) {
+	f := NewFile(filepath.Join(t.TempDir(), "leases"))
+	if _, err := f.Acquire(context.Background(), Request{Token: "ddddcccc", Holder: "a", Size: 5}); err != nil {
+		t.Fatalf("Failed to acquire lease: %v", err)
+	}
+	if _, err := f.Acquire(context.Background(), Request{Token: "ddddcccc", Holder: "b", Size: 5}); err != nil {
+		t.Fatalf("Failed to acquire lease: %v", err)
+	}
+
+	leases, err := f.Leases()
+	if err != nil {
+		t.Fatalf("Failed to read leases: %v", err)
+	}
+	if len(leases) != 1 || leases[0].Holder != "b" || leases[0].Start != 6 || leases[0].End != 11 {
+		t.Errorf("Leases are %v, expected b's 6-10", leases)
+	}
+}
+
+func TestFileLockTimeout(t *testing.T) {
+	f := NewFile(filepath.Join(t.TempDir(), "leases"))
+	lock, err := f.lock(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to lock: %v", err)
+	}
+	defer lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := f.Acquire(ctx, Request{Token: "ddddcccc", Holder: "a", Size: 5}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Acquiring while locked gave %v, expected a timeout", err)
+	}
+}
+
+func TestHTTPBadKey(t *testing.T) {
+	srv := httptest.NewServer(Handler(NewMemory(), []byte("0123456789abcdef")))
+	defer srv.Close()
+
+	c := &HTTPClient{URL: srv.URL + Path, Key: []byte("wrong")}
+	if _, err := c.Acquire(context.Background(), Request{Token: "ddddcccc", Holder: "a", Size: 5}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Acquiring with the wrong key gave %v, expected ErrBadSignature", err)
+	}
+
+	c = &HTTPClient{URL: srv.URL + Path}
+	if _, err := c.Acquire(context.Background(), Request{Token: "ddddcccc", Holder: "a", Size: 5}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Acquiring without a key gave %v, expected ErrBadSignature", err)
+	}
+}
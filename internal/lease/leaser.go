@@ -0,0 +1,234 @@
+package lease
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/arr2036/yksofttoken/internal/fsutil"
+	"github.com/arr2036/yksofttoken/internal/token"
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// DefaultSize is how many counter values a Leaser leases at a time.  Each
+// counter value is good for up to 255 OTPs, or one power cycle.
+const DefaultSize = 16
+
+// Leaser generates OTPs from a manager's tokens within leases from a
+// coordinator.  The next lease is acquired as the current one runs low,
+// so generating carries on if the coordinator is briefly unreachable.
+// Leases are dropped once another holder is granted a later one.
+// Leases are kept in the token directory, so they outlive the process,
+// e.g. across CLI invocations.
+type Leaser struct {
+	Size int // Counter values to lease at a time
+	Low  int // Counter values left in a lease when the next is acquired
+
+	m      *token.Manager
+	c      Coordinator
+	holder string
+	mu     sync.Mutex // Serializes generation, so leases aren't acquired twice
+}
+
+// NewLeaser returns a leaser for m's tokens, leasing from c as holder
+func NewLeaser(m *token.Manager, c Coordinator, holder string) *Leaser {
+	return &Leaser{
+		Size:   DefaultSize,
+		Low:    DefaultSize / 4,
+		m:      m,
+		c:      c,
+		holder: holder,
+	}
+}
+
+// held is the leases held for a token
+type held struct {
+	current *Lease
+	next    *Lease // Acquired ahead of time, as current ran low
+}
+
+// Generate generates an OTP from the named token within its lease,
+// acquiring a lease if it doesn't have one, and moving to the next when
+// the current lease is used up
+func (l *Leaser) Generate(ctx context.Context, name string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t, err := l.m.Get(name)
+	if err != nil {
+		return "", err
+	}
+	id := yubikey.ModHexEncode(t.PublicID)
+
+	h, err := l.load(name, id)
+	if err != nil {
+		return "", err
+	}
+	if err := l.dropSuperseded(ctx, name, id, &h); err != nil {
+		return "", err
+	}
+
+	// A new lease is only needed once, unless a power cycle jumps past
+	// the one just acquired
+	for i := 0; i < 3; i++ {
+		if h.current == nil {
+			if t, err = l.m.Get(name); err != nil {
+				return "", err
+			}
+			lease, err := l.c.Acquire(ctx, Request{Token: id, Holder: l.holder, From: t.Counter + 1, Size: l.Size})
+			if err != nil {
+				return "", fmt.Errorf("failed to lease counters: %w", err)
+			}
+			h.current = &lease
+			if err := l.save(name, h); err != nil {
+				return "", err
+			}
+		}
+
+		otp, err := l.m.GenerateInRange(ctx, name, h.current.Start, h.current.End)
+		if errors.Is(err, token.ErrOutsideRange) {
+			h.current, h.next = h.next, nil
+			if err := l.save(name, h); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		l.renew(ctx, name, id, &h)
+		return otp, nil
+	}
+	return "", fmt.Errorf("%w: '%s' keeps moving past its leases", token.ErrOutsideRange, name)
+}
+
+// dropSuperseded drops the leases held for the named token if another
+// holder has been granted a later one since.  Validation servers reject
+// counters behind the last they accepted, so only the holder of the newest
+// lease can authenticate.  If the coordinator can't be reached the leases
+// held are kept.
+func (l *Leaser) dropSuperseded(ctx context.Context, name, id string, h *held) error {
+	newest := h.next
+	if newest == nil {
+		newest = h.current
+	}
+	if newest == nil {
+		return nil
+	}
+
+	last, ok, err := l.c.Last(ctx, id)
+	if err != nil || !ok || last.Start <= newest.Start {
+		return nil
+	}
+	*h = held{}
+	return l.save(name, *h)
+}
+
+// renew acquires the next lease if the current one is running low.  It's
+// retried with the next OTP if it fails.
+func (l *Leaser) renew(ctx context.Context, name, id string, h *held) {
+	if h.next != nil {
+		return
+	}
+	t, err := l.m.Get(name)
+	if err != nil || int(h.current.End)-int(t.Counter) > l.Low {
+		return
+	}
+
+	lease, err := l.c.Acquire(ctx, Request{Token: id, Holder: l.holder, From: h.current.End, Size: l.Size})
+	if err != nil {
+		return
+	}
+	h.next = &lease
+	l.save(name, *h)
+}
+
+// Leases returns the current and next lease held for the named token,
+// either of which may be nil
+func (l *Leaser) Leases(name string) (*Lease, *Lease, error) {
+	t, err := l.m.Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := l.load(name, yubikey.ModHexEncode(t.PublicID))
+	return h.current, h.next, err
+}
+
+// path returns where the leases for the named token are kept.  It's
+// hidden so it isn't listed as a token.
+func (l *Leaser) path(name string) string {
+	return filepath.Join(l.m.Dir(), "."+name+".lease")
+}
+
+// load loads the leases held for the named token.  Leases held for a token
+// with a different public ID, such as one the token has since been
+// replaced by, are dropped.
+func (l *Leaser) load(name, id string) (held, error) {
+	file, err := os.Open(l.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return held{}, nil
+	}
+	if err != nil {
+		return held{}, err
+	}
+	defer file.Close()
+
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(scanner.Text(), ":"); ok {
+			fields[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return held{}, err
+	}
+	if fields["token"] != id || fields["holder"] != l.holder {
+		return held{}, nil
+	}
+
+	var h held
+	if h.current, err = parseRange(id, l.holder, fields["start"], fields["end"]); err != nil {
+		return held{}, fmt.Errorf("invalid lease '%s': %w", l.path(name), err)
+	}
+	if h.next, err = parseRange(id, l.holder, fields["next_start"], fields["next_end"]); err != nil {
+		return held{}, fmt.Errorf("invalid lease '%s': %w", l.path(name), err)
+	}
+	if h.current == nil {
+		h.current, h.next = h.next, nil
+	}
+	return h, nil
+}
+
+// parseRange parses a lease's range, returning nil if it's missing
+func parseRange(id, holder, start, end string) (*Lease, error) {
+	if start == "" && end == "" {
+		return nil, nil
+	}
+	s, err1 := strconv.ParseUint(start, 10, 16)
+	e, err2 := strconv.ParseUint(end, 10, 16)
+	if err := errors.Join(err1, err2); err != nil {
+		return nil, err
+	}
+	return &Lease{Token: id, Holder: holder, Start: uint16(s), End: uint16(e)}, nil
+}
+
+// save saves the leases held for the named token
+func (l *Leaser) save(name string, h held) error {
+	var b strings.Builder
+	if h.current != nil {
+		fmt.Fprintf(&b, "token: %s\nholder: %s\n", h.current.Token, h.current.Holder)
+		fmt.Fprintf(&b, "start: %d\nend: %d\n", h.current.Start, h.current.End)
+	}
+	if h.next != nil {
+		fmt.Fprintf(&b, "next_start: %d\nnext_end: %d\n", h.next.Start, h.next.End)
+	}
+	return fsutil.WriteFileAtomic(l.path(name), []byte(b.String()))
+}
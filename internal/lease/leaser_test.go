@@ -0,0 +1,167 @@
+package lease
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// countingCoordinator counts the leases acquired through it
+type countingCoordinator struct {
+	Coordinator
+	n atomic.Int32
+}
+
+func (c *countingCoordinator) Acquire(ctx context.Context, req Request) (Lease, error) {
+	c.n.Add(1)
+	return c.Coordinator.Acquire(ctx, req)
+}
+
+// newHosts returns managers for n hosts, each with a copy of the same token
+func newHosts(t *testing.T, n int) ([]*token.Manager, *token.SoftToken) {
+	t.Helper()
+	tok, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+
+	var managers []*token.Manager
+	for i := 0; i < n; i++ {
+		m := token.NewManager(t.TempDir())
+		if err := m.Create("vpn", tok); err != nil {
+			t.Fatalf("Failed to create token: %v", err)
+		}
+		managers = append(managers, m)
+	}
+	return managers, tok
+}
+
+func TestLeaserHosts(t *testing.T) {
+	managers, tok := newHosts(t, 2)
+	c := NewMemory()
+
+	var leasers []*Leaser
+	for i, m := range managers {
+		l := NewLeaser(m, c, []string{"a", "b"}[i])
+		l.Size, l.Low = 2, 1
+		leasers = append(leasers, l)
+	}
+
+	// Each host power cycles often, so moves through its leases quickly
+	seen := make(map[[2]int]int)
+	for i := 0; i < 40; i++ {
+		host := i % 2
+		if i%3 == 0 {
+			if err := managers[host].PowerCycle("vpn"); err != nil {
+				t.Fatalf("Failed to power cycle: %v", err)
+			}
+		}
+
+		otp, err := leasers[host].Generate(context.Background(), "vpn")
+		if err != nil {
+			t.Fatalf("Failed to generate OTP: %v", err)
+		}
+		_, block, err := yubikey.ParseOTP(otp, tok.AESKey[:])
+		if err != nil {
+			t.Fatalf("Failed to parse OTP: %v", err)
+		}
+
+		counters := [2]int{int(block.Counter), int(block.Session)}
+		if other, ok := seen[counters]; ok {
+			t.Fatalf("Hosts %d and %d both generated counter %d/%d", other, host, block.Counter, block.Session)
+		}
+		seen[counters] = host
+
+		current, _, err := leasers[host].Leases("vpn")
+		if err != nil {
+			t.Fatalf("Failed to load leases: %v", err)
+		}
+		if current == nil || !current.Contains(block.Counter) {
+			t.Errorf("Host %d generated counter %d outside its lease %v", host, block.Counter, current)
+		}
+	}
+}
+
+func TestLeaserRenew(t *testing.T) {
+	managers, _ := newHosts(t, 1)
+	c := &countingCoordinator{Coordinator: NewMemory()}
+	l := NewLeaser(managers[0], c, "a")
+	l.Size, l.Low = 4, 1
+
+	generate := func() {
+		t.Helper()
+		if _, err := l.Generate(context.Background(), "vpn"); err != nil {
+			t.Fatalf("Failed to generate OTP: %v", err)
+		}
+	}
+
+	generate()
+	current, next, err := l.Leases("vpn")
+	if err != nil || current == nil || next != nil {
+		t.Fatalf("After the first OTP leases are %v, %v, %v, expected only a current lease", current, next, err)
+	}
+
+	// Power cycle up to the last counter of the lease, which renews it
+	for i := 0; i < 3; i++ {
+		if err := managers[0].PowerCycle("vpn"); err != nil {
+			t.Fatalf("Failed to power cycle: %v", err)
+		}
+	}
+	generate()
+	if _, next, _ = l.Leases("vpn"); next == nil || next.Start != current.End {
+		t.Fatalf("Running low acquired next lease %v, expected one from %d", next, current.End)
+	}
+
+	// Moving past the lease switches to the next, without a new lease
+	if err := managers[0].PowerCycle("vpn"); err != nil {
+		t.Fatalf("Failed to power cycle: %v", err)
+	}
+	before := c.n.Load()
+	generate()
+	if got, _, _ := l.Leases("vpn"); got == nil || *got != *next {
+		t.Errorf("Current lease is %v after switching, expected %v", got, next)
+	}
+
+	// Leases are kept for the next process
+	again := NewLeaser(managers[0], c, "a")
+	again.Size, again.Low = l.Size, l.Low
+	if _, err := again.Generate(context.Background(), "vpn"); err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	if n := c.n.Load() - before; n != 0 {
+		t.Errorf("Acquired %d leases after switching and restarting, expected none", n)
+	}
+	if _, err := os.Stat(again.path("vpn")); err != nil {
+		t.Errorf("Lease file missing: %v", err)
+	}
+}
+
+func TestLeaserSuperseded(t *testing.T) {
+	managers, _ := newHosts(t, 2)
+	c := NewMemory()
+	a, b := NewLeaser(managers[0], c, "a"), NewLeaser(managers[1], c, "b")
+
+	for _, l := range []*Leaser{a, b, a} {
+		if _, err := l.Generate(context.Background(), "vpn"); err != nil {
+			t.Fatalf("Failed to generate OTP: %v", err)
+		}
+	}
+
+	// b was granted a later lease than a's first, so a must lease again
+	// rather than generate counters behind b's
+	fromA, _, err := a.Leases("vpn")
+	if err != nil || fromA == nil {
+		t.Fatalf("Failed to get a's lease: %v", err)
+	}
+	fromB, _, err := b.Leases("vpn")
+	if err != nil || fromB == nil {
+		t.Fatalf("Failed to get b's lease: %v", err)
+	}
+	if fromA.Start < fromB.End {
+		t.Errorf("a kept generating from %v after b was granted %v", fromA, fromB)
+	}
+}
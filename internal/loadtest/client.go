@@ -0,0 +1,140 @@
+// Package loadtest drives Yubikey validation servers with OTPs from soft
+// tokens, measuring latency and checking replay detection
+package loadtest
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/arr2036/yksofttoken/internal/validator"
+)
+
+// ErrBadSignature indicates a YK-VAL response wasn't signed with the
+// client's API key
+var ErrBadSignature = errors.New("bad signature")
+
+// Verifier submits an OTP to a validation server, returning the status the
+// server reported
+type Verifier interface {
+	Verify(ctx context.Context, otp string) (string, error)
+}
+
+// YKValClient verifies OTPs with a YK-VAL server, using protocol version 2.0
+type YKValClient struct {
+	URL      string       // Verification endpoint, e.g. https://host/wsapi/2.0/verify
+	ClientID string       // Client ID to send
+	APIKey   []byte       // Key to sign requests with, or nil to not sign
+	HTTP     *http.Client // Client to use, or nil for http.DefaultClient
+}
+
+// Verify submits an OTP, returning the status from the response.  With an
+// API key, an OK or REPLAYED_OTP response must be signed with it, and answer
+// this request.  Other statuses, such as BAD_SIGNATURE or NO_SUCH_CLIENT,
+// come from a server that may not have the client's key, so they're
+// returned as they are.
+func (c *YKValClient) Verify(ctx context.Context, otp string) (string, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	params := url.Values{}
+	params.Set("id", c.ClientID)
+	params.Set("otp", otp)
+	params.Set("nonce", hex.EncodeToString(nonce[:]))
+	if c.APIKey != nil {
+		params.Set("h", validator.Sign(params, c.APIKey))
+	}
+
+	lines, err := get(ctx, c.HTTP, c.URL, params)
+	if err != nil {
+		return "", err
+	}
+	resp := url.Values{}
+	for _, line := range lines {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			resp.Set(k, v)
+		}
+	}
+
+	status := resp.Get("status")
+	if status == "" {
+		return "", fmt.Errorf("no status in response")
+	}
+
+	// A forged or replayed response could report a validation the server
+	// never made, hiding a broken server
+	if c.APIKey != nil && (status == validator.StatusOK || status == validator.StatusReplayedOTP) {
+		if resp.Get("h") != validator.Sign(resp, c.APIKey) {
+			return "", fmt.Errorf("%w: %s response", ErrBadSignature, status)
+		}
+		if resp.Get("nonce") != params.Get("nonce") || resp.Get("otp") != otp {
+			return "", fmt.Errorf("%w: %s response is for another request", ErrBadSignature, status)
+		}
+	}
+	return status, nil
+}
+
+// YKKSMClient decrypts OTPs with a YK-KSM server.  A KSM doesn't detect
+// replayed OTPs, so the status is only ever OK or an ERR message.
+type YKKSMClient struct {
+	URL  string       // Decryption endpoint, e.g. https://host/wsapi/decrypt
+	HTTP *http.Client // Client to use, or nil for http.DefaultClient
+}
+
+// Verify submits an OTP, returning "OK" or the server's error message
+func (c *YKKSMClient) Verify(ctx context.Context, otp string) (string, error) {
+	params := url.Values{}
+	params.Set("otp", otp)
+
+	lines, err := get(ctx, c.HTTP, c.URL, params)
+	if err != nil {
+		return "", err
+	}
+	if len(lines) == 0 {
+		return "", fmt.Errorf("empty response")
+	}
+
+	if strings.HasPrefix(lines[0], "OK") {
+		return "OK", nil
+	}
+	return lines[0], nil
+}
+
+// get makes a GET request, returning the non-empty lines of the response
+func get(ctx context.Context, client *http.Client, endpoint string, params url.Values) ([]string, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
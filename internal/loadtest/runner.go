@@ -0,0 +1,197 @@
+package loadtest
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// Config describes a load test
+type Config struct {
+	Streams     []*token.Stream // One stream per soft token
+	Verifier    Verifier
+	Rate        float64       // Requests per second across all tokens, 0 for unlimited
+	Concurrency int           // Maximum concurrent requests, capped at the number of tokens
+	Requests    int           // Stop after this many requests, 0 for no limit
+	Duration    time.Duration // Stop after this long, 0 for no limit
+
+	// ReplayFraction is the fraction of requests that resend an OTP the
+	// server has already seen, to check it's rejected as a replay
+	ReplayFraction float64
+}
+
+// Report summarises a load test
+type Report struct {
+	Requests       int
+	Errors         int            // Requests that failed without a status
+	Statuses       map[string]int // Count of each status the server reported
+	Latencies      []time.Duration
+	Elapsed        time.Duration
+	DoubleAccepted []string // OTPs the server accepted more than once
+}
+
+// Throughput returns the achieved requests per second
+func (r *Report) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+// Percentile returns the latency below which p percent of requests completed
+func (r *Report) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+
+	i := int(float64(len(r.Latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(r.Latencies) {
+		i = len(r.Latencies) - 1
+	}
+	return r.Latencies[i]
+}
+
+// job is a single request for a worker
+type job struct {
+	otp string
+}
+
+// collector accumulates results from the workers
+type collector struct {
+	mu       sync.Mutex
+	report   *Report
+	accepted map[string]bool
+}
+
+func (c *collector) record(otp, status string, latency time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.report.Requests++
+	if err != nil {
+		c.report.Errors++
+		return
+	}
+
+	c.report.Latencies = append(c.report.Latencies, latency)
+	c.report.Statuses[status]++
+
+	if status == "OK" {
+		if c.accepted[otp] {
+			c.report.DoubleAccepted = append(c.report.DoubleAccepted, otp)
+		}
+		c.accepted[otp] = true
+	}
+}
+
+// Run runs a load test until ctx is done, or the request or duration limit
+// is reached.  A token's OTPs are always submitted in order, by the same
+// worker, so a correct server never sees them out of sequence.
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if len(cfg.Streams) == 0 {
+		return nil, errors.New("no tokens to test with")
+	}
+	if cfg.Verifier == nil {
+		return nil, errors.New("no verifier")
+	}
+
+	workers := cfg.Concurrency
+	if workers <= 0 {
+		workers = 1
+	}
+	if workers > len(cfg.Streams) {
+		workers = len(cfg.Streams)
+	}
+
+	// Requests in flight when the duration expires are allowed to finish
+	stop := ctx
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		stop, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	c := &collector{
+		report:   &Report{Statuses: make(map[string]int)},
+		accepted: make(map[string]bool),
+	}
+
+	queues := make([]chan job, workers)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan job, 1)
+		wg.Add(1)
+		go func(queue chan job) {
+			defer wg.Done()
+			for j := range queue {
+				start := time.Now()
+				status, err := cfg.Verifier.Verify(ctx, j.otp)
+				c.record(j.otp, status, time.Since(start), err)
+			}
+		}(queues[i])
+	}
+
+	var tick <-chan time.Time
+	if cfg.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	start := time.Now()
+	last := make([]string, len(cfg.Streams)) // Last OTP sent from each stream
+	var buf []byte
+	var err error
+
+produce:
+	for sent := 0; cfg.Requests == 0 || sent < cfg.Requests; sent++ {
+		if tick != nil {
+			select {
+			case <-stop.Done():
+				break produce
+			case <-tick:
+			}
+		} else if stop.Err() != nil {
+			break
+		}
+
+		i := sent % len(cfg.Streams)
+
+		var otp string
+		if last[i] != "" && rand.Float64() < cfg.ReplayFraction {
+			otp = last[i]
+		} else {
+			buf, err = cfg.Streams[i].Next(buf[:0])
+			if err != nil {
+				break
+			}
+			otp = string(buf)
+			last[i] = otp
+		}
+
+		select {
+		case <-stop.Done():
+			break produce
+		case queues[i%workers] <- job{otp: otp}:
+		}
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+
+	r := c.report
+	r.Elapsed = time.Since(start)
+	sort.Slice(r.Latencies, func(a, b int) bool { return r.Latencies[a] < r.Latencies[b] })
+
+	return r, err
+}
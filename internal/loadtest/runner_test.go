@@ -0,0 +1,146 @@
+package loadtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+	"github.com/arr2036/yksofttoken/internal/validator"
+)
+
+// newTestStreams creates n tokens registered with v, returning a stream for each
+func newTestStreams(t *testing.T, v *validator.Validator, n int) []*token.Stream {
+	t.Helper()
+
+	streams := make([]*token.Stream, n)
+	for i := range streams {
+		tok, err := token.New()
+		if err != nil {
+			t.Fatalf("Failed to create new token: %v", err)
+		}
+		v.RegisterToken(tok)
+
+		if streams[i], err = tok.NewStream(0); err != nil {
+			t.Fatalf("NewStream failed: %v", err)
+		}
+	}
+	return streams
+}
+
+func TestRunYKVal(t *testing.T) {
+	v := validator.New()
+	key := []byte("load test key")
+	srv := httptest.NewServer(validator.YKValHandler(v, map[string][]byte{"1": key}))
+	defer srv.Close()
+
+	r, err := Run(context.Background(), Config{
+		Streams:        newTestStreams(t, v, 8),
+		Verifier:       &YKValClient{URL: srv.URL + validator.YKValPath, ClientID: "1", APIKey: key},
+		Concurrency:    4,
+		Requests:       400,
+		ReplayFraction: 0.2,
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if r.Requests != 400 || r.Errors != 0 {
+		t.Errorf("Requests = %d, errors = %d, expected 400 and 0", r.Requests, r.Errors)
+	}
+	if len(r.DoubleAccepted) != 0 {
+		t.Errorf("%d OTPs accepted twice by a replay-detecting server", len(r.DoubleAccepted))
+	}
+	if r.Statuses[validator.StatusOK]+r.Statuses[validator.StatusReplayedOTP] != 400 {
+		t.Errorf("Statuses = %v, expected only OK and REPLAYED_OTP", r.Statuses)
+	}
+	if r.Statuses[validator.StatusReplayedOTP] == 0 {
+		t.Error("No replays were sent")
+	}
+
+	if r.Percentile(50) > r.Percentile(99) || r.Percentile(99) > r.Percentile(100) {
+		t.Errorf("Percentiles out of order: p50 %v, p99 %v, max %v",
+			r.Percentile(50), r.Percentile(99), r.Percentile(100))
+	}
+}
+
+func TestRunDetectsDoubleAcceptance(t *testing.T) {
+	v := validator.New()
+	srv := httptest.NewServer(validator.YKKSMHandler(v))
+	defer srv.Close()
+
+	// A KSM never detects replays, so every replay is accepted twice
+	r, err := Run(context.Background(), Config{
+		Streams:        newTestStreams(t, v, 2),
+		Verifier:       &YKKSMClient{URL: srv.URL + validator.YKKSMPath},
+		Requests:       100,
+		ReplayFraction: 0.5,
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if r.Statuses["OK"] != 100 {
+		t.Errorf("Statuses = %v, expected 100 OK", r.Statuses)
+	}
+	if len(r.DoubleAccepted) == 0 {
+		t.Error("Replays accepted by the KSM weren't reported")
+	}
+}
+
+func TestRunRateAndDuration(t *testing.T) {
+	v := validator.New()
+	srv := httptest.NewServer(validator.YKValHandler(v, nil))
+	defer srv.Close()
+
+	r, err := Run(context.Background(), Config{
+		Streams:  newTestStreams(t, v, 1),
+		Verifier: &YKValClient{URL: srv.URL + validator.YKValPath, ClientID: "1"},
+		Rate:     50,
+		Duration: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// 10 requests at 50/s, allowing for timer slop
+	if r.Requests < 5 || r.Requests > 11 {
+		t.Errorf("Requests = %d, expected about 10", r.Requests)
+	}
+	if r.Statuses[validator.StatusOK] != r.Requests {
+		t.Errorf("Statuses = %v, expected all OK", r.Statuses)
+	}
+}
+
+func TestYKValBadSignature(t *testing.T) {
+	v := validator.New()
+	srv := httptest.NewServer(validator.YKValHandler(v, map[string][]byte{"1": []byte("server key")}))
+	defer srv.Close()
+
+	streams := newTestStreams(t, v, 1)
+	otp, err := streams[0].Next(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+
+	c := &YKValClient{URL: srv.URL + validator.YKValPath, ClientID: "1", APIKey: []byte("client key")}
+	if status, err := c.Verify(context.Background(), string(otp)); err != nil || status != validator.StatusBadSignature {
+		t.Errorf("Verifying with the wrong key gave %s, %v, expected %s", status, err, validator.StatusBadSignature)
+	}
+}
+
+func TestYKValForgedResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "h=Zm9yZ2Vk\r\notp=%s\r\nnonce=%s\r\nstatus=OK\r\n", r.URL.Query().Get("otp"), r.URL.Query().Get("nonce"))
+	}))
+	defer srv.Close()
+
+	c := &YKValClient{URL: srv.URL, ClientID: "1", APIKey: []byte("client key")}
+	if _, err := c.Verify(context.Background(), "ddddccccccccbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Verifying against a forged OK gave %v, expected ErrBadSignature", err)
+	}
+}
@@ -0,0 +1,190 @@
+// Package profile stores named profiles, each with its own token directory,
+// e.g. one per customer
+package profile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrProfileExists indicates a profile with the same name already exists
+	ErrProfileExists = errors.New("profile already exists")
+	// ErrProfileNotFound indicates no profile with the given name exists
+	ErrProfileNotFound = errors.New("profile not found")
+	// ErrInvalidName indicates a profile name is empty, or contains a '.'
+	ErrInvalidName = errors.New("invalid profile name")
+	// ErrLastProfile indicates the only remaining profile can't be deleted
+	ErrLastProfile = errors.New("can't delete the last profile")
+)
+
+// DefaultName is the name of the profile used when none have been created
+const DefaultName = "Default"
+
+// Preference keys
+const (
+	namesKey   = "profiles"
+	currentKey = "profile"
+)
+
+// Preferences is where profiles are persisted, e.g. fyne.Preferences
+type Preferences interface {
+	String(key string) string
+	SetString(key string, value string)
+	StringList(key string) []string
+	SetStringList(key string, value []string)
+	RemoveValue(key string)
+}
+
+// Profile is a token directory, and the token to select when it's opened
+type Profile struct {
+	Name         string
+	Dir          string
+	DefaultToken string // May be empty, or name a token that no longer exists
+}
+
+// Store reads and writes profiles in a set of preferences
+type Store struct {
+	prefs      Preferences
+	defaultDir string
+}
+
+// NewStore returns a store for the profiles in prefs.  Profiles without a
+// directory use defaultDir.
+func NewStore(prefs Preferences, defaultDir string) *Store {
+	return &Store{prefs: prefs, defaultDir: defaultDir}
+}
+
+func dirKey(name string) string {
+	return "profile." + name + ".dir"
+}
+
+func defaultTokenKey(name string) string {
+	return "profile." + name + ".defaultToken"
+}
+
+// names returns the names of the stored profiles, or just the default
+// profile if none have been stored
+func (s *Store) names() []string {
+	names := s.prefs.StringList(namesKey)
+	if len(names) == 0 {
+		return []string{DefaultName}
+	}
+	return names
+}
+
+// Names returns the names of the profiles, in the order they were created
+func (s *Store) Names() []string {
+	return append([]string(nil), s.names()...)
+}
+
+// Get returns the named profile
+func (s *Store) Get(name string) (Profile, error) {
+	for _, n := range s.names() {
+		if n != name {
+			continue
+		}
+
+		p := Profile{
+			Name:         name,
+			Dir:          s.prefs.String(dirKey(name)),
+			DefaultToken: s.prefs.String(defaultTokenKey(name)),
+		}
+		if p.Dir == "" {
+			p.Dir = s.defaultDir
+		}
+		return p, nil
+	}
+	return Profile{}, fmt.Errorf("%w: '%s'", ErrProfileNotFound, name)
+}
+
+// Create adds a new profile
+func (s *Store) Create(p Profile) error {
+	if err := checkName(p.Name); err != nil {
+		return err
+	}
+
+	names := s.names()
+	for _, n := range names {
+		if n == p.Name {
+			return fmt.Errorf("%w: '%s'", ErrProfileExists, p.Name)
+		}
+	}
+
+	s.set(p)
+	s.prefs.SetStringList(namesKey, append(names, p.Name))
+	return nil
+}
+
+// Update changes an existing profile's directory and default token
+func (s *Store) Update(p Profile) error {
+	if _, err := s.Get(p.Name); err != nil {
+		return err
+	}
+
+	s.set(p)
+	// The default profile may not have been stored yet
+	s.prefs.SetStringList(namesKey, s.names())
+	return nil
+}
+
+func (s *Store) set(p Profile) {
+	s.prefs.SetString(dirKey(p.Name), p.Dir)
+	s.prefs.SetString(defaultTokenKey(p.Name), p.DefaultToken)
+}
+
+// Delete removes a profile.  The last profile can't be deleted.  If the
+// current profile is deleted, the first remaining one becomes current.
+func (s *Store) Delete(name string) error {
+	if _, err := s.Get(name); err != nil {
+		return err
+	}
+
+	names := s.names()
+	if len(names) == 1 {
+		return ErrLastProfile
+	}
+
+	remaining := make([]string, 0, len(names)-1)
+	for _, n := range names {
+		if n != name {
+			remaining = append(remaining, n)
+		}
+	}
+	s.prefs.SetStringList(namesKey, remaining)
+	s.prefs.RemoveValue(dirKey(name))
+	s.prefs.RemoveValue(defaultTokenKey(name))
+
+	if s.prefs.String(currentKey) == name {
+		s.prefs.SetString(currentKey, remaining[0])
+	}
+	return nil
+}
+
+// Current returns the profile last selected with SetCurrent, or the first
+// profile if that no longer exists
+func (s *Store) Current() Profile {
+	if p, err := s.Get(s.prefs.String(currentKey)); err == nil {
+		return p
+	}
+	p, _ := s.Get(s.names()[0])
+	return p
+}
+
+// SetCurrent selects the named profile
+func (s *Store) SetCurrent(name string) error {
+	if _, err := s.Get(name); err != nil {
+		return err
+	}
+	s.prefs.SetString(currentKey, name)
+	return nil
+}
+
+// checkName checks a profile name can be used in preference keys
+func checkName(name string) error {
+	if strings.TrimSpace(name) != name || name == "" || strings.Contains(name, ".") {
+		return fmt.Errorf("%w: '%s'", ErrInvalidName, name)
+	}
+	return nil
+}
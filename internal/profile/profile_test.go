@@ -0,0 +1,125 @@
+package profile
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// memPreferences is an in-memory Preferences
+type memPreferences struct {
+	strings map[string]string
+	lists   map[string][]string
+}
+
+func newMemPreferences() *memPreferences {
+	return &memPreferences{strings: make(map[string]string), lists: make(map[string][]string)}
+}
+
+func (p *memPreferences) String(key string) string           { return p.strings[key] }
+func (p *memPreferences) SetString(key string, value string) { p.strings[key] = value }
+func (p *memPreferences) StringList(key string) []string     { return p.lists[key] }
+func (p *memPreferences) SetStringList(key string, value []string) {
+	p.lists[key] = append([]string(nil), value...)
+}
+func (p *memPreferences) RemoveValue(key string) {
+	delete(p.strings, key)
+	delete(p.lists, key)
+}
+
+func TestStoreDefault(t *testing.T) {
+	s := NewStore(newMemPreferences(), "/home/user/.yksoft")
+
+	if names := s.Names(); !reflect.DeepEqual(names, []string{DefaultName}) {
+		t.Fatalf("Names() = %v, expected only the default profile", names)
+	}
+
+	p := s.Current()
+	if p.Name != DefaultName || p.Dir != "/home/user/.yksoft" {
+		t.Errorf("Current() = %+v, expected the default profile in the default directory", p)
+	}
+}
+
+func TestStoreCreateAndSwitch(t *testing.T) {
+	prefs := newMemPreferences()
+	s := NewStore(prefs, "/default")
+
+	acme := Profile{Name: "acme", Dir: "/srv/acme", DefaultToken: "vpn"}
+	if err := s.Create(acme); err != nil {
+		t.Fatalf("Failed to create profile: %v", err)
+	}
+	if err := s.Create(acme); !errors.Is(err, ErrProfileExists) {
+		t.Errorf("Creating a duplicate profile gave %v, expected ErrProfileExists", err)
+	}
+
+	if names := s.Names(); !reflect.DeepEqual(names, []string{DefaultName, "acme"}) {
+		t.Errorf("Names() = %v", names)
+	}
+
+	if err := s.SetCurrent("acme"); err != nil {
+		t.Fatalf("Failed to select profile: %v", err)
+	}
+
+	// A new store over the same preferences sees the same profiles
+	if p := NewStore(prefs, "/default").Current(); p != acme {
+		t.Errorf("Current() = %+v, expected %+v", p, acme)
+	}
+
+	if err := s.SetCurrent("missing"); !errors.Is(err, ErrProfileNotFound) {
+		t.Errorf("Selecting a missing profile gave %v, expected ErrProfileNotFound", err)
+	}
+}
+
+func TestStoreUpdate(t *testing.T) {
+	s := NewStore(newMemPreferences(), "/default")
+
+	if err := s.Update(Profile{Name: DefaultName, Dir: "/elsewhere", DefaultToken: "main"}); err != nil {
+		t.Fatalf("Failed to update the default profile: %v", err)
+	}
+	p, err := s.Get(DefaultName)
+	if err != nil {
+		t.Fatalf("Failed to get profile: %v", err)
+	}
+	if p.Dir != "/elsewhere" || p.DefaultToken != "main" {
+		t.Errorf("Get() = %+v after update", p)
+	}
+
+	if err := s.Update(Profile{Name: "missing"}); !errors.Is(err, ErrProfileNotFound) {
+		t.Errorf("Updating a missing profile gave %v, expected ErrProfileNotFound", err)
+	}
+}
+
+func TestStoreDelete(t *testing.T) {
+	s := NewStore(newMemPreferences(), "/default")
+
+	if err := s.Delete(DefaultName); !errors.Is(err, ErrLastProfile) {
+		t.Errorf("Deleting the last profile gave %v, expected ErrLastProfile", err)
+	}
+
+	if err := s.Create(Profile{Name: "acme", Dir: "/srv/acme"}); err != nil {
+		t.Fatalf("Failed to create profile: %v", err)
+	}
+	if err := s.SetCurrent("acme"); err != nil {
+		t.Fatalf("Failed to select profile: %v", err)
+	}
+	if err := s.Delete("acme"); err != nil {
+		t.Fatalf("Failed to delete profile: %v", err)
+	}
+
+	if p := s.Current(); p.Name != DefaultName {
+		t.Errorf("Current() = %+v after deleting the current profile, expected the default", p)
+	}
+	if _, err := s.Get("acme"); !errors.Is(err, ErrProfileNotFound) {
+		t.Errorf("Deleted profile still exists: %v", err)
+	}
+}
+
+func TestStoreInvalidName(t *testing.T) {
+	s := NewStore(newMemPreferences(), "/default")
+
+	for _, name := range []string{"", " acme", "acme.corp"} {
+		if err := s.Create(Profile{Name: name}); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Creating profile %q gave %v, expected ErrInvalidName", name, err)
+		}
+	}
+}
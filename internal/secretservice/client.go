@@ -0,0 +1,298 @@
+// Package secretservice stores secrets in a desktop keyring through the
+// freedesktop.org Secret Service API, as provided by GNOME Keyring, KWallet
+// and KeePassXC.
+package secretservice
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Secret Service names, paths and interfaces
+const (
+	ServiceName     = "org.freedesktop.secrets"
+	ServicePath     = dbus.ObjectPath("/org/freedesktop/secrets")
+	serviceIface    = "org.freedesktop.Secret.Service"
+	collectionIface = "org.freedesktop.Secret.Collection"
+	itemIface       = "org.freedesktop.Secret.Item"
+	promptIface     = "org.freedesktop.Secret.Prompt"
+	sessionIface    = "org.freedesktop.Secret.Session"
+
+	labelProperty      = "org.freedesktop.Secret.Item.Label"
+	attributesProperty = "org.freedesktop.Secret.Item.Attributes"
+	collectionLabel    = "org.freedesktop.Secret.Collection.Label"
+
+	// errIsLocked is returned for items in a locked collection
+	errIsLocked = "org.freedesktop.Secret.Error.IsLocked"
+)
+
+// noPrompt is returned in place of a prompt when none is needed
+const noPrompt = dbus.ObjectPath("/")
+
+// defaultAlias is the collection secrets are created in, usually the
+// login keyring
+const defaultAlias = "default"
+
+// promptTimeout is how long to wait for the user to answer a prompt, such
+// as for the keyring's password
+const promptTimeout = 2 * time.Minute
+
+var (
+	// ErrNotFound indicates no secret has the attributes looked up
+	ErrNotFound = errors.New("secret not found")
+	// ErrDismissed indicates the user dismissed a prompt, such as for the
+	// keyring's password
+	ErrDismissed = errors.New("prompt dismissed")
+	// ErrPromptTimeout indicates the user didn't answer a prompt in time
+	ErrPromptTimeout = errors.New("timed out waiting for prompt")
+)
+
+// Secret is a secret as passed over the bus
+type Secret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// Client stores secrets in a Secret Service.  Secrets are passed with the
+// plain algorithm, so are only as private as the bus, which on a desktop is
+// the user's own session bus.  Clients are safe for concurrent use.
+type Client struct {
+	conn    *dbus.Conn
+	session dbus.ObjectPath
+	mu      sync.Mutex // Serializes calls, so prompts' signals aren't mixed up
+}
+
+// Connect returns a client for the Secret Service on the session bus
+func Connect() (*Client, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to session bus: %w", err)
+	}
+	return New(conn)
+}
+
+// New returns a client for the Secret Service on the bus conn is
+// connected to
+func New(conn *dbus.Conn) (*Client, error) {
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	err := conn.Object(ServiceName, ServicePath).
+		Call(serviceIface+".OpenSession", 0, "plain", dbus.MakeVariant("")).
+		Store(&output, &session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Secret Service session: %w", err)
+	}
+	return &Client{conn: conn, session: session}, nil
+}
+
+// Close closes the client's session.  The connection is left open.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.Object(ServiceName, c.session).Call(sessionIface+".Close", 0).Err
+}
+
+// Get returns the secret with the given attributes, unlocking it if needed
+func (c *Client) Get(attrs map[string]string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	items, err := c.search(attrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrNotFound
+	}
+
+	var s Secret
+	err = c.conn.Object(ServiceName, items[0]).Call(itemIface+".GetSecret", 0, c.session).Store(&s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+	return s.Value, nil
+}
+
+// Put stores a secret with the given label and attributes in the default
+// collection, replacing any with the same attributes
+func (c *Client) Put(label string, attrs map[string]string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	collection, err := c.collection()
+	if err != nil {
+		return err
+	}
+
+	props := map[string]dbus.Variant{
+		labelProperty:      dbus.MakeVariant(label),
+		attributesProperty: dbus.MakeVariant(attrs),
+	}
+	s := Secret{Session: c.session, Parameters: []byte{}, Value: value, ContentType: "text/plain"}
+
+	var item, prompt dbus.ObjectPath
+	err = c.conn.Object(ServiceName, collection).
+		Call(collectionIface+".CreateItem", 0, props, s, true).
+		Store(&item, &prompt)
+	if err != nil {
+		return fmt.Errorf("failed to store secret: %w", err)
+	}
+	_, err = c.prompt(prompt)
+	return err
+}
+
+// Delete deletes every secret with the given attributes, or returns
+// ErrNotFound if there are none
+func (c *Client) Delete(attrs map[string]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	items, err := c.search(attrs)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return ErrNotFound
+	}
+
+	for _, item := range items {
+		var prompt dbus.ObjectPath
+		if err := c.conn.Object(ServiceName, item).Call(itemIface+".Delete", 0).Store(&prompt); err != nil {
+			return fmt.Errorf("failed to delete secret: %w", err)
+		}
+		if _, err := c.prompt(prompt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// search returns the items with the given attributes, unlocking any that
+// are locked
+func (c *Client) search(attrs map[string]string) ([]dbus.ObjectPath, error) {
+	var unlocked, locked []dbus.ObjectPath
+	err := c.conn.Object(ServiceName, ServicePath).
+		Call(serviceIface+".SearchItems", 0, attrs).
+		Store(&unlocked, &locked)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search secrets: %w", err)
+	}
+	if len(locked) == 0 {
+		return unlocked, nil
+	}
+
+	more, err := c.unlock(locked)
+	if err != nil {
+		return nil, err
+	}
+	return append(unlocked, more...), nil
+}
+
+// collection returns the default collection, unlocked, creating it if it
+// doesn't exist
+func (c *Client) collection() (dbus.ObjectPath, error) {
+	service := c.conn.Object(ServiceName, ServicePath)
+
+	var collection dbus.ObjectPath
+	if err := service.Call(serviceIface+".ReadAlias", 0, defaultAlias).Store(&collection); err != nil {
+		return "", fmt.Errorf("failed to find default collection: %w", err)
+	}
+
+	if collection == noPrompt {
+		props := map[string]dbus.Variant{collectionLabel: dbus.MakeVariant("Login")}
+		var prompt dbus.ObjectPath
+		err := service.Call(serviceIface+".CreateCollection", 0, props, defaultAlias).Store(&collection, &prompt)
+		if err != nil {
+			return "", fmt.Errorf("failed to create default collection: %w", err)
+		}
+		if prompt != noPrompt {
+			result, err := c.prompt(prompt)
+			if err != nil {
+				return "", err
+			}
+			path, ok := result.Value().(dbus.ObjectPath)
+			if !ok {
+				return "", errors.New("failed to create default collection: unexpected prompt result")
+			}
+			collection = path
+		}
+	}
+
+	if _, err := c.unlock([]dbus.ObjectPath{collection}); err != nil {
+		return "", err
+	}
+	return collection, nil
+}
+
+// unlock unlocks objects, prompting the user if needed, and returns those
+// unlocked
+func (c *Client) unlock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, error) {
+	var unlocked []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	err := c.conn.Object(ServiceName, ServicePath).
+		Call(serviceIface+".Unlock", 0, objects).
+		Store(&unlocked, &prompt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock secrets: %w", err)
+	}
+	if prompt == noPrompt {
+		return unlocked, nil
+	}
+
+	result, err := c.prompt(prompt)
+	if err != nil {
+		return nil, err
+	}
+	more, _ := result.Value().([]dbus.ObjectPath)
+	return append(unlocked, more...), nil
+}
+
+// prompt shows a prompt, unless it's noPrompt, and returns its result once
+// the user has answered it
+func (c *Client) prompt(prompt dbus.ObjectPath) (dbus.Variant, error) {
+	if prompt == noPrompt || prompt == "" {
+		return dbus.Variant{}, nil
+	}
+
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(prompt),
+		dbus.WithMatchInterface(promptIface),
+		dbus.WithMatchMember("Completed"),
+	}
+	if err := c.conn.AddMatchSignal(match...); err != nil {
+		return dbus.Variant{}, err
+	}
+	defer c.conn.RemoveMatchSignal(match...)
+
+	signals := make(chan *dbus.Signal, 8)
+	c.conn.Signal(signals)
+	defer c.conn.RemoveSignal(signals)
+
+	if err := c.conn.Object(ServiceName, prompt).Call(promptIface+".Prompt", 0, "").Err; err != nil {
+		return dbus.Variant{}, fmt.Errorf("failed to prompt: %w", err)
+	}
+
+	timeout := time.After(promptTimeout)
+	for {
+		select {
+		case s := <-signals:
+			if s.Path != prompt || s.Name != promptIface+".Completed" || len(s.Body) != 2 {
+				continue
+			}
+			if dismissed, _ := s.Body[0].(bool); dismissed {
+				return dbus.Variant{}, ErrDismissed
+			}
+			result, _ := s.Body[1].(dbus.Variant)
+			return result, nil
+
+		case <-timeout:
+			return dbus.Variant{}, ErrPromptTimeout
+		}
+	}
+}
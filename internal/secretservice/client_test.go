@@ -0,0 +1,166 @@
+package secretservice_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/arr2036/yksofttoken/internal/secretservice"
+)
+
+// busConfig configures a private session bus listening in a directory
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:dir=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startBus starts a private session bus, stopped when the test ends, and
+// returns its address.  The test is skipped if dbus-daemon isn't installed.
+func startBus(t *testing.T) string {
+	t.Helper()
+
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not installed")
+	}
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	if err := os.WriteFile(config, []byte(fmt.Sprintf(busConfig, dir)), 0600); err != nil {
+		t.Fatalf("Failed to write bus config: %v", err)
+	}
+
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Failed to start dbus-daemon: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start dbus-daemon: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read bus address: %v", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+// connect returns a connection to the bus at address, closed when the test
+// ends
+func connect(t *testing.T, address string) *dbus.Conn {
+	t.Helper()
+
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatalf("Failed to connect to bus: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// newTestService starts a private bus with a Memory Secret Service, and
+// returns the service, a client for it and the bus's address
+func newTestService(t *testing.T) (*secretservice.Memory, *secretservice.Client, string) {
+	t.Helper()
+
+	address := startBus(t)
+	m, err := secretservice.ServeMemory(connect(t, address))
+	if err != nil {
+		t.Fatalf("Failed to serve Secret Service: %v", err)
+	}
+
+	c, err := secretservice.New(connect(t, address))
+	if err != nil {
+		t.Fatalf("Failed to connect to Secret Service: %v", err)
+	}
+	return m, c, address
+}
+
+func TestClient(t *testing.T) {
+	m, c, _ := newTestService(t)
+	a := map[string]string{"application": "test", "name": "a"}
+	b := map[string]string{"application": "test", "name": "b"}
+
+	if _, err := c.Get(a); !errors.Is(err, secretservice.ErrNotFound) {
+		t.Errorf("Getting a missing secret gave %v, expected ErrNotFound", err)
+	}
+
+	if err := c.Put("a", a, []byte("one")); err != nil {
+		t.Fatalf("Failed to put secret: %v", err)
+	}
+	if err := c.Put("b", b, []byte("two")); err != nil {
+		t.Fatalf("Failed to put secret: %v", err)
+	}
+	if err := c.Put("a", a, []byte("three")); err != nil {
+		t.Fatalf("Failed to replace secret: %v", err)
+	}
+	if n := len(m.Items()); n != 2 {
+		t.Errorf("Service holds %d secrets, expected 2", n)
+	}
+
+	if value, err := c.Get(a); err != nil || string(value) != "three" {
+		t.Errorf("Got %q, %v, expected the replaced secret", value, err)
+	}
+	if value, err := c.Get(b); err != nil || string(value) != "two" {
+		t.Errorf("Got %q, %v, expected \"two\"", value, err)
+	}
+
+	if err := c.Delete(a); err != nil {
+		t.Fatalf("Failed to delete secret: %v", err)
+	}
+	if _, err := c.Get(a); !errors.Is(err, secretservice.ErrNotFound) {
+		t.Errorf("Getting a deleted secret gave %v, expected ErrNotFound", err)
+	}
+	if err := c.Delete(a); !errors.Is(err, secretservice.ErrNotFound) {
+		t.Errorf("Deleting a missing secret gave %v, expected ErrNotFound", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Errorf("Failed to close session: %v", err)
+	}
+}
+
+func TestClientUnlock(t *testing.T) {
+	m, c, _ := newTestService(t)
+	attrs := map[string]string{"application": "test"}
+
+	if err := c.Put("a", attrs, []byte("secret")); err != nil {
+		t.Fatalf("Failed to put secret: %v", err)
+	}
+
+	// Reading a locked secret prompts to unlock it
+	m.Lock()
+	if value, err := c.Get(attrs); err != nil || string(value) != "secret" {
+		t.Errorf("Got %q, %v from a locked collection", value, err)
+	}
+	if m.Locked() {
+		t.Error("Collection still locked after prompting")
+	}
+
+	// As does storing one
+	m.Lock()
+	if err := c.Put("b", map[string]string{"application": "other"}, []byte("x")); err != nil {
+		t.Errorf("Failed to put secret in a locked collection: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package secretservice
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// memoryCollection is the path of a Memory service's only collection
+const memoryCollection = ServicePath + "/collection/login"
+
+// Memory is a Secret Service keeping secrets in memory.  It stands in for a
+// desktop keyring where there isn't one, such as in tests and on headless
+// machines.  It has a single collection, the default, and only supports
+// the plain algorithm.
+type Memory struct {
+	conn   *dbus.Conn
+	mu     sync.Mutex
+	items  map[dbus.ObjectPath]*memoryItem
+	next   int
+	locked bool
+}
+
+type memoryItem struct {
+	label string
+	attrs map[string]string
+	value []byte
+}
+
+// ServeMemory serves a Memory Secret Service on conn's bus, owning the
+// Secret Service's name
+func ServeMemory(conn *dbus.Conn) (*Memory, error) {
+	m := &Memory{conn: conn, items: make(map[dbus.ObjectPath]*memoryItem)}
+
+	if err := conn.Export(memoryService{m}, ServicePath, serviceIface); err != nil {
+		return nil, err
+	}
+	if err := conn.Export(memoryCollectionObject{m}, memoryCollection, collectionIface); err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.RequestName(ServiceName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return nil, err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return nil, fmt.Errorf("'%s' is already owned", ServiceName)
+	}
+	return m, nil
+}
+
+// Lock locks the collection, so secrets can't be read or stored until a
+// client unlocks it through a prompt
+func (m *Memory) Lock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.locked = true
+}
+
+// Locked returns true if the collection is locked
+func (m *Memory) Locked() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.locked
+}
+
+// Items returns the attributes of every secret held
+func (m *Memory) Items() []map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	items := make([]map[string]string, 0, len(m.items))
+	for _, item := range m.items {
+		items = append(items, item.attrs)
+	}
+	return items
+}
+
+// newPath returns a new object path under base
+func (m *Memory) newPath(base dbus.ObjectPath) dbus.ObjectPath {
+	m.next++
+	return base + "/" + dbus.ObjectPath(strconv.Itoa(m.next))
+}
+
+// isLocked returns the error for using a locked collection
+func isLocked() *dbus.Error {
+	return dbus.NewError(errIsLocked, []interface{}{"collection is locked"})
+}
+
+// memoryService is the org.freedesktop.Secret.Service interface
+type memoryService struct {
+	m *Memory
+}
+
+func (s memoryService) OpenSession(algorithm string, input dbus.Variant) (dbus.Variant, dbus.ObjectPath, *dbus.Error) {
+	if algorithm != "plain" {
+		return dbus.Variant{}, "", dbus.NewError("org.freedesktop.DBus.Error.NotSupported", []interface{}{"only plain is supported"})
+	}
+
+	s.m.mu.Lock()
+	path := s.m.newPath(ServicePath + "/session")
+	s.m.mu.Unlock()
+
+	if err := s.m.conn.Export(memorySession{s.m, path}, path, sessionIface); err != nil {
+		return dbus.Variant{}, "", dbus.MakeFailedError(err)
+	}
+	return dbus.MakeVariant(""), path, nil
+}
+
+func (s memoryService) CreateCollection(props map[string]dbus.Variant, alias string) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	return memoryCollection, noPrompt, nil
+}
+
+func (s memoryService) ReadAlias(name string) (dbus.ObjectPath, *dbus.Error) {
+	if name != defaultAlias {
+		return noPrompt, nil
+	}
+	return memoryCollection, nil
+}
+
+func (s memoryService) SearchItems(attrs map[string]string) ([]dbus.ObjectPath, []dbus.ObjectPath, *dbus.Error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	found := []dbus.ObjectPath{}
+	for path, item := range s.m.items {
+		if matches(item.attrs, attrs) {
+			found = append(found, path)
+		}
+	}
+	if s.m.locked {
+		return []dbus.ObjectPath{}, found, nil
+	}
+	return found, []dbus.ObjectPath{}, nil
+}
+
+func (s memoryService) Unlock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	s.m.mu.Lock()
+	locked := s.m.locked
+	var path dbus.ObjectPath
+	if locked {
+		path = s.m.newPath(ServicePath + "/prompt")
+	}
+	s.m.mu.Unlock()
+
+	if !locked {
+		return objects, noPrompt, nil
+	}
+	if err := s.m.conn.Export(memoryPrompt{s.m, path, objects}, path, promptIface); err != nil {
+		return nil, "", dbus.MakeFailedError(err)
+	}
+	return []dbus.ObjectPath{}, path, nil
+}
+
+// matches returns true if attrs has every attribute in want
+func matches(attrs, want map[string]string) bool {
+	for k, v := range want {
+		if attrs[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// memoryCollectionObject is the org.freedesktop.Secret.Collection
+// interface
+type memoryCollectionObject struct {
+	m *Memory
+}
+
+func (c memoryCollectionObject) CreateItem(props map[string]dbus.Variant, secret Secret, replace bool) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	label, _ := props[labelProperty].Value().(string)
+	attrs, _ := props[attributesProperty].Value().(map[string]string)
+
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	if c.m.locked {
+		return "", "", isLocked()
+	}
+
+	if replace {
+		for path, item := range c.m.items {
+			if matches(item.attrs, attrs) && len(item.attrs) == len(attrs) {
+				item.label, item.value = label, secret.Value
+				return path, noPrompt, nil
+			}
+		}
+	}
+
+	path := c.m.newPath(memoryCollection)
+	if err := c.m.conn.Export(memoryItemObject{c.m, path}, path, itemIface); err != nil {
+		return "", "", dbus.MakeFailedError(err)
+	}
+	c.m.items[path] = &memoryItem{label: label, attrs: attrs, value: secret.Value}
+	return path, noPrompt, nil
+}
+
+// memoryItemObject is the org.freedesktop.Secret.Item interface
+type memoryItemObject struct {
+	m    *Memory
+	path dbus.ObjectPath
+}
+
+func (i memoryItemObject) GetSecret(session dbus.ObjectPath) (Secret, *dbus.Error) {
+	i.m.mu.Lock()
+	defer i.m.mu.Unlock()
+	if i.m.locked {
+		return Secret{}, isLocked()
+	}
+
+	item, ok := i.m.items[i.path]
+	if !ok {
+		return Secret{}, dbus.NewError("org.freedesktop.Secret.Error.NoSuchObject", []interface{}{string(i.path)})
+	}
+	return Secret{Session: session, Parameters: []byte{}, Value: item.value, ContentType: "text/plain"}, nil
+}
+
+func (i memoryItemObject) Delete() (dbus.ObjectPath, *dbus.Error) {
+	i.m.mu.Lock()
+	defer i.m.mu.Unlock()
+	if i.m.locked {
+		return "", isLocked()
+	}
+
+	delete(i.m.items, i.path)
+	i.m.conn.Export(nil, i.path, itemIface)
+	return noPrompt, nil
+}
+
+// memorySession is the org.freedesktop.Secret.Session interface
+type memorySession struct {
+	m    *Memory
+	path dbus.ObjectPath
+}
+
+func (s memorySession) Close() *dbus.Error {
+	s.m.conn.Export(nil, s.path, sessionIface)
+	return nil
+}
+
+// memoryPrompt is the org.freedesktop.Secret.Prompt interface.  Prompting
+// unlocks the collection straight away, as if the user entered its
+// password.
+type memoryPrompt struct {
+	m       *Memory
+	path    dbus.ObjectPath
+	objects []dbus.ObjectPath
+}
+
+func (p memoryPrompt) Prompt(windowID string) *dbus.Error {
+	p.m.mu.Lock()
+	p.m.locked = false
+	p.m.mu.Unlock()
+
+	p.m.conn.Export(nil, p.path, promptIface)
+	if err := p.m.conn.Emit(p.path, promptIface+".Completed", false, dbus.MakeVariant(p.objects)); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (p memoryPrompt) Dismiss() *dbus.Error {
+	p.m.conn.Export(nil, p.path, promptIface)
+	if err := p.m.conn.Emit(p.path, promptIface+".Completed", true, dbus.MakeVariant("")); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
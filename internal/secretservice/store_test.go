@@ -0,0 +1,170 @@
+package secretservice_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// The token package's secret store is tested here, where there's a bus to
+// test it against
+
+func TestSecretStore(t *testing.T) {
+	m, c, _ := newTestService(t)
+	dir := t.TempDir()
+
+	s, err := token.NewSecretStore(dir, c)
+	if err != nil {
+		t.Fatalf("Failed to create secret store: %v", err)
+	}
+	manager := token.NewManagerWithStore(dir, s)
+
+	tok, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	if err := manager.Create("a", tok); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := manager.Generate(context.Background(), "a"); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	// Only counters and metadata reach the disk
+	data, err := os.ReadFile(token.GetTokenPath(dir, "a"))
+	if err != nil {
+		t.Fatalf("Failed to read token file: %v", err)
+	}
+	for _, secret := range [][]byte{tok.AESKey[:], tok.PrivateID[:]} {
+		if strings.Contains(string(data), yubikey.HexEncode(secret)) {
+			t.Errorf("Token file holds a secret:\n%s", data)
+		}
+	}
+	if !strings.Contains(string(data), token.KeyringField+": "+token.KeyringSecretService) {
+		t.Errorf("Token file not marked as keeping its secrets in the keyring:\n%s", data)
+	}
+	if _, err := token.LoadWithVault(token.GetTokenPath(dir, "a"), nil); !errors.Is(err, token.ErrInKeyring) {
+		t.Errorf("Loading the token file directly gave %v, expected ErrInKeyring", err)
+	}
+	if n := len(m.Items()); n != 1 {
+		t.Errorf("Keyring holds %d secrets, expected 1", n)
+	}
+
+	// A second manager, such as the CLI, gets the whole token
+	saved, err := manager.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	loaded, err := token.NewManagerWithStore(dir, s).Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token from a second manager: %v", err)
+	}
+	if loaded.AESKey != tok.AESKey || loaded.PrivateID != tok.PrivateID || loaded.Counter != saved.Counter {
+		t.Error("Token loaded from the secret store differs from the one saved")
+	}
+
+	if err := manager.Delete("a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if n := len(m.Items()); n != 0 {
+		t.Errorf("Keyring holds %d secrets after deleting the token, expected none", n)
+	}
+}
+
+func TestSecretStoreMissing(t *testing.T) {
+	m, c, _ := newTestService(t)
+	dir := t.TempDir()
+
+	s, err := token.NewSecretStore(dir, c)
+	if err != nil {
+		t.Fatalf("Failed to create secret store: %v", err)
+	}
+	tok, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	if err := token.NewManagerWithStore(dir, s).Create("a", tok); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// The keyring was reset, or the token directory copied elsewhere
+	for _, attrs := range m.Items() {
+		if err := c.Delete(attrs); err != nil {
+			t.Fatalf("Failed to delete secret: %v", err)
+		}
+	}
+	if _, err := s.Get("a"); !errors.Is(err, token.ErrSecretsMissing) {
+		t.Errorf("Getting a token without its secrets gave %v, expected ErrSecretsMissing", err)
+	}
+}
+
+func TestMigrateSecretStore(t *testing.T) {
+	m, c, address := newTestService(t)
+	dir := t.TempDir()
+
+	files := token.NewManager(dir)
+	for _, name := range []string{"a", "b"} {
+		tok, err := token.New()
+		if err != nil {
+			t.Fatalf("Failed to create new token: %v", err)
+		}
+		if err := files.Create(name, tok); err != nil {
+			t.Fatalf("Create(%s) failed: %v", name, err)
+		}
+	}
+	if _, err := files.StartRotation("a", false); err != nil {
+		t.Fatalf("StartRotation failed: %v", err)
+	}
+	before, err := files.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+
+	// The session bus the migration connects to is the private one
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", address)
+	if err := token.MigrateStore(dir, token.StoreConfig{Backend: token.BackendSecretService}); err != nil {
+		t.Fatalf("Failed to migrate to the keyring: %v", err)
+	}
+	if n := len(m.Items()); n != 3 {
+		t.Errorf("Keyring holds %d secrets, expected 3 including the successor", n)
+	}
+	if _, err := token.LoadWithVault(token.GetTokenPath(dir, "b"), nil); !errors.Is(err, token.ErrInKeyring) {
+		t.Errorf("Token file still holds its secrets after migrating: %v", err)
+	}
+
+	s, err := token.NewSecretStore(dir, c)
+	if err != nil {
+		t.Fatalf("Failed to create secret store: %v", err)
+	}
+	keyring := token.NewManagerWithStore(dir, s)
+	if names, err := keyring.Names(); err != nil || !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("Migrated store holds %v, %v", names, err)
+	}
+	if after, err := keyring.Get("a"); err != nil || after.AESKey != before.AESKey {
+		t.Errorf("Migrated token differs: %v", err)
+	}
+	if _, err := keyring.Successor("a"); err != nil {
+		t.Errorf("Successor lost in migration: %v", err)
+	}
+
+	// And back to plain files
+	if err := token.MigrateStore(dir, token.StoreConfig{Backend: token.BackendFile}); err != nil {
+		t.Fatalf("Failed to migrate to files: %v", err)
+	}
+	if n := len(m.Items()); n != 0 {
+		t.Errorf("Keyring holds %d secrets after migrating back, expected none", n)
+	}
+	after, err := token.LoadWithVault(token.GetTokenPath(dir, "a"), nil)
+	if err != nil {
+		t.Fatalf("Failed to load token file after migrating back: %v", err)
+	}
+	if after.AESKey != before.AESKey || after.PrivateID != before.PrivateID {
+		t.Error("Token file differs after migrating back")
+	}
+}
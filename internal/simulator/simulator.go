@@ -0,0 +1,320 @@
+// Package simulator simulates a fleet of soft tokens being used over months
+// of virtual time, checking the OTPs they generate for anomalies
+package simulator
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// timerWrap is the period of the 24-bit 8Hz timer, in timer ticks
+const timerWrap = 0xffffff
+
+// Anomaly kinds
+const (
+	AnomalyCounter   = "non-monotonic-counter"
+	AnomalyTimestamp = "non-monotonic-timestamp"
+	AnomalyExhausted = "counter-exhausted"
+	AnomalyRejected  = "rejected"
+	AnomalyGenerate  = "generate-failed"
+	AnomalySink      = "sink-failed"
+)
+
+// Schedule is how each token in the fleet is used
+type Schedule struct {
+	Interval   time.Duration // Mean time between uses
+	Jitter     float64       // Random variation of Interval, as a fraction of it (0-1)
+	Burst      int           // OTPs generated per use, at least 1
+	PowerCycle float64       // Probability the token is plugged in again before a use (0-1)
+}
+
+// Config describes a simulation
+type Config struct {
+	Tokens       int
+	StartCounter uint16 // Initial use counter of every token, 0 for a new token's
+	Start        time.Time
+	Duration     time.Duration
+	Schedule     Schedule
+	Sink         Sink  // Where OTPs are submitted, or nil to only check them
+	Seed         int64 // Seed for the schedule's randomness
+
+	// Register is called with each token before the simulation starts,
+	// e.g. to register it with the validator behind Sink
+	Register func(name string, t *token.SoftToken)
+
+	// Ready is called once every token is registered, before any is used.
+	// An error aborts the simulation.
+	Ready func() error
+}
+
+// Anomaly is something unexpected seen during a simulation
+type Anomaly struct {
+	Time   time.Time // Virtual time
+	Token  string
+	Kind   string
+	Detail string
+}
+
+func (a Anomaly) String() string {
+	return fmt.Sprintf("%s %s %s: %s", a.Time.UTC().Format(time.RFC3339), a.Token, a.Kind, a.Detail)
+}
+
+// Report summarises a simulation
+type Report struct {
+	OTPs           int
+	PowerUps       int
+	SessionWraps   int            // Use counter increments caused by the session counter wrapping
+	TimestampWraps int            // Times the 24-bit timer wrapped within a power-up
+	Exhausted      int            // Tokens whose use counter reached its maximum
+	Statuses       map[string]int // Count of each status the sink reported
+	Anomalies      []Anomaly
+}
+
+// simToken is a token in the fleet, and the last OTP it generated
+type simToken struct {
+	name  string
+	token *token.SoftToken
+	next  time.Time
+	dead  bool
+
+	seen      bool
+	counter   uint16
+	session   uint8
+	timestamp uint32
+	lastOTP   time.Time
+	poweredUp bool // Powered up since the last OTP
+}
+
+// schedule orders tokens by when they're next used
+type schedule []*simToken
+
+func (s schedule) Len() int            { return len(s) }
+func (s schedule) Less(i, j int) bool  { return s[i].next.Before(s[j].next) }
+func (s schedule) Swap(i, j int)       { s[i], s[j] = s[j], s[i] }
+func (s *schedule) Push(x interface{}) { *s = append(*s, x.(*simToken)) }
+func (s *schedule) Pop() interface{} {
+	old := *s
+	st := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return st
+}
+
+// simulation is the state of a running simulation
+type simulation struct {
+	cfg    Config
+	rnd    *rand.Rand
+	report *Report
+}
+
+// Run creates a fleet of tokens and simulates their use from cfg.Start
+// until cfg.Duration has passed.  Tokens are used in virtual time order,
+// though the OTPs of one use may be spread over a few seconds to satisfy
+// the 8Hz timer's rate limit.
+func Run(cfg Config) (*Report, error) {
+	if cfg.Tokens <= 0 {
+		return nil, errors.New("no tokens to simulate")
+	}
+	if cfg.Schedule.Interval <= 0 {
+		return nil, errors.New("schedule interval must be positive")
+	}
+	if cfg.Schedule.Burst <= 0 {
+		cfg.Schedule.Burst = 1
+	}
+	if cfg.Start.IsZero() {
+		cfg.Start = time.Now()
+	}
+
+	s := &simulation{
+		cfg:    cfg,
+		rnd:    rand.New(rand.NewSource(cfg.Seed)),
+		report: &Report{Statuses: make(map[string]int)},
+	}
+
+	fleet, err := s.newFleet()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Ready != nil {
+		if err := cfg.Ready(); err != nil {
+			return nil, err
+		}
+	}
+
+	end := cfg.Start.Add(cfg.Duration)
+	for fleet.Len() > 0 {
+		st := heap.Pop(&fleet).(*simToken)
+		if st.next.After(end) {
+			break
+		}
+
+		s.use(st)
+		if !st.dead {
+			st.next = st.next.Add(s.interval())
+			heap.Push(&fleet, st)
+		}
+	}
+
+	return s.report, nil
+}
+
+// newFleet creates the tokens, powered up at the start time
+func (s *simulation) newFleet() (schedule, error) {
+	fleet := make(schedule, 0, s.cfg.Tokens)
+	publicIDs := make(map[string]bool)
+	start := s.cfg.Start.Unix()
+
+	for i := 0; i < s.cfg.Tokens; i++ {
+		t, err := token.New()
+		if err != nil {
+			return nil, err
+		}
+		if publicIDs[string(t.PublicID)] {
+			i-- // Public IDs must be unique for the validator
+			continue
+		}
+		publicIDs[string(t.PublicID)] = true
+
+		t.Created, t.LastUse, t.PowerOn = start, start, start
+		if s.cfg.StartCounter != 0 {
+			t.Counter = s.cfg.StartCounter
+		}
+
+		st := &simToken{
+			name:  fmt.Sprintf("sim-%04d", i+1),
+			token: t,
+			next:  s.cfg.Start.Add(time.Duration(s.rnd.Int63n(int64(s.cfg.Schedule.Interval)))),
+		}
+		if s.cfg.Register != nil {
+			s.cfg.Register(st.name, t.Clone())
+		}
+		fleet = append(fleet, st)
+	}
+
+	heap.Init(&fleet)
+	return fleet, nil
+}
+
+// interval returns the time until a token's next use
+func (s *simulation) interval() time.Duration {
+	sched := s.cfg.Schedule
+	jitter := sched.Jitter * (2*s.rnd.Float64() - 1)
+	d := time.Duration(float64(sched.Interval) * (1 + jitter))
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+func (s *simulation) anomaly(at time.Time, st *simToken, kind, detail string) {
+	s.report.Anomalies = append(s.report.Anomalies, Anomaly{Time: at, Token: st.name, Kind: kind, Detail: detail})
+}
+
+// use simulates one use of a token.  Waiting on the rate limit moves the
+// token's next use on, so it's scheduled from when this one finished.
+func (s *simulation) use(st *simToken) {
+	at := st.next
+	defer func() { st.next = at }()
+
+	if s.rnd.Float64() < s.cfg.Schedule.PowerCycle {
+		if err := st.token.PowerUpAt(at); err != nil {
+			s.fail(at, st, err)
+			return
+		}
+		st.poweredUp = true
+		s.report.PowerUps++
+	}
+
+	for n := 0; n < s.cfg.Schedule.Burst; {
+		otp, err := st.token.GenerateOTPAt(at)
+
+		var rle *token.RateLimitError
+		if errors.As(err, &rle) {
+			at = at.Add(rle.Wait)
+			continue
+		}
+		if err != nil {
+			s.fail(at, st, err)
+			return
+		}
+
+		s.report.OTPs++
+		s.check(at, st, otp)
+		s.submit(at, st, otp)
+		n++
+	}
+}
+
+// fail records a token failing to generate an OTP.  A token whose counter
+// is exhausted can't be used again, so is retired.
+func (s *simulation) fail(at time.Time, st *simToken, err error) {
+	if errors.Is(err, token.ErrCounterExhausted) {
+		s.anomaly(at, st, AnomalyExhausted, err.Error())
+		s.report.Exhausted++
+		st.dead = true
+		return
+	}
+	s.anomaly(at, st, AnomalyGenerate, err.Error())
+}
+
+// check decrypts an OTP, checking its counters increase and its timestamp
+// doesn't go backwards within a power-up, other than when the timer wraps
+func (s *simulation) check(at time.Time, st *simToken, otp string) {
+	_, block, err := yubikey.ParseOTP(otp, st.token.AESKey[:])
+	if err != nil {
+		s.anomaly(at, st, AnomalyGenerate, fmt.Sprintf("OTP doesn't decrypt: %v", err))
+		return
+	}
+
+	if st.seen {
+		switch {
+		case block.Counter < st.counter || (block.Counter == st.counter && block.Session <= st.session):
+			s.anomaly(at, st, AnomalyCounter, fmt.Sprintf("counter %d/%d after %d/%d",
+				block.Counter, block.Session, st.counter, st.session))
+
+		case block.Counter > st.counter && !st.poweredUp:
+			s.report.SessionWraps++
+
+		case block.Counter == st.counter && block.Timestamp < st.timestamp:
+			// The timer may have wrapped since the last OTP
+			elapsed := uint64(at.Sub(st.lastOTP).Seconds()*8) + 1
+			if uint64(st.timestamp)+elapsed >= timerWrap {
+				s.report.TimestampWraps++
+			} else {
+				s.anomaly(at, st, AnomalyTimestamp, fmt.Sprintf("timestamp %06x after %06x",
+					block.Timestamp, st.timestamp))
+			}
+		}
+	}
+
+	st.seen = true
+	st.counter, st.session, st.timestamp = block.Counter, block.Session, block.Timestamp
+	st.lastOTP = at
+	st.poweredUp = false
+}
+
+// submit submits an OTP to the sink
+func (s *simulation) submit(at time.Time, st *simToken, otp string) {
+	if s.cfg.Sink == nil {
+		return
+	}
+
+	status, err := s.cfg.Sink.Submit(at, st.name, otp)
+	if err != nil {
+		s.anomaly(at, st, AnomalySink, err.Error())
+		return
+	}
+	if status == "" {
+		return
+	}
+
+	s.report.Statuses[status]++
+	if status != "OK" {
+		s.anomaly(at, st, AnomalyRejected, fmt.Sprintf("%s rejected with %s", otp, status))
+	}
+}
@@ -0,0 +1,133 @@
+package simulator
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+	"github.com/arr2036/yksofttoken/internal/validator"
+)
+
+func TestRunMonths(t *testing.T) {
+	v := validator.New()
+
+	r, err := Run(Config{
+		Tokens:   10,
+		Start:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Duration: 90 * 24 * time.Hour,
+		Schedule: Schedule{Interval: time.Hour, Jitter: 0.5, Burst: 2},
+		Sink:     &ValidatorSink{Validator: v},
+		Register: func(name string, t *token.SoftToken) { v.RegisterToken(t) },
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	for _, a := range r.Anomalies {
+		t.Errorf("Anomaly: %s", a)
+	}
+	if r.Statuses[validator.StatusOK] != r.OTPs {
+		t.Errorf("Statuses = %v, expected %d OK", r.Statuses, r.OTPs)
+	}
+
+	// Never power cycled, so the session counter and timer both wrap
+	if r.SessionWraps == 0 {
+		t.Error("No session wraps in 90 days")
+	}
+	if r.TimestampWraps == 0 {
+		t.Error("No timestamp wraps in 90 days")
+	}
+}
+
+func TestRunExhaustion(t *testing.T) {
+	r, err := Run(Config{
+		Tokens:       3,
+		StartCounter: 0x7ffe,
+		Duration:     24 * time.Hour,
+		Schedule:     Schedule{Interval: time.Hour, PowerCycle: 1},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if r.Exhausted != 3 {
+		t.Errorf("Exhausted = %d, expected 3", r.Exhausted)
+	}
+	if r.PowerUps != 3 || r.OTPs != 3 {
+		t.Errorf("PowerUps = %d, OTPs = %d, expected one use of each token", r.PowerUps, r.OTPs)
+	}
+	for _, a := range r.Anomalies {
+		if a.Kind != AnomalyExhausted {
+			t.Errorf("Unexpected anomaly: %s", a)
+		}
+	}
+}
+
+func TestRunWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+
+	r, err := Run(Config{
+		Tokens:   2,
+		Duration: 10 * time.Hour,
+		Schedule: Schedule{Interval: time.Hour, Burst: 3},
+		Sink:     &WriterSink{W: &buf},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != r.OTPs {
+		t.Errorf("Wrote %d lines, expected %d", len(lines), r.OTPs)
+	}
+	if len(r.Statuses) != 0 {
+		t.Errorf("Statuses = %v, expected none from a writer", r.Statuses)
+	}
+}
+
+func TestUseRateLimited(t *testing.T) {
+	tok, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+
+	start := time.Unix(1700000000, 0)
+	s := &simulation{
+		cfg:    Config{Schedule: Schedule{Interval: time.Hour, Burst: 40}},
+		rnd:    rand.New(rand.NewSource(1)),
+		report: &Report{},
+	}
+	st := &simToken{name: "a", token: tok, next: start}
+	s.use(st)
+
+	// More OTPs than the rate limit allows in a second spread the use out,
+	// and the next use is scheduled from the last OTP
+	if !st.lastOTP.After(start) {
+		t.Fatalf("Burst of %d OTPs wasn't rate limited", s.cfg.Schedule.Burst)
+	}
+	if !st.next.Equal(st.lastOTP) {
+		t.Errorf("Next use scheduled from %v, expected %v", st.next, st.lastOTP)
+	}
+}
+
+func TestCheckNonMonotonic(t *testing.T) {
+	tok, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	otp, err := tok.GenerateOTP()
+	if err != nil {
+		t.Fatalf("GenerateOTP failed: %v", err)
+	}
+
+	s := &simulation{report: &Report{}}
+	st := &simToken{name: "a", token: tok, seen: true, counter: tok.Counter + 1}
+	s.check(time.Now(), st, otp)
+
+	if len(s.report.Anomalies) != 1 || s.report.Anomalies[0].Kind != AnomalyCounter {
+		t.Errorf("Anomalies = %v, expected one %s", s.report.Anomalies, AnomalyCounter)
+	}
+}
@@ -0,0 +1,52 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/loadtest"
+	"github.com/arr2036/yksofttoken/internal/validator"
+)
+
+// Sink receives the OTPs generated by a simulation
+type Sink interface {
+	// Submit submits an OTP generated by a token at the virtual time at,
+	// returning the validation status, or "" if the sink doesn't validate
+	Submit(at time.Time, tokenName, otp string) (string, error)
+}
+
+// WriterSink writes each OTP as a line of virtual time, token name and OTP
+type WriterSink struct {
+	W io.Writer
+}
+
+// Submit writes the OTP
+func (s *WriterSink) Submit(at time.Time, tokenName, otp string) (string, error) {
+	_, err := fmt.Fprintf(s.W, "%s %s %s\n", at.UTC().Format(time.RFC3339), tokenName, otp)
+	return "", err
+}
+
+// ValidatorSink validates OTPs with an in-process validator, with each
+// simulated token registered with it
+type ValidatorSink struct {
+	Validator *validator.Validator
+}
+
+// Submit validates the OTP
+func (s *ValidatorSink) Submit(at time.Time, tokenName, otp string) (string, error) {
+	return s.Validator.Verify(otp).Status, nil
+}
+
+// VerifierSink submits OTPs to a validation server, such as a YK-VAL.  The
+// server sees them in real time, so must not reject them for their
+// timestamps.
+type VerifierSink struct {
+	Verifier loadtest.Verifier
+}
+
+// Submit submits the OTP to the server
+func (s *VerifierSink) Submit(at time.Time, tokenName, otp string) (string, error) {
+	return s.Verifier.Verify(context.Background(), otp)
+}
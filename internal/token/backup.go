@@ -0,0 +1,198 @@
+package token
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// ErrRestoreConflict indicates part of a backup wasn't restored, because
+// it would have rolled back or replaced what's there locally
+var ErrRestoreConflict = errors.New("conflicts with local state")
+
+// RestoreAction is what restoring part of a backup did
+type RestoreAction int
+
+const (
+	// RestoreAdded means it didn't exist locally, and was restored
+	RestoreAdded RestoreAction = iota
+	// RestoreUpdated means the backup was further on, and was restored
+	RestoreUpdated
+	// RestoreUnchanged means what's there locally is already as far on
+	RestoreUnchanged
+	// RestoreConflict means it wasn't restored, see RestoreResult.Err
+	RestoreConflict
+)
+
+func (a RestoreAction) String() string {
+	switch a {
+	case RestoreAdded:
+		return "added"
+	case RestoreUpdated:
+		return "updated"
+	case RestoreUnchanged:
+		return "unchanged"
+	case RestoreConflict:
+		return "conflict"
+	}
+	return fmt.Sprintf("RestoreAction(%d)", int(a))
+}
+
+// RestoreResult reports what restoring a token, or other part of a backup,
+// did
+type RestoreResult struct {
+	Name   string
+	Action RestoreAction
+	Err    error // Why it conflicts, wrapping ErrRestoreConflict
+}
+
+// Export returns every record in the store, including successors and
+// retired tokens, as unencrypted token files keyed by name.  The secrets
+// of tokens kept in a keyring are included.
+func (m *Manager) Export() (map[string][]byte, error) {
+	m.mu.Lock()
+	v, locked := m.vault, m.locked
+	m.mu.Unlock()
+	if locked {
+		return nil, ErrLocked
+	}
+
+	names, err := m.store.List()
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string][]byte)
+	for _, name := range names {
+		data, err := m.store.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read '%s': %w", name, err)
+		}
+		// Other files in the token directory, such as a bolt store's
+		// database, aren't tokens
+		if !bytes.HasPrefix(data, []byte(PublicIDField+":")) {
+			continue
+		}
+		t, err := decodeToken(data, name, v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load '%s': %w", name, err)
+		}
+		records[name] = t.marshal()
+		t.wipe()
+	}
+	return records, nil
+}
+
+// Restore saves the records returned by Export to the store, encrypting
+// them if the directory is encrypted.  A record is only restored if it's
+// new, or further on than the local token with the same public ID, so
+// counters are never rolled back.  Records whose public ID is another local
+// token's, or behind their high-water mark if the manager keeps marks,
+// aren't restored either, nor are records over local ones that can't be
+// loaded.
+func (m *Manager) Restore(records map[string][]byte) ([]RestoreResult, error) {
+	if m.Locked() {
+		return nil, ErrLocked
+	}
+
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := []RestoreResult{}
+	for _, name := range names {
+		t, err := decodeToken(records[name], name, nil)
+		if err != nil {
+			return results, fmt.Errorf("invalid token '%s' in backup: %w", name, err)
+		}
+		action, ev, err := m.restore(name, t)
+		t.wipe()
+		if errors.Is(err, ErrRestoreConflict) {
+			results = append(results, RestoreResult{Name: name, Action: RestoreConflict, Err: err})
+			continue
+		}
+		if err != nil {
+			return results, fmt.Errorf("failed to restore '%s': %w", name, err)
+		}
+		results = append(results, RestoreResult{Name: name, Action: action})
+		if ev != nil {
+			m.publish(*ev)
+		}
+	}
+	return results, nil
+}
+
+// restore restores t as the named record, unless it would roll back the
+// local one.  It returns the event to publish, if any.
+func (m *Manager) restore(name string, t *SoftToken) (RestoreAction, *Event, error) {
+	// A token the manager has loaded is updated with it
+	m.mu.Lock()
+	v := m.vault
+	mt := m.tokens[name]
+	m.mu.Unlock()
+	if mt != nil {
+		mt.mu.Lock()
+		defer mt.mu.Unlock()
+	}
+
+	unlock, err := m.store.Lock(name)
+	if err != nil {
+		return RestoreConflict, nil, err
+	}
+	defer unlock()
+
+	action := RestoreAdded
+	local, err := readRecord(m.store, name, v)
+	switch {
+	case errors.Is(err, ErrTokenNotFound):
+	case err != nil:
+		return RestoreConflict, nil, fmt.Errorf("%w: local '%s' can't be loaded: %w", ErrRestoreConflict, name, err)
+	case !bytes.Equal(local.PublicID, t.PublicID):
+		return RestoreConflict, nil, fmt.Errorf("%w: backup is token %s, local '%s' is %s", ErrRestoreConflict,
+			yubikey.ModHexEncode(t.PublicID), name, yubikey.ModHexEncode(local.PublicID))
+	case counterAhead(local, t):
+		return RestoreConflict, nil, fmt.Errorf("%w: backup at counter %d session %d is behind local %d/%d",
+			ErrRestoreConflict, t.Counter, t.Session, local.Counter, local.Session)
+	case !counterAhead(t, local):
+		return RestoreUnchanged, nil, nil
+	default:
+		action = RestoreUpdated
+	}
+
+	// A token renamed since the backup would be restored alongside itself,
+	// generating the same OTPs.  Successors and retired tokens share their
+	// token's public ID.
+	if !isHidden(name) {
+		if err := checkPublicID(m.store, t.PublicID, name); errors.Is(err, ErrPublicIDInUse) {
+			return RestoreConflict, nil, fmt.Errorf("%w: %w", ErrRestoreConflict, err)
+		} else if err != nil {
+			return RestoreConflict, nil, err
+		}
+	}
+
+	// A token used since the backup may have been deleted, or used from
+	// another directory
+	if err := m.marks.Check(t); err != nil {
+		return RestoreConflict, nil, fmt.Errorf("%w: %w", ErrRestoreConflict, err)
+	}
+
+	if err := saveRecord(m.store, name, t, v, m.marks); err != nil {
+		return RestoreConflict, nil, err
+	}
+	if isHidden(name) {
+		return action, nil, nil
+	}
+
+	if mt != nil {
+		mt.token = t.Clone()
+	}
+	ev := &Event{Type: EventAdded, Name: name, Counter: t.Counter, Session: t.Session}
+	if action == RestoreUpdated {
+		ev.Type = EventReloaded
+	}
+	return action, ev, nil
+}
@@ -0,0 +1,201 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// restoreActions returns the action restoring each record took
+func restoreActions(t *testing.T, results []RestoreResult) map[string]RestoreAction {
+	t.Helper()
+
+	actions := make(map[string]RestoreAction)
+	for _, r := range results {
+		if (r.Action == RestoreConflict) != (r.Err != nil) {
+			t.Errorf("Result for '%s' is %v with error %v", r.Name, r.Action, r.Err)
+		}
+		if r.Err != nil && !errors.Is(r.Err, ErrRestoreConflict) {
+			t.Errorf("Conflict for '%s' is %v, expected ErrRestoreConflict", r.Name, r.Err)
+		}
+		actions[r.Name] = r.Action
+	}
+	return actions
+}
+
+func TestManagerExportRestore(t *testing.T) {
+	m := newTestManager(t, "a", "b", "c")
+	if _, err := m.StartRotation("a", false); err != nil {
+		t.Fatalf("StartRotation failed: %v", err)
+	}
+	records, err := m.Export()
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if len(records) != 4 {
+		t.Errorf("Exported %d records, expected 4 including the successor", len(records))
+	}
+
+	// Restoring into an empty directory restores everything
+	restored := NewManager(t.TempDir())
+	events := &eventRecorder{}
+	restored.Subscribe(events.record)
+	results, err := restored.Restore(records)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	for name, action := range restoreActions(t, results) {
+		if action != RestoreAdded {
+			t.Errorf("Restoring '%s' into an empty directory was %v", name, action)
+		}
+	}
+	if n := events.count(EventAdded); n != 3 {
+		t.Errorf("Got %d EventAdded, expected 3", n)
+	}
+	if _, err := restored.Successor("a"); err != nil {
+		t.Errorf("Successor not restored: %v", err)
+	}
+
+	// Tokens used since the backup are never rolled back, and tokens used
+	// elsewhere are brought forward
+	if _, err := restored.Generate(context.Background(), "a"); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	if _, err := m.Generate(context.Background(), "b"); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	if records, err = m.Export(); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	before, err := restored.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	if results, err = restored.Restore(records); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	actions := restoreActions(t, results)
+	if actions["a"] != RestoreConflict || actions["b"] != RestoreUpdated || actions["c"] != RestoreUnchanged {
+		t.Errorf("Restore took %v, expected a conflict, b updated and c unchanged", actions)
+	}
+	if after, err := restored.Get("a"); err != nil || after.Counter != before.Counter || after.Session != before.Session {
+		t.Errorf("Conflicting token rolled back: %v", err)
+	}
+	want, _ := m.Get("b")
+	if got, err := restored.Get("b"); err != nil || got.Session != want.Session {
+		t.Errorf("Updated token not reloaded: %v", err)
+	}
+}
+
+func TestManagerRestoreConflicts(t *testing.T) {
+	m := newTestManager(t, "a")
+	records, err := m.Export()
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	// Another token under the same name isn't replaced
+	other := newTestManager(t, "a")
+	results, err := other.Restore(records)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if actions := restoreActions(t, results); actions["a"] != RestoreConflict {
+		t.Errorf("Restoring over a different token was %v", actions["a"])
+	}
+
+	// Nor is a token that's been renamed, which would be restored beside
+	// itself
+	renamed := NewManager(t.TempDir())
+	if _, err := renamed.Restore(records); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if err := renamed.Store().Put("b", records["a"]); err != nil {
+		t.Fatalf("Failed to rename token: %v", err)
+	}
+	if err := renamed.Store().Delete("a"); err != nil {
+		t.Fatalf("Failed to rename token: %v", err)
+	}
+	results, err = renamed.Restore(records)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if actions := restoreActions(t, results); actions["a"] != RestoreConflict || !errors.Is(results[0].Err, ErrPublicIDInUse) {
+		t.Errorf("Restoring a renamed token gave %+v, expected a conflict", results)
+	}
+
+	// A local token that can't be loaded is a conflict, and the rest of
+	// the backup is still restored
+	both, err := newTestManager(t, "a", "c").Export()
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	broken := newTestManager(t)
+	if err := broken.Store().Put("a", []byte("public_id: vvvvvvvvvvvv\ncounter: x\n")); err != nil {
+		t.Fatalf("Failed to break token: %v", err)
+	}
+	results, err = broken.Restore(both)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if actions := restoreActions(t, results); actions["a"] != RestoreConflict || actions["c"] != RestoreAdded {
+		t.Errorf("Restoring over a broken token took %v, expected a conflict and c added", actions)
+	}
+
+	// Nor is a token behind its high-water mark, even where it's gone
+	used := NewManager(t.TempDir(), WithMarks(NewMarks(t.TempDir())))
+	if _, err := used.Restore(records); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if _, err := used.Generate(context.Background(), "a"); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	if err := used.Delete("a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	results, err = used.Restore(records)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	var rollbackErr *RollbackError
+	if len(results) != 1 || !errors.As(results[0].Err, &rollbackErr) {
+		t.Errorf("Restoring a token behind its mark gave %+v, expected a RollbackError", results)
+	}
+}
+
+func TestManagerExportRestoreEncrypted(t *testing.T) {
+	m := newTestManager(t, "a")
+	if err := m.Encrypt("secret"); err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	m.Lock()
+	if _, err := m.Export(); !errors.Is(err, ErrLocked) {
+		t.Errorf("Exporting a locked directory gave %v, expected ErrLocked", err)
+	}
+	if err := m.Unlock("secret"); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	records, err := m.Export()
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if fieldValue(records["a"], EncryptedField) != "" {
+		t.Error("Exported token still encrypted")
+	}
+
+	// Restored tokens are encrypted with the directory they're restored to
+	restored := NewManager(t.TempDir())
+	if err := restored.Encrypt("other"); err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if _, err := restored.Restore(records); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	data, err := restored.Store().Get("a")
+	if err != nil {
+		t.Fatalf("Failed to read restored token: %v", err)
+	}
+	if fieldValue(data, EncryptedField) == "" {
+		t.Error("Restored token not encrypted")
+	}
+}
@@ -0,0 +1,255 @@
+package token
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// defaultStreamChunk is how many OTPs a Stream reserves at a time
+const defaultStreamChunk = 256
+
+// Reservation is a range of consecutive OTPs reserved from a token, along
+// with the timer state needed to generate them
+type Reservation struct {
+	Counter   uint16 // Use counter of the first OTP
+	Session   uint8  // Session counter of the first OTP
+	Count     int    // Number of OTPs reserved
+	TimerBase int64  // Unix timestamp the 8Hz timer counts from
+	PonRand   uint32 // Timer offset, with the low nibble clear
+}
+
+// Reserver reserves n OTPs from a token, persisting the token's new state
+// before returning
+type Reserver func(n int) (Reservation, error)
+
+// Reserve advances the token's counters past the next n OTPs, so they can
+// be generated later without touching the token.  The counters advance
+// exactly as if GenerateOTP had been called n times, and nothing is
+// reserved if the use counter would be exhausted.
+func (t *SoftToken) Reserve(n int) (Reservation, error) {
+	return t.reserveAt(n, time.Now())
+}
+
+func (t *SoftToken) reserveAt(n int, now time.Time) (Reservation, error) {
+	if n <= 0 {
+		return Reservation{}, fmt.Errorf("invalid reservation size %d", n)
+	}
+
+	counter, session := t.Counter, t.Session
+	r := Reservation{Count: n}
+
+	for i := 0; i < n; i++ {
+		var ok bool
+		if counter, session, ok = nextOTP(counter, session); !ok {
+			return Reservation{}, ErrCounterExhausted
+		}
+		if i == 0 {
+			r.Counter, r.Session = counter, session
+		}
+	}
+
+	t.Counter, t.Session = counter, session
+
+	// OTPs from the reservation are stamped with the current 8th of a
+	// second.  Advance the same-second counter to match, so the next OTP
+	// generated normally doesn't go back in time.
+	unixNow := now.Unix()
+	eighths := uint32(now.Nanosecond() / (int(time.Second) / 8))
+	if unixNow != t.LastUse {
+		t.LastUse = unixNow
+		t.PonRand &= 0xfffffff0
+	}
+	if t.PonRand&0x0f < eighths {
+		t.PonRand = (t.PonRand & 0xfffffff0) | eighths
+	}
+
+	r.TimerBase = t.timerBase()
+	r.PonRand = t.PonRand & 0xfffffff0
+
+	return r, nil
+}
+
+// nextOTP returns the counters of the OTP following one with the given
+// counters, or false if the use counter is exhausted
+func nextOTP(counter uint16, session uint8) (uint16, uint8, bool) {
+	if session != 0xff {
+		return counter, session + 1, true
+	}
+	if counter >= 0x7fff {
+		return counter, session, false
+	}
+	return counter + 1, 1, true
+}
+
+// Stream generates OTPs in bulk, for load testing validators.  It reserves
+// OTPs from a token a chunk at a time, reuses a single AES cipher, and
+// generates each OTP without allocating.  A Stream is not safe for
+// concurrent use.
+type Stream struct {
+	reserve Reserver
+	chunk   int
+
+	publicID []byte // Modhex encoded
+	block    cipher.Block
+	tb       yubikey.TokenBlock
+
+	r         Reservation // Current reservation
+	remaining int         // OTPs left in r
+
+	buf    [yubikey.OTPSize]byte
+	rnd    [512]byte // Random values, refilled when exhausted
+	rndPos int
+}
+
+// NewStream returns a stream generating OTPs from t's secrets, reserving
+// chunk OTPs at a time with reserve.  If chunk is 0 a default is used.
+func NewStream(t *SoftToken, chunk int, reserve Reserver) (*Stream, error) {
+	if chunk <= 0 {
+		chunk = defaultStreamChunk
+	}
+
+	block, err := yubikey.NewCipher(t.AESKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Stream{
+		reserve:  reserve,
+		chunk:    chunk,
+		publicID: yubikey.AppendModHex(nil, t.PublicID),
+		block:    block,
+		rndPos:   len(Stream{}.rnd),
+	}
+	s.tb.UID = t.PrivateID
+
+	return s, nil
+}
+
+// NewStream returns a stream reserving OTPs directly from the token.  The
+// caller must save the token before using any OTP the stream generates.
+func (t *SoftToken) NewStream(chunk int) (*Stream, error) {
+	return NewStream(t, chunk, t.Reserve)
+}
+
+// OTPLen returns the length of the OTPs the stream generates
+func (s *Stream) OTPLen() int {
+	return len(s.publicID) + yubikey.OTPModHexSize
+}
+
+// Next appends the next OTP to dst, returning the extended buffer.  If dst
+// has at least OTPLen bytes spare capacity Next doesn't allocate, except
+// when reserving the next chunk.
+func (s *Stream) Next(dst []byte) ([]byte, error) {
+	return s.nextAt(dst, time.Now())
+}
+
+func (s *Stream) nextAt(dst []byte, now time.Time) ([]byte, error) {
+	if s.remaining == 0 {
+		r, err := s.reserve(s.chunk)
+		if err != nil {
+			return dst, err
+		}
+		s.r, s.remaining = r, r.Count
+	}
+
+	if s.rndPos+2 > len(s.rnd) {
+		if _, err := rand.Read(s.rnd[:]); err != nil {
+			return dst, fmt.Errorf("failed to generate random: %w", err)
+		}
+		s.rndPos = 0
+	}
+
+	// The 8Hz timer, as of the 8th of a second we're in
+	ticks := (now.UnixNano() - s.r.TimerBase*int64(time.Second)) / (int64(time.Second) / 8)
+
+	s.tb.Counter = s.r.Counter
+	s.tb.Session = s.r.Session
+	s.tb.Timestamp = timerValue(ticks, s.r.PonRand)
+	s.tb.Random = binary.LittleEndian.Uint16(s.rnd[s.rndPos:])
+	s.rndPos += 2
+
+	s.tb.EncryptTo(s.block, &s.buf)
+
+	dst = append(dst, s.publicID...)
+	dst = yubikey.AppendModHex(dst, s.buf[:])
+
+	// Step to the next OTP in the reservation
+	s.remaining--
+	if s.remaining > 0 {
+		s.r.Counter, s.r.Session, _ = nextOTP(s.r.Counter, s.r.Session)
+	}
+
+	return dst, nil
+}
+
+// GenerateN generates n OTPs, reserving them all up front
+func (t *SoftToken) GenerateN(n int) ([]string, error) {
+	return generateN(t, n, t.Reserve)
+}
+
+func generateN(t *SoftToken, n int, reserve Reserver) ([]string, error) {
+	if n <= 0 {
+		return nil, errors.New("n must be positive")
+	}
+
+	s, err := NewStream(t, n, reserve)
+	if err != nil {
+		return nil, err
+	}
+
+	otps := make([]string, n)
+	buf := make([]byte, 0, s.OTPLen())
+	for i := range otps {
+		buf, err = s.Next(buf[:0])
+		if err != nil {
+			return nil, err
+		}
+		otps[i] = string(buf)
+	}
+
+	return otps, nil
+}
+
+// NewStream returns a stream generating OTPs from the named token.  Each
+// chunk is reserved and saved through the manager before use.
+func (m *Manager) NewStream(name string, chunk int) (*Stream, error) {
+	t, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewStream(t, chunk, m.reserver(name))
+}
+
+// GenerateN generates n OTPs from the named token, reserving and saving
+// them all up front
+func (m *Manager) GenerateN(name string, n int) ([]string, error) {
+	t, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return generateN(t, n, m.reserver(name))
+}
+
+// reserver returns a Reserver taking reservations from the named token.
+// Each reservation is published as an EventReserved, so it can be audited.
+func (m *Manager) reserver(name string) Reserver {
+	return func(n int) (Reservation, error) {
+		var r Reservation
+		err := m.Update(name, func(t *SoftToken) error {
+			var err error
+			r, err = t.Reserve(n)
+			return err
+		})
+		if err != nil {
+			return r, err
+		}
+		m.publish(Event{Type: EventReserved, Name: name, Counter: r.Counter, Session: r.Session, Count: r.Count})
+		return r, nil
+	}
+}
@@ -0,0 +1,271 @@
+package token
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// strictValidator accepts OTPs only if their counters strictly increase,
+// and their timestamps don't go backwards within a power-up
+type strictValidator struct {
+	t        *testing.T
+	token    *SoftToken
+	accepted int
+
+	counter   uint16
+	session   uint8
+	timestamp uint32
+}
+
+func (v *strictValidator) validate(otp string) {
+	v.t.Helper()
+
+	publicID, block, err := yubikey.ParseOTP(otp, v.token.AESKey[:])
+	if err != nil {
+		v.t.Fatalf("OTP %d: %v", v.accepted, err)
+	}
+	if !bytes.Equal(publicID, v.token.PublicID) {
+		v.t.Fatalf("OTP %d: public ID mismatch", v.accepted)
+	}
+	if block.UID != v.token.PrivateID {
+		v.t.Fatalf("OTP %d: private ID mismatch", v.accepted)
+	}
+
+	if v.accepted > 0 {
+		if block.Counter < v.counter || (block.Counter == v.counter && block.Session <= v.session) {
+			v.t.Fatalf("OTP %d: replayed, %d/%d after %d/%d",
+				v.accepted, block.Counter, block.Session, v.counter, v.session)
+		}
+		if block.Counter == v.counter && block.Timestamp < v.timestamp {
+			v.t.Fatalf("OTP %d: timestamp went backwards, %d after %d",
+				v.accepted, block.Timestamp, v.timestamp)
+		}
+	}
+
+	v.counter, v.session, v.timestamp = block.Counter, block.Session, block.Timestamp
+	v.accepted++
+}
+
+func TestReserveMatchesGenerateOTP(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	tok.Session = 0xfc // Reservation spans a session wrap
+
+	reference := tok.Clone()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := reference.generateAt(now.Add(time.Duration(i) * time.Second)); err != nil {
+			t.Fatalf("generateAt failed: %v", err)
+		}
+	}
+
+	r, err := tok.Reserve(5)
+	if err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+
+	if r.Counter != 1 || r.Session != 0xfd || r.Count != 5 {
+		t.Errorf("Reservation = %+v, expected counter 1, session 0xfd, count 5", r)
+	}
+	if tok.Counter != reference.Counter || tok.Session != reference.Session {
+		t.Errorf("Counters after Reserve = %d/%d, expected %d/%d",
+			tok.Counter, tok.Session, reference.Counter, reference.Session)
+	}
+}
+
+func TestReserveExhausted(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	tok.Counter = 0x7fff
+	tok.Session = 0xfe
+	before := tok.Clone()
+
+	if _, err := tok.Reserve(2); !errors.Is(err, ErrCounterExhausted) {
+		t.Errorf("Reserve = %v, expected ErrCounterExhausted", err)
+	}
+	if tok.Counter != before.Counter || tok.Session != before.Session {
+		t.Error("Failed Reserve changed token counters")
+	}
+
+	if _, err := tok.Reserve(1); err != nil {
+		t.Errorf("Reserving the last OTP failed: %v", err)
+	}
+}
+
+func TestGenerateNStrictlyValid(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	v := &strictValidator{t: t, token: tok.Clone()}
+
+	// Enough OTPs to wrap the session counter several times
+	otps, err := tok.GenerateN(1000)
+	if err != nil {
+		t.Fatalf("GenerateN failed: %v", err)
+	}
+	for _, otp := range otps {
+		v.validate(otp)
+	}
+
+	// Normal generation carries on where the batch left off
+	for i := 0; i < 3; i++ {
+		otp, err := tok.GenerateOTP()
+		if err != nil {
+			t.Fatalf("GenerateOTP failed: %v", err)
+		}
+		v.validate(otp)
+	}
+}
+
+func TestStreamAcrossChunks(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	v := &strictValidator{t: t, token: tok.Clone()}
+
+	s, err := tok.NewStream(7)
+	if err != nil {
+		t.Fatalf("NewStream failed: %v", err)
+	}
+
+	var buf []byte
+	for i := 0; i < 50; i++ {
+		buf, err = s.Next(buf[:0])
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if len(buf) != s.OTPLen() {
+			t.Errorf("OTP length = %d, expected %d", len(buf), s.OTPLen())
+		}
+		v.validate(string(buf))
+	}
+}
+
+func TestStreamNoAllocs(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+
+	s, err := tok.NewStream(10000)
+	if err != nil {
+		t.Fatalf("NewStream failed: %v", err)
+	}
+	buf := make([]byte, 0, s.OTPLen())
+
+	// Take the reservation before measuring
+	if buf, err = s.Next(buf[:0]); err != nil {
+		t.Fatalf("Next failed: %v", err)
+	}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		buf, _ = s.Next(buf[:0])
+	})
+	if allocs != 0 {
+		t.Errorf("Next made %.2f allocations per OTP, expected 0", allocs)
+	}
+}
+
+func TestManagerGenerateN(t *testing.T) {
+	m := newTestManager(t, "a")
+	before, _ := m.Get("a")
+
+	otps, err := m.GenerateN("a", 300)
+	if err != nil {
+		t.Fatalf("GenerateN failed: %v", err)
+	}
+
+	v := &strictValidator{t: t, token: before}
+	for _, otp := range otps {
+		v.validate(otp)
+	}
+
+	// The reservation must have been saved before the OTPs were returned
+	loaded, err := Load(filepath.Join(m.Dir(), "a"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if loaded.Counter != v.counter || loaded.Session != v.session {
+		t.Errorf("Saved counters = %d/%d, expected %d/%d",
+			loaded.Counter, loaded.Session, v.counter, v.session)
+	}
+}
+
+// BenchmarkGenerateOTP measures generating OTPs one at a time, with a new
+// cipher for each.  The clock is advanced so rate limiting never sleeps.
+func BenchmarkGenerateOTP(b *testing.B) {
+	tok, err := New()
+	if err != nil {
+		b.Fatalf("Failed to create new token: %v", err)
+	}
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if tok.Counter >= 0x7ffe {
+			tok.Counter = 1
+		}
+		if _, err := tok.generateAt(now.Add(time.Duration(i) * time.Second)); err != nil {
+			b.Fatalf("generateAt failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkStream measures generating OTPs from a Stream
+func BenchmarkStream(b *testing.B) {
+	tok, err := New()
+	if err != nil {
+		b.Fatalf("Failed to create new token: %v", err)
+	}
+
+	s, err := tok.NewStream(0)
+	if err != nil {
+		b.Fatalf("NewStream failed: %v", err)
+	}
+	buf := make([]byte, 0, s.OTPLen())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if tok.Counter >= 0x7ffe {
+			tok.Counter = 1
+		}
+		if buf, err = s.Next(buf[:0]); err != nil {
+			b.Fatalf("Next failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkGenerateN measures generating batches of 1000, reporting the
+// cost of each OTP as well as each batch
+func BenchmarkGenerateN(b *testing.B) {
+	const batch = 1000
+	tok, err := New()
+	if err != nil {
+		b.Fatalf("Failed to create new token: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if tok.Counter >= 0x7000 {
+			tok.Counter = 1
+		}
+		if _, err := tok.GenerateN(batch); err != nil {
+			b.Fatalf("GenerateN failed: %v", err)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*batch), "ns/otp")
+}
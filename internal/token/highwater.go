@@ -0,0 +1,231 @@
+package token
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/arr2036/yksofttoken/internal/fsutil"
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// Mark is the highest counter and session saved for a token
+type Mark struct {
+	Counter uint16
+	Session uint8
+}
+
+// RollbackError indicates a token's counters are behind its high-water
+// mark, so it would generate OTPs a validation server has already seen
+type RollbackError struct {
+	PublicID string
+	Counter  uint16
+	Session  uint8
+	Mark     Mark
+}
+
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("token '%s' counter %d/%d is behind %d/%d, the highest it has reached, "+
+		"it may have been restored from a backup", e.PublicID, e.Counter, e.Session, e.Mark.Counter, e.Mark.Session)
+}
+
+// Marks is a directory of high-water marks, one file per token, recording
+// the highest counters saved for each token outside the token directory, so
+// a token restored from an old backup or snapshot is detected.  A Manager
+// keeps them if it's given them with WithMarks.  A nil *Marks keeps none.
+// It's safe for concurrent use.
+type Marks struct {
+	dir string
+	mu  sync.Mutex // Serializes raising marks in this process
+}
+
+// DefaultMarksDir returns the directory high-water marks are kept in by
+// default, in the user's configuration directory rather than alongside
+// the tokens, so it isn't restored with them
+func DefaultMarksDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "yksoft", "highwater"), nil
+}
+
+// NewMarks returns the high-water marks kept in dir
+func NewMarks(dir string) *Marks {
+	return &Marks{dir: dir}
+}
+
+// path returns the file holding t's mark.  Tokens are identified by their
+// public ID alone, as the validation server identifies them, so a token
+// given new secrets, by rotating its key or replacing it with a successor
+// keeping its public ID, keeps its mark.
+func (ms *Marks) path(t *SoftToken) string {
+	return filepath.Join(ms.dir, yubikey.ModHexEncode(t.PublicID)+".mark")
+}
+
+// Get returns t's mark, and false if it doesn't have one
+func (ms *Marks) Get(t *SoftToken) (Mark, bool, error) {
+	file, err := os.Open(ms.path(t))
+	if errors.Is(err, os.ErrNotExist) {
+		return Mark{}, false, nil
+	}
+	if err != nil {
+		return Mark{}, false, err
+	}
+	defer file.Close()
+
+	var mark Mark
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+
+		switch strings.TrimSpace(parts[0]) {
+		case CounterField:
+			counter, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return Mark{}, false, fmt.Errorf("invalid high-water mark counter: %w", err)
+			}
+			mark.Counter = uint16(counter)
+		case SessionField:
+			session, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return Mark{}, false, fmt.Errorf("invalid high-water mark session: %w", err)
+			}
+			mark.Session = uint8(session)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Mark{}, false, err
+	}
+	return mark, true, nil
+}
+
+// Raise raises t's mark to its counters, if they're ahead of it
+func (ms *Marks) Raise(t *SoftToken) error {
+	if ms == nil {
+		return nil
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	mark, ok, err := ms.Get(t)
+	if err != nil {
+		return err
+	}
+	if ok && !markAhead(t, mark) {
+		return nil
+	}
+
+	if err := os.MkdirAll(ms.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create high-water mark directory: %w", err)
+	}
+	data := fmt.Sprintf("%s: %d\n%s: %d\n", CounterField, t.Counter, SessionField, t.Session)
+	return fsutil.WriteFileAtomic(ms.path(t), []byte(data))
+}
+
+// Check returns a *RollbackError if t's counters are behind its mark
+func (ms *Marks) Check(t *SoftToken) error {
+	if ms == nil {
+		return nil
+	}
+
+	mark, ok, err := ms.Get(t)
+	if err != nil || !ok {
+		return err
+	}
+	if t.Counter < mark.Counter || (t.Counter == mark.Counter && t.Session < mark.Session) {
+		return &RollbackError{
+			PublicID: yubikey.ModHexEncode(t.PublicID),
+			Counter:  t.Counter,
+			Session:  t.Session,
+			Mark:     mark,
+		}
+	}
+	return nil
+}
+
+// markAhead returns true if t's counters are ahead of mark
+func markAhead(t *SoftToken, mark Mark) bool {
+	return t.Counter > mark.Counter || (t.Counter == mark.Counter && t.Session > mark.Session)
+}
+
+// JumpPast moves the token's counter past mark, so every OTP it generates
+// from then on is newer than any generated up to the mark
+func (t *SoftToken) JumpPast(mark Mark) error {
+	if mark.Counter >= maxCounter {
+		return ErrCounterExhausted
+	}
+	if t.Counter <= mark.Counter {
+		t.Counter = mark.Counter + 1
+		t.Session = 0
+	}
+	return nil
+}
+
+// JumpCounter moves the named token's counter past its high-water mark,
+// after loading it failed with a *RollbackError, and saves it
+func (m *Manager) JumpCounter(name string) error {
+	if m.marks == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	v, locked := m.vault, m.locked
+	mt := m.tokens[name]
+	m.mu.Unlock()
+	if locked {
+		return ErrLocked
+	}
+
+	// A token loaded before it was rolled back is updated too
+	if mt != nil {
+		mt.mu.Lock()
+	}
+	t, err := m.jumpCounter(name, v)
+	if err == nil && mt != nil {
+		mt.token = t.Clone()
+	}
+	if mt != nil {
+		mt.mu.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+
+	m.publish(Event{Type: EventReloaded, Name: name, Counter: t.Counter, Session: t.Session})
+	return nil
+}
+
+func (m *Manager) jumpCounter(name string, v *Vault) (*SoftToken, error) {
+	unlock, err := m.store.Lock(name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	t, err := readRecord(m.store, name, v)
+	if err != nil {
+		return nil, err
+	}
+
+	mark, ok, err := m.marks.Get(t)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if err := t.JumpPast(mark); err != nil {
+			return nil, err
+		}
+	}
+	return t, saveRecord(m.store, name, t, v, m.marks)
+}
@@ -0,0 +1,184 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+// newMarksManager returns a manager keeping high-water marks in a
+// temporary directory, with a new token for each name
+func newMarksManager(t *testing.T, names ...string) (*Manager, *Marks) {
+	t.Helper()
+	marks := NewMarks(t.TempDir())
+	m := NewManager(t.TempDir(), WithMarks(marks))
+	for _, name := range names {
+		tok, err := New()
+		if err != nil {
+			t.Fatalf("Failed to create new token: %v", err)
+		}
+		if err := m.Create(name, tok); err != nil {
+			t.Fatalf("Create(%s) failed: %v", name, err)
+		}
+	}
+	return m, marks
+}
+
+func TestHighWaterRollback(t *testing.T) {
+	m, marks := newMarksManager(t, "a")
+	path := GetTokenPath(m.Dir(), "a")
+	backup, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read token: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := m.PowerCycle("a"); err != nil {
+			t.Fatalf("Failed to power cycle: %v", err)
+		}
+	}
+	tok, err := m.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	mark, ok, err := marks.Get(tok)
+	if err != nil || !ok || mark.Counter != tok.Counter || mark.Session != tok.Session {
+		t.Fatalf("Mark is %+v, %v, %v, expected %d/%d", mark, ok, err, tok.Counter, tok.Session)
+	}
+
+	// Restoring the backup is detected
+	if err := os.WriteFile(path, backup, 0600); err != nil {
+		t.Fatalf("Failed to restore token: %v", err)
+	}
+	_, err = NewManager(m.Dir(), WithMarks(marks)).Get("a")
+	var rollbackErr *RollbackError
+	if !errors.As(err, &rollbackErr) {
+		t.Fatalf("Loading a rolled back token gave %v, expected a RollbackError", err)
+	}
+	if rollbackErr.Mark != mark || rollbackErr.Counter != 1 {
+		t.Errorf("RollbackError %+v doesn't match mark %+v", rollbackErr, mark)
+	}
+	if _, err := NewManager(m.Dir()).Get("a"); err != nil {
+		t.Errorf("Getting a rolled back token without marks gave %v", err)
+	}
+
+	// Saving at a lower counter doesn't lower the mark
+	restored, err := readRecord(m.Store(), "a", nil)
+	if err != nil {
+		t.Fatalf("Failed to load token: %v", err)
+	}
+	if err := saveRecord(m.Store(), "a", restored, nil, marks); err != nil {
+		t.Fatalf("Failed to save token: %v", err)
+	}
+	if after, _, _ := marks.Get(tok); after != mark {
+		t.Errorf("Mark lowered to %+v", after)
+	}
+
+	// A token with the same public ID but new secrets shares the mark, as
+	// the validation server still has the old token's counters
+	successor, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	successor.PublicID = tok.PublicID
+	if err := saveRecord(m.Store(), "a", successor, nil, marks); err != nil {
+		t.Fatalf("Failed to save token: %v", err)
+	}
+	if _, err := loadRecord(m.Store(), "a", nil, marks); !errors.As(err, &rollbackErr) {
+		t.Errorf("Loading a successor behind the mark gave %v, expected a RollbackError", err)
+	}
+}
+
+func TestHighWaterKeyRotation(t *testing.T) {
+	m, marks := newMarksManager(t, "a")
+	if err := m.PowerCycle("a"); err != nil {
+		t.Fatalf("Failed to power cycle: %v", err)
+	}
+	before, err := m.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+
+	for _, step := range []func(*SoftToken) error{(*SoftToken).StageKey, (*SoftToken).SwitchKey, (*SoftToken).CommitKey} {
+		if err := m.Update("a", step); err != nil {
+			t.Fatalf("Failed to rotate key: %v", err)
+		}
+	}
+	after, err := m.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	if after.AESKey == before.AESKey {
+		t.Fatal("Key wasn't rotated")
+	}
+
+	// The new key carries on from the old key's mark
+	mark, ok, err := marks.Get(after)
+	if err != nil || !ok || mark.Counter != before.Counter || mark.Session != before.Session {
+		t.Errorf("Mark after key rotation is %+v, %v, %v, expected %d/%d", mark, ok, err, before.Counter, before.Session)
+	}
+	if entries, err := os.ReadDir(marks.dir); err != nil || len(entries) != 1 {
+		t.Errorf("Found %d marks, %v, expected the token's one", len(entries), err)
+	}
+}
+
+func TestManagerJumpCounter(t *testing.T) {
+	m, marks := newMarksManager(t, "a")
+	path := GetTokenPath(m.Dir(), "a")
+
+	backup, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read token: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := m.PowerCycle("a"); err != nil {
+			t.Fatalf("Failed to power cycle: %v", err)
+		}
+	}
+	if _, err := m.Generate(context.Background(), "a"); err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+	used, err := m.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+
+	if err := os.WriteFile(path, backup, 0600); err != nil {
+		t.Fatalf("Failed to restore token: %v", err)
+	}
+	fresh := NewManager(m.Dir(), WithMarks(marks))
+	var rollbackErr *RollbackError
+	if _, err := fresh.Get("a"); !errors.As(err, &rollbackErr) {
+		t.Fatalf("Getting a rolled back token gave %v, expected a RollbackError", err)
+	}
+
+	rec := &eventRecorder{}
+	fresh.Subscribe(rec.record)
+	if err := fresh.JumpCounter("a"); err != nil {
+		t.Fatalf("Failed to jump counter: %v", err)
+	}
+	jumped, err := fresh.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token after jumping its counter: %v", err)
+	}
+	if jumped.Counter <= used.Counter {
+		t.Errorf("Counter jumped to %d, expected past %d", jumped.Counter, used.Counter)
+	}
+	if rec.count(EventReloaded) != 1 {
+		t.Errorf("Expected 1 EventReloaded, got %d", rec.count(EventReloaded))
+	}
+}
+
+func TestJumpPastExhausted(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	if err := tok.JumpPast(Mark{Counter: maxCounter}); !errors.Is(err, ErrCounterExhausted) {
+		t.Errorf("Jumping past the last counter gave %v, expected ErrCounterExhausted", err)
+	}
+	if err := tok.JumpPast(Mark{Counter: 10, Session: 200}); err != nil || tok.Counter != 11 || tok.Session != 0 {
+		t.Errorf("Jumped to %d/%d, %v, expected 11/0", tok.Counter, tok.Session, err)
+	}
+}
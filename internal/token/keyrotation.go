@@ -0,0 +1,188 @@
+package token
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+var (
+	// ErrKeyRotationInProgress indicates a key is already staged, or a
+	// switch hasn't been committed
+	ErrKeyRotationInProgress = errors.New("key rotation already in progress")
+	// ErrNoStagedKey indicates there's no staged key to switch to or discard
+	ErrNoStagedKey = errors.New("no staged key")
+	// ErrNoPreviousKey indicates there's no switch to commit or roll back
+	ErrNoPreviousKey = errors.New("no previous key")
+)
+
+// KeySet is a private ID and AES key, which are registered together
+type KeySet struct {
+	PrivateID [yubikey.UIDSize]byte
+	AESKey    [yubikey.KeySize]byte
+}
+
+// KeyRotationState is how far through a two-phase key rotation a token is
+type KeyRotationState int
+
+const (
+	// KeyRotationNone means no key rotation is in progress
+	KeyRotationNone KeyRotationState = iota
+	// KeyRotationStaged means a new key is staged, but not yet used
+	KeyRotationStaged
+	// KeyRotationSwitched means the new key is in use, and the old one is
+	// kept for rollback
+	KeyRotationSwitched
+)
+
+func (s KeyRotationState) String() string {
+	switch s {
+	case KeyRotationStaged:
+		return "staged"
+	case KeyRotationSwitched:
+		return "switched"
+	default:
+		return "none"
+	}
+}
+
+// KeyRotationState returns how far through a key rotation the token is
+func (t *SoftToken) KeyRotationState() KeyRotationState {
+	switch {
+	case t.PreviousKey != nil:
+		return KeyRotationSwitched
+	case t.StagedKey != nil:
+		return KeyRotationStaged
+	default:
+		return KeyRotationNone
+	}
+}
+
+// StageKey generates a new private ID and AES key, and stages them
+// alongside the active ones.  OTPs are still generated with the active
+// key until SwitchKey is called.
+func (t *SoftToken) StageKey() error {
+	if t.KeyRotationState() != KeyRotationNone {
+		return ErrKeyRotationInProgress
+	}
+
+	staged := &KeySet{}
+	if _, err := rand.Read(staged.PrivateID[:]); err != nil {
+		return fmt.Errorf("failed to generate private ID: %w", err)
+	}
+	if _, err := rand.Read(staged.AESKey[:]); err != nil {
+		return fmt.Errorf("failed to generate AES key: %w", err)
+	}
+
+	t.StagedKey = staged
+	return nil
+}
+
+// StagedRegistrationInfo returns the registration information the token
+// will have once it switches to its staged key
+func (t *SoftToken) StagedRegistrationInfo() (string, error) {
+	if t.StagedKey == nil {
+		return "", ErrNoStagedKey
+	}
+
+	return fmt.Sprintf("%s, %s, %s", yubikey.ModHexEncode(t.PublicID),
+		yubikey.HexEncode(t.StagedKey.PrivateID[:]), yubikey.HexEncode(t.StagedKey.AESKey[:])), nil
+}
+
+// SwitchKey makes the staged key active, keeping the old one so the switch
+// can be rolled back.  The counters carry on, so a validator that tracks
+// them by public ID accepts OTPs from the new key once it's registered.
+func (t *SoftToken) SwitchKey() error {
+	if t.PreviousKey != nil {
+		return ErrKeyRotationInProgress
+	}
+	if t.StagedKey == nil {
+		return ErrNoStagedKey
+	}
+
+	t.PreviousKey = &KeySet{PrivateID: t.PrivateID, AESKey: t.AESKey}
+	t.PrivateID, t.AESKey = t.StagedKey.PrivateID, t.StagedKey.AESKey
+	t.StagedKey = nil
+	return nil
+}
+
+// RollbackKey switches back to the previous key.  The new key is staged
+// again, so the switch can be retried.
+func (t *SoftToken) RollbackKey() error {
+	if t.PreviousKey == nil {
+		return ErrNoPreviousKey
+	}
+
+	t.StagedKey = &KeySet{PrivateID: t.PrivateID, AESKey: t.AESKey}
+	t.PrivateID, t.AESKey = t.PreviousKey.PrivateID, t.PreviousKey.AESKey
+	t.PreviousKey = nil
+	return nil
+}
+
+// CommitKey discards the previous key, completing the rotation
+func (t *SoftToken) CommitKey() error {
+	if t.PreviousKey == nil {
+		return ErrNoPreviousKey
+	}
+
+	t.PreviousKey = nil
+	return nil
+}
+
+// DiscardKey discards the staged key, abandoning the rotation
+func (t *SoftToken) DiscardKey() error {
+	if t.StagedKey == nil || t.PreviousKey != nil {
+		return ErrNoStagedKey
+	}
+
+	t.StagedKey = nil
+	return nil
+}
+
+// keySetFields accumulates a KeySet's fields as they're loaded
+type keySetFields struct {
+	set                  KeySet
+	hasPrivateID, hasKey bool
+}
+
+func (f *keySetFields) setPrivateID(value string) error {
+	decoded, err := yubikey.HexDecode(value)
+	if err != nil {
+		return err
+	}
+	if len(decoded) != yubikey.UIDSize {
+		return yubikey.ErrInvalidLength
+	}
+	copy(f.set.PrivateID[:], decoded)
+	f.hasPrivateID = true
+	return nil
+}
+
+func (f *keySetFields) setAESKey(value string) error {
+	decoded, err := yubikey.HexDecode(value)
+	if err != nil {
+		return err
+	}
+	if len(decoded) != yubikey.KeySize {
+		return yubikey.ErrInvalidLength
+	}
+	copy(f.set.AESKey[:], decoded)
+	f.hasKey = true
+	return nil
+}
+
+// keySet returns the loaded KeySet, nil if none was loaded, or an error if
+// only half of one was
+func (f *keySetFields) keySet() (*KeySet, error) {
+	switch {
+	case f.hasPrivateID && f.hasKey:
+		set := f.set
+		return &set, nil
+	case f.hasPrivateID || f.hasKey:
+		return nil, errors.New("private ID and AES key must both be present")
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,159 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// checkKey checks the token's next OTP decrypts with key, and has privateID
+func checkKey(t *testing.T, tok *SoftToken, keys KeySet) {
+	t.Helper()
+
+	otp, err := tok.GenerateOTP()
+	if err != nil {
+		t.Fatalf("GenerateOTP failed: %v", err)
+	}
+	_, block, err := yubikey.ParseOTP(otp, keys.AESKey[:])
+	if err != nil {
+		t.Fatalf("OTP doesn't decrypt with the expected key: %v", err)
+	}
+	if block.UID != keys.PrivateID {
+		t.Errorf("OTP private ID = %x, expected %x", block.UID, keys.PrivateID)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	oldKeys := KeySet{PrivateID: tok.PrivateID, AESKey: tok.AESKey}
+
+	// reload saves and loads the token, as the pending state must persist
+	reload := func() {
+		t.Helper()
+		if err := tok.Save(path); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		if tok, err = Load(path); err != nil {
+			t.Fatalf("Load failed: %v", err)
+		}
+	}
+
+	if err := tok.StageKey(); err != nil {
+		t.Fatalf("StageKey failed: %v", err)
+	}
+	reload()
+	if tok.KeyRotationState() != KeyRotationStaged {
+		t.Fatalf("State = %s, expected staged", tok.KeyRotationState())
+	}
+	newKeys := *tok.StagedKey
+
+	info, err := tok.StagedRegistrationInfo()
+	if err != nil {
+		t.Fatalf("StagedRegistrationInfo failed: %v", err)
+	}
+	if !strings.HasSuffix(info, yubikey.HexEncode(newKeys.AESKey[:])) {
+		t.Errorf("StagedRegistrationInfo = %s, expected the staged key", info)
+	}
+
+	// Still generating with the old key
+	checkKey(t, tok, oldKeys)
+
+	if err := tok.SwitchKey(); err != nil {
+		t.Fatalf("SwitchKey failed: %v", err)
+	}
+	reload()
+	if tok.KeyRotationState() != KeyRotationSwitched {
+		t.Fatalf("State = %s, expected switched", tok.KeyRotationState())
+	}
+	checkKey(t, tok, newKeys)
+
+	if err := tok.RollbackKey(); err != nil {
+		t.Fatalf("RollbackKey failed: %v", err)
+	}
+	reload()
+	if tok.KeyRotationState() != KeyRotationStaged {
+		t.Fatalf("State after rollback = %s, expected staged", tok.KeyRotationState())
+	}
+	checkKey(t, tok, oldKeys)
+
+	if err := tok.SwitchKey(); err != nil {
+		t.Fatalf("SwitchKey failed: %v", err)
+	}
+	if err := tok.CommitKey(); err != nil {
+		t.Fatalf("CommitKey failed: %v", err)
+	}
+	reload()
+	if tok.KeyRotationState() != KeyRotationNone {
+		t.Fatalf("State after commit = %s, expected none", tok.KeyRotationState())
+	}
+	checkKey(t, tok, newKeys)
+	if err := tok.RollbackKey(); !errors.Is(err, ErrNoPreviousKey) {
+		t.Errorf("RollbackKey after commit = %v, expected ErrNoPreviousKey", err)
+	}
+}
+
+func TestKeyRotationStateErrors(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+
+	if err := tok.SwitchKey(); !errors.Is(err, ErrNoStagedKey) {
+		t.Errorf("SwitchKey without a staged key = %v, expected ErrNoStagedKey", err)
+	}
+	if err := tok.CommitKey(); !errors.Is(err, ErrNoPreviousKey) {
+		t.Errorf("CommitKey without a switch = %v, expected ErrNoPreviousKey", err)
+	}
+
+	if err := tok.StageKey(); err != nil {
+		t.Fatalf("StageKey failed: %v", err)
+	}
+	if err := tok.StageKey(); !errors.Is(err, ErrKeyRotationInProgress) {
+		t.Errorf("Second StageKey = %v, expected ErrKeyRotationInProgress", err)
+	}
+
+	// Clones don't share the staged key
+	c := tok.Clone()
+	c.StagedKey.AESKey[0] ^= 0xff
+	if c.StagedKey.AESKey == tok.StagedKey.AESKey {
+		t.Error("Clone shares the staged key")
+	}
+
+	if err := tok.DiscardKey(); err != nil {
+		t.Fatalf("DiscardKey failed: %v", err)
+	}
+	if tok.KeyRotationState() != KeyRotationNone {
+		t.Errorf("State after discard = %s, expected none", tok.KeyRotationState())
+	}
+}
+
+func TestLoadIncompleteKeySet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	if err := tok.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("Failed to open token file: %v", err)
+	}
+	fmt.Fprintf(f, "%s: 000102030405060708090a0b0c0d0e0f\n", StagedAESKeyField)
+	f.Close()
+
+	if _, err := Load(path); err == nil {
+		t.Error("Load accepted a staged key without a private ID")
+	}
+}
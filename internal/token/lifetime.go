@@ -0,0 +1,42 @@
+package token
+
+import "fmt"
+
+// maxCounter is the highest use counter a token can reach
+const maxCounter = 0x7fff
+
+// Lifetime is how much use a token has left before its use counter is
+// exhausted, and it must be replaced
+type Lifetime struct {
+	PowerUps int // Power-ups remaining
+	OTPs     int // OTPs remaining, if the token is never power cycled
+}
+
+// Lifetime returns the token's remaining lifetime.  Each power-up uses a
+// counter value, as does each wrap of the session counter.
+func (t *SoftToken) Lifetime() Lifetime {
+	if t.Counter >= maxCounter {
+		return Lifetime{OTPs: int(0xff - t.Session)}
+	}
+
+	powerUps := maxCounter - int(t.Counter)
+	return Lifetime{
+		PowerUps: powerUps,
+		OTPs:     int(0xff-t.Session) + powerUps*0xff,
+	}
+}
+
+// Exhausted returns true if no more OTPs can be generated
+func (l Lifetime) Exhausted() bool {
+	return l.OTPs == 0
+}
+
+// Low returns true if either the power-ups or OTPs remaining are at or
+// below the policy's warning thresholds
+func (l Lifetime) Low(p Policy) bool {
+	return l.PowerUps <= p.WarnPowerUps || l.OTPs <= p.WarnOTPs
+}
+
+func (l Lifetime) String() string {
+	return fmt.Sprintf("%d power-ups, %d OTPs remaining", l.PowerUps, l.OTPs)
+}
@@ -0,0 +1,67 @@
+package token
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLifetime(t *testing.T) {
+	tests := []struct {
+		counter  uint16
+		session  uint8
+		powerUps int
+		otps     int
+	}{
+		{1, 0, 0x7ffe, 0xff + 0x7ffe*0xff},
+		{0x7ffe, 0xff, 1, 0xff},
+		{0x7fff, 0xfe, 0, 1},
+		{0x7fff, 0xff, 0, 0},
+	}
+
+	for _, tt := range tests {
+		tok := &SoftToken{Counter: tt.counter, Session: tt.session}
+		l := tok.Lifetime()
+		if l.PowerUps != tt.powerUps || l.OTPs != tt.otps {
+			t.Errorf("Lifetime(%04x/%02x) = %+v, expected %d power-ups, %d OTPs",
+				tt.counter, tt.session, l, tt.powerUps, tt.otps)
+		}
+		if l.Exhausted() != (tt.otps == 0) {
+			t.Errorf("Lifetime(%04x/%02x).Exhausted() = %v", tt.counter, tt.session, l.Exhausted())
+		}
+	}
+}
+
+func TestLifetimeMatchesGeneration(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	tok.Counter = 0x7ffe
+	tok.Session = 0xf0
+
+	remaining := tok.Lifetime().OTPs
+	r, err := tok.Reserve(remaining)
+	if err != nil {
+		t.Fatalf("Reserving the remaining %d OTPs failed: %v", remaining, err)
+	}
+	if r.Count != remaining || !tok.Lifetime().Exhausted() {
+		t.Errorf("Lifetime after reserving everything = %+v, expected exhausted", tok.Lifetime())
+	}
+	if _, err := tok.Reserve(1); !errors.Is(err, ErrCounterExhausted) {
+		t.Errorf("Reserve on exhausted token = %v, expected ErrCounterExhausted", err)
+	}
+}
+
+func TestLifetimeLow(t *testing.T) {
+	p := Policy{WarnPowerUps: 10, WarnOTPs: 100}
+
+	if (Lifetime{PowerUps: 11, OTPs: 3000}).Low(p) {
+		t.Error("Lifetime above both thresholds is low")
+	}
+	if !(Lifetime{PowerUps: 10, OTPs: 3000}).Low(p) {
+		t.Error("Lifetime at the power-up threshold isn't low")
+	}
+	if !(Lifetime{PowerUps: 500, OTPs: 99}).Low(p) {
+		t.Error("Lifetime below the OTP threshold isn't low")
+	}
+}
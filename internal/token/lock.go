@@ -0,0 +1,121 @@
+package token
+
+import (
+	"fmt"
+)
+
+// Locked returns true if the manager is locked
+func (m *Manager) Locked() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.locked
+}
+
+// Encrypted returns true if the manager's token directory is encrypted
+func (m *Manager) Encrypted() bool {
+	return IsEncrypted(m.dir)
+}
+
+// Lock drops every loaded token, zeroing its secrets, and closes the
+// vault.  Until Unlock is called every operation on a token fails with
+// ErrLocked.  Operations in progress are finished first.
+func (m *Manager) Lock() {
+	m.mu.Lock()
+	tokens, v := m.tokens, m.vault
+	m.tokens = make(map[string]*managedToken)
+	m.vault = nil
+	m.locked = true
+	m.mu.Unlock()
+
+	for _, mt := range tokens {
+		mt.mu.Lock()
+		mt.token.wipe()
+		mt.deleted = true
+		mt.mu.Unlock()
+	}
+	if v != nil {
+		v.Close()
+	}
+}
+
+// Unlock unlocks the manager.  If the token directory is encrypted its
+// vault is opened with passphrase, otherwise passphrase is ignored.
+func (m *Manager) Unlock(passphrase string) error {
+	var v *Vault
+	if m.Encrypted() {
+		var err error
+		if v, err = OpenVault(m.dir, passphrase); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vault != nil {
+		m.vault.Close()
+	}
+	m.vault = v
+	m.locked = false
+	return nil
+}
+
+// Encrypt creates a vault for the token directory with passphrase, and
+// encrypts every token in it, including successors and retired tokens
+func (m *Manager) Encrypt(passphrase string) error {
+	if m.Locked() {
+		return ErrLocked
+	}
+
+	v, err := CreateVault(m.dir, passphrase)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.vault = v
+	m.mu.Unlock()
+
+	names, err := m.Names()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		mt, err := m.get(name)
+		if err != nil {
+			return err
+		}
+		mt.mu.Lock()
+		err = m.save(mt.token, name)
+		mt.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to encrypt token '%s': %w", name, err)
+		}
+	}
+
+	// Successors and retired tokens hold secrets too
+	records, err := m.store.List()
+	if err != nil {
+		return err
+	}
+	for _, name := range records {
+		if !isHidden(name) {
+			continue
+		}
+		t, err := readRecord(m.store, name, v)
+		if err != nil {
+			return fmt.Errorf("failed to load '%s': %w", name, err)
+		}
+		if err := m.save(t, name); err != nil {
+			return fmt.Errorf("failed to encrypt '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// errGone returns the error for a token that was deleted, or dropped by
+// Lock, while an operation waited for it
+func (m *Manager) errGone(name string) error {
+	if m.Locked() {
+		return ErrLocked
+	}
+	return fmt.Errorf("%w: '%s'", ErrTokenNotFound, name)
+}
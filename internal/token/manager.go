@@ -0,0 +1,558 @@
+package token
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTokenExists indicates a token with the same name already exists
+	ErrTokenExists = errors.New("token already exists")
+	// ErrTokenNotFound indicates no token with the given name exists
+	ErrTokenNotFound = errors.New("token not found")
+	// ErrStaleToken indicates a token's counters on disk have moved ahead
+	// of the manager's copy, e.g. because the CLI used it, so saving would
+	// roll them back
+	ErrStaleToken = errors.New("token changed on disk")
+	// ErrOutsideRange indicates a token's next OTP would be outside the
+	// counter range it was limited to
+	ErrOutsideRange = errors.New("counter outside range")
+)
+
+// EventType identifies the kind of change an Event describes
+type EventType int
+
+const (
+	// EventAdded is published when a token is created
+	EventAdded EventType = iota
+	// EventRemoved is published when a token is deleted
+	EventRemoved
+	// EventCounterChanged is published when a token's counter or session changes
+	EventCounterChanged
+	// EventRotated is published when a token is replaced by its successor
+	EventRotated
+	// EventReplaced is published when a token is replaced with Replace
+	EventReplaced
+	// EventReloaded is published when a token is reloaded after something
+	// other than the manager changed it on disk
+	EventReloaded
+	// EventGenerated is published when an OTP is generated, after the
+	// EventCounterChanged for it
+	EventGenerated
+	// EventReserved is published when OTPs are reserved for generating in
+	// bulk, after the EventCounterChanged for them
+	EventReserved
+)
+
+// Event describes a change to a token owned by a Manager
+type Event struct {
+	Type    EventType
+	Name    string // Token name
+	Counter uint16 // Use counter after the change, or of the first OTP reserved
+	Session uint8  // Session counter after the change, or of the first OTP reserved
+	OTP     string // The OTP generated, only set for EventGenerated
+	Count   int    // Number of OTPs reserved, only set for EventReserved
+}
+
+// Manager owns the tokens in a token directory, serializing changes to
+// each token and publishing an Event for each change.  It's safe for
+// concurrent use.
+type Manager struct {
+	dir   string // Holds the policy, vault and other metadata
+	store Store  // Holds the tokens
+	marks *Marks // High-water marks of the tokens, nil to keep none
+
+	mu          sync.Mutex // Protects vault, locked, tokens, subscribers and nextSub
+	vault       *Vault     // Key for an encrypted directory, nil if unencrypted or locked
+	locked      bool
+	tokens      map[string]*managedToken
+	subscribers map[int]func(Event)
+	nextSub     int
+}
+
+// managedToken is a loaded token, and the lock serializing access to it
+type managedToken struct {
+	mu      sync.Mutex
+	token   *SoftToken
+	deleted bool // Set once the token is deleted, to stop it being saved again
+}
+
+// ManagerOption configures a Manager
+type ManagerOption func(*Manager)
+
+// WithMarks keeps the tokens' high-water marks in ms.  Loading a token
+// behind its mark fails with a *RollbackError.
+func WithMarks(ms *Marks) ManagerOption {
+	return func(m *Manager) {
+		m.marks = ms
+	}
+}
+
+// NewManager returns a manager for the tokens kept in files in tokenDir.
+// If the directory is encrypted the manager starts locked.
+func NewManager(tokenDir string, opts ...ManagerOption) *Manager {
+	return NewManagerWithStore(tokenDir, NewFileStore(tokenDir), opts...)
+}
+
+// NewManagerWithStore returns a manager for the tokens in store, with the
+// policy, vault and other metadata in tokenDir.  tokenDir is empty for a
+// store without one, such as an EphemeralStore.
+func NewManagerWithStore(tokenDir string, store Store, opts ...ManagerOption) *Manager {
+	m := &Manager{
+		dir:         tokenDir,
+		store:       store,
+		locked:      IsEncrypted(tokenDir),
+		tokens:      make(map[string]*managedToken),
+		subscribers: make(map[int]func(Event)),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// OpenManager returns a manager for tokenDir, using the store configured
+// for it
+func OpenManager(tokenDir string, opts ...ManagerOption) (*Manager, error) {
+	store, err := OpenStore(tokenDir)
+	if err != nil {
+		return nil, err
+	}
+	return NewManagerWithStore(tokenDir, store, opts...), nil
+}
+
+// Dir returns the token directory the manager owns
+func (m *Manager) Dir() string {
+	return m.dir
+}
+
+// Store returns the store holding the manager's tokens
+func (m *Manager) Store() Store {
+	return m.store
+}
+
+// Names returns the names of all tokens in the store, sorted
+func (m *Manager) Names() ([]string, error) {
+	records, err := m.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, name := range records {
+		if !isHidden(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Subscribe registers fn to be called with every subsequent event.  fn is
+// called on the goroutine that made the change, after the change is saved,
+// and must not block.  The returned function unsubscribes.
+func (m *Manager) Subscribe(fn func(Event)) func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.nextSub
+	m.nextSub++
+	m.subscribers[id] = fn
+
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subscribers, id)
+	}
+}
+
+// publish calls every subscriber with ev
+func (m *Manager) publish(ev Event) {
+	m.mu.Lock()
+	subs := make([]func(Event), 0, len(m.subscribers))
+	for _, fn := range m.subscribers {
+		subs = append(subs, fn)
+	}
+	m.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(ev)
+	}
+}
+
+// get returns the managed token for name, loading it if necessary
+func (m *Manager) get(name string) (*managedToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.locked {
+		return nil, ErrLocked
+	}
+	if mt, ok := m.tokens[name]; ok {
+		return mt, nil
+	}
+
+	t, err := loadRecord(m.store, name, m.vault, m.marks)
+	if err != nil {
+		return nil, err
+	}
+
+	mt := &managedToken{token: t}
+	m.tokens[name] = mt
+	return mt, nil
+}
+
+// Get returns a copy of the named token's current state
+func (m *Manager) Get(name string) (*SoftToken, error) {
+	mt, err := m.get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return mt.token.Clone(), nil
+}
+
+// Create saves a new token under name, failing if one already exists
+func (m *Manager) Create(name string, t *SoftToken) error {
+	if name == "" {
+		name = "default"
+	}
+
+	m.mu.Lock()
+	if m.locked {
+		m.mu.Unlock()
+		return ErrLocked
+	}
+	if _, ok := m.tokens[name]; ok {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: '%s'", ErrTokenExists, name)
+	}
+	if _, err := m.store.Get(name); !errors.Is(err, ErrTokenNotFound) {
+		m.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: '%s'", ErrTokenExists, name)
+	}
+
+	t = t.Clone()
+	if err := saveRecord(m.store, name, t, m.vault, m.marks); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	m.tokens[name] = &managedToken{token: t}
+	m.mu.Unlock()
+
+	m.publish(Event{Type: EventAdded, Name: name, Counter: t.Counter, Session: t.Session})
+	return nil
+}
+
+// Delete removes the named token from disk
+func (m *Manager) Delete(name string) error {
+	m.mu.Lock()
+	mt, loaded := m.tokens[name]
+	delete(m.tokens, name)
+	m.mu.Unlock()
+
+	// Wait for any in progress operation on the token to finish
+	if loaded {
+		mt.mu.Lock()
+		defer mt.mu.Unlock()
+		mt.deleted = true
+	}
+
+	if err := m.store.Delete(name); err != nil {
+		return err
+	}
+
+	// A successor from an unfinished rotation goes with it
+	m.store.Delete(successorName(name))
+
+	m.publish(Event{Type: EventRemoved, Name: name})
+	return nil
+}
+
+// Replace replaces the named token with t, such as when regenerating its
+// secrets
+func (m *Manager) Replace(name string, t *SoftToken) error {
+	mt, err := m.get(name)
+	if err != nil {
+		return err
+	}
+
+	mt.mu.Lock()
+	if mt.deleted {
+		mt.mu.Unlock()
+		return m.errGone(name)
+	}
+	t = t.Clone()
+	if err := m.save(t, name); err != nil {
+		mt.mu.Unlock()
+		return err
+	}
+	mt.token = t
+	mt.mu.Unlock()
+
+	m.publish(Event{Type: EventReplaced, Name: name, Counter: t.Counter, Session: t.Session})
+	return nil
+}
+
+// Update calls fn with the named token while holding its lock, then saves
+// the token if fn changed it.  If fn returns an error the token isn't
+// saved, and its in-memory state is restored.
+func (m *Manager) Update(name string, fn func(t *SoftToken) error) error {
+	mt, err := m.get(name)
+	if err != nil {
+		return err
+	}
+
+	mt.mu.Lock()
+	if mt.deleted {
+		mt.mu.Unlock()
+		return m.errGone(name)
+	}
+	before := mt.token.Clone()
+	if err := fn(mt.token); err != nil {
+		mt.token = before
+		mt.mu.Unlock()
+		return err
+	}
+	if reflect.DeepEqual(before, mt.token) {
+		mt.mu.Unlock()
+		return nil
+	}
+
+	// Other processes saving the token wait for this one
+	unlock, err := m.store.Lock(name)
+	if err != nil {
+		mt.token = before
+		mt.mu.Unlock()
+		return err
+	}
+
+	// A token deleted by someone else isn't recreated
+	disk, err := m.load(name)
+	if errors.Is(err, ErrTokenNotFound) {
+		unlock()
+		mt.token = before
+		mt.mu.Unlock()
+
+		m.forget(name)
+		m.publish(Event{Type: EventRemoved, Name: name})
+		return m.errGone(name)
+	}
+	if err != nil {
+		unlock()
+		mt.token = before
+		mt.mu.Unlock()
+		return err
+	}
+
+	// Never save over counters someone else has moved on.  The token is
+	// reloaded instead, so retrying uses the newer counters.
+	if counterAhead(disk, before) {
+		unlock()
+		mt.token = disk
+		ev := Event{Type: EventReloaded, Name: name, Counter: disk.Counter, Session: disk.Session}
+		mt.mu.Unlock()
+
+		m.publish(ev)
+		return fmt.Errorf("%w: '%s'", ErrStaleToken, name)
+	}
+
+	err = m.save(mt.token, name)
+	unlock()
+	if err != nil {
+		mt.token = before
+		mt.mu.Unlock()
+		return err
+	}
+	ev := Event{Type: EventCounterChanged, Name: name, Counter: mt.token.Counter, Session: mt.token.Session}
+	changed := before.Counter != ev.Counter || before.Session != ev.Session
+	mt.mu.Unlock()
+
+	if changed {
+		m.publish(ev)
+	}
+	return nil
+}
+
+// Reload reloads the named token from disk if something other than the
+// manager has changed it, publishing EventReloaded.  It returns true if the
+// token was reloaded.  Tokens that haven't been loaded yet are left alone,
+// as they'll be read from disk when they're first used.
+func (m *Manager) Reload(name string) (bool, error) {
+	m.mu.Lock()
+	mt, ok := m.tokens[name]
+	m.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	mt.mu.Lock()
+	if mt.deleted {
+		mt.mu.Unlock()
+		return false, nil
+	}
+	disk, err := m.load(name)
+	if err != nil {
+		mt.mu.Unlock()
+		return false, err
+	}
+	if sameState(disk, mt.token) {
+		mt.mu.Unlock()
+		return false, nil
+	}
+	mt.token = disk
+	ev := Event{Type: EventReloaded, Name: name, Counter: disk.Counter, Session: disk.Session}
+	mt.mu.Unlock()
+
+	m.publish(ev)
+	return true, nil
+}
+
+// load loads the named record, decrypting it if the directory is encrypted
+func (m *Manager) load(name string) (*SoftToken, error) {
+	m.mu.Lock()
+	v, locked := m.vault, m.locked
+	m.mu.Unlock()
+
+	if locked {
+		return nil, ErrLocked
+	}
+	return loadRecord(m.store, name, v, m.marks)
+}
+
+// save saves a token as the named record, encrypting it if the directory
+// is encrypted
+func (m *Manager) save(t *SoftToken, name string) error {
+	m.mu.Lock()
+	v, locked := m.vault, m.locked
+	m.mu.Unlock()
+
+	if locked {
+		return ErrLocked
+	}
+	return saveRecord(m.store, name, t, v, m.marks)
+}
+
+// forget drops the named token after its file was removed by something
+// other than the manager
+func (m *Manager) forget(name string) {
+	m.mu.Lock()
+	mt, ok := m.tokens[name]
+	delete(m.tokens, name)
+	m.mu.Unlock()
+
+	if ok {
+		mt.mu.Lock()
+		mt.deleted = true
+		mt.mu.Unlock()
+	}
+}
+
+// counterAhead returns true if a's counters are ahead of b's
+func counterAhead(a, b *SoftToken) bool {
+	return a.Counter > b.Counter || (a.Counter == b.Counter && a.Session > b.Session)
+}
+
+// sameState returns true if a and b would be saved identically
+func sameState(a, b *SoftToken) bool {
+	if !bytes.Equal(a.PublicID, b.PublicID) {
+		return false
+	}
+	ac, bc := *a, *b
+	ac.PublicID, bc.PublicID = nil, nil
+	return reflect.DeepEqual(ac, bc)
+}
+
+// Generate generates an OTP from the named token and saves its new state.
+// Waiting for the token's rate limit to clear can be cancelled with ctx.
+func (m *Manager) Generate(ctx context.Context, name string) (string, error) {
+	return m.generate(ctx, name, nil)
+}
+
+// GenerateInRange is Generate, but only generates an OTP whose use counter
+// is in [start, end), such as a range leased from a coordinator.  A token
+// behind start is powered up at start first.  If the OTP would be outside
+// the range, nothing is generated and ErrOutsideRange is returned.
+func (m *Manager) GenerateInRange(ctx context.Context, name string, start, end uint16) (string, error) {
+	return m.generate(ctx, name, func(t *SoftToken) error {
+		if t.Counter < start {
+			if err := t.PowerUpWithCounter(start); err != nil {
+				return err
+			}
+		}
+		if counter, _, ok := nextOTP(t.Counter, t.Session); !ok || counter >= end {
+			return fmt.Errorf("%w: '%s' next counter %d, range %d-%d", ErrOutsideRange, name, counter, start, end-1)
+		}
+		return nil
+	})
+}
+
+// generate generates an OTP from the named token, after calling check, if
+// it's non-nil, to prepare the token or refuse to generate
+func (m *Manager) generate(ctx context.Context, name string, check func(t *SoftToken) error) (string, error) {
+	var otp string
+	var ev Event
+	err := m.Update(name, func(t *SoftToken) error {
+		if check != nil {
+			if err := check(t); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if otp, err = t.GenerateOTPContext(ctx); err != nil {
+			return err
+		}
+		ev = Event{Type: EventGenerated, Name: name, Counter: t.Counter, Session: t.Session, OTP: otp}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	m.publish(ev)
+	return otp, nil
+}
+
+// PowerCycle power cycles the named token and saves its new state
+func (m *Manager) PowerCycle(name string) error {
+	return m.Update(name, func(t *SoftToken) error {
+		return t.PowerUp()
+	})
+}
+
+// ApplyPowerPolicy power cycles the named token if policy requires it for
+// the event, returning true if it did
+func (m *Manager) ApplyPowerPolicy(name string, policy PowerCyclePolicy, ev PowerEvent) (bool, error) {
+	var cycled bool
+	err := m.Update(name, func(t *SoftToken) error {
+		var err error
+		cycled, err = policy.Apply(t, ev, time.Now())
+		return err
+	})
+	return cycled, err
+}
+
+// RateLimitDelay returns how long generating an OTP from the named token
+// would currently block
+func (m *Manager) RateLimitDelay(name string) (time.Duration, error) {
+	mt, err := m.get(name)
+	if err != nil {
+		return 0, err
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return mt.token.RateLimitDelay(), nil
+}
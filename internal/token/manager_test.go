@@ -0,0 +1,383 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// eventRecorder collects events published by a Manager
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) record(ev Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func (r *eventRecorder) count(typ EventType) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, ev := range r.events {
+		if ev.Type == typ {
+			n++
+		}
+	}
+	return n
+}
+
+func newTestManager(t *testing.T, names ...string) *Manager {
+	m := NewManager(t.TempDir())
+	for _, name := range names {
+		tok, err := New()
+		if err != nil {
+			t.Fatalf("Failed to create new token: %v", err)
+		}
+		if err := m.Create(name, tok); err != nil {
+			t.Fatalf("Create(%s) failed: %v", name, err)
+		}
+	}
+	return m
+}
+
+func TestManagerCreateDelete(t *testing.T) {
+	m := newTestManager(t)
+	rec := &eventRecorder{}
+	m.Subscribe(rec.record)
+
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	if err := m.Create("a", tok); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := m.Create("a", tok); !errors.Is(err, ErrTokenExists) {
+		t.Errorf("Second Create = %v, expected ErrTokenExists", err)
+	}
+
+	names, err := m.Names()
+	if err != nil || len(names) != 1 || names[0] != "a" {
+		t.Errorf("Names = %v, %v, expected [a]", names, err)
+	}
+
+	if err := m.Delete("a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := m.Get("a"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Get after Delete = %v, expected ErrTokenNotFound", err)
+	}
+	if _, err := m.Generate(context.Background(), "a"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Generate after Delete = %v, expected ErrTokenNotFound", err)
+	}
+
+	if rec.count(EventAdded) != 1 || rec.count(EventRemoved) != 1 {
+		t.Errorf("Events = %+v, expected one added and one removed", rec.events)
+	}
+}
+
+func TestManagerGetIsCopy(t *testing.T) {
+	m := newTestManager(t, "a")
+
+	tok, err := m.Get("a")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	tok.Counter = 1000
+	tok.PublicID[0] = 0xff
+
+	again, err := m.Get("a")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if again.Counter == 1000 || again.PublicID[0] == 0xff {
+		t.Error("Modifying a token returned by Get changed the managed token")
+	}
+}
+
+func TestManagerUpdateError(t *testing.T) {
+	m := newTestManager(t, "a")
+	before, _ := m.Get("a")
+
+	err := m.Update("a", func(t *SoftToken) error {
+		t.Counter = 1000
+		return errors.New("failed")
+	})
+	if err == nil {
+		t.Fatal("Update should have returned fn's error")
+	}
+
+	after, _ := m.Get("a")
+	if after.Counter != before.Counter {
+		t.Errorf("Counter = %d after failed update, expected %d", after.Counter, before.Counter)
+	}
+
+	loaded, err := Load(filepath.Join(m.Dir(), "a"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if loaded.Counter != before.Counter {
+		t.Error("Failed update was saved")
+	}
+}
+
+func TestManagerConcurrentGenerate(t *testing.T) {
+	const perToken = 6 // Stays within the rate limit, so the test is fast
+
+	names := []string{"a", "b", "c"}
+	m := newTestManager(t, names...)
+	rec := &eventRecorder{}
+	m.Subscribe(rec.record)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	otps := make(map[string]bool)
+	errs := make(chan error, len(names)*perToken)
+
+	for _, name := range names {
+		for i := 0; i < perToken; i++ {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+
+				otp, err := m.Generate(context.Background(), name)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				// Readers run alongside writers
+				if _, err := m.Get(name); err != nil {
+					errs <- err
+					return
+				}
+
+				mu.Lock()
+				otps[otp] = true
+				mu.Unlock()
+			}(name)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Concurrent operation failed: %v", err)
+	}
+
+	if len(otps) != len(names)*perToken {
+		t.Errorf("Generated %d unique OTPs, expected %d", len(otps), len(names)*perToken)
+	}
+	if rec.count(EventCounterChanged) != len(names)*perToken {
+		t.Errorf("Published %d counter events, expected %d", rec.count(EventCounterChanged), len(names)*perToken)
+	}
+
+	// Every generation must have been saved
+	for _, name := range names {
+		loaded, err := Load(filepath.Join(m.Dir(), name))
+		if err != nil {
+			t.Fatalf("Load failed: %v", err)
+		}
+		if loaded.Session != 1+perToken {
+			t.Errorf("Token %s session = %d, expected %d", name, loaded.Session, 1+perToken)
+		}
+	}
+}
+
+func TestManagerConcurrentCreate(t *testing.T) {
+	m := newTestManager(t)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			tok, err := New()
+			if err != nil {
+				t.Errorf("Failed to create new token: %v", err)
+				return
+			}
+
+			// Half the goroutines race to create the same token
+			name := fmt.Sprintf("token%d", i%4)
+			if err := m.Create(name, tok); err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			} else if !errors.Is(err, ErrTokenExists) {
+				t.Errorf("Create failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if created != 4 {
+		t.Errorf("Created %d tokens, expected 4", created)
+	}
+}
+
+func TestManagerUnsubscribe(t *testing.T) {
+	m := newTestManager(t, "a")
+	rec := &eventRecorder{}
+	unsubscribe := m.Subscribe(rec.record)
+
+	if err := m.PowerCycle("a"); err != nil {
+		t.Fatalf("PowerCycle failed: %v", err)
+	}
+	unsubscribe()
+	if err := m.PowerCycle("a"); err != nil {
+		t.Fatalf("PowerCycle failed: %v", err)
+	}
+
+	if rec.count(EventCounterChanged) != 1 {
+		t.Errorf("Received %d events, expected 1", rec.count(EventCounterChanged))
+	}
+}
+
+func TestManagerReplace(t *testing.T) {
+	m := newTestManager(t, "a")
+	rec := &eventRecorder{}
+	m.Subscribe(rec.record)
+
+	replacement, err := NewWithOptions(nil, nil, nil, 500)
+	if err != nil {
+		t.Fatalf("NewWithOptions failed: %v", err)
+	}
+	if err := m.Replace("a", replacement); err != nil {
+		t.Fatalf("Replace failed: %v", err)
+	}
+
+	loaded, err := Load(filepath.Join(m.Dir(), "a"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if loaded.AESKey != replacement.AESKey || loaded.Counter != 501 {
+		t.Error("Replacement wasn't saved")
+	}
+	if rec.count(EventReplaced) != 1 {
+		t.Errorf("Got %d replace events, expected 1", rec.count(EventReplaced))
+	}
+
+	if err := m.Replace("missing", replacement); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Replace(missing) = %v, expected ErrTokenNotFound", err)
+	}
+}
+
+func TestManagerStaleSave(t *testing.T) {
+	m := newTestManager(t, "a")
+	rec := &eventRecorder{}
+	m.Subscribe(rec.record)
+
+	if _, err := m.Generate(context.Background(), "a"); err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+
+	// Another process, such as the CLI, uses the token
+	other := NewManager(m.Dir())
+	for i := 0; i < 3; i++ {
+		if _, err := other.Generate(context.Background(), "a"); err != nil {
+			t.Fatalf("Failed to generate OTP: %v", err)
+		}
+	}
+	onDisk, err := other.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+
+	if _, err := m.Generate(context.Background(), "a"); !errors.Is(err, ErrStaleToken) {
+		t.Fatalf("Generating from a stale token gave %v, expected ErrStaleToken", err)
+	}
+	if rec.count(EventReloaded) != 1 {
+		t.Errorf("Expected 1 EventReloaded, got %d", rec.count(EventReloaded))
+	}
+
+	reloaded, err := m.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	if reloaded.Counter != onDisk.Counter || reloaded.Session != onDisk.Session {
+		t.Errorf("Token not reloaded, counters %d/%d, expected %d/%d",
+			reloaded.Counter, reloaded.Session, onDisk.Counter, onDisk.Session)
+	}
+
+	// Retrying carries on from the counters on disk
+	if _, err := m.Generate(context.Background(), "a"); err != nil {
+		t.Fatalf("Failed to generate OTP after reload: %v", err)
+	}
+	saved, err := Load(GetTokenPath(m.Dir(), "a"))
+	if err != nil {
+		t.Fatalf("Failed to load token: %v", err)
+	}
+	if !counterAhead(saved, onDisk) {
+		t.Errorf("Saved counters %d/%d aren't ahead of %d/%d",
+			saved.Counter, saved.Session, onDisk.Counter, onDisk.Session)
+	}
+}
+
+func TestManagerDeletedElsewhere(t *testing.T) {
+	m := newTestManager(t, "a")
+	rec := &eventRecorder{}
+	m.Subscribe(rec.record)
+
+	if _, err := m.Generate(context.Background(), "a"); err != nil {
+		t.Fatalf("Failed to generate OTP: %v", err)
+	}
+
+	// Another process deletes the token
+	if err := NewManager(m.Dir()).Delete("a"); err != nil {
+		t.Fatalf("Failed to delete token: %v", err)
+	}
+
+	if _, err := m.Generate(context.Background(), "a"); !errors.Is(err, ErrTokenNotFound) {
+		t.Fatalf("Generating from a deleted token gave %v, expected ErrTokenNotFound", err)
+	}
+	if rec.count(EventRemoved) != 1 {
+		t.Errorf("Expected 1 EventRemoved, got %d", rec.count(EventRemoved))
+	}
+	if _, err := Load(GetTokenPath(m.Dir(), "a")); err == nil {
+		t.Error("Deleted token was recreated")
+	}
+	if _, err := m.Get("a"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Getting the deleted token gave %v, expected ErrTokenNotFound", err)
+	}
+}
+
+func TestManagerReload(t *testing.T) {
+	m := newTestManager(t, "a")
+	rec := &eventRecorder{}
+	m.Subscribe(rec.record)
+
+	if reloaded, err := m.Reload("a"); err != nil || reloaded {
+		t.Errorf("Reload of an unchanged token gave %v, %v", reloaded, err)
+	}
+
+	other := NewManager(m.Dir())
+	if err := other.PowerCycle("a"); err != nil {
+		t.Fatalf("Failed to power cycle token: %v", err)
+	}
+
+	if reloaded, err := m.Reload("a"); err != nil || !reloaded {
+		t.Errorf("Reload of a changed token gave %v, %v", reloaded, err)
+	}
+	if rec.count(EventReloaded) != 1 {
+		t.Errorf("Expected 1 EventReloaded, got %d", rec.count(EventReloaded))
+	}
+
+	got, _ := m.Get("a")
+	want, _ := other.Get("a")
+	if !sameState(got, want) {
+		t.Errorf("Reloaded token doesn't match the one on disk")
+	}
+}
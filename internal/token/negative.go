@@ -0,0 +1,162 @@
+package token
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// ErrUnknownNegativeKind indicates an unrecognised negative test OTP kind
+var ErrUnknownNegativeKind = errors.New("unknown negative test OTP kind")
+
+// NegativeKind is a way a negative test OTP is invalid
+type NegativeKind string
+
+// Negative test OTP kinds
+const (
+	NegativeBadCRC        NegativeKind = "bad-crc"
+	NegativeUIDMismatch   NegativeKind = "uid-mismatch"
+	NegativeReplayed      NegativeKind = "replayed"
+	NegativeRollback      NegativeKind = "counter-rollback"
+	NegativeWrongPublicID NegativeKind = "wrong-public-id"
+	NegativeTruncated     NegativeKind = "truncated"
+	NegativeOddLength     NegativeKind = "odd-length"
+	NegativeWrongKey      NegativeKind = "wrong-key"
+)
+
+// NegativeKinds lists every kind of negative test OTP
+var NegativeKinds = []NegativeKind{
+	NegativeBadCRC,
+	NegativeUIDMismatch,
+	NegativeReplayed,
+	NegativeRollback,
+	NegativeWrongPublicID,
+	NegativeTruncated,
+	NegativeOddLength,
+	NegativeWrongKey,
+}
+
+// NegativeOTP is a deliberately invalid OTP, for checking validators
+// reject it
+type NegativeOTP struct {
+	Kind   NegativeKind
+	OTP    string
+	Reason string // Why a validator should reject the OTP
+	Replay bool   // Rejected as a replay (REPLAYED_OTP), rather than as invalid (BAD_OTP)
+}
+
+// NegativeOTPs returns one negative test OTP of each kind.  Apart from its
+// defect each OTP is the one the token would generate next, so a validator
+// that skips a check will accept it.  Replays reuse the counters of the
+// token's last OTP, so are only rejected by a validator that has seen it.
+// The token isn't modified.
+func (t *SoftToken) NegativeOTPs() ([]NegativeOTP, error) {
+	otps := make([]NegativeOTP, len(NegativeKinds))
+	for i, kind := range NegativeKinds {
+		otp, err := t.NegativeOTP(kind)
+		if err != nil {
+			return nil, err
+		}
+		otps[i] = otp
+	}
+	return otps, nil
+}
+
+// NegativeOTP returns a negative test OTP of the given kind, without
+// modifying the token
+func (t *SoftToken) NegativeOTP(kind NegativeKind) (NegativeOTP, error) {
+	n := NegativeOTP{Kind: kind}
+
+	// The block the token would use next
+	next := t.Clone()
+	now := time.Now()
+	now = now.Add(next.rateLimitDelayAt(now))
+	block, err := next.nextBlock(now)
+	if err != nil {
+		return n, err
+	}
+
+	publicID := t.PublicID
+	key := t.AESKey
+
+	switch kind {
+	case NegativeBadCRC:
+		n.Reason = "CRC of the decrypted token block is wrong"
+		block.ComputeCRC()
+		block.CRC ^= 0x8000
+		return n, n.encrypt(publicID, block, key[:], false)
+
+	case NegativeUIDMismatch:
+		n.Reason = "private ID doesn't match the registered private ID"
+		block.UID[0] ^= 0xff
+
+	case NegativeReplayed, NegativeRollback:
+		if kind == NegativeRollback && t.Counter == 0 {
+			return n, errors.New("counter is zero, and can't be rolled back")
+		}
+		n.Replay = true
+		block.Counter, block.Session = t.Counter, t.Session
+		if kind == NegativeReplayed {
+			n.Reason = fmt.Sprintf("counter %d and session %d were used by the last OTP", t.Counter, t.Session)
+		} else {
+			block.Counter--
+			n.Reason = fmt.Sprintf("counter %d is lower than the last used counter %d", block.Counter, t.Counter)
+		}
+
+	case NegativeWrongPublicID:
+		n.Reason = "public ID isn't the one registered for the private ID and key"
+		publicID = append([]byte{}, t.PublicID...)
+		if len(publicID) == 0 {
+			publicID = []byte{0}
+		}
+		publicID[len(publicID)-1] ^= 0xff
+
+	case NegativeTruncated:
+		n.Reason = "last byte of the token block is missing"
+		if err := n.encrypt(publicID, block, key[:], true); err != nil {
+			return n, err
+		}
+		n.OTP = n.OTP[:len(n.OTP)-2]
+		return n, nil
+
+	case NegativeOddLength:
+		n.Reason = "OTP has an odd number of modhex characters"
+		if err := n.encrypt(publicID, block, key[:], true); err != nil {
+			return n, err
+		}
+		n.OTP = n.OTP[:len(n.OTP)-1]
+		return n, nil
+
+	case NegativeWrongKey:
+		n.Reason = "token block is encrypted with a different AES key"
+		for key == t.AESKey {
+			if _, err := rand.Read(key[:]); err != nil {
+				return n, fmt.Errorf("failed to generate AES key: %w", err)
+			}
+		}
+
+	default:
+		return n, fmt.Errorf("%w: '%s'", ErrUnknownNegativeKind, kind)
+	}
+
+	return n, n.encrypt(publicID, block, key[:], true)
+}
+
+// encrypt sets the OTP from the public ID and block, computing the block's
+// CRC first if crc is true
+func (n *NegativeOTP) encrypt(publicID []byte, block *yubikey.TokenBlock, key []byte, crc bool) error {
+	if crc {
+		block.ComputeCRC()
+	}
+
+	otp, err := block.Encrypt(key)
+	if err != nil {
+		return err
+	}
+
+	n.OTP = yubikey.ModHexEncode(publicID) + otp
+	return nil
+}
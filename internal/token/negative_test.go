@@ -0,0 +1,87 @@
+package token
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+func TestNegativeOTPs(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+
+	if _, err := tok.GenerateOTP(); err != nil {
+		t.Fatalf("GenerateOTP failed: %v", err)
+	}
+	before := tok.Clone()
+
+	otps, err := tok.NegativeOTPs()
+	if err != nil {
+		t.Fatalf("NegativeOTPs failed: %v", err)
+	}
+	if len(otps) != len(NegativeKinds) {
+		t.Fatalf("Got %d negative OTPs, expected %d", len(otps), len(NegativeKinds))
+	}
+	if tok.Counter != before.Counter || tok.Session != before.Session ||
+		tok.LastUse != before.LastUse || tok.PonRand != before.PonRand {
+		t.Error("NegativeOTPs advanced the token state")
+	}
+
+	for _, n := range otps {
+		if n.Reason == "" {
+			t.Errorf("%s has no reason", n.Kind)
+		}
+
+		publicID, block, err := yubikey.ParseOTP(n.OTP, tok.AESKey[:])
+		switch n.Kind {
+		case NegativeBadCRC, NegativeWrongKey:
+			if !errors.Is(err, yubikey.ErrCRCMismatch) {
+				t.Errorf("%s: ParseOTP = %v, expected ErrCRCMismatch", n.Kind, err)
+			}
+
+		case NegativeTruncated, NegativeOddLength:
+			if err == nil {
+				t.Errorf("%s: ParseOTP succeeded", n.Kind)
+			}
+
+		case NegativeUIDMismatch:
+			if err != nil || block.UID == tok.PrivateID {
+				t.Errorf("%s: ParseOTP = %v, expected a different private ID", n.Kind, err)
+			}
+
+		case NegativeWrongPublicID:
+			if err != nil || bytes.Equal(publicID, tok.PublicID) {
+				t.Errorf("%s: ParseOTP = %v, expected a different public ID", n.Kind, err)
+			}
+
+		case NegativeReplayed, NegativeRollback:
+			if err != nil {
+				t.Fatalf("%s: ParseOTP failed: %v", n.Kind, err)
+			}
+			if !n.Replay {
+				t.Errorf("%s isn't labelled as a replay", n.Kind)
+			}
+			replayed := block.Counter < tok.Counter ||
+				(block.Counter == tok.Counter && block.Session <= tok.Session)
+			if !replayed {
+				t.Errorf("%s: counter %d/%d isn't a replay of %d/%d",
+					n.Kind, block.Counter, block.Session, tok.Counter, tok.Session)
+			}
+		}
+	}
+}
+
+func TestNegativeOTPUnknownKind(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+
+	if _, err := tok.NegativeOTP("bogus"); !errors.Is(err, ErrUnknownNegativeKind) {
+		t.Errorf("NegativeOTP(bogus) = %v, expected ErrUnknownNegativeKind", err)
+	}
+}
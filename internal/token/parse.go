@@ -0,0 +1,115 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// MaxInitialCounter is the highest counter a token can be initialised with,
+// as it's always incremented on first use
+const MaxInitialCounter = maxCounter - 1
+
+// ParsePublicID parses a modhex public ID, as entered by a user
+func ParsePublicID(s string) ([]byte, error) {
+	publicID, err := yubikey.ModHexDecode(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public ID: %w", err)
+	}
+	if len(publicID) > yubikey.MaxPublicIDSize {
+		return nil, fmt.Errorf("public ID too long: %d bytes, maximum is %d",
+			len(publicID), yubikey.MaxPublicIDSize)
+	}
+	return publicID, nil
+}
+
+// ParsePrivateID parses a hex private ID, as entered by a user
+func ParsePrivateID(s string) ([]byte, error) {
+	return parseHexField(s, "private ID", yubikey.UIDSize)
+}
+
+// ParseAESKey parses a hex AES key, as entered by a user
+func ParseAESKey(s string) ([]byte, error) {
+	return parseHexField(s, "AES key", yubikey.KeySize)
+}
+
+// ParseCounter parses an initial use counter, as entered by a user
+func ParseCounter(s string) (uint16, error) {
+	v, err := strconv.ParseUint(strings.TrimSpace(s), 0, 16)
+	if err != nil || v > MaxInitialCounter {
+		return 0, fmt.Errorf("invalid counter, must be 0-%d", MaxInitialCounter)
+	}
+	return uint16(v), nil
+}
+
+func parseHexField(s, name string, size int) ([]byte, error) {
+	decoded, err := yubikey.HexDecode(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if len(decoded) != size {
+		return nil, fmt.Errorf("invalid %s: must be %d hex digits", name, size*2)
+	}
+	return decoded, nil
+}
+
+// ParseRegistrationInfo creates a token from registration information in
+// the format produced by RegistrationInfo, i.e. "public ID, private ID,
+// AES key".  The token's counter starts at counter.
+func ParseRegistrationInfo(s string, counter uint16) (*SoftToken, error) {
+	fields := strings.Split(strings.TrimSpace(s), ",")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("registration info must be 'public ID, private ID, AES key', got %d fields", len(fields))
+	}
+
+	publicID, err := ParsePublicID(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	privateID, err := ParsePrivateID(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	aesKey, err := ParseAESKey(fields[2])
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWithOptions(publicID, privateID, aesKey, counter)
+}
+
+// ErrIncompleteToken indicates parsed token data is missing a token's
+// public ID or AES key
+var ErrIncompleteToken = errors.New("incomplete token")
+
+// ParseToken creates a token from the fields of a token file, or from
+// registration information in the format produced by RegistrationInfo.
+// Registration information may be followed by token file fields, such as
+// the counters saved from its last use, otherwise its counter starts at 0.
+// Encrypted token files can't be parsed.
+func ParseToken(data []byte) (*SoftToken, error) {
+	s := strings.TrimSpace(string(data))
+	if first, rest, _ := strings.Cut(s, "\n"); !strings.Contains(first, ":") {
+		t, err := ParseRegistrationInfo(first, 0)
+		if err != nil || strings.TrimSpace(rest) == "" {
+			return t, err
+		}
+		// Later fields replace earlier ones
+		s = string(t.marshal()) + rest
+	}
+
+	t, err := decodeToken([]byte(s), "token", nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.PublicID) == 0 {
+		return nil, fmt.Errorf("%w: no %s", ErrIncompleteToken, PublicIDField)
+	}
+	if t.AESKey == ([yubikey.KeySize]byte{}) {
+		return nil, fmt.Errorf("%w: no %s", ErrIncompleteToken, AESKeyField)
+	}
+	return t, nil
+}
@@ -0,0 +1,112 @@
+package token
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	if id, err := ParsePublicID(" ddddcbdefghi "); err != nil || !bytes.Equal(id, []byte{0x22, 0x22, 0x01, 0x23, 0x45, 0x67}) {
+		t.Errorf("ParsePublicID = %x, %v", id, err)
+	}
+	if id, err := ParsePublicID(""); err != nil || len(id) != 0 {
+		t.Errorf("ParsePublicID(\"\") = %x, %v, expected an empty public ID", id, err)
+	}
+	if _, err := ParsePrivateID("aabbccddeeff"); err != nil {
+		t.Errorf("ParsePrivateID failed: %v", err)
+	}
+	if _, err := ParseAESKey("000102030405060708090a0b0c0d0e0f"); err != nil {
+		t.Errorf("ParseAESKey failed: %v", err)
+	}
+	if c, err := ParseCounter("0x10"); err != nil || c != 16 {
+		t.Errorf("ParseCounter(0x10) = %d, %v", c, err)
+	}
+
+	invalid := []struct {
+		name string
+		fn   func() error
+	}{
+		{"odd length public ID", func() error { _, err := ParsePublicID("ddd"); return err }},
+		{"hex public ID", func() error { _, err := ParsePublicID("0123"); return err }},
+		{"17 byte public ID", func() error { _, err := ParsePublicID(string(bytes.Repeat([]byte("cc"), 17))); return err }},
+		{"short private ID", func() error { _, err := ParsePrivateID("aabbcc"); return err }},
+		{"modhex private ID", func() error { _, err := ParsePrivateID("ddddddddddxx"); return err }},
+		{"long AES key", func() error { _, err := ParseAESKey("000102030405060708090a0b0c0d0e0f00"); return err }},
+		{"negative counter", func() error { _, err := ParseCounter("-1"); return err }},
+		{"counter at max", func() error { _, err := ParseCounter("32767"); return err }},
+	}
+	for _, tt := range invalid {
+		if tt.fn() == nil {
+			t.Errorf("Accepted %s", tt.name)
+		}
+	}
+}
+
+func TestParseRegistrationInfo(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+
+	parsed, err := ParseRegistrationInfo(tok.RegistrationInfo()+"\n", 10)
+	if err != nil {
+		t.Fatalf("ParseRegistrationInfo failed: %v", err)
+	}
+	if !bytes.Equal(parsed.PublicID, tok.PublicID) || parsed.PrivateID != tok.PrivateID || parsed.AESKey != tok.AESKey {
+		t.Errorf("ParseRegistrationInfo = %s, expected %s", parsed.RegistrationInfo(), tok.RegistrationInfo())
+	}
+	if parsed.Counter != 11 {
+		t.Errorf("Counter = %d, expected 11", parsed.Counter)
+	}
+
+	for _, s := range []string{
+		"",
+		"ddddcbdefghi, aabbccddeeff",
+		"ddddcbdefghi, aabbccddeeff, 000102030405060708090a0b0c0d0e0f, extra",
+		"ddddcbdefghi, aabbccddeeff, 000102030405060708090a0b0c0d0e",
+	} {
+		if _, err := ParseRegistrationInfo(s, 0); err == nil {
+			t.Errorf("ParseRegistrationInfo(%q) succeeded", s)
+		}
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	tok.Counter, tok.Session = 42, 7
+
+	for _, data := range [][]byte{tok.marshal(), []byte(tok.RegistrationInfo() + "\n")} {
+		parsed, err := ParseToken(data)
+		if err != nil {
+			t.Fatalf("ParseToken(%q) failed: %v", data, err)
+		}
+		if parsed.RegistrationInfo() != tok.RegistrationInfo() {
+			t.Errorf("ParseToken = %s, expected %s", parsed.RegistrationInfo(), tok.RegistrationInfo())
+		}
+	}
+	if parsed, err := ParseToken(tok.marshal()); err != nil || parsed.Counter != 42 || parsed.Session != 7 {
+		t.Errorf("ParseToken of a token file lost its counters: %v", err)
+	}
+	state := tok.RegistrationInfo() + "\ncounter: 42\nsession: 7\n"
+	parsed, err := ParseToken([]byte(state))
+	if err != nil {
+		t.Fatalf("ParseToken of registration information and counters failed: %v", err)
+	}
+	if parsed.Counter != 42 || parsed.Session != 7 || parsed.AESKey != tok.AESKey {
+		t.Errorf("ParseToken of registration information and counters at %d/%d, expected 42/7", parsed.Counter, parsed.Session)
+	}
+
+	for _, s := range []string{
+		"",
+		"public_id: ddddcbdefghi\ncounter: 3\n",
+		"aes_key: 000102030405060708090a0b0c0d0e0f\n",
+		"public_id: ddddcbdefghi\nencrypted: AAAA\n",
+	} {
+		if _, err := ParseToken([]byte(s)); err == nil {
+			t.Errorf("ParseToken(%q) succeeded", s)
+		}
+	}
+}
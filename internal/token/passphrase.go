@@ -0,0 +1,114 @@
+package token
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Sealed data fields, after the vault file fields it shares
+const (
+	sealedKindField = "kind"
+	sealedDataField = "sealed"
+)
+
+// ErrNotSealed indicates data wasn't sealed with SealWithPassphrase, or was
+// sealed as something else
+var ErrNotSealed = errors.New("not sealed data")
+
+// SealWithPassphrase encrypts and authenticates data with a key derived
+// from passphrase, as a vault's is, for data kept outside a token
+// directory such as a backup.  kind says what the data is, and is
+// authenticated with it.  The result is in the vault file's format.
+func SealWithPassphrase(kind, passphrase string, iterations int, data []byte) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase must not be empty")
+	}
+	if iterations <= 0 || iterations > maxIterations {
+		return nil, fmt.Errorf("iterations must be 1-%d", maxIterations)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s: %s\n", sealedKindField, kind)
+	fmt.Fprintf(&buf, "%s: %s\n", vaultKDFField, vaultKDF)
+	fmt.Fprintf(&buf, "%s: %d\n", vaultIterationsField, iterations)
+	fmt.Fprintf(&buf, "%s: %s\n", vaultSaltField, hex.EncodeToString(salt))
+
+	// Everything before the sealed data is authenticated with it
+	v := &Vault{key: pbkdf2SHA256([]byte(passphrase), salt, iterations, 32)}
+	defer v.Close()
+	sealed, err := v.seal(data, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(&buf, "%s: %s\n", sealedDataField, sealed)
+	return buf.Bytes(), nil
+}
+
+// OpenWithPassphrase reverses SealWithPassphrase.  It fails with
+// ErrWrongPassphrase if passphrase is wrong or the data has been modified.
+func OpenWithPassphrase(kind, passphrase string, data []byte) ([]byte, error) {
+	i := bytes.Index(data, []byte("\n"+sealedDataField+":"))
+	if i < 0 {
+		return nil, ErrNotSealed
+	}
+	header := data[:i+1]
+
+	var iterations int
+	var salt []byte
+	var err error
+	found := ""
+	for _, line := range strings.Split(string(header), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+
+		switch strings.TrimSpace(parts[0]) {
+		case sealedKindField:
+			found = value
+		case vaultKDFField:
+			if value != vaultKDF {
+				return nil, fmt.Errorf("unsupported kdf '%s'", value)
+			}
+		case vaultIterationsField:
+			if iterations, err = strconv.Atoi(value); err != nil || iterations <= 0 || iterations > maxIterations {
+				return nil, fmt.Errorf("invalid iterations '%s'", value)
+			}
+		case vaultSaltField:
+			if salt, err = hex.DecodeString(value); err != nil {
+				return nil, fmt.Errorf("invalid salt: %w", err)
+			}
+		}
+	}
+	if found != kind {
+		return nil, fmt.Errorf("%w: expected %s, found '%s'", ErrNotSealed, kind, found)
+	}
+	if iterations == 0 || len(salt) == 0 {
+		return nil, fmt.Errorf("%w: missing fields", ErrNotSealed)
+	}
+
+	sealed := strings.TrimSpace(string(data[i+1+len(sealedDataField)+1:]))
+	if _, err := base64.StdEncoding.DecodeString(sealed); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotSealed, err)
+	}
+
+	v := &Vault{key: pbkdf2SHA256([]byte(passphrase), salt, iterations, 32)}
+	defer v.Close()
+	plain, err := v.open(sealed, header)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plain, nil
+}
@@ -0,0 +1,48 @@
+package token
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSealWithPassphrase(t *testing.T) {
+	plain := []byte("tokens")
+	sealed, err := SealWithPassphrase("test", "secret", 1000, plain)
+	if err != nil {
+		t.Fatalf("SealWithPassphrase failed: %v", err)
+	}
+	if bytes.Contains(sealed, plain) {
+		t.Error("Sealed data holds the plaintext")
+	}
+
+	opened, err := OpenWithPassphrase("test", "secret", sealed)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Fatalf("OpenWithPassphrase gave %q, %v", opened, err)
+	}
+
+	if _, err := OpenWithPassphrase("test", "wrong", sealed); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Opening with the wrong passphrase gave %v, expected ErrWrongPassphrase", err)
+	}
+	if _, err := OpenWithPassphrase("other", "secret", sealed); !errors.Is(err, ErrNotSealed) {
+		t.Errorf("Opening as another kind gave %v, expected ErrNotSealed", err)
+	}
+	if _, err := OpenWithPassphrase("test", "secret", []byte("public_id: x\n")); !errors.Is(err, ErrNotSealed) {
+		t.Errorf("Opening unsealed data gave %v, expected ErrNotSealed", err)
+	}
+
+	// The parameters the key is derived with are authenticated too
+	tampered := bytes.Replace(sealed, []byte("iterations: 1000"), []byte("iterations: 1001"), 1)
+	if _, err := OpenWithPassphrase("test", "secret", tampered); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Opening with changed iterations gave %v, expected ErrWrongPassphrase", err)
+	}
+
+	// Without deriving a key from an iteration count no one would choose
+	huge := bytes.Replace(sealed, []byte("iterations: 1000"), []byte("iterations: 2000000000"), 1)
+	if _, err := OpenWithPassphrase("test", "secret", huge); err == nil || errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Opening with huge iterations gave %v, expected them to be rejected", err)
+	}
+	if _, err := SealWithPassphrase("test", "secret", maxIterations+1, plain); err == nil {
+		t.Error("Sealed with more iterations than can be opened")
+	}
+}
@@ -0,0 +1,255 @@
+package token
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/arr2036/yksofttoken/internal/fsutil"
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+const (
+	// PolicyFile is the name of the policy file in a token directory
+	PolicyFile = ".policy"
+
+	// Field names for policy persistence
+	PublicIDPrefixField = "public_id_prefix"
+	PublicIDLengthField = "public_id_length"
+	WarnPowerUpsField   = "warn_power_ups"
+	WarnOTPsField       = "warn_otps"
+
+	// maxCollisionRetries is how many random public IDs NewUnique tries
+	// before giving up
+	maxCollisionRetries = 16
+)
+
+// ErrPublicIDInUse indicates a public ID is already assigned to another token
+var ErrPublicIDInUse = errors.New("public ID already in use")
+
+// Policy controls how public IDs are assigned to new tokens, and when to
+// warn that a token's lifetime is running out
+type Policy struct {
+	PublicIDPrefix []byte // Fixed leading bytes of every public ID
+	PublicIDLength int    // Total public ID length in bytes (0-16)
+
+	WarnPowerUps int // Warn when this many power-ups or fewer remain
+	WarnOTPs     int // Warn when this many OTPs or fewer remain
+}
+
+// DefaultPolicy is used when no policy has been configured.  It produces
+// 6 byte public IDs with the dddd prefix (0x2222 in modhex), and warns
+// when about 3% of a token's lifetime remains.
+var DefaultPolicy = Policy{
+	PublicIDPrefix: []byte{0x22, 0x22},
+	PublicIDLength: yubikey.PublicIDSize,
+	WarnPowerUps:   1000,
+	WarnOTPs:       1000 * 0xff,
+}
+
+// Validate checks the policy can produce valid public IDs
+func (p Policy) Validate() error {
+	if p.PublicIDLength < 0 || p.PublicIDLength > yubikey.MaxPublicIDSize {
+		return fmt.Errorf("invalid public ID length %d, must be 0-%d",
+			p.PublicIDLength, yubikey.MaxPublicIDSize)
+	}
+	if len(p.PublicIDPrefix) > p.PublicIDLength {
+		return fmt.Errorf("public ID prefix (%d bytes) longer than public ID (%d bytes)",
+			len(p.PublicIDPrefix), p.PublicIDLength)
+	}
+	if p.WarnPowerUps < 0 || p.WarnOTPs < 0 {
+		return errors.New("lifetime warning thresholds must not be negative")
+	}
+	return nil
+}
+
+// NewPublicID generates a random public ID that conforms to the policy
+func (p Policy) NewPublicID() ([]byte, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	publicID := make([]byte, p.PublicIDLength)
+	n := copy(publicID, p.PublicIDPrefix)
+	if _, err := rand.Read(publicID[n:]); err != nil {
+		return nil, fmt.Errorf("failed to generate public ID: %w", err)
+	}
+	return publicID, nil
+}
+
+// Allows returns true if the public ID conforms to the policy
+func (p Policy) Allows(publicID []byte) bool {
+	return len(publicID) == p.PublicIDLength && bytes.HasPrefix(publicID, p.PublicIDPrefix)
+}
+
+// LoadPolicy loads the policy for a token directory, returning
+// DefaultPolicy if none has been configured
+func LoadPolicy(tokenDir string) (Policy, error) {
+	file, err := os.Open(filepath.Join(tokenDir, PolicyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return DefaultPolicy, nil
+	}
+	if err != nil {
+		return Policy{}, err
+	}
+	defer file.Close()
+
+	return ParsePolicy(file, DefaultPolicy)
+}
+
+// ParsePolicy reads "field: value" lines in the policy file's format,
+// setting them over base, and validates the result.  Unknown fields are
+// ignored.
+func ParsePolicy(r io.Reader, base Policy) (Policy, error) {
+	p := base
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		switch key {
+		case PublicIDPrefixField:
+			decoded, err := yubikey.ModHexDecode(value)
+			if err != nil {
+				return Policy{}, fmt.Errorf("invalid public_id_prefix: %w", err)
+			}
+			p.PublicIDPrefix = decoded
+
+		case PublicIDLengthField:
+			v, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return Policy{}, fmt.Errorf("invalid public_id_length: %w", err)
+			}
+			p.PublicIDLength = int(v)
+
+		case WarnPowerUpsField:
+			v, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return Policy{}, fmt.Errorf("invalid warn_power_ups: %w", err)
+			}
+			p.WarnPowerUps = int(v)
+
+		case WarnOTPsField:
+			v, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return Policy{}, fmt.Errorf("invalid warn_otps: %w", err)
+			}
+			p.WarnOTPs = int(v)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Policy{}, err
+	}
+
+	if err := p.Validate(); err != nil {
+		return Policy{}, err
+	}
+
+	return p, nil
+}
+
+// String returns the policy as it's saved in the policy file
+func (p Policy) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s\n", PublicIDPrefixField, yubikey.ModHexEncode(p.PublicIDPrefix))
+	fmt.Fprintf(&b, "%s: %d\n", PublicIDLengthField, p.PublicIDLength)
+	fmt.Fprintf(&b, "%s: %d\n", WarnPowerUpsField, p.WarnPowerUps)
+	fmt.Fprintf(&b, "%s: %d\n", WarnOTPsField, p.WarnOTPs)
+	return b.String()
+}
+
+// SavePolicy saves the policy for a token directory
+func SavePolicy(tokenDir string, p Policy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(tokenDir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return fsutil.WriteFileAtomic(filepath.Join(tokenDir, PolicyFile), []byte(p.String()))
+}
+
+// CheckPublicID returns an error wrapping ErrPublicIDInUse if any token in
+// tokenDir other than the one named exclude already uses publicID
+func CheckPublicID(tokenDir string, publicID []byte, exclude string) error {
+	return checkPublicID(NewFileStore(tokenDir), publicID, exclude)
+}
+
+// CheckPublicID returns an error wrapping ErrPublicIDInUse if any token in
+// the manager's store other than the one named exclude already uses
+// publicID
+func (m *Manager) CheckPublicID(publicID []byte, exclude string) error {
+	return checkPublicID(m.store, publicID, exclude)
+}
+
+func checkPublicID(s Store, publicID []byte, exclude string) error {
+	names, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if name == exclude || isHidden(name) {
+			continue
+		}
+
+		// Tokens we can't parse can't collide, and shouldn't block creation
+		otherID, err := recordPublicID(s, name)
+		if err != nil {
+			continue
+		}
+
+		if bytes.Equal(otherID, publicID) {
+			return fmt.Errorf("%w by token '%s'", ErrPublicIDInUse, name)
+		}
+	}
+
+	return nil
+}
+
+// NewUnique creates a new token using the given policy, with a public ID
+// not used by any other token in tokenDir
+func NewUnique(tokenDir string, p Policy) (*SoftToken, error) {
+	return newUnique(NewFileStore(tokenDir), p)
+}
+
+// NewUnique creates a new token using the given policy, with a public ID
+// not used by any other token in the manager's store
+func (m *Manager) NewUnique(p Policy) (*SoftToken, error) {
+	return newUnique(m.store, p)
+}
+
+func newUnique(s Store, p Policy) (*SoftToken, error) {
+	for i := 0; i < maxCollisionRetries; i++ {
+		t, err := NewWithPolicy(p)
+		if err != nil {
+			return nil, err
+		}
+
+		err = checkPublicID(s, t.PublicID, "")
+		if err == nil {
+			return t, nil
+		}
+		if !errors.Is(err, ErrPublicIDInUse) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("%w: no free public IDs found with prefix %s",
+		ErrPublicIDInUse, yubikey.ModHexEncode(p.PublicIDPrefix))
+}
@@ -0,0 +1,195 @@
+package token
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	p, err := LoadPolicy(t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadPolicy failed: %v", err)
+	}
+
+	if p.PublicIDLength != 6 || !bytes.Equal(p.PublicIDPrefix, []byte{0x22, 0x22}) {
+		t.Errorf("Missing policy file should give DefaultPolicy, got %+v", p)
+	}
+}
+
+func TestPolicySaveLoad(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	p := Policy{PublicIDPrefix: []byte{0x12, 0x34, 0x56}, PublicIDLength: 8}
+	if err := SavePolicy(tmpDir, p); err != nil {
+		t.Fatalf("SavePolicy failed: %v", err)
+	}
+
+	loaded, err := LoadPolicy(tmpDir)
+	if err != nil {
+		t.Fatalf("LoadPolicy failed: %v", err)
+	}
+
+	if loaded.PublicIDLength != 8 {
+		t.Errorf("PublicIDLength = %d, expected 8", loaded.PublicIDLength)
+	}
+	if !bytes.Equal(loaded.PublicIDPrefix, p.PublicIDPrefix) {
+		t.Errorf("PublicIDPrefix = %x, expected %x", loaded.PublicIDPrefix, p.PublicIDPrefix)
+	}
+
+	// The policy file must not show up as a token
+	names, err := ListTokens(tmpDir)
+	if err != nil {
+		t.Fatalf("ListTokens failed: %v", err)
+	}
+	if len(names) != 0 {
+		t.Errorf("ListTokens = %v, expected no tokens", names)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader("public_id_length: 8\nunknown: 1\n"), DefaultPolicy)
+	if err != nil {
+		t.Fatalf("ParsePolicy failed: %v", err)
+	}
+	if p.PublicIDLength != 8 || !bytes.Equal(p.PublicIDPrefix, DefaultPolicy.PublicIDPrefix) {
+		t.Errorf("ParsePolicy = %+v, expected the default with a length of 8", p)
+	}
+
+	for _, invalid := range []string{"public_id_prefix: xyz", "public_id_length: 17", "warn_otps: -1"} {
+		if _, err := ParsePolicy(strings.NewReader(invalid), DefaultPolicy); err == nil {
+			t.Errorf("ParsePolicy(%q) succeeded", invalid)
+		}
+	}
+
+	// What's saved parses back to the same policy
+	if parsed, err := ParsePolicy(strings.NewReader(p.String()), Policy{}); err != nil || !reflect.DeepEqual(parsed, p) {
+		t.Errorf("Parsing %q gave %+v, %v, expected %+v", p.String(), parsed, err, p)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy Policy
+		valid  bool
+	}{
+		{Policy{PublicIDLength: 0}, true},
+		{Policy{PublicIDLength: 16}, true},
+		{Policy{PublicIDPrefix: []byte{1, 2}, PublicIDLength: 2}, true},
+		{Policy{PublicIDLength: 17}, false},
+		{Policy{PublicIDLength: -1}, false},
+		{Policy{PublicIDPrefix: []byte{1, 2, 3}, PublicIDLength: 2}, false},
+	}
+
+	for _, tt := range tests {
+		err := tt.policy.Validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("Validate(%+v) = %v, expected valid=%v", tt.policy, err, tt.valid)
+		}
+	}
+}
+
+func TestNewWithPolicyLengths(t *testing.T) {
+	for _, length := range []int{0, 2, 6, 16} {
+		p := Policy{PublicIDPrefix: []byte{0x01, 0x02}, PublicIDLength: length}
+		if length < len(p.PublicIDPrefix) {
+			p.PublicIDPrefix = nil
+		}
+
+		tok, err := NewWithPolicy(p)
+		if err != nil {
+			t.Fatalf("NewWithPolicy(%d) failed: %v", length, err)
+		}
+		if !p.Allows(tok.PublicID) {
+			t.Errorf("Public ID %x does not conform to policy %+v", tok.PublicID, p)
+		}
+
+		otp, err := tok.GenerateOTP()
+		if err != nil {
+			t.Fatalf("GenerateOTP failed: %v", err)
+		}
+		if len(otp) != length*2+32 {
+			t.Errorf("OTP length = %d, expected %d", len(otp), length*2+32)
+		}
+
+		// Round trip through persistence
+		path := filepath.Join(t.TempDir(), "token")
+		if err := tok.Save(path); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		loaded, err := Load(path)
+		if err != nil {
+			t.Fatalf("Load failed: %v", err)
+		}
+		if !bytes.Equal(loaded.PublicID, tok.PublicID) {
+			t.Errorf("Loaded public ID %x, expected %x", loaded.PublicID, tok.PublicID)
+		}
+	}
+}
+
+func TestNewWithOptionsPublicIDTooLong(t *testing.T) {
+	_, err := NewWithOptions(make([]byte, 17), nil, nil, 0)
+	if err == nil {
+		t.Error("Expected error for 17 byte public ID")
+	}
+}
+
+func TestCheckPublicID(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	if err := tok.Save(filepath.Join(tmpDir, "existing")); err != nil {
+		t.Fatalf("Failed to save token: %v", err)
+	}
+
+	// Unparseable files must not block the check
+	if err := os.WriteFile(filepath.Join(tmpDir, "garbage"), []byte("counter: x\n"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	err = CheckPublicID(tmpDir, tok.PublicID, "")
+	if !errors.Is(err, ErrPublicIDInUse) {
+		t.Errorf("CheckPublicID = %v, expected ErrPublicIDInUse", err)
+	}
+
+	// A token doesn't collide with itself
+	if err := CheckPublicID(tmpDir, tok.PublicID, "existing"); err != nil {
+		t.Errorf("CheckPublicID excluding owner = %v, expected nil", err)
+	}
+
+	other, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	if err := CheckPublicID(tmpDir, other.PublicID, ""); err != nil {
+		t.Errorf("CheckPublicID for fresh ID = %v, expected nil", err)
+	}
+}
+
+func TestNewUniqueExhausted(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// With a prefix covering the whole public ID there's only one
+	// possible value, so the second token can't be created
+	p := Policy{PublicIDPrefix: []byte{0xab, 0xcd}, PublicIDLength: 2}
+
+	tok, err := NewUnique(tmpDir, p)
+	if err != nil {
+		t.Fatalf("NewUnique failed: %v", err)
+	}
+	if err := tok.Save(filepath.Join(tmpDir, "first")); err != nil {
+		t.Fatalf("Failed to save token: %v", err)
+	}
+
+	_, err = NewUnique(tmpDir, p)
+	if !errors.Is(err, ErrPublicIDInUse) {
+		t.Errorf("NewUnique = %v, expected ErrPublicIDInUse", err)
+	}
+}
@@ -0,0 +1,180 @@
+package token
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PowerCycleMode selects when a token is power cycled
+type PowerCycleMode int
+
+const (
+	// PowerCycleNever only increments the use counter when the session counter wraps
+	PowerCycleNever PowerCycleMode = iota
+	// PowerCycleOnStart power cycles a token the first time an application uses it
+	PowerCycleOnStart
+	// PowerCycleOnInvocation power cycles a token on every CLI invocation
+	PowerCycleOnInvocation
+	// PowerCycleOnIdle power cycles a token if it hasn't been used for IdleTimeout
+	PowerCycleOnIdle
+)
+
+// PowerEvent identifies the point at which a power cycle policy is consulted
+type PowerEvent int
+
+const (
+	// PowerEventStart is raised the first time an application uses a token
+	PowerEventStart PowerEvent = iota
+	// PowerEventInvocation is raised when a CLI invocation uses a token
+	PowerEventInvocation
+	// PowerEventGenerate is raised before every OTP is generated
+	PowerEventGenerate
+)
+
+// PowerCyclePolicy controls when a token is automatically power cycled
+type PowerCyclePolicy struct {
+	Mode        PowerCycleMode
+	IdleTimeout time.Duration // Only used with PowerCycleOnIdle
+}
+
+// ParsePowerCyclePolicy parses a policy in the format produced by
+// PowerCyclePolicy.String, i.e. "never", "start", "invocation" or
+// "idle:<duration>"
+func ParsePowerCyclePolicy(s string) (PowerCyclePolicy, error) {
+	mode, arg, _ := strings.Cut(strings.TrimSpace(s), ":")
+
+	switch mode {
+	case "", "never":
+		return PowerCyclePolicy{Mode: PowerCycleNever}, nil
+
+	case "start":
+		return PowerCyclePolicy{Mode: PowerCycleOnStart}, nil
+
+	case "invocation":
+		return PowerCyclePolicy{Mode: PowerCycleOnInvocation}, nil
+
+	case "idle":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return PowerCyclePolicy{}, fmt.Errorf("invalid idle timeout: %w", err)
+		}
+		if d <= 0 {
+			return PowerCyclePolicy{}, fmt.Errorf("invalid idle timeout: %s", arg)
+		}
+		return PowerCyclePolicy{Mode: PowerCycleOnIdle, IdleTimeout: d}, nil
+	}
+
+	return PowerCyclePolicy{}, fmt.Errorf("unknown power cycle policy '%s'", s)
+}
+
+// String returns the policy in a format suitable for ParsePowerCyclePolicy
+func (p PowerCyclePolicy) String() string {
+	switch p.Mode {
+	case PowerCycleOnStart:
+		return "start"
+	case PowerCycleOnInvocation:
+		return "invocation"
+	case PowerCycleOnIdle:
+		return "idle:" + p.IdleTimeout.String()
+	default:
+		return "never"
+	}
+}
+
+// Apply power cycles the token if the policy requires it for the event,
+// returning true if it did
+func (p PowerCyclePolicy) Apply(t *SoftToken, ev PowerEvent, now time.Time) (bool, error) {
+	switch p.Mode {
+	case PowerCycleOnStart:
+		if ev != PowerEventStart {
+			return false, nil
+		}
+
+	case PowerCycleOnInvocation:
+		if ev != PowerEventInvocation {
+			return false, nil
+		}
+
+	case PowerCycleOnIdle:
+		if ev != PowerEventGenerate || now.Sub(time.Unix(t.LastUse, 0)) < p.IdleTimeout {
+			return false, nil
+		}
+
+	default:
+		return false, nil
+	}
+
+	if err := t.PowerUpAt(now); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PowerUp emulates plugging the token in.  As with a hardware token the
+// use counter is incremented, the session counter is reset, and the 8Hz
+// timer restarts from a random value.
+func (t *SoftToken) PowerUp() error {
+	return t.PowerUpAt(time.Now())
+}
+
+// PowerUpAt is PowerUp with the power-up time specified
+func (t *SoftToken) PowerUpAt(now time.Time) error {
+	if t.Counter >= 0x7fff {
+		return ErrCounterExhausted
+	}
+
+	ponRand, err := newPonRand()
+	if err != nil {
+		return err
+	}
+
+	t.Counter++
+	t.Session = 0 // Incremented to 1 by the first OTP
+	t.PonRand = ponRand
+	t.PowerOn = now.Unix()
+
+	return nil
+}
+
+// PowerUpWithCounter is PowerUp, but with the use counter set to counter
+// rather than incremented.  It's used to move a token forwards, such as
+// into a leased counter range, so counter must be ahead of the token's.
+func (t *SoftToken) PowerUpWithCounter(counter uint16) error {
+	if counter <= t.Counter {
+		return fmt.Errorf("counter %d isn't ahead of %d", counter, t.Counter)
+	}
+	if counter > maxCounter {
+		return ErrCounterExhausted
+	}
+
+	t.Counter = counter - 1
+	return t.PowerUp()
+}
+
+// timerBase returns the time the token's 8Hz timer started counting from
+func (t *SoftToken) timerBase() int64 {
+	if t.PowerOn == 0 {
+		return t.Created // Token created before power-up tracking
+	}
+	return t.PowerOn
+}
+
+// timerValue returns the 24-bit 8Hz timer, ticks after power-up.  The sum
+// is 64 bit so the timer only ever wraps at 24 bits, rather than also
+// jumping back when a 32 bit sum would overflow.
+func timerValue(ticks int64, ponRand uint32) uint32 {
+	return uint32((uint64(ticks) + uint64(ponRand)) % 0xffffff)
+}
+
+// newPonRand generates a power-on random value, with the low nibble clear
+// for same-second increments
+func newPonRand() (uint32, error) {
+	var ponRandBytes [4]byte
+	if _, err := rand.Read(ponRandBytes[:]); err != nil {
+		return 0, fmt.Errorf("failed to generate ponrand: %w", err)
+	}
+	return binary.LittleEndian.Uint32(ponRandBytes[:]) & 0xfffffff0, nil
+}
@@ -0,0 +1,179 @@
+package token
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPowerUp(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := tok.GenerateOTP(); err != nil {
+			t.Fatalf("GenerateOTP failed: %v", err)
+		}
+	}
+
+	counter := tok.Counter
+	at := time.Now().Add(time.Hour)
+	if err := tok.PowerUpAt(at); err != nil {
+		t.Fatalf("PowerUpAt failed: %v", err)
+	}
+
+	if tok.Counter != counter+1 {
+		t.Errorf("Counter = %d, expected %d", tok.Counter, counter+1)
+	}
+	if tok.PowerOn != at.Unix() {
+		t.Errorf("PowerOn = %d, expected %d", tok.PowerOn, at.Unix())
+	}
+	if tok.PonRand&0x0f != 0 {
+		t.Errorf("PonRand low nibble = %x, expected 0", tok.PonRand&0x0f)
+	}
+
+	// First OTP after power-up uses session 1
+	if _, err := tok.GenerateOTP(); err != nil {
+		t.Fatalf("GenerateOTP failed: %v", err)
+	}
+	if tok.Session != 1 {
+		t.Errorf("Session = %d, expected 1", tok.Session)
+	}
+}
+
+func TestPowerUpExhausted(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	tok.Counter = 0x7fff
+
+	if err := tok.PowerUp(); !errors.Is(err, ErrCounterExhausted) {
+		t.Errorf("PowerUp = %v, expected ErrCounterExhausted", err)
+	}
+	if tok.Counter != 0x7fff {
+		t.Errorf("Counter changed to %d on failed power-up", tok.Counter)
+	}
+}
+
+func TestPowerOnSaveLoad(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	if err := tok.PowerUpAt(time.Unix(tok.Created+60, 0)); err != nil {
+		t.Fatalf("PowerUpAt failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "token")
+	if err := tok.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if loaded.PowerOn != tok.PowerOn {
+		t.Errorf("PowerOn mismatch: %d != %d", loaded.PowerOn, tok.PowerOn)
+	}
+}
+
+func TestParsePowerCyclePolicy(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected PowerCyclePolicy
+	}{
+		{"", PowerCyclePolicy{Mode: PowerCycleNever}},
+		{"never", PowerCyclePolicy{Mode: PowerCycleNever}},
+		{"start", PowerCyclePolicy{Mode: PowerCycleOnStart}},
+		{"invocation", PowerCyclePolicy{Mode: PowerCycleOnInvocation}},
+		{"idle:15m", PowerCyclePolicy{Mode: PowerCycleOnIdle, IdleTimeout: 15 * time.Minute}},
+	}
+
+	for _, tt := range tests {
+		p, err := ParsePowerCyclePolicy(tt.input)
+		if err != nil {
+			t.Errorf("ParsePowerCyclePolicy(%q) returned error: %v", tt.input, err)
+			continue
+		}
+		if p != tt.expected {
+			t.Errorf("ParsePowerCyclePolicy(%q) = %+v, expected %+v", tt.input, p, tt.expected)
+		}
+
+		// Round trip
+		again, err := ParsePowerCyclePolicy(p.String())
+		if err != nil || again != p {
+			t.Errorf("Round trip of %q failed: %+v, %v", p.String(), again, err)
+		}
+	}
+
+	for _, input := range []string{"sometimes", "idle", "idle:0s", "idle:-1m"} {
+		if _, err := ParsePowerCyclePolicy(input); err == nil {
+			t.Errorf("ParsePowerCyclePolicy(%q) should have returned error", input)
+		}
+	}
+}
+
+func TestPowerCyclePolicyApply(t *testing.T) {
+	now := time.Now()
+	idle := PowerCyclePolicy{Mode: PowerCycleOnIdle, IdleTimeout: 10 * time.Minute}
+
+	tests := []struct {
+		name     string
+		policy   PowerCyclePolicy
+		event    PowerEvent
+		lastUse  time.Time
+		expected bool
+	}{
+		{"never", PowerCyclePolicy{Mode: PowerCycleNever}, PowerEventStart, now, false},
+		{"start on start", PowerCyclePolicy{Mode: PowerCycleOnStart}, PowerEventStart, now, true},
+		{"start on generate", PowerCyclePolicy{Mode: PowerCycleOnStart}, PowerEventGenerate, now, false},
+		{"invocation on invocation", PowerCyclePolicy{Mode: PowerCycleOnInvocation}, PowerEventInvocation, now, true},
+		{"invocation on start", PowerCyclePolicy{Mode: PowerCycleOnInvocation}, PowerEventStart, now, false},
+		{"idle when busy", idle, PowerEventGenerate, now.Add(-time.Minute), false},
+		{"idle when idle", idle, PowerEventGenerate, now.Add(-time.Hour), true},
+		{"idle on start", idle, PowerEventStart, now.Add(-time.Hour), false},
+	}
+
+	for _, tt := range tests {
+		tok, err := New()
+		if err != nil {
+			t.Fatalf("Failed to create new token: %v", err)
+		}
+		tok.LastUse = tt.lastUse.Unix()
+		counter := tok.Counter
+
+		cycled, err := tt.policy.Apply(tok, tt.event, now)
+		if err != nil {
+			t.Fatalf("%s: Apply returned error: %v", tt.name, err)
+		}
+		if cycled != tt.expected {
+			t.Errorf("%s: Apply = %v, expected %v", tt.name, cycled, tt.expected)
+		}
+		if cycled && tok.Counter != counter+1 {
+			t.Errorf("%s: Counter = %d, expected %d", tt.name, tok.Counter, counter+1)
+		}
+		if !cycled && tok.Counter != counter {
+			t.Errorf("%s: Counter changed without power cycle", tt.name)
+		}
+	}
+}
+
+func TestTimerValueWrap(t *testing.T) {
+	// Unchanged from a 32 bit sum until it would overflow
+	if v := timerValue(100, 0x10); v != 0x74 {
+		t.Errorf("timerValue = %06x, expected 000074", v)
+	}
+
+	// Crossing 2^32 only advances the timer by a tick
+	ponRand := uint32(0xfffffff0)
+	before := timerValue(0x0f, ponRand)
+	after := timerValue(0x10, ponRand)
+	if after != (before+1)%0xffffff {
+		t.Errorf("Timer went from %06x to %06x across a 32 bit overflow", before, after)
+	}
+}
@@ -0,0 +1,45 @@
+package token
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxSameSecondOTPs is how many OTPs can be generated within one second
+// before the 8Hz timer would run ahead of the wall clock
+const maxSameSecondOTPs = 7
+
+// RateLimitError indicates OTPs are being generated faster than the token's
+// 8Hz timer allows
+type RateLimitError struct {
+	Wait time.Duration // How long until the next OTP can be generated
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited, next OTP available in %s", e.Wait.Round(time.Millisecond))
+}
+
+// RateLimitDelay returns how long GenerateOTP will block before generating
+// the next OTP, or 0 if it won't block
+func (t *SoftToken) RateLimitDelay() time.Duration {
+	return t.rateLimitDelayAt(time.Now())
+}
+
+func (t *SoftToken) rateLimitDelayAt(now time.Time) time.Duration {
+	if now.Unix() != t.LastUse || (t.PonRand&0x0000000f) < maxSameSecondOTPs {
+		return 0
+	}
+	return time.Unix(t.LastUse+1, 0).Sub(now)
+}
+
+// TryGenerateOTP is GenerateOTP, but instead of blocking when rate limited
+// it returns a *RateLimitError, leaving the token state unchanged
+func (t *SoftToken) TryGenerateOTP() (string, error) {
+	return t.generateAt(time.Now())
+}
+
+// GenerateOTPAt is TryGenerateOTP as if the current time were now, for
+// simulating tokens in virtual time
+func (t *SoftToken) GenerateOTPAt(now time.Time) (string, error) {
+	return t.generateAt(now)
+}
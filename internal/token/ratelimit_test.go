@@ -0,0 +1,104 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// rateLimited returns a token that will be rate limited if used before
+// the end of the current second
+func rateLimited(t *testing.T) *SoftToken {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	tok.LastUse = time.Now().Unix()
+	tok.PonRand |= maxSameSecondOTPs
+	return tok
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+
+	now := time.Unix(tok.LastUse, int64(250*time.Millisecond))
+	if d := tok.rateLimitDelayAt(now); d != 0 {
+		t.Errorf("Fresh token delay = %s, expected 0", d)
+	}
+
+	tok.PonRand |= maxSameSecondOTPs
+	if d := tok.rateLimitDelayAt(now); d != 750*time.Millisecond {
+		t.Errorf("Rate limited delay = %s, expected 750ms", d)
+	}
+
+	// Limit only applies within the same second
+	if d := tok.rateLimitDelayAt(now.Add(time.Second)); d != 0 {
+		t.Errorf("Delay in next second = %s, expected 0", d)
+	}
+}
+
+func TestTryGenerateOTPRateLimited(t *testing.T) {
+	tok := rateLimited(t)
+	before := *tok
+
+	_, err := tok.TryGenerateOTP()
+
+	// The second may have ticked over since rateLimited
+	if tok.LastUse != before.LastUse {
+		t.Skip("Second boundary crossed")
+	}
+
+	var rateLimitErr *RateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		t.Fatalf("TryGenerateOTP = %v, expected *RateLimitError", err)
+	}
+	if rateLimitErr.Wait <= 0 || rateLimitErr.Wait > time.Second {
+		t.Errorf("Wait = %s, expected (0, 1s]", rateLimitErr.Wait)
+	}
+	if tok.Session != before.Session || tok.Counter != before.Counter || tok.PonRand != before.PonRand {
+		t.Error("Token state changed by rate limited TryGenerateOTP")
+	}
+}
+
+func TestGenerateOTPContextCancelled(t *testing.T) {
+	tok := rateLimited(t)
+	before := *tok
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := tok.GenerateOTPContext(ctx)
+	if tok.LastUse != before.LastUse {
+		t.Skip("Second boundary crossed")
+	}
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GenerateOTPContext = %v, expected context.DeadlineExceeded", err)
+	}
+	if tok.Session != before.Session || tok.PonRand != before.PonRand {
+		t.Error("Token state changed by cancelled GenerateOTPContext")
+	}
+}
+
+func TestGenerateOTPContextWaits(t *testing.T) {
+	tok := rateLimited(t)
+	session := tok.Session
+
+	otp, err := tok.GenerateOTPContext(context.Background())
+	if err != nil {
+		t.Fatalf("GenerateOTPContext failed: %v", err)
+	}
+	if len(otp) != 44 {
+		t.Errorf("OTP length = %d, expected 44", len(otp))
+	}
+	if tok.Session != session+1 {
+		t.Errorf("Session = %d, expected %d", tok.Session, session+1)
+	}
+	if tok.PonRand&0x0f != 0 {
+		t.Errorf("PonRand low nibble = %x, expected reset to 0", tok.PonRand&0x0f)
+	}
+}
@@ -0,0 +1,180 @@
+package token
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrRotationInProgress indicates a token already has a successor
+	// waiting to be registered
+	ErrRotationInProgress = errors.New("rotation already in progress")
+	// ErrNoRotation indicates a token has no rotation in progress
+	ErrNoRotation = errors.New("no rotation in progress")
+)
+
+// successorName returns the record the named token's successor is kept in
+// until its rotation completes.  It's hidden so it isn't listed as a token.
+func successorName(name string) string {
+	return "." + name + ".successor"
+}
+
+// retiredName returns the record the named token is kept in once it's been
+// replaced
+func retiredName(name string, at time.Time) string {
+	return "." + name + ".retired-" + strconv.FormatInt(at.Unix(), 10)
+}
+
+// StartRotation creates a successor for the named token, returning it so
+// its registration information can be exported.  If keepPublicID is true
+// the successor has the same public ID, and continues the token's use
+// counter, as the validation server keeps the last counter it saw for the
+// public ID.  Otherwise it's assigned a new one by the directory's policy.
+// The named token remains usable until CompleteRotation is called.
+func (m *Manager) StartRotation(name string, keepPublicID bool) (*SoftToken, error) {
+	mt, err := m.get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if mt.deleted {
+		return nil, m.errGone(name)
+	}
+
+	next := successorName(name)
+	if _, err := m.store.Get(next); !errors.Is(err, ErrTokenNotFound) {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: '%s'", ErrRotationInProgress, name)
+	}
+
+	policy, err := LoadPolicy(m.dir)
+	if err != nil {
+		return nil, err
+	}
+	successor, err := m.NewUnique(policy)
+	if err != nil {
+		return nil, err
+	}
+	if keepPublicID {
+		successor.PublicID = append([]byte{}, mt.token.PublicID...)
+		if err := continueCounter(successor, mt.token); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := m.save(successor, next); err != nil {
+		return nil, err
+	}
+	return successor, nil
+}
+
+// Successor returns the successor of the named token, if a rotation is in
+// progress
+func (m *Manager) Successor(name string) (*SoftToken, error) {
+	successor, err := m.load(successorName(name))
+	if errors.Is(err, ErrTokenNotFound) {
+		return nil, fmt.Errorf("%w: '%s'", ErrNoRotation, name)
+	}
+	return successor, err
+}
+
+// CompleteRotation replaces the named token with its successor.  It should
+// only be called once the successor is registered with the validation
+// server.  The old token is retired to a hidden record in the store.
+func (m *Manager) CompleteRotation(name string) error {
+	mt, err := m.get(name)
+	if err != nil {
+		return err
+	}
+
+	mt.mu.Lock()
+	if mt.deleted {
+		mt.mu.Unlock()
+		return m.errGone(name)
+	}
+
+	successor, err := m.Successor(name)
+	if err != nil {
+		mt.mu.Unlock()
+		return err
+	}
+
+	// The token may have been used since the rotation started
+	if bytes.Equal(successor.PublicID, mt.token.PublicID) && successor.Counter <= mt.token.Counter {
+		err := continueCounter(successor, mt.token)
+		if err == nil {
+			err = m.save(successor, successorName(name))
+		}
+		if err != nil {
+			mt.mu.Unlock()
+			return err
+		}
+	}
+
+	err = m.replace(name, time.Now())
+	if err == nil {
+		mt.token = successor
+	}
+	mt.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	m.publish(Event{Type: EventRotated, Name: name, Counter: successor.Counter, Session: successor.Session})
+	return nil
+}
+
+// continueCounter starts successor's use counter after predecessor's, so
+// its OTPs aren't rejected as replays of the predecessor's
+func continueCounter(successor, predecessor *SoftToken) error {
+	if predecessor.Counter >= maxCounter {
+		return ErrCounterExhausted
+	}
+	successor.Counter = predecessor.Counter + 1
+	successor.Session = 0
+	return nil
+}
+
+// replace retires the named token's record and puts its successor's
+// record in its place.  The records are copied as they are, so they stay
+// encrypted if they were.
+func (m *Manager) replace(name string, at time.Time) error {
+	unlock, err := m.store.Lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := m.store.Get(name)
+	if err != nil {
+		return err
+	}
+	next, err := m.store.Get(successorName(name))
+	if err != nil {
+		return err
+	}
+
+	if err := m.store.Put(retiredName(name, at), current); err != nil {
+		return fmt.Errorf("failed to retire token: %w", err)
+	}
+	if err := m.store.Put(name, next); err != nil {
+		return fmt.Errorf("failed to replace token: %w", err)
+	}
+	return m.store.Delete(successorName(name))
+}
+
+// CancelRotation discards the successor of the named token
+func (m *Manager) CancelRotation(name string) error {
+	err := m.store.Delete(successorName(name))
+	if errors.Is(err, ErrTokenNotFound) {
+		return fmt.Errorf("%w: '%s'", ErrNoRotation, name)
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package token
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotation(t *testing.T) {
+	m := newTestManager(t, "a")
+	rec := &eventRecorder{}
+	m.Subscribe(rec.record)
+	old, _ := m.Get("a")
+
+	if _, err := m.Successor("a"); !errors.Is(err, ErrNoRotation) {
+		t.Errorf("Successor before rotation = %v, expected ErrNoRotation", err)
+	}
+
+	successor, err := m.StartRotation("a", false)
+	if err != nil {
+		t.Fatalf("StartRotation failed: %v", err)
+	}
+	if bytes.Equal(successor.PublicID, old.PublicID) {
+		t.Error("Successor has the old public ID")
+	}
+	if _, err := m.StartRotation("a", false); !errors.Is(err, ErrRotationInProgress) {
+		t.Errorf("Second StartRotation = %v, expected ErrRotationInProgress", err)
+	}
+
+	// The old token stays in use, and the successor isn't listed
+	if _, err := m.Generate(context.Background(), "a"); err != nil {
+		t.Fatalf("Generate during rotation failed: %v", err)
+	}
+	if names, _ := m.Names(); len(names) != 1 {
+		t.Errorf("Names during rotation = %v, expected [a]", names)
+	}
+
+	if err := m.CompleteRotation("a"); err != nil {
+		t.Fatalf("CompleteRotation failed: %v", err)
+	}
+
+	current, err := m.Get("a")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if current.AESKey != successor.AESKey || !bytes.Equal(current.PublicID, successor.PublicID) {
+		t.Error("Token wasn't replaced by its successor")
+	}
+	loaded, err := Load(filepath.Join(m.Dir(), "a"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if loaded.AESKey != successor.AESKey {
+		t.Error("Successor wasn't saved as the token")
+	}
+	if rec.count(EventRotated) != 1 {
+		t.Errorf("Got %d rotation events, expected 1", rec.count(EventRotated))
+	}
+
+	// The old token is retired, not deleted
+	entries, _ := os.ReadDir(m.Dir())
+	var retired int
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".a.retired-") {
+			retired++
+		}
+	}
+	if retired != 1 {
+		t.Errorf("Found %d retired tokens, expected 1", retired)
+	}
+
+	if _, err := m.Successor("a"); !errors.Is(err, ErrNoRotation) {
+		t.Errorf("Successor after rotation = %v, expected ErrNoRotation", err)
+	}
+}
+
+func TestRotationKeepPublicID(t *testing.T) {
+	m := newTestManager(t, "a")
+	old, _ := m.Get("a")
+
+	successor, err := m.StartRotation("a", true)
+	if err != nil {
+		t.Fatalf("StartRotation failed: %v", err)
+	}
+	if !bytes.Equal(successor.PublicID, old.PublicID) {
+		t.Error("Successor doesn't have the old public ID")
+	}
+	if successor.AESKey == old.AESKey || successor.PrivateID == old.PrivateID {
+		t.Error("Successor reuses the old secrets")
+	}
+}
+
+func TestRotationCancel(t *testing.T) {
+	m := newTestManager(t, "a")
+	old, _ := m.Get("a")
+
+	if _, err := m.StartRotation("a", false); err != nil {
+		t.Fatalf("StartRotation failed: %v", err)
+	}
+	if err := m.CancelRotation("a"); err != nil {
+		t.Fatalf("CancelRotation failed: %v", err)
+	}
+	if err := m.CompleteRotation("a"); !errors.Is(err, ErrNoRotation) {
+		t.Errorf("CompleteRotation after cancel = %v, expected ErrNoRotation", err)
+	}
+
+	current, _ := m.Get("a")
+	if current.AESKey != old.AESKey {
+		t.Error("Cancelled rotation replaced the token")
+	}
+
+	// Deleting a token discards its successor
+	if _, err := m.StartRotation("a", false); err != nil {
+		t.Fatalf("StartRotation failed: %v", err)
+	}
+	if err := m.Delete("a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := m.Successor("a"); !errors.Is(err, ErrNoRotation) {
+		t.Errorf("Successor after delete = %v, expected ErrNoRotation", err)
+	}
+}
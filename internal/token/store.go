@@ -0,0 +1,521 @@
+package token
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/fsutil"
+)
+
+// Store persists tokens as records, by name.  A record is what would be
+// saved in a token file, encrypted if the token directory is.  Names
+// starting with "." are hidden records, such as successors and retired
+// tokens, which aren't tokens in their own right.  Stores must be safe for
+// concurrent use.
+type Store interface {
+	// List returns the names of every record, hidden ones included, sorted
+	List() ([]string, error)
+	// Get returns the named record, or an error wrapping ErrTokenNotFound
+	Get(name string) ([]byte, error)
+	// Put creates or replaces the named record.  A partly written record
+	// is never seen by Get.
+	Put(name string, data []byte) error
+	// Delete removes the named record, or returns an error wrapping
+	// ErrTokenNotFound
+	Delete(name string) error
+	// Lock takes an exclusive lock on the named record, held until the
+	// returned function is called.  Where the backend allows it the lock
+	// excludes other processes too.
+	Lock(name string) (func(), error)
+}
+
+// StoreConfigFile selects a token directory's store.  Without it tokens
+// are kept in files in the directory.
+const StoreConfigFile = ".store"
+
+const (
+	// Field names for the store configuration
+	BackendField = "backend"
+	PathField    = "path"
+)
+
+// Store backends
+const (
+	BackendFile          = "file"
+	BackendBolt          = "bolt"
+	BackendSecretService = "secret-service"
+)
+
+// KeyringField marks a token file whose secrets are kept in a keyring, and
+// names the keyring
+const KeyringField = "keyring"
+
+// KeyringSecretService is the keyring field of tokens with their secrets in
+// the Secret Service
+const KeyringSecretService = "secret-service"
+
+// defaultBoltFile is the database a bolt store uses, in the token
+// directory, if no path is configured
+const defaultBoltFile = "tokens.db"
+
+var (
+	// ErrUnknownBackend indicates a store configuration names a backend
+	// that doesn't exist
+	ErrUnknownBackend = errors.New("unknown store backend")
+	// ErrInKeyring indicates a token file's secrets are kept in a keyring,
+	// so it can only be loaded through its store
+	ErrInKeyring = errors.New("token secrets are kept in the keyring")
+	// ErrSecretsMissing indicates a token file's secrets weren't found in
+	// its keyring
+	ErrSecretsMissing = errors.New("token secrets missing from keyring")
+)
+
+// StoreConfig is a token directory's store configuration
+type StoreConfig struct {
+	Backend string
+	Path    string // Database for the bolt backend, relative to the token directory
+}
+
+// LoadStoreConfig loads the store configuration of a token directory,
+// defaulting to the file backend
+func LoadStoreConfig(tokenDir string) (StoreConfig, error) {
+	c := StoreConfig{Backend: BackendFile}
+
+	file, err := os.Open(filepath.Join(tokenDir, StoreConfigFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+
+		switch strings.TrimSpace(parts[0]) {
+		case BackendField:
+			c.Backend = value
+		case PathField:
+			c.Path = value
+		}
+	}
+	return c, scanner.Err()
+}
+
+// SaveStoreConfig saves the store configuration of a token directory
+func SaveStoreConfig(tokenDir string, c StoreConfig) error {
+	data := fmt.Sprintf("%s: %s\n", BackendField, c.Backend)
+	if c.Path != "" {
+		data += fmt.Sprintf("%s: %s\n", PathField, c.Path)
+	}
+	if err := os.MkdirAll(tokenDir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return fsutil.WriteFileAtomic(filepath.Join(tokenDir, StoreConfigFile), []byte(data))
+}
+
+// OpenStore opens the store configured for a token directory
+func OpenStore(tokenDir string) (Store, error) {
+	c, err := LoadStoreConfig(tokenDir)
+	if err != nil {
+		return nil, err
+	}
+	return openStore(tokenDir, c)
+}
+
+// openStore opens the store c configures for a token directory
+func openStore(tokenDir string, c StoreConfig) (Store, error) {
+	switch c.Backend {
+	case BackendFile, "":
+		return NewFileStore(tokenDir), nil
+	case BackendBolt:
+		path := c.Path
+		if path == "" {
+			path = defaultBoltFile
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(tokenDir, path)
+		}
+		return NewBoltStore(path)
+	case BackendSecretService:
+		return openSecretStore(tokenDir)
+	}
+	return nil, fmt.Errorf("%w: '%s'", ErrUnknownBackend, c.Backend)
+}
+
+// MigrateStore moves every record in a token directory's store to the
+// store c configures, and makes it the directory's store.  Records are only
+// removed from the old store once they're all in the new one.  Migrating to
+// the current store puts every record again, which moves the secrets of
+// token files copied into a secret store's directory into the keyring.
+func MigrateStore(tokenDir string, c StoreConfig) error {
+	if c.Backend == "" {
+		c.Backend = BackendFile
+	}
+	current, err := LoadStoreConfig(tokenDir)
+	if err != nil {
+		return err
+	}
+
+	from, err := openStore(tokenDir, current)
+	if err != nil {
+		return err
+	}
+	to := from
+	if c != current {
+		if to, err = openStore(tokenDir, c); err != nil {
+			return err
+		}
+	}
+
+	// A secret store reads files still holding their secrets, so it takes
+	// over the files it shares before they're moved.  Were the move
+	// interrupted, it can then be finished by migrating again.
+	early := c != current && isSecretStore(to) && sharesFiles(from, to)
+	if early {
+		if err := SaveStoreConfig(tokenDir, c); err != nil {
+			return err
+		}
+	}
+
+	records, err := from.List()
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, name := range records {
+		data, err := from.Get(name)
+		if err != nil {
+			return fmt.Errorf("failed to read '%s': %w", name, err)
+		}
+		// Other files in the token directory, such as a bolt store's
+		// database, are left where they are
+		if !bytes.HasPrefix(data, []byte(PublicIDField+":")) {
+			continue
+		}
+		if !isSecretStore(from) && fieldValue(data, KeyringField) != "" {
+			return fmt.Errorf("failed to read '%s': %w", name, ErrInKeyring)
+		}
+		if err := to.Put(name, data); err != nil {
+			return fmt.Errorf("failed to migrate '%s': %w", name, err)
+		}
+		names = append(names, name)
+	}
+
+	if c == current {
+		return nil
+	}
+	if !early {
+		if err := SaveStoreConfig(tokenDir, c); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		if err := release(from, to, name); err != nil {
+			return fmt.Errorf("failed to remove '%s' from the old store: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// release removes a migrated record from the store it was migrated from.
+// Only what isn't shared with the store it was migrated to is removed.
+func release(from, to Store, name string) error {
+	var err error
+	switch {
+	case !sharesFiles(from, to):
+		err = from.Delete(name)
+	case isSecretStore(from):
+		err = from.(*SecretStore).forget(name)
+	}
+
+	if errors.Is(err, ErrTokenNotFound) {
+		return nil
+	}
+	return err
+}
+
+// isSecretStore returns true if s is a *SecretStore
+func isSecretStore(s Store) bool {
+	_, ok := s.(*SecretStore)
+	return ok
+}
+
+// sharesFiles returns true if stores a and b keep their records in the same
+// files, as file and secret stores on the same directory do
+func sharesFiles(a, b Store) bool {
+	return sameDir(filesDir(a), filesDir(b))
+}
+
+// filesDir returns the directory a store keeps its records' files in, or
+// "" if it doesn't keep them in files
+func filesDir(s Store) string {
+	switch s := s.(type) {
+	case *FileStore:
+		return s.Dir()
+	case *SecretStore:
+		return s.Dir()
+	}
+	return ""
+}
+
+// sameDir returns true if a and b are the same directory
+func sameDir(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+// secretFields are the fields of a token kept in the keyring
+var secretFields = map[string]bool{
+	PrivateIDField:         true,
+	AESKeyField:            true,
+	StagedPrivateIDField:   true,
+	StagedAESKeyField:      true,
+	PreviousPrivateIDField: true,
+	PreviousAESKeyField:    true,
+}
+
+// splitSecrets splits a record into the lines of its secret fields, and
+// the rest.  Any keyring marker is dropped.
+func splitSecrets(data []byte) (public, secrets []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		field := strings.TrimSpace(strings.SplitN(line, ":", 2)[0])
+
+		switch {
+		case field == KeyringField:
+		case secretFields[field]:
+			secrets = append(secrets, line+"\n"...)
+		default:
+			public = append(public, line+"\n"...)
+		}
+	}
+	return public, secrets
+}
+
+// FileStore keeps each record in a file in a directory, named after it.
+// It's the default store, and the layout the token directory has always
+// had.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a store keeping records in dir
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+// Dir returns the directory the store keeps records in
+func (s *FileStore) Dir() string {
+	return s.dir
+}
+
+// List returns the names of every record in the directory.  Hidden files
+// are only records if they hold a token, as the directory also holds
+// hidden metadata such as the policy.
+func (s *FileStore) List() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(name, ".") && !isTokenFile(filepath.Join(s.dir, name)) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// isTokenFile returns true if the file at path holds a token, encrypted or
+// not.  Temporary files being written are skipped.
+func isTokenFile(path string) bool {
+	if strings.Contains(filepath.Base(path), ".tmp-") {
+		return false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	first, _ := bufio.NewReader(file).ReadString('\n')
+	return strings.HasPrefix(first, PublicIDField+":")
+}
+
+// Get reads the named record's file
+func (s *FileStore) Get(name string) ([]byte, error) {
+	data, err := os.ReadFile(GetTokenPath(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: '%s'", ErrTokenNotFound, name)
+	}
+	return data, err
+}
+
+// Put writes the named record's file atomically
+func (s *FileStore) Put(name string, data []byte) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return fsutil.WriteFileAtomic(GetTokenPath(s.dir, name), data)
+}
+
+// Delete removes the named record's file
+func (s *FileStore) Delete(name string) error {
+	err := os.Remove(GetTokenPath(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: '%s'", ErrTokenNotFound, name)
+	}
+	return err
+}
+
+// Lock creates a hidden lock file beside the named record's file
+func (s *FileStore) Lock(name string) (func(), error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	return lockFile(filepath.Join(s.dir, "."+name+".lock"))
+}
+
+const (
+	// lockRetry is how often a held lock file is retried
+	lockRetry = 10 * time.Millisecond
+	// lockTimeout is how long to wait for a lock file
+	lockTimeout = 10 * time.Second
+)
+
+// ErrLockTimeout indicates a record stayed locked by another process
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+// lockFile takes the lock file at path, waiting up to lockTimeout for any
+// other process holding it, and returns a function releasing it
+func lockFile(path string) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	lock, err := fsutil.Lock(ctx, path, lockRetry)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w: '%s'", ErrLockTimeout, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lock.Unlock, nil
+}
+
+// MemoryStore keeps records in memory, for tests and tokens that mustn't
+// touch the disk
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string][]byte
+	locks   map[string]*sync.Mutex
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records: make(map[string][]byte),
+		locks:   make(map[string]*sync.Mutex),
+	}
+}
+
+// List returns the names of every record
+func (s *MemoryStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.records))
+	for name := range s.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Get returns a copy of the named record
+func (s *MemoryStore) Get(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.records[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrTokenNotFound, name)
+	}
+	return bytes.Clone(data), nil
+}
+
+// Put stores a copy of the named record
+func (s *MemoryStore) Put(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[name] = bytes.Clone(data)
+	return nil
+}
+
+// Delete removes the named record
+func (s *MemoryStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.records[name]; !ok {
+		return fmt.Errorf("%w: '%s'", ErrTokenNotFound, name)
+	}
+	delete(s.records, name)
+	return nil
+}
+
+// Lock locks the named record within this process
+func (s *MemoryStore) Lock(name string) (func(), error) {
+	s.mu.Lock()
+	l, ok := s.locks[name]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[name] = l
+	}
+	s.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock, nil
+}
+
+// isHidden returns true if name is a hidden record, rather than a token
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
@@ -0,0 +1,149 @@
+//go:build !js
+
+package token
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket holds the records in a bolt database
+var boltBucket = []byte("tokens")
+
+// boltOpenTimeout is how long to wait for another process to close the
+// database
+const boltOpenTimeout = 5 * time.Second
+
+// BoltStore keeps records in a single file bolt database.  The database is
+// only open while a record is read or written, so several processes, such
+// as the GUI and CLI, can share it.
+type BoltStore struct {
+	path  string
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// NewBoltStore returns a store keeping records in the bolt database at
+// path, creating it if it doesn't exist
+func NewBoltStore(path string) (*BoltStore, error) {
+	s := &BoltStore{path: path, locks: make(map[string]*sync.Mutex)}
+	err := s.update(func(b *bolt.Bucket) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Path returns the database's file
+func (s *BoltStore) Path() string {
+	return s.path
+}
+
+// update opens the database and calls fn in a read-write transaction
+func (s *BoltStore) update(fn func(b *bolt.Bucket) error) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %w", s.path, err)
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltBucket)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// view opens the database and calls fn in a read-only transaction
+func (s *BoltStore) view(fn func(b *bolt.Bucket) error) error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %w", s.path, err)
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(boltBucket))
+	})
+}
+
+// List returns the names of every record, in key order
+func (s *BoltStore) List() ([]string, error) {
+	names := []string{}
+	err := s.view(func(b *bolt.Bucket) error {
+		return b.ForEach(func(k, _ []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// Get returns the named record
+func (s *BoltStore) Get(name string) ([]byte, error) {
+	var data []byte
+	err := s.view(func(b *bolt.Bucket) error {
+		// Values are only valid during the transaction
+		if v := b.Get([]byte(name)); v != nil {
+			data = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrTokenNotFound, name)
+	}
+	return data, nil
+}
+
+// Put stores the named record
+func (s *BoltStore) Put(name string, data []byte) error {
+	return s.update(func(b *bolt.Bucket) error {
+		return b.Put([]byte(name), data)
+	})
+}
+
+// Delete removes the named record
+func (s *BoltStore) Delete(name string) error {
+	return s.update(func(b *bolt.Bucket) error {
+		if b.Get([]byte(name)) == nil {
+			return fmt.Errorf("%w: '%s'", ErrTokenNotFound, name)
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+// Lock locks the named record within this process, and with a hidden lock
+// file beside the database against other processes
+func (s *BoltStore) Lock(name string) (func(), error) {
+	s.mu.Lock()
+	l, ok := s.locks[name]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[name] = l
+	}
+	s.mu.Unlock()
+
+	l.Lock()
+	unlock, err := lockFile(filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+"."+name+".lock"))
+	if err != nil {
+		l.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		l.Unlock()
+	}, nil
+}
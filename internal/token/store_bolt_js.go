@@ -0,0 +1,20 @@
+//go:build js
+
+package token
+
+import "errors"
+
+// BoltStore isn't available in the browser, which has no files
+type BoltStore struct{}
+
+// NewBoltStore returns errors.ErrUnsupported in the browser
+func NewBoltStore(path string) (*BoltStore, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (s *BoltStore) List() ([]string, error)            { return nil, errors.ErrUnsupported }
+func (s *BoltStore) Get(name string) ([]byte, error)    { return nil, errors.ErrUnsupported }
+func (s *BoltStore) Put(name string, data []byte) error { return errors.ErrUnsupported }
+func (s *BoltStore) Delete(name string) error           { return errors.ErrUnsupported }
+func (s *BoltStore) Lock(name string) (func(), error)   { return nil, errors.ErrUnsupported }
+func (s *BoltStore) Path() string                       { return "" }
@@ -0,0 +1,121 @@
+package token
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// CounterStore keeps the counters and metadata of a token whose secrets
+// come from elsewhere, such as an environment variable.  A token's state is
+// the fields of its token file, without its private ID and AES keys.
+type CounterStore interface {
+	// Load returns the state last saved for the token with the given
+	// modhex public ID, or nil if there's none
+	Load(publicID string) ([]byte, error)
+	// Save saves the state of the token with the given modhex public ID
+	Save(publicID string, state []byte) error
+}
+
+// EphemeralStore holds a single token from outside a token directory, such
+// as one passed to a CI job, keeping its counters in a CounterStore.  The
+// token loaded is whichever is further on of the one it holds and the
+// state in the counter store, so the token it was created with can be
+// reused.  Only the token itself can be stored, so it can't be rotated or
+// deleted.
+type EphemeralStore struct {
+	name     string
+	publicID string
+	counters CounterStore
+
+	mu     sync.Mutex
+	record []byte
+	lock   sync.Mutex // Held by Lock
+}
+
+// NewEphemeralStore returns a store holding t under name, with its
+// counters kept in counters
+func NewEphemeralStore(name string, t *SoftToken, counters CounterStore) *EphemeralStore {
+	return &EphemeralStore{
+		name:     name,
+		publicID: yubikey.ModHexEncode(t.PublicID),
+		counters: counters,
+		record:   t.marshal(),
+	}
+}
+
+// List returns the name of the token held
+func (s *EphemeralStore) List() ([]string, error) {
+	return []string{s.name}, nil
+}
+
+// Get returns the token held, with the state in the counter store if it's
+// further on
+func (s *EphemeralStore) Get(name string) ([]byte, error) {
+	if name != s.name {
+		return nil, fmt.Errorf("%w: '%s'", ErrTokenNotFound, name)
+	}
+
+	s.mu.Lock()
+	record := s.record
+	s.mu.Unlock()
+
+	state, err := s.counters.Load(s.publicID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load counters: %w", err)
+	}
+	if state == nil {
+		return record, nil
+	}
+
+	stored, err := parseToken(bytes.NewReader(state))
+	if err != nil {
+		return nil, fmt.Errorf("invalid counters: %w", err)
+	}
+	if yubikey.ModHexEncode(stored.PublicID) != s.publicID {
+		return nil, fmt.Errorf("invalid counters: saved for token %s, not %s",
+			yubikey.ModHexEncode(stored.PublicID), s.publicID)
+	}
+	current, err := parseToken(bytes.NewReader(record))
+	if err != nil {
+		return nil, err
+	}
+	if !counterAhead(stored, current) {
+		return record, nil
+	}
+
+	public, _ := splitSecrets(state)
+	_, secrets := splitSecrets(record)
+	return append(public, secrets...), nil
+}
+
+// Put saves the token's state to the counter store
+func (s *EphemeralStore) Put(name string, data []byte) error {
+	if name != s.name {
+		return fmt.Errorf("%w: only '%s' can be stored", errors.ErrUnsupported, s.name)
+	}
+
+	public, _ := splitSecrets(data)
+	if err := s.counters.Save(s.publicID, public); err != nil {
+		return fmt.Errorf("failed to save counters: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record = data
+	return nil
+}
+
+// Delete isn't supported
+func (s *EphemeralStore) Delete(name string) error {
+	return fmt.Errorf("%w: ephemeral tokens can't be deleted", errors.ErrUnsupported)
+}
+
+// Lock locks the token within this process
+func (s *EphemeralStore) Lock(name string) (func(), error) {
+	s.lock.Lock()
+	return s.lock.Unlock, nil
+}
@@ -0,0 +1,164 @@
+//go:build !js
+
+package token
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/arr2036/yksofttoken/internal/secretservice"
+)
+
+// SecretStore keeps the private IDs and AES keys of records in a desktop
+// keyring, through the Secret Service API.  The rest of each record, its
+// counters and metadata, is kept in a file in the token directory, marked
+// as having its secrets in the keyring.  Records without secrets, such as
+// tokens encrypted with a vault, are kept in their files as they are.
+type SecretStore struct {
+	files  *FileStore
+	client *secretservice.Client
+	dir    string // Absolute, to tell token directories apart in the keyring
+
+	mu   sync.Mutex
+	sums map[string][sha256.Size]byte // Secrets known to be in the keyring
+}
+
+// NewSecretStore returns a store keeping records in dir, with their
+// secrets in the Secret Service c is a client of
+func NewSecretStore(dir string, c *secretservice.Client) (*SecretStore, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretStore{
+		files:  NewFileStore(dir),
+		client: c,
+		dir:    abs,
+		sums:   make(map[string][sha256.Size]byte),
+	}, nil
+}
+
+// openSecretStore returns a store keeping secrets in the Secret Service on
+// the session bus
+func openSecretStore(dir string) (*SecretStore, error) {
+	c, err := secretservice.Connect()
+	if err != nil {
+		return nil, err
+	}
+	return NewSecretStore(dir, c)
+}
+
+// Dir returns the directory the records' files are kept in
+func (s *SecretStore) Dir() string {
+	return s.files.Dir()
+}
+
+// attributes identify the named record's secrets in the keyring
+func (s *SecretStore) attributes(name string) map[string]string {
+	return map[string]string{
+		"application": "yksoft",
+		"directory":   s.dir,
+		"token":       name,
+	}
+}
+
+// List returns the names of every record's file
+func (s *SecretStore) List() ([]string, error) {
+	return s.files.List()
+}
+
+// Get returns the named record, with its secrets from the keyring
+func (s *SecretStore) Get(name string) ([]byte, error) {
+	data, err := s.files.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if fieldValue(data, KeyringField) == "" {
+		return data, nil
+	}
+
+	secrets, err := s.client.Get(s.attributes(name))
+	if errors.Is(err, secretservice.ErrNotFound) {
+		return nil, fmt.Errorf("%w: '%s'", ErrSecretsMissing, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.remember(name, secrets)
+
+	public, _ := splitSecrets(data)
+	return append(public, secrets...), nil
+}
+
+// Put stores the named record's secrets in the keyring, then the rest of
+// it in its file.  Secrets already in the keyring aren't stored again.
+func (s *SecretStore) Put(name string, data []byte) error {
+	public, secrets := splitSecrets(data)
+	if len(secrets) == 0 {
+		old, _ := s.files.Get(name)
+		if err := s.files.Put(name, data); err != nil {
+			return err
+		}
+		if fieldValue(old, KeyringField) != "" {
+			return s.forget(name)
+		}
+		return nil
+	}
+
+	if !s.known(name, secrets) {
+		label := fmt.Sprintf("yksoft token '%s'", name)
+		if err := s.client.Put(label, s.attributes(name), secrets); err != nil {
+			return err
+		}
+		s.remember(name, secrets)
+	}
+
+	public = append(public, []byte(fmt.Sprintf("%s: %s\n", KeyringField, KeyringSecretService))...)
+	return s.files.Put(name, public)
+}
+
+// Delete removes the named record's file and its secrets
+func (s *SecretStore) Delete(name string) error {
+	if err := s.files.Delete(name); err != nil {
+		return err
+	}
+	return s.forget(name)
+}
+
+// Lock locks the named record's file
+func (s *SecretStore) Lock(name string) (func(), error) {
+	return s.files.Lock(name)
+}
+
+// forget removes the named record's secrets from the keyring, if they're
+// there, leaving its file
+func (s *SecretStore) forget(name string) error {
+	s.mu.Lock()
+	delete(s.sums, name)
+	s.mu.Unlock()
+
+	err := s.client.Delete(s.attributes(name))
+	if errors.Is(err, secretservice.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// remember records that secrets are the named record's in the keyring
+func (s *SecretStore) remember(name string, secrets []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sums[name] = sha256.Sum256(secrets)
+}
+
+// known returns true if secrets are known to be the named record's in the
+// keyring
+func (s *SecretStore) known(name string, secrets []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum, ok := s.sums[name]
+	return ok && sum == sha256.Sum256(secrets)
+}
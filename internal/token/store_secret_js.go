@@ -0,0 +1,21 @@
+//go:build js
+
+package token
+
+import "errors"
+
+// SecretStore isn't available in the browser, which has no session bus
+type SecretStore struct{}
+
+// openSecretStore returns errors.ErrUnsupported in the browser
+func openSecretStore(dir string) (*SecretStore, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (s *SecretStore) Dir() string                        { return "" }
+func (s *SecretStore) List() ([]string, error)            { return nil, errors.ErrUnsupported }
+func (s *SecretStore) Get(name string) ([]byte, error)    { return nil, errors.ErrUnsupported }
+func (s *SecretStore) Put(name string, data []byte) error { return errors.ErrUnsupported }
+func (s *SecretStore) Delete(name string) error           { return errors.ErrUnsupported }
+func (s *SecretStore) Lock(name string) (func(), error)   { return nil, errors.ErrUnsupported }
+func (s *SecretStore) forget(name string) error           { return errors.ErrUnsupported }
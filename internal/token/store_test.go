@@ -0,0 +1,289 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arr2036/yksofttoken/internal/fsutil"
+)
+
+// testStores returns a fresh store of each kind, by name
+func testStores(t *testing.T) map[string]Store {
+	bs, err := NewBoltStore(filepath.Join(t.TempDir(), "tokens.db"))
+	if err != nil {
+		t.Fatalf("Failed to create bolt store: %v", err)
+	}
+	return map[string]Store{
+		"file":   NewFileStore(t.TempDir()),
+		"memory": NewMemoryStore(),
+		"bolt":   bs,
+	}
+}
+
+func TestStore(t *testing.T) {
+	for kind, s := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			if names, err := s.List(); err != nil || len(names) != 0 {
+				t.Fatalf("Empty store listed %v, %v", names, err)
+			}
+			if _, err := s.Get("a"); !errors.Is(err, ErrTokenNotFound) {
+				t.Errorf("Getting a missing record gave %v, expected ErrTokenNotFound", err)
+			}
+			if err := s.Delete("a"); !errors.Is(err, ErrTokenNotFound) {
+				t.Errorf("Deleting a missing record gave %v, expected ErrTokenNotFound", err)
+			}
+
+			records := map[string]string{
+				"b":            "public_id: vvvvvvvvvvvb\n",
+				"a":            "public_id: vvvvvvvvvvva\n",
+				".a.successor": "public_id: vvvvvvvvvvvc\n",
+			}
+			for name, data := range records {
+				if err := s.Put(name, []byte(data)); err != nil {
+					t.Fatalf("Failed to put '%s': %v", name, err)
+				}
+			}
+
+			names, err := s.List()
+			if err != nil {
+				t.Fatalf("Failed to list records: %v", err)
+			}
+			if expected := []string{".a.successor", "a", "b"}; !reflect.DeepEqual(names, expected) {
+				t.Errorf("Listed %v, expected %v", names, expected)
+			}
+
+			if err := s.Put("a", []byte("public_id: vvvvvvvvvvvd\n")); err != nil {
+				t.Fatalf("Failed to replace 'a': %v", err)
+			}
+			if data, err := s.Get("a"); err != nil || string(data) != "public_id: vvvvvvvvvvvd\n" {
+				t.Errorf("Got %q, %v after replacing 'a'", data, err)
+			}
+
+			if err := s.Delete("a"); err != nil {
+				t.Fatalf("Failed to delete 'a': %v", err)
+			}
+			if _, err := s.Get("a"); !errors.Is(err, ErrTokenNotFound) {
+				t.Errorf("Getting a deleted record gave %v, expected ErrTokenNotFound", err)
+			}
+		})
+	}
+}
+
+func TestStoreLock(t *testing.T) {
+	for kind, s := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			held := 0
+
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					unlock, err := s.Lock("a")
+					if err != nil {
+						t.Errorf("Failed to lock 'a': %v", err)
+						return
+					}
+					mu.Lock()
+					held++
+					if held > 1 {
+						t.Error("Lock held twice at once")
+					}
+					mu.Unlock()
+
+					mu.Lock()
+					held--
+					mu.Unlock()
+					unlock()
+				}()
+			}
+			wg.Wait()
+
+			// Locks aren't records
+			if names, err := s.List(); err != nil || len(names) != 0 {
+				t.Errorf("Store listed %v, %v after locking", names, err)
+			}
+		})
+	}
+}
+
+func TestFileStoreStaleLock(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStore(dir)
+	path := filepath.Join(dir, ".a.lock")
+
+	staleUnlock, err := s.Lock("a")
+	if err != nil {
+		t.Fatalf("Failed to lock 'a': %v", err)
+	}
+	old := time.Now().Add(-2 * fsutil.LockStale)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("Failed to age lock: %v", err)
+	}
+
+	unlock, err := s.Lock("a")
+	if err != nil {
+		t.Fatalf("Failed to break stale lock: %v", err)
+	}
+	owner, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read lock: %v", err)
+	}
+
+	// The broken lock's holder mustn't remove the new lock
+	staleUnlock()
+	if data, err := os.ReadFile(path); err != nil || string(data) != string(owner) {
+		t.Errorf("Unlocking the broken lock left %q, %v, expected %q", data, err, owner)
+	}
+
+	unlock()
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Lock left behind after unlocking: %v", err)
+	}
+}
+
+func TestStoreManager(t *testing.T) {
+	for kind, s := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			m := NewManagerWithStore(t.TempDir(), s)
+
+			tok, err := m.NewUnique(DefaultPolicy)
+			if err != nil {
+				t.Fatalf("Failed to create token: %v", err)
+			}
+			if err := m.Create("a", tok); err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			if err := m.CheckPublicID(tok.PublicID, ""); !errors.Is(err, ErrPublicIDInUse) {
+				t.Errorf("CheckPublicID gave %v, expected ErrPublicIDInUse", err)
+			}
+
+			if _, err := m.Generate(context.Background(), "a"); err != nil {
+				t.Fatalf("Generate failed: %v", err)
+			}
+
+			// A second manager on the store sees the saved counters
+			saved, err := m.Get("a")
+			if err != nil {
+				t.Fatalf("Failed to get token: %v", err)
+			}
+			loaded, err := NewManagerWithStore(m.Dir(), s).Get("a")
+			if err != nil {
+				t.Fatalf("Failed to get token from a second manager: %v", err)
+			}
+			if !sameState(loaded, saved) {
+				t.Errorf("Loaded counter %d session %d, expected %d and %d",
+					loaded.Counter, loaded.Session, saved.Counter, saved.Session)
+			}
+
+			successor, err := m.StartRotation("a", false)
+			if err != nil {
+				t.Fatalf("StartRotation failed: %v", err)
+			}
+			if names, err := m.Names(); err != nil || !reflect.DeepEqual(names, []string{"a"}) {
+				t.Errorf("Names gave %v, %v during rotation", names, err)
+			}
+			if err := m.CompleteRotation("a"); err != nil {
+				t.Fatalf("CompleteRotation failed: %v", err)
+			}
+			rotated, err := NewManagerWithStore(m.Dir(), s).Get("a")
+			if err != nil {
+				t.Fatalf("Failed to get rotated token: %v", err)
+			}
+			if string(rotated.PublicID) != string(successor.PublicID) {
+				t.Error("Token not replaced by its successor")
+			}
+
+			if err := m.Delete("a"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if _, err := s.Get("a"); !errors.Is(err, ErrTokenNotFound) {
+				t.Errorf("Record still present after Delete: %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenStore(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := OpenStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to open default store: %v", err)
+	}
+	if fs, ok := s.(*FileStore); !ok || fs.Dir() != dir {
+		t.Errorf("Default store is %T, expected a FileStore on the token directory", s)
+	}
+
+	if err := SaveStoreConfig(dir, StoreConfig{Backend: BackendBolt}); err != nil {
+		t.Fatalf("Failed to save store config: %v", err)
+	}
+	s, err = OpenStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to open bolt store: %v", err)
+	}
+	if bs, ok := s.(*BoltStore); !ok || bs.Path() != filepath.Join(dir, defaultBoltFile) {
+		t.Errorf("Configured store is %T, expected a BoltStore in the token directory", s)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, StoreConfigFile), []byte("backend: nosuch\n"), 0600); err != nil {
+		t.Fatalf("Failed to write store config: %v", err)
+	}
+	if _, err := OpenStore(dir); !errors.Is(err, ErrUnknownBackend) {
+		t.Errorf("Opening an unknown backend gave %v, expected ErrUnknownBackend", err)
+	}
+}
+
+func TestMigrateStore(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager(dir)
+	for _, name := range []string{"a", "b"} {
+		tok, err := New()
+		if err != nil {
+			t.Fatalf("Failed to create new token: %v", err)
+		}
+		if err := m.Create(name, tok); err != nil {
+			t.Fatalf("Create(%s) failed: %v", name, err)
+		}
+	}
+	before, err := m.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+
+	if err := MigrateStore(dir, StoreConfig{Backend: BackendBolt}); err != nil {
+		t.Fatalf("Failed to migrate to bolt: %v", err)
+	}
+	if names, err := ListTokens(dir); err != nil || !reflect.DeepEqual(names, []string{defaultBoltFile}) {
+		t.Errorf("Token directory holds %v, %v after migrating, expected only the database", names, err)
+	}
+
+	migrated, err := OpenManager(dir)
+	if err != nil {
+		t.Fatalf("Failed to open migrated store: %v", err)
+	}
+	if names, err := migrated.Names(); err != nil || !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("Migrated store holds %v, %v", names, err)
+	}
+	if after, err := migrated.Get("a"); err != nil || !sameState(after, before) {
+		t.Errorf("Migrated token differs: %v", err)
+	}
+
+	// And back, leaving the database alone
+	if err := MigrateStore(dir, StoreConfig{}); err != nil {
+		t.Fatalf("Failed to migrate to files: %v", err)
+	}
+	if after, err := LoadWithVault(GetTokenPath(dir, "a"), nil); err != nil || !sameState(after, before) {
+		t.Errorf("Token file differs after migrating back: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, defaultBoltFile)); err != nil {
+		t.Errorf("Database removed by migrating: %v", err)
+	}
+}
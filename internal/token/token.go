@@ -3,10 +3,13 @@ package token
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -26,30 +29,55 @@ const (
 	CreatedField   = "created"
 	LastUseField   = "lastuse"
 	PonRandField   = "ponrand"
+	PowerOnField   = "poweron"
+
+	// Field names for two-phase key rotation, only present during one
+	StagedPrivateIDField   = "staged_private_id"
+	StagedAESKeyField      = "staged_aes_key"
+	PreviousPrivateIDField = "previous_private_id"
+	PreviousAESKeyField    = "previous_aes_key"
 )
 
+// ErrCounterExhausted indicates the use counter can't be incremented any further
+var ErrCounterExhausted = errors.New("token counter at max, token must be regenerated")
+
 // SoftToken represents a software Yubikey token
 type SoftToken struct {
-	PublicID  [yubikey.PublicIDSize]byte // 6 byte public identifier
-	PrivateID [yubikey.UIDSize]byte      // 6 byte private identifier
-	AESKey    [yubikey.KeySize]byte      // 16 byte AES key
-	Counter   uint16                     // Usage counter
-	Session   uint8                      // Session use counter
-	Created   int64                      // Unix timestamp of creation
-	LastUse   int64                      // Unix timestamp of last use
-	PonRand   uint32                     // Power-on random value
+	PublicID  []byte                // 0-16 byte public identifier
+	PrivateID [yubikey.UIDSize]byte // 6 byte private identifier
+	AESKey    [yubikey.KeySize]byte // 16 byte AES key
+	Counter   uint16                // Usage counter
+	Session   uint8                 // Session use counter
+	Created   int64                 // Unix timestamp of creation
+	LastUse   int64                 // Unix timestamp of last use
+	PonRand   uint32                // Power-on random value
+	PowerOn   int64                 // Unix timestamp of last power-up, 0 if never
+
+	StagedKey   *KeySet // New secrets staged by StageKey, nil if none
+	PreviousKey *KeySet // Secrets replaced by SwitchKey, kept for rollback until CommitKey
 }
 
-// New creates a new SoftToken with random values
+// New creates a new SoftToken with random values, using DefaultPolicy
+// to assign the public ID
 func New() (*SoftToken, error) {
+	return NewWithPolicy(DefaultPolicy)
+}
+
+// NewWithPolicy creates a new SoftToken with random values, using the
+// given policy to assign the public ID
+func NewWithPolicy(p Policy) (*SoftToken, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
 	t := &SoftToken{}
 
-	// Generate random public ID with dddd prefix (0x2222 in modhex)
-	t.PublicID[0] = 0x22
-	t.PublicID[1] = 0x22
-	if _, err := rand.Read(t.PublicID[2:]); err != nil {
-		return nil, fmt.Errorf("failed to generate public ID: %w", err)
+	// Generate random public ID with the policy's fixed prefix
+	publicID, err := p.NewPublicID()
+	if err != nil {
+		return nil, err
 	}
+	t.PublicID = publicID
 
 	// Generate random private ID
 	if _, err := rand.Read(t.PrivateID[:]); err != nil {
@@ -69,13 +97,13 @@ func New() (*SoftToken, error) {
 	now := time.Now().Unix()
 	t.Created = now
 	t.LastUse = now
+	t.PowerOn = now
 
 	// Generate power-on random
-	var ponRandBytes [4]byte
-	if _, err := rand.Read(ponRandBytes[:]); err != nil {
-		return nil, fmt.Errorf("failed to generate ponrand: %w", err)
+	t.PonRand, err = newPonRand()
+	if err != nil {
+		return nil, err
 	}
-	t.PonRand = binary.LittleEndian.Uint32(ponRandBytes[:]) & 0xfffffff0
 
 	return t, nil
 }
@@ -88,32 +116,63 @@ func NewWithOptions(publicID, privateID []byte, aesKey []byte, counter uint16) (
 	}
 
 	if publicID != nil {
-		copy(t.PublicID[:], publicID)
+		if len(publicID) > yubikey.MaxPublicIDSize {
+			return nil, fmt.Errorf("public ID too long: %d bytes, maximum is %d",
+				len(publicID), yubikey.MaxPublicIDSize)
+		}
+		t.PublicID = append([]byte{}, publicID...)
 	}
 
 	if privateID != nil {
+		if len(privateID) != yubikey.UIDSize {
+			return nil, fmt.Errorf("private ID must be %d bytes, got %d", yubikey.UIDSize, len(privateID))
+		}
 		copy(t.PrivateID[:], privateID)
 	}
 
 	if aesKey != nil {
+		if len(aesKey) != yubikey.KeySize {
+			return nil, fmt.Errorf("AES key must be %d bytes, got %d", yubikey.KeySize, len(aesKey))
+		}
 		copy(t.AESKey[:], aesKey)
 	}
 
+	if counter > MaxInitialCounter {
+		return nil, fmt.Errorf("counter must be at most %d", MaxInitialCounter)
+	}
+
 	t.Counter = counter + 1 // Always increment on first use
 
 	return t, nil
 }
 
-// Load loads a token from a file
-func Load(path string) (*SoftToken, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// Clone returns a deep copy of the token
+func (t *SoftToken) Clone() *SoftToken {
+	c := *t
+	c.PublicID = append([]byte{}, t.PublicID...)
+	if t.StagedKey != nil {
+		staged := *t.StagedKey
+		c.StagedKey = &staged
 	}
-	defer file.Close()
+	if t.PreviousKey != nil {
+		previous := *t.PreviousKey
+		c.PreviousKey = &previous
+	}
+	return &c
+}
+
+// Load loads a token from a file.  Encrypted tokens need their directory's
+// vault, see LoadWithVault.
+func Load(path string) (*SoftToken, error) {
+	return LoadWithVault(path, nil)
+}
 
+// parseToken parses a token's fields, ignoring any it doesn't know
+func parseToken(r io.Reader) (*SoftToken, error) {
+	var err error
 	t := &SoftToken{}
-	scanner := bufio.NewScanner(file)
+	var staged, previous keySetFields
+	scanner := bufio.NewScanner(r)
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -131,7 +190,10 @@ func Load(path string) (*SoftToken, error) {
 			if err != nil {
 				return nil, fmt.Errorf("invalid public_id: %w", err)
 			}
-			copy(t.PublicID[:], decoded)
+			if len(decoded) > yubikey.MaxPublicIDSize {
+				return nil, errors.New("invalid public_id: too long")
+			}
+			t.PublicID = decoded
 
 		case PrivateIDField:
 			decoded, err := yubikey.HexDecode(value)
@@ -185,6 +247,33 @@ func Load(path string) (*SoftToken, error) {
 				return nil, fmt.Errorf("invalid ponrand: %w", err)
 			}
 			t.PonRand = uint32(v)
+
+		case PowerOnField:
+			v, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid poweron: %w", err)
+			}
+			t.PowerOn = v
+
+		case StagedPrivateIDField:
+			if err := staged.setPrivateID(value); err != nil {
+				return nil, fmt.Errorf("invalid staged_private_id: %w", err)
+			}
+
+		case StagedAESKeyField:
+			if err := staged.setAESKey(value); err != nil {
+				return nil, fmt.Errorf("invalid staged_aes_key: %w", err)
+			}
+
+		case PreviousPrivateIDField:
+			if err := previous.setPrivateID(value); err != nil {
+				return nil, fmt.Errorf("invalid previous_private_id: %w", err)
+			}
+
+		case PreviousAESKeyField:
+			if err := previous.setAESKey(value); err != nil {
+				return nil, fmt.Errorf("invalid previous_aes_key: %w", err)
+			}
 		}
 	}
 
@@ -192,85 +281,148 @@ func Load(path string) (*SoftToken, error) {
 		return nil, err
 	}
 
+	if t.StagedKey, err = staged.keySet(); err != nil {
+		return nil, fmt.Errorf("invalid staged key: %w", err)
+	}
+	if t.PreviousKey, err = previous.keySet(); err != nil {
+		return nil, fmt.Errorf("invalid previous key: %w", err)
+	}
+
 	return t, nil
 }
 
-// Save saves the token to a file
+// Save saves the token to a file.  Tokens in an encrypted directory must
+// be saved with SaveWithVault.
 func (t *SoftToken) Save(path string) error {
-	// Create directory if it doesn't exist
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
-	}
+	return t.SaveWithVault(path, nil)
+}
 
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+// marshal returns the token's fields, as saved in its file
+func (t *SoftToken) marshal() []byte {
+	var buf bytes.Buffer
 
-	publicIDModHex := yubikey.ModHexEncode(t.PublicID[:])
+	publicIDModHex := yubikey.ModHexEncode(t.PublicID)
 	privateIDHex := yubikey.HexEncode(t.PrivateID[:])
 	aesKeyHex := yubikey.HexEncode(t.AESKey[:])
 
-	fmt.Fprintf(file, "%s: %s\n", PublicIDField, publicIDModHex)
-	fmt.Fprintf(file, "%s: %s\n", PrivateIDField, privateIDHex)
-	fmt.Fprintf(file, "%s: %s\n", AESKeyField, aesKeyHex)
-	fmt.Fprintf(file, "%s: %d\n", CounterField, t.Counter)
-	fmt.Fprintf(file, "%s: %d\n", SessionField, t.Session)
-	fmt.Fprintf(file, "%s: %d\n", CreatedField, t.Created)
-	fmt.Fprintf(file, "%s: %d\n", LastUseField, t.LastUse)
-	fmt.Fprintf(file, "%s: %d\n", PonRandField, t.PonRand)
+	fmt.Fprintf(&buf, "%s: %s\n", PublicIDField, publicIDModHex)
+	fmt.Fprintf(&buf, "%s: %s\n", PrivateIDField, privateIDHex)
+	fmt.Fprintf(&buf, "%s: %s\n", AESKeyField, aesKeyHex)
+	fmt.Fprintf(&buf, "%s: %d\n", CounterField, t.Counter)
+	fmt.Fprintf(&buf, "%s: %d\n", SessionField, t.Session)
+	fmt.Fprintf(&buf, "%s: %d\n", CreatedField, t.Created)
+	fmt.Fprintf(&buf, "%s: %d\n", LastUseField, t.LastUse)
+	fmt.Fprintf(&buf, "%s: %d\n", PonRandField, t.PonRand)
+	fmt.Fprintf(&buf, "%s: %d\n", PowerOnField, t.PowerOn)
+
+	if t.StagedKey != nil {
+		fmt.Fprintf(&buf, "%s: %s\n", StagedPrivateIDField, yubikey.HexEncode(t.StagedKey.PrivateID[:]))
+		fmt.Fprintf(&buf, "%s: %s\n", StagedAESKeyField, yubikey.HexEncode(t.StagedKey.AESKey[:]))
+	}
+	if t.PreviousKey != nil {
+		fmt.Fprintf(&buf, "%s: %s\n", PreviousPrivateIDField, yubikey.HexEncode(t.PreviousKey.PrivateID[:]))
+		fmt.Fprintf(&buf, "%s: %s\n", PreviousAESKeyField, yubikey.HexEncode(t.PreviousKey.AESKey[:]))
+	}
 
-	return nil
+	return buf.Bytes()
 }
 
-// GenerateOTP generates a new OTP and updates the token state
+// GenerateOTP generates a new OTP and updates the token state.  If OTPs
+// are being generated too quickly it blocks until the rate limit clears.
 func (t *SoftToken) GenerateOTP() (string, error) {
+	return t.GenerateOTPContext(context.Background())
+}
+
+// GenerateOTPContext is GenerateOTP, but waiting for the rate limit to
+// clear can be cancelled with ctx.  If ctx is done before an OTP is
+// generated the token state is left unchanged.
+func (t *SoftToken) GenerateOTPContext(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	for {
+		if wait := t.RateLimitDelay(); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return "", ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		// The clock may still be in the previous second when the timer fires
+		otp, err := t.generateAt(time.Now())
+		var rateLimitErr *RateLimitError
+		if !errors.As(err, &rateLimitErr) {
+			return otp, err
+		}
+	}
+}
+
+// generateAt generates a new OTP as if the current time were now
+func (t *SoftToken) generateAt(now time.Time) (string, error) {
+	block, err := t.nextBlock(now)
+	if err != nil {
+		return "", err
+	}
+
+	// Generate encrypted OTP
+	otp, err := block.Generate(t.AESKey[:])
+	if err != nil {
+		return "", err
+	}
+
+	// Prepend public ID
+	publicIDModHex := yubikey.ModHexEncode(t.PublicID)
+
+	return publicIDModHex + otp, nil
+}
+
+// nextBlock advances the token state as if an OTP were generated at now,
+// and returns the token block for that OTP
+func (t *SoftToken) nextBlock(now time.Time) (*yubikey.TokenBlock, error) {
+	unixNow := now.Unix()
+
+	// Handle rate limiting before any state changes
+	if unixNow == t.LastUse && (t.PonRand&0x0000000f) >= maxSameSecondOTPs {
+		return nil, &RateLimitError{Wait: time.Unix(t.LastUse+1, 0).Sub(now)}
+	}
+
 	// Update session counter
 	if t.Session == 0xff {
 		// Session counter wrapped, increment main counter
 		if t.Counter >= 0x7fff {
-			return "", errors.New("token counter at max, token must be regenerated")
+			return nil, ErrCounterExhausted
 		}
-		t.Counter++
 
 		// Generate new power-on random
-		var ponRandBytes [4]byte
-		if _, err := rand.Read(ponRandBytes[:]); err != nil {
-			return "", fmt.Errorf("failed to generate ponrand: %w", err)
+		ponRand, err := newPonRand()
+		if err != nil {
+			return nil, err
 		}
-		t.PonRand = binary.LittleEndian.Uint32(ponRandBytes[:]) & 0xfffffff0
+		t.Counter++
+		t.PonRand = ponRand
 		t.Session = 1
 	} else {
 		t.Session++
 	}
 
-	now := time.Now().Unix()
-
-	// Handle rate limiting
-	if now == t.LastUse {
-		if (t.PonRand & 0x0000000f) > 6 {
-			// Rate limit - wait 1 second
-			time.Sleep(time.Second)
-			now = time.Now().Unix()
-			t.PonRand &= 0xfffffff0
-		} else {
-			t.PonRand++
-		}
+	if unixNow == t.LastUse {
+		t.PonRand++
 	} else {
-		t.LastUse = now
+		t.LastUse = unixNow
 		t.PonRand &= 0xfffffff0
 	}
 
 	// Calculate 8hz timestamp
-	hzTime := uint32((now-t.Created)*8) + t.PonRand
-	hzTime %= 0xffffff // 24-bit wrap
+	hzTime := timerValue((unixNow-t.timerBase())*8, t.PonRand)
 
 	// Generate random for this OTP
 	var rndBytes [2]byte
 	if _, err := rand.Read(rndBytes[:]); err != nil {
-		return "", fmt.Errorf("failed to generate random: %w", err)
+		return nil, fmt.Errorf("failed to generate random: %w", err)
 	}
 	random := binary.LittleEndian.Uint16(rndBytes[:])
 
@@ -283,21 +435,12 @@ func (t *SoftToken) GenerateOTP() (string, error) {
 	}
 	copy(block.UID[:], t.PrivateID[:])
 
-	// Generate encrypted OTP
-	otp, err := block.Generate(t.AESKey[:])
-	if err != nil {
-		return "", err
-	}
-
-	// Prepend public ID
-	publicIDModHex := yubikey.ModHexEncode(t.PublicID[:])
-
-	return publicIDModHex + otp, nil
+	return block, nil
 }
 
 // RegistrationInfo returns the registration information for the token
 func (t *SoftToken) RegistrationInfo() string {
-	publicIDModHex := yubikey.ModHexEncode(t.PublicID[:])
+	publicIDModHex := yubikey.ModHexEncode(t.PublicID)
 	privateIDHex := yubikey.HexEncode(t.PrivateID[:])
 	aesKeyHex := yubikey.HexEncode(t.AESKey[:])
 
@@ -320,3 +463,23 @@ func GetTokenPath(tokenDir, tokenName string) string {
 	}
 	return filepath.Join(tokenDir, tokenName)
 }
+
+// ListTokens returns the names of all tokens in a token directory.  Hidden
+// files are skipped, and a missing directory contains no tokens.
+func ListTokens(tokenDir string) ([]string, error) {
+	entries, err := os.ReadDir(tokenDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
@@ -1,6 +1,7 @@
 package token
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
 	"testing"
@@ -63,7 +64,7 @@ func TestTokenSaveLoad(t *testing.T) {
 	}
 
 	// Compare fields
-	if tok.PublicID != loaded.PublicID {
+	if !bytes.Equal(tok.PublicID, loaded.PublicID) {
 		t.Error("PublicID mismatch")
 	}
 	if tok.PrivateID != loaded.PrivateID {
@@ -204,3 +205,15 @@ func TestGetTokenPath(t *testing.T) {
 		t.Errorf("GetTokenPath with empty name = %s, expected %s", path, expected)
 	}
 }
+
+func TestNewWithOptionsInvalid(t *testing.T) {
+	if _, err := NewWithOptions(nil, make([]byte, 5), nil, 0); err == nil {
+		t.Error("NewWithOptions accepted a 5 byte private ID")
+	}
+	if _, err := NewWithOptions(nil, nil, make([]byte, 15), 0); err == nil {
+		t.Error("NewWithOptions accepted a 15 byte AES key")
+	}
+	if _, err := NewWithOptions(nil, nil, nil, MaxInitialCounter+1); err == nil {
+		t.Error("NewWithOptions accepted a counter that can't be incremented")
+	}
+}
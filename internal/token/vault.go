@@ -0,0 +1,398 @@
+package token
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/arr2036/yksofttoken/internal/fsutil"
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+var (
+	// ErrLocked indicates a token directory is encrypted, and hasn't been
+	// unlocked with its passphrase
+	ErrLocked = errors.New("token directory is locked")
+	// ErrWrongPassphrase indicates a passphrase doesn't unlock a vault
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	// ErrAlreadyEncrypted indicates a token directory already has a vault
+	ErrAlreadyEncrypted = errors.New("token directory is already encrypted")
+)
+
+// EncryptedField holds the sealed fields of an encrypted token.  The
+// public ID is left in the clear, as it's in every OTP anyway, and is
+// needed to keep public IDs unique.
+const EncryptedField = "encrypted"
+
+// vaultFile is the file in an encrypted token directory holding the
+// parameters its key is derived with
+const vaultFile = ".vault"
+
+// Vault file fields
+const (
+	vaultKDFField        = "kdf"
+	vaultIterationsField = "iterations"
+	vaultSaltField       = "salt"
+	vaultCheckField      = "check"
+)
+
+const (
+	vaultKDF   = "pbkdf2-sha256"
+	vaultCheck = "yksoft vault" // Sealed in the vault file to check passphrases
+)
+
+// vaultIterations is the PBKDF2 iteration count for new vaults
+var vaultIterations = 600000
+
+// maxIterations is the highest PBKDF2 iteration count accepted, 10 times
+// the default, so a tampered file can't make deriving the key take hours
+const maxIterations = 6000000
+
+// Vault holds the key the tokens in an encrypted token directory are
+// sealed with
+type Vault struct {
+	key []byte // AES-256 key, zeroed by Close
+}
+
+// IsEncrypted returns true if the token directory has a vault
+func IsEncrypted(tokenDir string) bool {
+	if tokenDir == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(tokenDir, vaultFile))
+	return err == nil
+}
+
+// CreateVault creates a vault for the token directory, with a key derived
+// from passphrase.  Tokens saved with the vault are encrypted, but existing
+// tokens are left as they are.
+func CreateVault(tokenDir, passphrase string) (*Vault, error) {
+	if IsEncrypted(tokenDir) {
+		return nil, ErrAlreadyEncrypted
+	}
+	if passphrase == "" {
+		return nil, errors.New("passphrase must not be empty")
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	v := &Vault{key: pbkdf2SHA256([]byte(passphrase), salt, vaultIterations, 32)}
+	check, err := v.seal([]byte(vaultCheck), []byte(vaultFile))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(tokenDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s: %s\n", vaultKDFField, vaultKDF)
+	fmt.Fprintf(&buf, "%s: %d\n", vaultIterationsField, vaultIterations)
+	fmt.Fprintf(&buf, "%s: %s\n", vaultSaltField, hex.EncodeToString(salt))
+	fmt.Fprintf(&buf, "%s: %s\n", vaultCheckField, check)
+
+	if err := fsutil.WriteFileAtomic(filepath.Join(tokenDir, vaultFile), buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// OpenVault opens the token directory's vault with passphrase
+func OpenVault(tokenDir, passphrase string) (*Vault, error) {
+	file, err := os.Open(filepath.Join(tokenDir, vaultFile))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var iterations int
+	var salt []byte
+	var check string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		switch key {
+		case vaultKDFField:
+			if value != vaultKDF {
+				return nil, fmt.Errorf("unsupported kdf '%s'", value)
+			}
+		case vaultIterationsField:
+			if iterations, err = strconv.Atoi(value); err != nil || iterations <= 0 || iterations > maxIterations {
+				return nil, fmt.Errorf("invalid iterations '%s'", value)
+			}
+		case vaultSaltField:
+			if salt, err = hex.DecodeString(value); err != nil {
+				return nil, fmt.Errorf("invalid salt: %w", err)
+			}
+		case vaultCheckField:
+			check = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if iterations == 0 || len(salt) == 0 || check == "" {
+		return nil, errors.New("invalid vault: missing fields")
+	}
+
+	v := &Vault{key: pbkdf2SHA256([]byte(passphrase), salt, iterations, 32)}
+	if plain, err := v.open(check, []byte(vaultFile)); err != nil || string(plain) != vaultCheck {
+		v.Close()
+		return nil, ErrWrongPassphrase
+	}
+	return v, nil
+}
+
+// Close zeroes the vault's key.  The vault can't be used afterwards.
+func (v *Vault) Close() {
+	for i := range v.key {
+		v.key[i] = 0
+	}
+	v.key = nil
+}
+
+func (v *Vault) aead() (cipher.AEAD, error) {
+	if v.key == nil {
+		return nil, ErrLocked
+	}
+	block, err := aes.NewCipher(v.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts and authenticates plain, and authenticates aad, returning
+// the nonce and ciphertext base64 encoded
+func (v *Vault) seal(plain, aad []byte) (string, error) {
+	aead, err := v.aead()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, aad)), nil
+}
+
+// open reverses seal
+func (v *Vault) open(sealed string, aad []byte) ([]byte, error) {
+	aead, err := v.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+}
+
+// LoadWithVault loads a token from a file, decrypting it with v if it's
+// encrypted.  Unencrypted tokens are loaded as they are, so a directory can
+// be encrypted a token at a time.
+func LoadWithVault(path string, v *Vault) (*SoftToken, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeToken(data, filepath.Base(path), v)
+}
+
+// decodeToken parses a token file's contents, decrypting them with v if
+// they're encrypted.  name is only used in errors.
+func decodeToken(data []byte, name string, v *Vault) (*SoftToken, error) {
+	t, err := parseToken(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if fieldValue(data, KeyringField) != "" {
+		return nil, fmt.Errorf("%w: '%s'", ErrInKeyring, name)
+	}
+
+	sealed := fieldValue(data, EncryptedField)
+	if sealed == "" {
+		return t, nil
+	}
+	if v == nil {
+		return nil, fmt.Errorf("%w: '%s' is encrypted", ErrLocked, name)
+	}
+
+	// The clear public ID is authenticated, so it can't be swapped
+	plain, err := v.open(sealed, []byte(yubikey.ModHexEncode(t.PublicID)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token: %w", err)
+	}
+	return parseToken(bytes.NewReader(plain))
+}
+
+// SaveWithVault saves the token to a file, encrypting it with v unless v
+// is nil
+func (t *SoftToken) SaveWithVault(path string, v *Vault) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	data, err := t.encode(v)
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(path, data)
+}
+
+// encode returns the token file's contents, encrypted with v unless v is
+// nil.  The public ID is left in the clear so tokens can be told apart.
+func (t *SoftToken) encode(v *Vault) ([]byte, error) {
+	data := t.marshal()
+	if v == nil {
+		return data, nil
+	}
+
+	publicID := yubikey.ModHexEncode(t.PublicID)
+	sealed, err := v.seal(data, []byte(publicID))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%s: %s\n%s: %s\n", PublicIDField, publicID, EncryptedField, sealed)), nil
+}
+
+// loadRecord loads the named record from a store, decrypting it with v.
+// A token whose counters are behind its mark in ms fails with a
+// *RollbackError.
+func loadRecord(s Store, name string, v *Vault, ms *Marks) (*SoftToken, error) {
+	t, err := readRecord(s, name, v)
+	if err != nil {
+		return nil, err
+	}
+	if err := ms.Check(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// readRecord is loadRecord, without checking the token's high-water mark
+func readRecord(s Store, name string, v *Vault) (*SoftToken, error) {
+	data, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return decodeToken(data, name, v)
+}
+
+// saveRecord saves the token as the named record in a store, encrypting
+// it with v, and raises its mark in ms
+func saveRecord(s Store, name string, t *SoftToken, v *Vault, ms *Marks) error {
+	data, err := t.encode(v)
+	if err != nil {
+		return err
+	}
+	if err := s.Put(name, data); err != nil {
+		return err
+	}
+	return ms.Raise(t)
+}
+
+// fieldValue returns the value of a field in a token file, or "" if it
+// doesn't have it
+func fieldValue(data []byte, field string) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == field {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+// recordPublicID returns the public ID of the named record, which can be
+// read without decrypting it
+func recordPublicID(s Store, name string) ([]byte, error) {
+	data, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := parseToken(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return t.PublicID, nil
+}
+
+// wipe zeroes the token's secrets
+func (t *SoftToken) wipe() {
+	t.PrivateID = [yubikey.UIDSize]byte{}
+	t.AESKey = [yubikey.KeySize]byte{}
+	if t.StagedKey != nil {
+		*t.StagedKey = KeySet{}
+	}
+	if t.PreviousKey != nil {
+		*t.PreviousKey = KeySet{}
+	}
+}
+
+// pbkdf2SHA256 derives a key from a password, as in RFC 8018
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	key := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	t := make([]byte, hashLen)
+	var index [4]byte
+
+	for block := 1; block <= blocks; block++ {
+		binary.BigEndian.PutUint32(index[:], uint32(block))
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(index[:])
+		u = prf.Sum(u[:0])
+		copy(t, u)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,176 @@
+package token
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+func init() {
+	// Keep tests fast; the iteration count is stored in each vault
+	vaultIterations = 1000
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+			"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+
+	for _, tt := range tests {
+		want, _ := hex.DecodeString(tt.want)
+		got := pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations, len(want))
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %x, expected %s", tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+}
+
+func TestVaultSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	v, err := CreateVault(dir, "correct horse")
+	if err != nil {
+		t.Fatalf("Failed to create vault: %v", err)
+	}
+	if !IsEncrypted(dir) {
+		t.Fatal("Directory not encrypted after creating vault")
+	}
+	if _, err := CreateVault(dir, "again"); !errors.Is(err, ErrAlreadyEncrypted) {
+		t.Errorf("Creating a second vault gave %v, expected ErrAlreadyEncrypted", err)
+	}
+
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	path := GetTokenPath(dir, "a")
+	if err := tok.SaveWithVault(path, v); err != nil {
+		t.Fatalf("Failed to save token: %v", err)
+	}
+
+	// Secrets never reach the disk in the clear
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read token: %v", err)
+	}
+	if strings.Contains(string(data), hex.EncodeToString(tok.AESKey[:])) || strings.Contains(string(data), AESKeyField) {
+		t.Errorf("Encrypted token file contains the AES key:\n%s", data)
+	}
+
+	if _, err := Load(path); !errors.Is(err, ErrLocked) {
+		t.Errorf("Loading an encrypted token without a vault gave %v, expected ErrLocked", err)
+	}
+	if id, err := recordPublicID(NewFileStore(dir), "a"); err != nil || string(id) != string(tok.PublicID) {
+		t.Errorf("recordPublicID gave %x, %v, expected %x", id, err, tok.PublicID)
+	}
+
+	if _, err := OpenVault(dir, "wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Opening vault with the wrong passphrase gave %v, expected ErrWrongPassphrase", err)
+	}
+	reopened, err := OpenVault(dir, "correct horse")
+	if err != nil {
+		t.Fatalf("Failed to open vault: %v", err)
+	}
+	loaded, err := LoadWithVault(path, reopened)
+	if err != nil {
+		t.Fatalf("Failed to load encrypted token: %v", err)
+	}
+	if !sameState(loaded, tok) {
+		t.Error("Loaded token doesn't match the saved one")
+	}
+
+	// Swapping the public ID in the clear is detected
+	swapped := strings.Replace(string(data), yubikey.ModHexEncode(tok.PublicID), "cccccccccccc", 1)
+	if err := os.WriteFile(path, []byte(swapped), 0600); err != nil {
+		t.Fatalf("Failed to write token: %v", err)
+	}
+	if _, err := LoadWithVault(path, reopened); err == nil {
+		t.Error("Loaded a token whose public ID was changed")
+	}
+
+	reopened.Close()
+	if _, err := LoadWithVault(path, reopened); err == nil {
+		t.Error("Loaded a token with a closed vault")
+	}
+}
+
+func TestManagerLockUnlock(t *testing.T) {
+	m := newTestManager(t, "a")
+	before, err := m.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+
+	if err := m.Encrypt("passphrase"); err != nil {
+		t.Fatalf("Failed to encrypt directory: %v", err)
+	}
+	if _, err := Load(GetTokenPath(m.Dir(), "a")); !errors.Is(err, ErrLocked) {
+		t.Errorf("Token still readable without the vault: %v", err)
+	}
+
+	m.Lock()
+	if !m.Locked() {
+		t.Fatal("Manager not locked")
+	}
+	if _, err := m.Get("a"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Get while locked gave %v, expected ErrLocked", err)
+	}
+	if _, err := m.Generate(context.Background(), "a"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Generate while locked gave %v, expected ErrLocked", err)
+	}
+	if names, err := m.Names(); err != nil || len(names) != 1 {
+		t.Errorf("Names while locked gave %v, %v", names, err)
+	}
+
+	if err := m.Unlock("wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Unlock with the wrong passphrase gave %v, expected ErrWrongPassphrase", err)
+	}
+	if err := m.Unlock("passphrase"); err != nil {
+		t.Fatalf("Failed to unlock: %v", err)
+	}
+
+	after, err := m.Get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token after unlocking: %v", err)
+	}
+	if !sameState(before, after) {
+		t.Error("Token changed by encrypting, locking and unlocking")
+	}
+
+	// A new manager for the directory starts locked
+	if !NewManager(m.Dir()).Locked() {
+		t.Error("Manager for an encrypted directory isn't locked")
+	}
+}
+
+func TestManagerLockWipes(t *testing.T) {
+	m := newTestManager(t, "a")
+	mt, err := m.get("a")
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+
+	m.Lock()
+	if mt.token.AESKey != [16]byte{} || mt.token.PrivateID != [6]byte{} {
+		t.Error("Lock left secrets in memory")
+	}
+
+	// An unencrypted directory unlocks with any passphrase
+	if err := m.Unlock(""); err != nil {
+		t.Fatalf("Failed to unlock: %v", err)
+	}
+	if _, err := m.Get("a"); err != nil {
+		t.Errorf("Failed to get token after unlocking: %v", err)
+	}
+}
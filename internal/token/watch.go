@@ -0,0 +1,120 @@
+//go:build !js
+
+package token
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchSettle is how long Watch waits for a burst of changes to finish
+// before acting on them
+const watchSettle = 100 * time.Millisecond
+
+// Watch watches the token directory for changes made by other processes,
+// such as the CLI or a sync tool, until ctx is cancelled.  Token files
+// added or removed are published as EventAdded and EventRemoved, and loaded
+// tokens changed on disk are reloaded.  Changes made through the manager
+// itself may be published a second time.  Only tokens kept in files can be
+// watched; for other stores errors.ErrUnsupported is returned.
+func (m *Manager) Watch(ctx context.Context) error {
+	fs, ok := m.store.(*FileStore)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if err := w.Add(fs.Dir()); err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	if names, err := m.Names(); err == nil {
+		for _, name := range names {
+			known[name] = true
+		}
+	}
+
+	changed := make(map[string]bool)
+	var settle <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			// Hidden files are temporary files, policies and successors
+			name := filepath.Base(ev.Name)
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			changed[name] = true
+
+		case _, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			// Events may have been lost, so check every token
+			for name := range known {
+				changed[name] = true
+			}
+
+		case <-settle:
+			known = m.sync(known, changed)
+			changed = make(map[string]bool)
+			settle = nil
+			continue
+		}
+
+		if settle == nil {
+			settle = time.After(watchSettle)
+		}
+	}
+}
+
+// sync publishes the difference between the known token names and those
+// now in the token directory, and reloads the changed tokens.  It returns
+// the names now in the directory.
+func (m *Manager) sync(known, changed map[string]bool) map[string]bool {
+	names, err := m.Names()
+	if err != nil {
+		return known
+	}
+
+	current := make(map[string]bool, len(names))
+	for _, name := range names {
+		current[name] = true
+		if !known[name] {
+			m.publish(Event{Type: EventAdded, Name: name})
+		}
+	}
+
+	for name := range known {
+		if !current[name] {
+			m.forget(name)
+			m.publish(Event{Type: EventRemoved, Name: name})
+		}
+	}
+
+	for name := range changed {
+		if known[name] && current[name] {
+			m.Reload(name)
+		}
+	}
+
+	return current
+}
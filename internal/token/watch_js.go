@@ -0,0 +1,14 @@
+//go:build js
+
+package token
+
+import (
+	"context"
+	"errors"
+)
+
+// Watch isn't supported in the browser, which has no token directory to
+// watch
+func (m *Manager) Watch(ctx context.Context) error {
+	return errors.ErrUnsupported
+}
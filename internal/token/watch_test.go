@@ -0,0 +1,83 @@
+//go:build !js
+
+package token
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// waitForEvent waits for an event of the given type and name
+func waitForEvent(t *testing.T, events <-chan Event, typ EventType, name string) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == typ && ev.Name == name {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for event %d for '%s'", typ, name)
+		}
+	}
+}
+
+func TestManagerWatch(t *testing.T) {
+	m := newTestManager(t, "a")
+	if _, err := m.Get("a"); err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+
+	events := make(chan Event, 100)
+	m.Subscribe(func(ev Event) { events <- ev })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Watch(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Watch failed: %v", err)
+		}
+	}()
+
+	// Give the watcher time to start
+	time.Sleep(50 * time.Millisecond)
+
+	// Another process adds a token
+	other := NewManager(m.Dir())
+	tok, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	if err := other.Create("b", tok); err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	waitForEvent(t, events, EventAdded, "b")
+
+	// ...uses the token we have loaded
+	if err := other.PowerCycle("a"); err != nil {
+		t.Fatalf("Failed to power cycle token: %v", err)
+	}
+	waitForEvent(t, events, EventReloaded, "a")
+
+	want, _ := other.Get("a")
+	got, _ := m.Get("a")
+	if got.Counter != want.Counter {
+		t.Errorf("Watched token has counter %d, expected %d", got.Counter, want.Counter)
+	}
+
+	// ...and removes it
+	if err := os.Remove(GetTokenPath(m.Dir(), "a")); err != nil {
+		t.Fatalf("Failed to remove token: %v", err)
+	}
+	waitForEvent(t, events, EventRemoved, "a")
+
+	if _, err := m.Get("a"); err == nil {
+		t.Error("Removed token can still be loaded")
+	}
+}
@@ -0,0 +1,10 @@
+package validator
+
+import "errors"
+
+var (
+	// ErrUnknownToken indicates the OTP's public ID isn't registered
+	ErrUnknownToken = errors.New("unknown yubikey")
+	// ErrPrivateIDMismatch indicates the OTP decrypted with a different private ID
+	ErrPrivateIDMismatch = errors.New("private ID mismatch")
+)
@@ -0,0 +1,117 @@
+package validator
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// YKValPath is where YK-VAL serves verification requests
+	YKValPath = "/wsapi/2.0/verify"
+	// YKKSMPath is where YK-KSM serves decryption requests
+	YKKSMPath = "/wsapi/decrypt"
+)
+
+// Sign returns the YK-VAL protocol signature of params, i.e. the base64
+// HMAC-SHA1 of the sorted key=value pairs, excluding any existing signature
+func Sign(params url.Values, key []byte) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if k != "h" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + params.Get(k)
+	}
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(strings.Join(pairs, "&")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// YKValHandler serves the YK-VAL verification protocol (version 2.0) for v.
+// If clients is non-nil only listed client IDs are accepted, and request
+// signatures are checked and responses signed with the client's API key.
+func YKValHandler(v *Validator, clients map[string][]byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		id, otp, nonce := q.Get("id"), q.Get("otp"), q.Get("nonce")
+
+		now := time.Now().UTC()
+		resp := url.Values{}
+		resp.Set("t", fmt.Sprintf("%sZ%04d", now.Format("2006-01-02T15:04:05"), now.Nanosecond()/int(time.Millisecond)))
+		if otp != "" {
+			resp.Set("otp", otp)
+		}
+		if nonce != "" {
+			resp.Set("nonce", nonce)
+		}
+
+		var key []byte
+		switch {
+		case id == "" || otp == "" || nonce == "":
+			resp.Set("status", StatusMissingParam)
+
+		case clients != nil && clients[id] == nil:
+			resp.Set("status", StatusNoSuchClient)
+
+		default:
+			key = clients[id]
+			if key != nil && q.Get("h") != Sign(q, key) {
+				resp.Set("status", StatusBadSignature)
+				break
+			}
+			resp.Set("status", v.Verify(otp).Status)
+		}
+
+		if key != nil {
+			resp.Set("h", Sign(resp, key))
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		for _, k := range []string{"h", "t", "otp", "nonce", "status"} {
+			if resp.Has(k) {
+				fmt.Fprintf(w, "%s=%s\r\n", k, resp.Get(k))
+			}
+		}
+	})
+}
+
+// YKKSMHandler serves the YK-KSM decryption protocol for v.  Like a real
+// KSM it only decrypts, and doesn't detect replayed OTPs.
+func YKKSMHandler(v *Validator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+
+		otp := r.URL.Query().Get("otp")
+		if otp == "" {
+			fmt.Fprint(w, "ERR No OTP provided\n")
+			return
+		}
+
+		block, err := v.Decrypt(otp)
+		switch {
+		case errors.Is(err, ErrUnknownToken):
+			fmt.Fprint(w, "ERR Unknown yubikey\n")
+
+		case err != nil:
+			fmt.Fprint(w, "ERR Corrupt OTP\n")
+
+		default:
+			fmt.Fprintf(w, "OK counter=%04x low=%04x high=%02x use=%02x\n",
+				block.Counter, block.Timestamp&0xffff, block.Timestamp>>16, block.Session)
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package validator
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+// parseResponse parses a YK-VAL response into its fields
+func parseResponse(t *testing.T, resp *http.Response) url.Values {
+	t.Helper()
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	fields := url.Values{}
+	for _, line := range strings.Split(string(body), "\r\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			fields.Set(k, v)
+		}
+	}
+	return fields
+}
+
+func TestYKValHandler(t *testing.T) {
+	v := New()
+	tok := newTestToken(t, v)
+	key := []byte("0123456789abcdef0123")
+
+	srv := httptest.NewServer(YKValHandler(v, map[string][]byte{"1": key}))
+	defer srv.Close()
+
+	otp, err := tok.GenerateOTP()
+	if err != nil {
+		t.Fatalf("GenerateOTP failed: %v", err)
+	}
+
+	verify := func(id string, sign bool) url.Values {
+		params := url.Values{"id": {id}, "otp": {otp}, "nonce": {"0123456789abcdef"}}
+		if sign {
+			params.Set("h", Sign(params, key))
+		}
+		resp, err := http.Get(srv.URL + YKValPath + "?" + params.Encode())
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return parseResponse(t, resp)
+	}
+
+	if fields := verify("2", true); fields.Get("status") != StatusNoSuchClient {
+		t.Errorf("Unknown client status = %s, expected %s", fields.Get("status"), StatusNoSuchClient)
+	}
+	if fields := verify("1", false); fields.Get("status") != StatusBadSignature {
+		t.Errorf("Unsigned request status = %s, expected %s", fields.Get("status"), StatusBadSignature)
+	}
+
+	fields := verify("1", true)
+	if fields.Get("status") != StatusOK {
+		t.Errorf("Status = %s, expected %s", fields.Get("status"), StatusOK)
+	}
+	if fields.Get("otp") != otp || fields.Get("nonce") != "0123456789abcdef" {
+		t.Error("Response doesn't echo the OTP and nonce")
+	}
+	if fields.Get("h") != Sign(fields, key) {
+		t.Error("Response signature doesn't verify")
+	}
+
+	if fields := verify("1", true); fields.Get("status") != StatusReplayedOTP {
+		t.Errorf("Replay status = %s, expected %s", fields.Get("status"), StatusReplayedOTP)
+	}
+}
+
+func TestYKKSMHandler(t *testing.T) {
+	v := New()
+	tok := newTestToken(t, v)
+
+	srv := httptest.NewServer(YKKSMHandler(v))
+	defer srv.Close()
+
+	decrypt := func(otp string) string {
+		resp, err := http.Get(srv.URL + YKKSMPath + "?otp=" + url.QueryEscape(otp))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return string(body)
+	}
+
+	otp, err := tok.GenerateOTP()
+	if err != nil {
+		t.Fatalf("GenerateOTP failed: %v", err)
+	}
+
+	// The KSM doesn't detect replays
+	for i := 0; i < 2; i++ {
+		if body := decrypt(otp); !strings.HasPrefix(body, "OK counter=0001 ") {
+			t.Errorf("Response = %q, expected OK counter=0001", body)
+		}
+	}
+
+	unknown, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	if otp, err = unknown.GenerateOTP(); err != nil {
+		t.Fatalf("GenerateOTP failed: %v", err)
+	}
+	if body := decrypt(otp); body != "ERR Unknown yubikey\n" {
+		t.Errorf("Response = %q, expected ERR Unknown yubikey", body)
+	}
+}
@@ -0,0 +1,127 @@
+// Package validator provides an in-process Yubikey OTP validator, and HTTP
+// handlers emulating YK-VAL and YK-KSM servers for testing against
+package validator
+
+import (
+	"sync"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+	"github.com/arr2036/yksofttoken/internal/yubikey"
+)
+
+// Validation statuses, as returned by YK-VAL
+const (
+	StatusOK           = "OK"
+	StatusBadOTP       = "BAD_OTP"
+	StatusReplayedOTP  = "REPLAYED_OTP"
+	StatusMissingParam = "MISSING_PARAMETER"
+	StatusBadSignature = "BAD_SIGNATURE"
+	StatusNoSuchClient = "NO_SUCH_CLIENT"
+)
+
+// Result is the outcome of validating an OTP
+type Result struct {
+	Status  string
+	Counter uint16 // Decrypted use counter, if the OTP could be decrypted
+	Session uint8  // Decrypted session counter, if the OTP could be decrypted
+}
+
+// Validator validates OTPs against registered tokens, rejecting OTPs that
+// don't decrypt, and replayed OTPs.  It's safe for concurrent use.
+type Validator struct {
+	mu   sync.Mutex
+	keys map[string]*registration // Keyed by modhex public ID
+}
+
+// registration is a registered token, and the last OTP it was seen to use
+type registration struct {
+	privateID [yubikey.UIDSize]byte
+	key       [yubikey.KeySize]byte
+
+	seen    bool
+	counter uint16
+	session uint8
+}
+
+// New returns a validator with no tokens registered
+func New() *Validator {
+	return &Validator{keys: make(map[string]*registration)}
+}
+
+// Register registers a token's secrets, as exported by RegistrationInfo.
+// Registering a public ID again replaces its secrets, but keeps the last
+// counter seen for it, as YK-VAL does, so a replacement token must continue
+// the counter.
+func (v *Validator) Register(publicID []byte, privateID [yubikey.UIDSize]byte, key [yubikey.KeySize]byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	id := yubikey.ModHexEncode(publicID)
+	reg := &registration{privateID: privateID, key: key}
+	if prev, ok := v.keys[id]; ok {
+		reg.seen, reg.counter, reg.session = prev.seen, prev.counter, prev.session
+	}
+	v.keys[id] = reg
+}
+
+// RegisterToken registers a soft token
+func (v *Validator) RegisterToken(t *token.SoftToken) {
+	v.Register(t.PublicID, t.PrivateID, t.AESKey)
+}
+
+// Verify validates an OTP
+func (v *Validator) Verify(otp string) Result {
+	publicID, _, err := yubikey.SplitOTP(otp)
+	if err != nil {
+		return Result{Status: StatusBadOTP}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	reg, ok := v.keys[yubikey.ModHexEncode(publicID)]
+	if !ok {
+		return Result{Status: StatusBadOTP}
+	}
+
+	_, block, err := yubikey.ParseOTP(otp, reg.key[:])
+	if err != nil || block.UID != reg.privateID {
+		return Result{Status: StatusBadOTP}
+	}
+
+	res := Result{Counter: block.Counter, Session: block.Session}
+	if reg.seen && (block.Counter < reg.counter ||
+		(block.Counter == reg.counter && block.Session <= reg.session)) {
+		res.Status = StatusReplayedOTP
+		return res
+	}
+
+	reg.seen = true
+	reg.counter, reg.session = block.Counter, block.Session
+	res.Status = StatusOK
+	return res
+}
+
+// Decrypt decrypts an OTP without replay detection, as a YK-KSM would
+func (v *Validator) Decrypt(otp string) (*yubikey.TokenBlock, error) {
+	publicID, _, err := yubikey.SplitOTP(otp)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	reg, ok := v.keys[yubikey.ModHexEncode(publicID)]
+	v.mu.Unlock()
+	if !ok {
+		return nil, ErrUnknownToken
+	}
+
+	_, block, err := yubikey.ParseOTP(otp, reg.key[:])
+	if err != nil {
+		return nil, err
+	}
+	if block.UID != reg.privateID {
+		return nil, ErrPrivateIDMismatch
+	}
+	return block, nil
+}
@@ -0,0 +1,162 @@
+package validator
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/arr2036/yksofttoken/internal/token"
+)
+
+func newTestToken(t *testing.T, v *Validator) *token.SoftToken {
+	t.Helper()
+
+	tok, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	v.RegisterToken(tok)
+	return tok
+}
+
+func TestVerify(t *testing.T) {
+	v := New()
+	tok := newTestToken(t, v)
+
+	first, err := tok.GenerateOTP()
+	if err != nil {
+		t.Fatalf("GenerateOTP failed: %v", err)
+	}
+	second, err := tok.GenerateOTP()
+	if err != nil {
+		t.Fatalf("GenerateOTP failed: %v", err)
+	}
+
+	if res := v.Verify(second); res.Status != StatusOK {
+		t.Errorf("Verify(second) = %s, expected %s", res.Status, StatusOK)
+	}
+	if res := v.Verify(second); res.Status != StatusReplayedOTP {
+		t.Errorf("Verify(second) again = %s, expected %s", res.Status, StatusReplayedOTP)
+	}
+	if res := v.Verify(first); res.Status != StatusReplayedOTP {
+		t.Errorf("Verify(first) after second = %s, expected %s", res.Status, StatusReplayedOTP)
+	}
+}
+
+func TestVerifyBadOTP(t *testing.T) {
+	v := New()
+	tok := newTestToken(t, v)
+
+	unknown, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	otp, err := unknown.GenerateOTP()
+	if err != nil {
+		t.Fatalf("GenerateOTP failed: %v", err)
+	}
+	if res := v.Verify(otp); res.Status != StatusBadOTP {
+		t.Errorf("Verify(unregistered) = %s, expected %s", res.Status, StatusBadOTP)
+	}
+	if _, err := v.Decrypt(otp); !errors.Is(err, ErrUnknownToken) {
+		t.Errorf("Decrypt(unregistered) = %v, expected ErrUnknownToken", err)
+	}
+
+	// Same public ID and key, different private ID
+	wrongUID := tok.Clone()
+	wrongUID.PrivateID[0] ^= 0xff
+	if otp, err = wrongUID.GenerateOTP(); err != nil {
+		t.Fatalf("GenerateOTP failed: %v", err)
+	}
+	if res := v.Verify(otp); res.Status != StatusBadOTP {
+		t.Errorf("Verify(wrong private ID) = %s, expected %s", res.Status, StatusBadOTP)
+	}
+	if _, err := v.Decrypt(otp); !errors.Is(err, ErrPrivateIDMismatch) {
+		t.Errorf("Decrypt(wrong private ID) = %v, expected ErrPrivateIDMismatch", err)
+	}
+
+	if res := v.Verify("not an otp"); res.Status != StatusBadOTP {
+		t.Errorf("Verify(garbage) = %s, expected %s", res.Status, StatusBadOTP)
+	}
+}
+
+func TestVerifyNegativeOTPs(t *testing.T) {
+	v := New()
+	tok := newTestToken(t, v)
+
+	otp, err := tok.GenerateOTP()
+	if err != nil {
+		t.Fatalf("GenerateOTP failed: %v", err)
+	}
+	if res := v.Verify(otp); res.Status != StatusOK {
+		t.Fatalf("Verify = %s, expected %s", res.Status, StatusOK)
+	}
+
+	negatives, err := tok.NegativeOTPs()
+	if err != nil {
+		t.Fatalf("NegativeOTPs failed: %v", err)
+	}
+	for _, n := range negatives {
+		expected := StatusBadOTP
+		if n.Replay {
+			expected = StatusReplayedOTP
+		}
+		if res := v.Verify(n.OTP); res.Status != expected {
+			t.Errorf("Verify(%s) = %s, expected %s", n.Kind, res.Status, expected)
+		}
+	}
+
+	// None of them advanced the token, so its next OTP is still accepted
+	if otp, err = tok.GenerateOTP(); err != nil {
+		t.Fatalf("GenerateOTP failed: %v", err)
+	}
+	if res := v.Verify(otp); res.Status != StatusOK {
+		t.Errorf("Verify after negative OTPs = %s, expected %s", res.Status, StatusOK)
+	}
+}
+
+func TestVerifyRotatedToken(t *testing.T) {
+	v := New()
+	m := token.NewManager(t.TempDir())
+	tok, err := token.New()
+	if err != nil {
+		t.Fatalf("Failed to create new token: %v", err)
+	}
+	tok.Counter = 5
+	if err := m.Create("a", tok); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	v.RegisterToken(tok)
+
+	generate := func(when string) {
+		t.Helper()
+		otp, err := m.Generate(context.Background(), "a")
+		if err != nil {
+			t.Fatalf("Generate %s failed: %v", when, err)
+		}
+		if res := v.Verify(otp); res.Status != StatusOK {
+			t.Errorf("Verify %s = %s, expected %s", when, res.Status, StatusOK)
+		}
+	}
+
+	generate("before rotation")
+	successor, err := m.StartRotation("a", true)
+	if err != nil {
+		t.Fatalf("StartRotation failed: %v", err)
+	}
+
+	// The old token is still used until the successor is registered, and
+	// may pass the counter the successor started at
+	for i := 0; i < 2; i++ {
+		if err := m.PowerCycle("a"); err != nil {
+			t.Fatalf("PowerCycle failed: %v", err)
+		}
+		generate("during rotation")
+	}
+
+	v.RegisterToken(successor)
+	if err := m.CompleteRotation("a"); err != nil {
+		t.Fatalf("CompleteRotation failed: %v", err)
+	}
+	generate("after rotation")
+}
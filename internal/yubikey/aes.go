@@ -2,8 +2,18 @@ package yubikey
 
 import (
 	"crypto/aes"
+	"crypto/cipher"
 )
 
+// NewCipher returns an AES-128 block cipher for key, which can be reused
+// to encrypt many token blocks
+func NewCipher(key []byte) (cipher.Block, error) {
+	if len(key) != KeySize {
+		return nil, aes.KeySizeError(len(key))
+	}
+	return aes.NewCipher(key)
+}
+
 // AESEncrypt encrypts a 16-byte block with AES-128-ECB
 func AESEncrypt(key, plaintext []byte) ([]byte, error) {
 	if len(key) != 16 || len(plaintext) != 16 {
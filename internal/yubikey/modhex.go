@@ -2,7 +2,7 @@
 package yubikey
 
 import (
-	"errors"
+	"fmt"
 	"strings"
 )
 
@@ -30,18 +30,27 @@ func ModHexEncode(data []byte) string {
 	return string(result)
 }
 
+// AppendModHex appends the modhex encoding of data to dst, returning the
+// extended buffer
+func AppendModHex(dst, data []byte) []byte {
+	for _, b := range data {
+		dst = append(dst, modHexAlphabet[b>>4], modHexAlphabet[b&0x0f])
+	}
+	return dst
+}
+
 // ModHexDecode decodes a modhex string to byte slice
 func ModHexDecode(s string) ([]byte, error) {
 	s = strings.ToLower(s)
 	if len(s)%2 != 0 {
-		return nil, errors.New("modhex string must have even length")
+		return nil, fmt.Errorf("modhex string must have even length: %w", ErrInvalidLength)
 	}
 	result := make([]byte, len(s)/2)
 	for i := 0; i < len(s); i += 2 {
 		high, okHigh := modHexDecode[s[i]]
 		low, okLow := modHexDecode[s[i+1]]
 		if !okHigh || !okLow {
-			return nil, errors.New("invalid modhex character")
+			return nil, ErrInvalidModHex
 		}
 		result[i/2] = (high << 4) | low
 	}
@@ -62,7 +71,7 @@ func HexEncode(data []byte) string {
 func HexDecode(s string) ([]byte, error) {
 	s = strings.ToLower(s)
 	if len(s)%2 != 0 {
-		return nil, errors.New("hex string must have even length")
+		return nil, fmt.Errorf("hex string must have even length: %w", ErrInvalidLength)
 	}
 	result := make([]byte, len(s)/2)
 	for i := 0; i < len(s); i += 2 {
@@ -72,14 +81,14 @@ func HexDecode(s string) ([]byte, error) {
 		} else if s[i] >= 'a' && s[i] <= 'f' {
 			high = s[i] - 'a' + 10
 		} else {
-			return nil, errors.New("invalid hex character")
+			return nil, ErrInvalidHex
 		}
 		if s[i+1] >= '0' && s[i+1] <= '9' {
 			low = s[i+1] - '0'
 		} else if s[i+1] >= 'a' && s[i+1] <= 'f' {
 			low = s[i+1] - 'a' + 10
 		} else {
-			return nil, errors.New("invalid hex character")
+			return nil, ErrInvalidHex
 		}
 		result[i/2] = (high << 4) | low
 	}
@@ -162,3 +162,13 @@ func TestHexRoundTrip(t *testing.T) {
 		}
 	}
 }
+
+func TestAppendModHex(t *testing.T) {
+	data := []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc}
+
+	result := AppendModHex([]byte("prefix"), data)
+	expected := "prefix" + ModHexEncode(data)
+	if string(result) != expected {
+		t.Errorf("AppendModHex = %s, expected %s", result, expected)
+	}
+}
@@ -0,0 +1,56 @@
+package yubikey
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OTPModHexSize is the length of the encrypted part of an OTP in modhex characters
+const OTPModHexSize = OTPSize * 2
+
+// SplitOTP splits a modhex OTP into its public ID and encrypted token
+// block, without decrypting it
+func SplitOTP(otp string) (publicID []byte, ciphertext []byte, err error) {
+	otp = strings.ToLower(strings.TrimSpace(otp))
+	if len(otp) < OTPModHexSize || len(otp) > OTPModHexSize+MaxPublicIDSize*2 {
+		return nil, nil, ErrInvalidLength
+	}
+
+	split := len(otp) - OTPModHexSize
+	publicID, err = ModHexDecode(otp[:split])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid public ID: %w", err)
+	}
+
+	ciphertext, err = ModHexDecode(otp[split:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid token block: %w", err)
+	}
+
+	return publicID, ciphertext, nil
+}
+
+// ParseOTP splits a modhex OTP into its public ID and token block, then
+// decrypts the token block with key and verifies its CRC
+func ParseOTP(otp string, key []byte) ([]byte, *TokenBlock, error) {
+	publicID, ciphertext, err := SplitOTP(otp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, err := AESDecrypt(key, ciphertext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if CRC16(plaintext) != CRCOKResidual {
+		return nil, nil, ErrCRCMismatch
+	}
+
+	block := &TokenBlock{}
+	if err := block.UnmarshalBinary(plaintext); err != nil {
+		return nil, nil, err
+	}
+
+	return publicID, block, nil
+}
@@ -0,0 +1,116 @@
+package yubikey
+
+import (
+	"errors"
+	"testing"
+)
+
+var testKey = []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+	0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+
+func testBlock() *TokenBlock {
+	return &TokenBlock{
+		UID:       [UIDSize]byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+		Counter:   0x1234,
+		Timestamp: 0xabcdef,
+		Session:   0x42,
+		Random:    0x5678,
+	}
+}
+
+func TestParseOTP(t *testing.T) {
+	block := testBlock()
+	encrypted, err := block.Generate(testKey)
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+
+	publicID, parsed, err := ParseOTP("dddddddddddd"+encrypted, testKey)
+	if err != nil {
+		t.Fatalf("ParseOTP returned error: %v", err)
+	}
+
+	if ModHexEncode(publicID) != "dddddddddddd" {
+		t.Errorf("Public ID = %s, expected dddddddddddd", ModHexEncode(publicID))
+	}
+	if *parsed != *block {
+		t.Errorf("Parsed block = %+v, expected %+v", parsed, block)
+	}
+}
+
+func TestParseOTPWrongKey(t *testing.T) {
+	encrypted, err := testBlock().Generate(testKey)
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+
+	wrongKey := make([]byte, KeySize)
+	_, _, err = ParseOTP(encrypted, wrongKey)
+	if !errors.Is(err, ErrCRCMismatch) {
+		t.Errorf("ParseOTP with wrong key = %v, expected ErrCRCMismatch", err)
+	}
+}
+
+func TestParseOTPInvalid(t *testing.T) {
+	encrypted, err := testBlock().Generate(testKey)
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+
+	tests := []struct {
+		otp      string
+		expected error
+	}{
+		{encrypted[:31], ErrInvalidLength},
+		{"d" + encrypted, ErrInvalidLength},
+		{"dddd" + encrypted[:31] + "x", ErrInvalidModHex},
+		{"xxdd" + encrypted, ErrInvalidModHex},
+	}
+
+	for _, tt := range tests {
+		_, _, err := ParseOTP(tt.otp, testKey)
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("ParseOTP(%s) = %v, expected %v", tt.otp, err, tt.expected)
+		}
+	}
+}
+
+func TestEncryptTo(t *testing.T) {
+	expected, err := testBlock().Generate(testKey)
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+
+	c, err := NewCipher(testKey)
+	if err != nil {
+		t.Fatalf("NewCipher returned error: %v", err)
+	}
+
+	var out [OTPSize]byte
+	testBlock().EncryptTo(c, &out)
+	if ModHexEncode(out[:]) != expected {
+		t.Errorf("EncryptTo = %s, expected %s", ModHexEncode(out[:]), expected)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		testBlock().EncryptTo(c, &out)
+	})
+	if allocs != 0 {
+		t.Errorf("EncryptTo made %.0f allocations, expected 0", allocs)
+	}
+}
+
+func TestParseOTPBadCRC(t *testing.T) {
+	block := testBlock()
+	block.ComputeCRC()
+	block.CRC ^= 0x0001
+
+	encrypted, err := block.Encrypt(testKey)
+	if err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	if _, _, err := ParseOTP(encrypted, testKey); !errors.Is(err, ErrCRCMismatch) {
+		t.Errorf("ParseOTP with bad CRC = %v, expected ErrCRCMismatch", err)
+	}
+}
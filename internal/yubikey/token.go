@@ -1,6 +1,7 @@
 package yubikey
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 )
 
@@ -11,8 +12,10 @@ const (
 	KeySize = 16
 	// OTPSize is the size of the OTP block in bytes
 	OTPSize = 16
-	// PublicIDSize is the size of the public ID in bytes
+	// PublicIDSize is the default size of the public ID in bytes
 	PublicIDSize = 6
+	// MaxPublicIDSize is the largest public ID a Yubikey supports in bytes
+	MaxPublicIDSize = 16
 )
 
 // TokenBlock represents the internal structure of a Yubikey OTP
@@ -28,6 +31,14 @@ type TokenBlock struct {
 // MarshalBinary encodes the token block to bytes
 func (t *TokenBlock) MarshalBinary() []byte {
 	data := make([]byte, OTPSize)
+	t.MarshalTo(data)
+	return data
+}
+
+// MarshalTo encodes the token block into data, which must be at least
+// OTPSize bytes
+func (t *TokenBlock) MarshalTo(data []byte) {
+	_ = data[OTPSize-1] // Bounds check hint
 
 	// Copy UID
 	copy(data[0:6], t.UID[:])
@@ -49,8 +60,6 @@ func (t *TokenBlock) MarshalBinary() []byte {
 
 	// CRC (little-endian)
 	binary.LittleEndian.PutUint16(data[14:16], t.CRC)
-
-	return data
 }
 
 // UnmarshalBinary decodes bytes to the token block
@@ -83,7 +92,8 @@ func (t *TokenBlock) UnmarshalBinary(data []byte) error {
 
 // ComputeCRC computes and sets the CRC for the token block
 func (t *TokenBlock) ComputeCRC() {
-	data := t.MarshalBinary()
+	var data [OTPSize]byte
+	t.MarshalTo(data[:])
 	t.CRC = ^CRC16(data[:14])
 }
 
@@ -92,6 +102,13 @@ func (t *TokenBlock) Generate(key []byte) (string, error) {
 	// Compute CRC
 	t.ComputeCRC()
 
+	return t.Encrypt(key)
+}
+
+// Encrypt encrypts the token block with key as it is, without computing its
+// CRC, and returns it modhex encoded.  Generate should normally be used, this
+// is for deliberately generating invalid OTPs.
+func (t *TokenBlock) Encrypt(key []byte) (string, error) {
 	// Marshal to bytes
 	plaintext := t.MarshalBinary()
 
@@ -104,3 +121,13 @@ func (t *TokenBlock) Generate(key []byte) (string, error) {
 	// Encode as modhex
 	return ModHexEncode(ciphertext), nil
 }
+
+// EncryptTo computes the CRC for the token block, and encrypts it into
+// dst with a cipher from NewCipher.  Unlike Generate it doesn't allocate,
+// so it's suitable for generating OTPs in bulk.
+func (t *TokenBlock) EncryptTo(block cipher.Block, dst *[OTPSize]byte) {
+	t.MarshalTo(dst[:])
+	t.CRC = ^CRC16(dst[:14])
+	binary.LittleEndian.PutUint16(dst[14:16], t.CRC)
+	block.Encrypt(dst[:], dst[:])
+}
@@ -1,45 +1,82 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/driver/desktop"
 	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 
+	"github.com/arr2036/yksofttoken/internal/clipboard"
+	"github.com/arr2036/yksofttoken/internal/profile"
 	"github.com/arr2036/yksofttoken/internal/token"
 )
 
 const appVersion = "1.0.0"
 
+// prefPowerCycle is the preference key holding the power cycle policy
+const prefPowerCycle = "powerCycle"
+
 type ykSoftApp struct {
 	app        fyne.App
 	mainWindow fyne.Window
-	token      *token.SoftToken
-	tokenPath  string
+	manager    *token.Manager
 	tokenDir   string
 
+	profiles     *profile.Store
+	profile      profile.Profile    // Profile whose token directory is open
+	unsubscribe  func()             // Stops manager events, when switching profiles
+	stopWatching context.CancelFunc // Stops watching the token directory
+
+	policy      token.Policy // Directory policy, for lifetime warnings
+	powerPolicy token.PowerCyclePolicy
+	tray        desktop.App // Nil if the platform has no system tray
+	clipboard   *clipboard.Guard
+	unlocker    unlockProvider
+	content     fyne.CanvasObject // Main window content, hidden while locked
+
+	// OTP generation, tray actions and manager events run off the UI goroutine
+	mu             sync.Mutex         // Protects locked, poweredUp, tokenName, token, cancelGenerate, the idle timer and replacing manager
+	locked         bool               // Set while the lock screen is showing
+	poweredUp      map[string]bool    // Tokens power cycled since the application started
+	tokenName      string             // Name of the selected token
+	token          *token.SoftToken   // Snapshot of the selected token
+	cancelGenerate context.CancelFunc // Non-nil while an OTP is being generated
+	idleTimer      *time.Timer        // Locks the application once it's idle
+	idleGeneration int                // Changes whenever the idle timer is restarted or stopped
+
 	// UI elements
+	profileSelect  *widget.Select
 	tokenSelect    *widget.Select
 	otpDisplay     *widget.Entry
 	regInfoDisplay *widget.Entry
 	statusLabel    *widget.Label
 	counterLabel   *widget.Label
 	sessionLabel   *widget.Label
+	lifetimeLabel  *widget.Label
 	generateBtn    *widget.Button
 	copyBtn        *widget.Button
 	copyRegBtn     *widget.Button
+	powerCycleBtn  *widget.Button
+	progress       *widget.ProgressBarInfinite
 }
 
 func main() {
+	if isCLI(os.Args[1:]) {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+
 	ykApp := &ykSoftApp{}
 	ykApp.run()
 }
@@ -48,21 +85,38 @@ func (y *ykSoftApp) run() {
 	y.app = app.NewWithID("org.freeradius.yksoft")
 	y.mainWindow = y.app.NewWindow("YKSoft Token")
 
-	// Get default token directory
+	// Don't leave secrets in the clipboard once we've gone
+	y.clipboard = clipboard.NewGuard(y.mainWindow.Clipboard())
+	y.app.Lifecycle().SetOnStopped(y.clipboard.Clear)
+
+	// Tokens are in the default directory, unless a profile says otherwise
+	defaultDir, dirErr := token.GetDefaultTokenDir()
+	if dirErr != nil {
+		defaultDir = "."
+	}
+	y.profiles = profile.NewStore(y.app.Preferences(), defaultDir)
+	y.unlocker = passphraseUnlocker{}
+
+	// Load power cycle policy, falling back to never power cycling
 	var err error
-	y.tokenDir, err = token.GetDefaultTokenDir()
+	y.powerPolicy, err = token.ParsePowerCyclePolicy(
+		y.app.Preferences().StringWithFallback(prefPowerCycle, "never"))
 	if err != nil {
-		y.tokenDir = "."
+		y.powerPolicy = token.PowerCyclePolicy{Mode: token.PowerCycleNever}
 	}
 
-	// Ensure token directory exists
-	os.MkdirAll(y.tokenDir, 0700)
-
 	// Create UI
 	y.createUI()
 
-	// Load available tokens
-	y.refreshTokenList()
+	// Load available tokens, and follow changes to them
+	if err := y.openProfile(y.profiles.Current()); err != nil {
+		dialog.ShowError(err, y.mainWindow)
+	}
+	if dirErr != nil {
+		dialog.ShowError(fmt.Errorf("Failed to find your home directory, so tokens are stored in "+
+			"the current directory.  Choose a token directory in Settings.\n\n%v", dirErr), y.mainWindow)
+	}
+	y.setupTray()
 
 	// Set window properties
 	y.mainWindow.Resize(fyne.NewSize(500, 450))
@@ -72,15 +126,30 @@ func (y *ykSoftApp) run() {
 }
 
 func (y *ykSoftApp) createUI() {
+	// Profile selection
+	y.profileSelect = widget.NewSelect([]string{}, y.onProfileSelected)
+
+	newProfileBtn := widget.NewButtonWithIcon("", theme.ContentAddIcon(), y.onNewProfile)
+	settingsBtn := widget.NewButtonWithIcon("Settings", theme.SettingsIcon(), y.showSettings)
+	lockBtn := widget.NewButtonWithIcon("Lock", theme.LogoutIcon(), y.onLock)
+
+	profileRow := container.NewBorder(nil, nil, widget.NewLabel("Profile"),
+		container.NewHBox(newProfileBtn, settingsBtn, lockBtn),
+		y.profileSelect,
+	)
+
 	// Token selection
 	y.tokenSelect = widget.NewSelect([]string{}, y.onTokenSelected)
 	y.tokenSelect.PlaceHolder = "Select or create a token..."
 
 	newTokenBtn := widget.NewButtonWithIcon("New", theme.ContentAddIcon(), y.onNewToken)
+	importTokenBtn := widget.NewButtonWithIcon("Import", theme.DownloadIcon(), y.onImportToken)
+	regenerateTokenBtn := widget.NewButtonWithIcon("Regenerate", theme.ContentRedoIcon(), y.onRegenerateToken)
+	rotateTokenBtn := widget.NewButtonWithIcon("Rotate", theme.MediaReplayIcon(), y.onRotateToken)
 	deleteTokenBtn := widget.NewButtonWithIcon("Delete", theme.DeleteIcon(), y.onDeleteToken)
 
 	tokenRow := container.NewBorder(nil, nil, nil,
-		container.NewHBox(newTokenBtn, deleteTokenBtn),
+		container.NewHBox(newTokenBtn, importTokenBtn, regenerateTokenBtn, rotateTokenBtn, deleteTokenBtn),
 		y.tokenSelect,
 	)
 
@@ -96,7 +165,10 @@ func (y *ykSoftApp) createUI() {
 	y.copyBtn = widget.NewButtonWithIcon("Copy", theme.ContentCopyIcon(), y.onCopyOTP)
 	y.copyBtn.Disable()
 
-	otpButtons := container.NewHBox(y.generateBtn, y.copyBtn)
+	y.powerCycleBtn = widget.NewButtonWithIcon("Power Cycle", theme.ViewRefreshIcon(), y.onPowerCycle)
+	y.powerCycleBtn.Disable()
+
+	otpButtons := container.NewHBox(y.generateBtn, y.copyBtn, layout.NewSpacer(), y.powerCycleBtn)
 
 	// Registration info display
 	y.regInfoDisplay = widget.NewMultiLineEntry()
@@ -112,8 +184,14 @@ func (y *ykSoftApp) createUI() {
 	y.statusLabel = widget.NewLabel("No token loaded")
 	y.statusLabel.Alignment = fyne.TextAlignCenter
 
+	y.progress = widget.NewProgressBarInfinite()
+	y.progress.Stop()
+	y.progress.Hide()
+
 	y.counterLabel = widget.NewLabel("Counter: -")
 	y.sessionLabel = widget.NewLabel("Session: -")
+	y.lifetimeLabel = widget.NewLabel("")
+	y.lifetimeLabel.Alignment = fyne.TextAlignCenter
 
 	statsRow := container.NewHBox(
 		layout.NewSpacer(),
@@ -125,9 +203,11 @@ func (y *ykSoftApp) createUI() {
 
 	// About/Help
 	aboutBtn := widget.NewButtonWithIcon("About", theme.InfoIcon(), y.showAbout)
+	historyBtn := widget.NewButtonWithIcon("History", theme.HistoryIcon(), y.showHistory)
 
 	// Layout
 	content := container.NewVBox(
+		profileRow,
 		widget.NewCard("Token", "", container.NewVBox(tokenRow)),
 		widget.NewCard("One-Time Password", "", container.NewVBox(
 			y.otpDisplay,
@@ -139,51 +219,152 @@ func (y *ykSoftApp) createUI() {
 		)),
 		widget.NewCard("Status", "", container.NewVBox(
 			y.statusLabel,
+			y.progress,
 			statsRow,
+			y.lifetimeLabel,
 		)),
-		container.NewHBox(layout.NewSpacer(), aboutBtn),
+		container.NewHBox(historyBtn, layout.NewSpacer(), aboutBtn),
 	)
 
-	scrollContent := container.NewVScroll(content)
-	y.mainWindow.SetContent(scrollContent)
+	y.content = container.NewVScroll(content)
+	y.mainWindow.SetContent(y.content)
+	y.mainWindow.SetMainMenu(y.mainMenu())
+
+	// Key presses outside an entry count as activity too
+	y.mainWindow.Canvas().SetOnTypedKey(func(*fyne.KeyEvent) { y.touch() })
 }
 
 func (y *ykSoftApp) refreshTokenList() {
-	tokens := []string{}
+	tokens, err := y.manager.Names()
+	if err != nil {
+		tokens = []string{}
+	}
 
-	entries, err := os.ReadDir(y.tokenDir)
-	if err == nil {
-		for _, entry := range entries {
-			if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
-				tokens = append(tokens, entry.Name())
+	y.tokenSelect.Options = tokens
+	y.tokenSelect.Refresh()
+	if len(tokens) > 0 && y.tokenSelect.Selected == "" && !y.isLocked() {
+		// Prefer the profile's default token, if it still exists
+		selected := tokens[0]
+		for _, name := range tokens {
+			if name == y.profile.DefaultToken {
+				selected = name
 			}
 		}
+		y.tokenSelect.SetSelected(selected)
+	}
+}
+
+// onTokenEvent keeps the UI in sync with changes made through the manager,
+// whichever goroutine made them
+func (y *ykSoftApp) onTokenEvent(ev token.Event) {
+	switch ev.Type {
+	case token.EventAdded, token.EventRemoved:
+		// The selected token may have been removed by another process
+		if name, _ := y.current(); ev.Type == token.EventRemoved && ev.Name == name {
+			y.cancelGeneration()
+			y.setCurrent("", nil)
+			y.tokenSelect.ClearSelected()
+			y.clearUI()
+		}
+		y.refreshTokenList()
+		y.refreshTray()
+
+	case token.EventCounterChanged, token.EventReloaded, token.EventRotated, token.EventReplaced:
+		name, _ := y.current()
+		if ev.Name != name {
+			return
+		}
+
+		t, err := y.manager.Get(name)
+		if err != nil {
+			return
+		}
+
+		y.mu.Lock()
+		if y.tokenName == name {
+			y.token = t
+		}
+		y.mu.Unlock()
+
+		// OTPs from the old token are no use once it's replaced
+		if ev.Type == token.EventRotated || ev.Type == token.EventReplaced {
+			y.otpDisplay.SetText("")
+			y.copyBtn.Disable()
+		}
+		y.updateUI()
 	}
+}
 
-	y.tokenSelect.Options = tokens
-	if len(tokens) > 0 && y.tokenSelect.Selected == "" {
-		y.tokenSelect.SetSelected(tokens[0])
+// current returns the name and a snapshot of the selected token, or
+// nothing while the application is locked
+func (y *ykSoftApp) current() (string, *token.SoftToken) {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	if y.locked {
+		return "", nil
 	}
+	return y.tokenName, y.token
+}
+
+// setCurrent changes the selected token
+func (y *ykSoftApp) setCurrent(name string, t *token.SoftToken) {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	y.tokenName = name
+	y.token = t
 }
 
 func (y *ykSoftApp) onTokenSelected(name string) {
-	if name == "" {
+	if name == "" || y.isLocked() {
 		return
 	}
+	y.touch()
 
-	y.tokenPath = token.GetTokenPath(y.tokenDir, name)
+	y.cancelGeneration()
 
-	var err error
-	y.token, err = token.Load(y.tokenPath)
+	t, err := y.manager.Get(name)
+	var rollbackErr *token.RollbackError
+	if errors.As(err, &rollbackErr) {
+		y.offerJump(name, rollbackErr)
+		return
+	}
 	if err != nil {
 		dialog.ShowError(fmt.Errorf("Failed to load token: %v", err), y.mainWindow)
 		return
 	}
+	y.setCurrent(name, t)
+
+	// The first use of a token since the application started is a power-up
+	if y.firstUse(name) {
+		if err := y.applyPowerPolicy(name, token.PowerEventStart); err != nil {
+			dialog.ShowError(err, y.mainWindow)
+		}
+	}
 
 	y.updateUI()
 }
 
+// firstUse records a use of the named token, returning true if it's the
+// first since the application started
+func (y *ykSoftApp) firstUse(name string) bool {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	used := y.poweredUp[name]
+	y.poweredUp[name] = true
+	return !used
+}
+
+// applyPowerPolicy power cycles the named token if the policy requires it
+// for the event
+func (y *ykSoftApp) applyPowerPolicy(name string, ev token.PowerEvent) error {
+	if _, err := y.manager.ApplyPowerPolicy(name, y.powerPolicy, ev); err != nil {
+		return fmt.Errorf("Failed to power cycle token: %v", err)
+	}
+	return nil
+}
+
 func (y *ykSoftApp) onNewToken() {
+	y.touch()
 	entry := widget.NewEntry()
 	entry.SetPlaceHolder("Token name (e.g., default)")
 
@@ -197,32 +378,33 @@ func (y *ykSoftApp) onNewToken() {
 			}
 
 			name := strings.TrimSpace(entry.Text)
-			path := token.GetTokenPath(y.tokenDir, name)
 
-			// Check if token already exists
-			if _, err := os.Stat(path); err == nil {
-				dialog.ShowError(fmt.Errorf("Token '%s' already exists", name), y.mainWindow)
+			// Create new token, following the directory's public ID policy
+			policy, err := token.LoadPolicy(y.tokenDir)
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("Failed to load public ID policy: %v", err), y.mainWindow)
 				return
 			}
 
-			// Create new token
-			newToken, err := token.New()
+			newToken, err := y.manager.NewUnique(policy)
 			if err != nil {
 				dialog.ShowError(fmt.Errorf("Failed to create token: %v", err), y.mainWindow)
 				return
 			}
 
 			// Save token
-			if err := newToken.Save(path); err != nil {
-				dialog.ShowError(fmt.Errorf("Failed to save token: %v", err), y.mainWindow)
+			if err := y.manager.Create(name, newToken); err != nil {
+				if errors.Is(err, token.ErrTokenExists) {
+					err = fmt.Errorf("Token '%s' already exists", name)
+				} else {
+					err = fmt.Errorf("Failed to save token: %v", err)
+				}
+				dialog.ShowError(err, y.mainWindow)
 				return
 			}
 
-			y.token = newToken
-			y.tokenPath = path
-			y.refreshTokenList()
+			y.firstUse(name) // Creation is the first power-up
 			y.tokenSelect.SetSelected(name)
-			y.updateUI()
 
 			// Show registration info for new token
 			dialog.ShowInformation("Token Created",
@@ -234,11 +416,12 @@ func (y *ykSoftApp) onNewToken() {
 }
 
 func (y *ykSoftApp) onDeleteToken() {
-	if y.tokenPath == "" {
+	y.touch()
+	name, _ := y.current()
+	if name == "" {
 		return
 	}
 
-	name := filepath.Base(y.tokenPath)
 	dialog.ShowConfirm("Delete Token",
 		fmt.Sprintf("Are you sure you want to delete token '%s'?\n\nThis cannot be undone!", name),
 		func(confirmed bool) {
@@ -246,13 +429,13 @@ func (y *ykSoftApp) onDeleteToken() {
 				return
 			}
 
-			if err := os.Remove(y.tokenPath); err != nil {
+			y.cancelGeneration()
+			if err := y.manager.Delete(name); err != nil {
 				dialog.ShowError(fmt.Errorf("Failed to delete token: %v", err), y.mainWindow)
 				return
 			}
 
-			y.token = nil
-			y.tokenPath = ""
+			y.setCurrent("", nil)
 			y.tokenSelect.ClearSelected()
 			y.refreshTokenList()
 			y.clearUI()
@@ -262,19 +445,62 @@ func (y *ykSoftApp) onDeleteToken() {
 }
 
 func (y *ykSoftApp) onGenerateOTP() {
-	if y.token == nil {
+	y.touch()
+	name, _ := y.current()
+	if name == "" || y.generating() {
 		return
 	}
 
-	otp, err := y.token.GenerateOTP()
-	if err != nil {
-		dialog.ShowError(fmt.Errorf("Failed to generate OTP: %v", err), y.mainWindow)
+	ctx, cancel := context.WithCancel(context.Background())
+	y.mu.Lock()
+	y.cancelGenerate = cancel
+	y.mu.Unlock()
+	y.generateBtn.Disable()
+	y.powerCycleBtn.Disable()
+
+	// Anything taking the token's lock waits for a generation in progress,
+	// such as from the tray, which may block until the token's rate limit
+	// clears, so it's all done off the UI goroutine
+	go func() {
+		if err := y.applyPowerPolicy(name, token.PowerEventGenerate); err != nil {
+			y.finishGenerate(ctx, name, "", err)
+			return
+		}
+		if wait, _ := y.manager.RateLimitDelay(name); wait > 0 && ctx.Err() == nil {
+			y.statusLabel.SetText(fmt.Sprintf("Rate limited, waiting %s...", wait.Round(100*time.Millisecond)))
+			y.progress.Show()
+			y.progress.Start()
+		}
+
+		otp, err := y.manager.Generate(ctx, name)
+		if err != nil {
+			err = fmt.Errorf("Failed to generate OTP: %w", err)
+		}
+		y.finishGenerate(ctx, name, otp, err)
+	}()
+}
+
+// finishGenerate displays the result of an OTP generated by onGenerateOTP
+func (y *ykSoftApp) finishGenerate(ctx context.Context, name, otp string, err error) {
+	// The user switched tokens while we were waiting
+	if ctx.Err() != nil {
 		return
 	}
+	y.cancelGeneration()
 
-	// Save updated token state
-	if err := y.token.Save(y.tokenPath); err != nil {
-		dialog.ShowError(fmt.Errorf("Failed to save token state: %v", err), y.mainWindow)
+	if errors.Is(err, token.ErrCounterExhausted) {
+		y.updateUI()
+		y.offerRotation(name)
+		return
+	}
+	if errors.Is(err, token.ErrStaleToken) {
+		y.updateUI()
+		y.statusLabel.SetText("Token was used elsewhere and has been reloaded, generate again")
+		return
+	}
+	if err != nil {
+		y.updateUI()
+		dialog.ShowError(err, y.mainWindow)
 		return
 	}
 
@@ -283,50 +509,99 @@ func (y *ykSoftApp) onGenerateOTP() {
 	y.updateUI()
 }
 
+// generating returns true if an OTP is being generated
+func (y *ykSoftApp) generating() bool {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	return y.cancelGenerate != nil
+}
+
+// cancelGeneration abandons any OTP generation in progress
+func (y *ykSoftApp) cancelGeneration() {
+	y.mu.Lock()
+	if y.cancelGenerate != nil {
+		y.cancelGenerate()
+		y.cancelGenerate = nil
+	}
+	y.mu.Unlock()
+
+	y.progress.Stop()
+	y.progress.Hide()
+}
+
+func (y *ykSoftApp) onPowerCycle() {
+	y.touch()
+	name, _ := y.current()
+	if name == "" {
+		return
+	}
+
+	if err := y.manager.PowerCycle(name); err != nil {
+		dialog.ShowError(fmt.Errorf("Failed to power cycle token: %v", err), y.mainWindow)
+		return
+	}
+
+	y.statusLabel.SetText("Token power cycled")
+}
+
 func (y *ykSoftApp) onCopyOTP() {
-	if y.otpDisplay.Text != "" {
-		y.mainWindow.Clipboard().SetContent(y.otpDisplay.Text)
-		y.statusLabel.SetText("OTP copied to clipboard!")
-		go func() {
-			time.Sleep(2 * time.Second)
-			y.statusLabel.SetText("Ready")
-		}()
+	y.touch()
+	if y.otpDisplay.Text != "" && !y.isLocked() {
+		y.showStatus(y.copySecret("OTP", y.otpDisplay.Text))
 	}
 }
 
 func (y *ykSoftApp) onCopyRegInfo() {
-	if y.token != nil {
-		y.mainWindow.Clipboard().SetContent(y.token.RegistrationInfo())
-		y.statusLabel.SetText("Registration info copied to clipboard!")
-		go func() {
-			time.Sleep(2 * time.Second)
-			y.statusLabel.SetText("Ready")
-		}()
+	y.touch()
+	if _, t := y.current(); t != nil {
+		y.copyRegInfo(t.RegistrationInfo())
 	}
 }
 
 func (y *ykSoftApp) updateUI() {
-	if y.token == nil {
+	_, t := y.current()
+	if t == nil {
 		y.clearUI()
 		return
 	}
 
-	y.generateBtn.Enable()
+	// Leave generation disabled until the OTP in progress is done
+	if !y.generating() {
+		y.generateBtn.Enable()
+		y.powerCycleBtn.Enable()
+		y.statusLabel.SetText("Ready")
+	}
 	y.copyRegBtn.Enable()
-	y.regInfoDisplay.SetText(y.token.RegistrationInfo())
-	y.counterLabel.SetText(fmt.Sprintf("Counter: %d", y.token.Counter))
-	y.sessionLabel.SetText(fmt.Sprintf("Session: %d", y.token.Session))
-	y.statusLabel.SetText("Ready")
+	y.regInfoDisplay.SetText(t.RegistrationInfo())
+	y.counterLabel.SetText(fmt.Sprintf("Counter: %d", t.Counter))
+	y.sessionLabel.SetText(fmt.Sprintf("Session: %d", t.Session))
+
+	// Warn when the token needs replacing soon
+	lifetime := t.Lifetime()
+	switch {
+	case lifetime.Exhausted():
+		y.lifetimeLabel.SetText("Token exhausted, rotate it to continue")
+		y.lifetimeLabel.Importance = widget.DangerImportance
+	case lifetime.Low(y.policy):
+		y.lifetimeLabel.SetText(fmt.Sprintf("Token has %s, rotate it soon", lifetime))
+		y.lifetimeLabel.Importance = widget.WarningImportance
+	default:
+		y.lifetimeLabel.SetText(fmt.Sprintf("%d power-ups remaining", lifetime.PowerUps))
+		y.lifetimeLabel.Importance = widget.MediumImportance
+	}
+	y.lifetimeLabel.Refresh()
 }
 
 func (y *ykSoftApp) clearUI() {
 	y.generateBtn.Disable()
 	y.copyBtn.Disable()
 	y.copyRegBtn.Disable()
+	y.powerCycleBtn.Disable()
 	y.otpDisplay.SetText("")
 	y.regInfoDisplay.SetText("")
 	y.counterLabel.SetText("Counter: -")
 	y.sessionLabel.SetText("Session: -")
+	y.lifetimeLabel.SetText("")
 	y.statusLabel.SetText("No token loaded")
 }
 